@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// bodyReader streams the body of a PUT request directly off the protocol reader.
+//
+// The go command sends PUT bodies as a base64-encoded JSON string literal on the
+// line following the request. Rather than buffering the whole line, unmarshaling it
+// into a Go string, and then decoding it (which requires several copies of the body
+// to be held in memory at once), bodyReader unquotes the JSON string and decodes the
+// base64 payload on the fly as the consumer reads from it.
+//
+// Because the body shares the underlying bufio.Reader with the request stream, the
+// next request cannot be read until the body has been fully consumed. Callers use
+// wait() to block until that happens.
+type bodyReader struct {
+	src       *bufio.Reader
+	dec       io.Reader
+	size      int64
+	remaining int64
+
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error // Only safe to read after done is closed.
+}
+
+// newBodyReader returns a bodyReader that decodes a body of exactly size bytes
+// from src.
+func newBodyReader(src *bufio.Reader, size int64) *bodyReader {
+	return &bodyReader{
+		src:       src,
+		dec:       base64.NewDecoder(base64.StdEncoding, &jsonStringReader{src: src}),
+		size:      size,
+		remaining: size,
+		done:      make(chan struct{}),
+	}
+}
+
+// Read reads decoded body bytes. It returns io.EOF once exactly size bytes have
+// been read and the closing quote and trailing newline have been consumed.
+func (br *bodyReader) Read(p []byte) (int, error) {
+	select {
+	case <-br.done:
+		if br.err != nil {
+			return 0, br.err
+		}
+		return 0, io.EOF
+	default:
+	}
+
+	if int64(len(p)) > br.remaining {
+		p = p[:br.remaining]
+	}
+
+	n, err := br.dec.Read(p)
+	br.remaining -= int64(n)
+
+	if err != nil && err != io.EOF {
+		br.finish(fmt.Errorf("failed to decode base64 body: %w", err))
+		return n, br.err
+	}
+	if err == io.EOF && br.remaining > 0 {
+		br.finish(fmt.Errorf("size mismatch: expected %d, read %d", br.size, br.size-br.remaining))
+		return n, br.err
+	}
+
+	if br.remaining == 0 {
+		// Consume the rest of the encoded body eagerly (padding, closing quote and
+		// newline) so that the request stream is positioned at the next request as
+		// soon as the consumer has seen every byte, even if it never reads io.EOF.
+		br.finish(br.consumeTrailer())
+		if br.err != nil {
+			return n, br.err
+		}
+	}
+
+	return n, nil
+}
+
+// consumeTrailer verifies that the encoded body contains no more data and then
+// discards everything up to and including the newline that terminates the body line.
+func (br *bodyReader) consumeTrailer() error {
+	var extra [1]byte
+	for {
+		n, err := br.dec.Read(extra[:])
+		if n > 0 {
+			return fmt.Errorf("size mismatch: body is larger than expected %d bytes", br.size)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode base64 body: %w", err)
+		}
+	}
+
+	for {
+		c, err := br.src.ReadByte()
+		if err == io.EOF {
+			// The final line of the stream does not need a trailing newline.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading body line: %w", err)
+		}
+		switch c {
+		case '\n':
+			return nil
+		case ' ', '\t', '\r':
+		default:
+			return fmt.Errorf("unexpected character %q after body", c)
+		}
+	}
+}
+
+// wait blocks until the body has been fully consumed (or failed to decode) and
+// returns the decoding error, if any.
+func (br *bodyReader) wait() error {
+	<-br.done
+	return br.err
+}
+
+func (br *bodyReader) finish(err error) {
+	br.doneOnce.Do(func() {
+		br.err = err
+		close(br.done)
+	})
+}
+
+// jsonStringReader yields the unquoted contents of a JSON string literal read
+// from src. Leading whitespace (including blank lines) before the opening quote is
+// skipped, and reading stops at the closing quote, leaving src positioned right
+// after it.
+//
+// Escapes are unquoted as usual, but anything that doesn't map to a single ASCII
+// byte is rejected since it can never be part of a valid base64 payload.
+type jsonStringReader struct {
+	src    *bufio.Reader
+	opened bool
+	closed bool
+}
+
+var errUnterminatedString = errors.New("unterminated JSON string in body")
+
+func (jr *jsonStringReader) Read(p []byte) (int, error) {
+	if jr.closed {
+		return 0, io.EOF
+	}
+	if !jr.opened {
+		if err := jr.readOpeningQuote(); err != nil {
+			return 0, err
+		}
+		jr.opened = true
+	}
+
+	n := 0
+	for n < len(p) {
+		if jr.src.Buffered() == 0 && n > 0 {
+			// Don't block for more input if we already have something to return.
+			return n, nil
+		}
+
+		buf, err := jr.src.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return n, errUnterminatedString
+			}
+			return n, err
+		}
+
+		buf, _ = jr.src.Peek(jr.src.Buffered())
+		if len(buf) > len(p)-n {
+			buf = buf[:len(p)-n]
+		}
+		if i := bytes.IndexAny(buf, `"\`); i >= 0 {
+			buf = buf[:i]
+		}
+		if len(buf) > 0 {
+			n += copy(p[n:], buf)
+			jr.src.Discard(len(buf))
+			continue
+		}
+
+		// The next byte is either the closing quote or the start of an escape sequence.
+		c, _ := jr.src.ReadByte()
+		if c == '"' {
+			jr.closed = true
+			return n, io.EOF
+		}
+
+		unescaped, err := jr.readEscape()
+		if err != nil {
+			return n, err
+		}
+		p[n] = unescaped
+		n++
+	}
+
+	return n, nil
+}
+
+// readOpeningQuote skips whitespace and consumes the opening quote of the string.
+func (jr *jsonStringReader) readOpeningQuote() error {
+	for {
+		c, err := jr.src.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '"':
+			return nil
+		case ' ', '\t', '\r', '\n':
+		default:
+			return fmt.Errorf("expected JSON string for body, found %q", c)
+		}
+	}
+}
+
+// readEscape decodes the escape sequence following a backslash. Only escapes that
+// map to a single ASCII byte are supported since base64 is pure ASCII.
+func (jr *jsonStringReader) readEscape() (byte, error) {
+	c, err := jr.src.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, errUnterminatedString
+		}
+		return 0, err
+	}
+
+	switch c {
+	case '"', '\\', '/':
+		return c, nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'u':
+		var hexDigits [4]byte
+		if _, err := io.ReadFull(jr.src, hexDigits[:]); err != nil {
+			return 0, errUnterminatedString
+		}
+		var r rune
+		for _, h := range hexDigits {
+			var v byte
+			switch {
+			case h >= '0' && h <= '9':
+				v = h - '0'
+			case h >= 'a' && h <= 'f':
+				v = h - 'a' + 10
+			case h >= 'A' && h <= 'F':
+				v = h - 'A' + 10
+			default:
+				return 0, fmt.Errorf("invalid \\u escape in body: %q", hexDigits[:])
+			}
+			r = r<<4 | rune(v)
+		}
+		if r >= 0x80 {
+			return 0, fmt.Errorf("non-ASCII character U+%04X in base64 body", r)
+		}
+		return byte(r), nil
+	default:
+		return 0, fmt.Errorf("invalid escape sequence \\%c in body", c)
+	}
+}
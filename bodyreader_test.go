@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+const nextRequestLine = `{"ID":2,"Command":"get","ActionID":"AAAA"}` + "\n"
+
+// encodeBody encodes data the same way the go command does: a base64 JSON string
+// literal on its own line.
+func encodeBody(data []byte) string {
+	return `"` + base64.StdEncoding.EncodeToString(data) + `"` + "\n"
+}
+
+// readBody decodes a body of the given size from src and returns the decoded data
+// along with whatever is left in the stream afterwards.
+func readBody(t *testing.T, src *bufio.Reader, size int64) ([]byte, string) {
+	t.Helper()
+
+	br := newBodyReader(src, size)
+	data, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if err := br.wait(); err != nil {
+		t.Fatalf("unexpected body error: %v", err)
+	}
+
+	rest, err := io.ReadAll(src)
+	if err != nil {
+		t.Fatalf("failed to read rest of stream: %v", err)
+	}
+	return data, string(rest)
+}
+
+func TestBodyReader(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"single byte", []byte{0x42}},
+		{"two bytes", []byte{0x01, 0x02}},
+		{"three bytes", []byte{0x01, 0x02, 0x03}},
+		{"text", []byte("hello, world")},
+		{"binary", []byte{0x00, 0xff, 0xfe, 0x80, 0x7f, 0x3e, 0x3f}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := bufio.NewReader(strings.NewReader(encodeBody(tt.data) + nextRequestLine))
+			data, rest := readBody(t, src, int64(len(tt.data)))
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("decoded body = %x, expected %x", data, tt.data)
+			}
+			if rest != nextRequestLine {
+				t.Errorf("rest of stream = %q, expected %q", rest, nextRequestLine)
+			}
+		})
+	}
+}
+
+func TestBodyReaderJSONEncoded(t *testing.T) {
+	// json.Marshal is not what the go command uses, but any valid JSON encoding
+	// of the string should be accepted, including escaped characters.
+	data := []byte("some data that encodes to base64 with + and / characters \xfb\xff\xbf")
+	encoded, err := json.Marshal(base64.StdEncoding.EncodeToString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	escaped := strings.NewReplacer("/", `\/`, "+", `\u002b`).Replace(string(encoded))
+	if escaped == string(encoded) {
+		t.Fatalf("expected %s to contain characters that can be escaped", encoded)
+	}
+
+	for _, input := range []string{string(encoded), escaped} {
+		src := bufio.NewReader(strings.NewReader("\n  " + input + " \r\n" + nextRequestLine))
+		got, rest := readBody(t, src, int64(len(data)))
+		if !bytes.Equal(got, data) {
+			t.Errorf("decoded body = %q, expected %q (input: %s)", got, data, input)
+		}
+		if rest != nextRequestLine {
+			t.Errorf("rest of stream = %q, expected %q", rest, nextRequestLine)
+		}
+	}
+}
+
+func TestBodyReaderNoTrailingNewline(t *testing.T) {
+	data := []byte("last line of the stream")
+	src := bufio.NewReader(strings.NewReader(strings.TrimSuffix(encodeBody(data), "\n")))
+	got, rest := readBody(t, src, int64(len(data)))
+	if !bytes.Equal(got, data) {
+		t.Errorf("decoded body = %q, expected %q", got, data)
+	}
+	if rest != "" {
+		t.Errorf("rest of stream = %q, expected empty", rest)
+	}
+}
+
+func TestBodyReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		size  int64
+	}{
+		{"body shorter than size", encodeBody([]byte("short")), 10},
+		{"body longer than size", encodeBody([]byte("much longer body")), 4},
+		{"not a string", "12345\n", 4},
+		{"invalid base64", `"!!!!"` + "\n", 3},
+		{"unterminated string", `"aGVsbG8=`, 5},
+		{"invalid escape", `"aGVs\xbG8="` + "\n", 5},
+		{"non-ascii escape", `"aGVséG8="` + "\n", 5},
+		{"garbage after string", `"aGVsbG8=" x` + "\n", 5},
+		{"empty stream", "", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := newBodyReader(bufio.NewReader(strings.NewReader(tt.input)), tt.size)
+			_, readErr := io.ReadAll(br)
+			if readErr == nil {
+				t.Fatal("expected an error reading body, got nil")
+			}
+			if err := br.wait(); err == nil {
+				t.Fatal("expected wait to return an error, got nil")
+			}
+		})
+	}
+}
+
+// TestBodyReaderFinishesWithoutEOF verifies that the request stream is advanced
+// past the body as soon as the consumer has read every byte, without requiring
+// an extra Read that returns io.EOF.
+func TestBodyReaderFinishesWithoutEOF(t *testing.T) {
+	data := []byte("exactly sized read")
+	src := bufio.NewReader(strings.NewReader(encodeBody(data) + nextRequestLine))
+	br := newBodyReader(src, int64(len(data)))
+
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+
+	select {
+	case <-br.done:
+	default:
+		t.Fatal("body reader not finished after reading all bytes")
+	}
+
+	line, err := src.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read next line: %v", err)
+	}
+	if line != nextRequestLine {
+		t.Errorf("next line = %q, expected %q", line, nextRequestLine)
+	}
+}
+
+func TestBodyReaderLarge(t *testing.T) {
+	size := int64(64 << 20)
+	if testing.Short() {
+		size = 4 << 20
+	}
+
+	// Stream the encoded body through a pipe so that the test never holds the
+	// encoded form in memory, just like the go command writing to our stdin.
+	var (
+		pr, pw   = io.Pipe()
+		expected = sha256.New()
+		rng      = rand.New(rand.NewSource(1))
+	)
+	go func() {
+		pw.Write([]byte(`"`))
+		enc := base64.NewEncoder(base64.StdEncoding, pw)
+		io.Copy(enc, io.TeeReader(io.LimitReader(rng, size), expected))
+		enc.Close()
+		pw.Write([]byte("\"\n" + nextRequestLine))
+		pw.Close()
+	}()
+
+	src := bufio.NewReader(pr)
+	br := newBodyReader(src, size)
+	actual := sha256.New()
+	n, err := io.Copy(actual, br)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if n != size {
+		t.Fatalf("read %d bytes, expected %d", n, size)
+	}
+	if !bytes.Equal(actual.Sum(nil), expected.Sum(nil)) {
+		t.Fatal("decoded body does not match encoded data")
+	}
+
+	rest, err := io.ReadAll(src)
+	if err != nil {
+		t.Fatalf("failed to read rest of stream: %v", err)
+	}
+	if string(rest) != nextRequestLine {
+		t.Errorf("rest of stream = %q, expected %q", rest, nextRequestLine)
+	}
+}
+
+func TestReadRequestStreamsPutBody(t *testing.T) {
+	body := []byte("compiled object file contents")
+	input := `{"ID":1,"Command":"put","ActionID":"AQID","OutputID":"BAUG","BodySize":` +
+		"29}\n" + encodeBody(body) + "\n" + nextRequestLine
+
+	c := newConn(strings.NewReader(input), io.Discard)
+
+	req, err := c.readRequest()
+	if err != nil {
+		t.Fatalf("failed to read put request: %v", err)
+	}
+	if req.Command != CmdPut || req.BodySize != int64(len(body)) {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	got, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("body = %q, expected %q", got, body)
+	}
+
+	req, err = c.readRequest()
+	if err != nil {
+		t.Fatalf("failed to read get request: %v", err)
+	}
+	if req.Command != CmdGet || req.ID != 2 {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	if _, err := c.readRequest(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func FuzzBodyReader(f *testing.F) {
+	f.Add([]byte(""), uint8(16))
+	f.Add([]byte("a"), uint8(16))
+	f.Add([]byte("hello, world"), uint8(17))
+	f.Add(bytes.Repeat([]byte{0xff, 0x00, 0x3e}, 100), uint8(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, bufSize uint8) {
+		if len(data) == 0 {
+			// The go command never sends a body line for empty bodies.
+			return
+		}
+
+		// Vary the buffer size so that quotes, escapes and newlines land on
+		// buffer boundaries.
+		input := encodeBody(data) + nextRequestLine
+		src := bufio.NewReaderSize(strings.NewReader(input), 16+int(bufSize))
+		got, rest := readBody(t, src, int64(len(data)))
+		if !bytes.Equal(got, data) {
+			t.Fatalf("decoded body = %x, expected %x", got, data)
+		}
+		if rest != nextRequestLine {
+			t.Fatalf("rest of stream = %q, expected %q", rest, nextRequestLine)
+		}
+	})
+}
+
+func FuzzBodyReaderArbitraryInput(f *testing.F) {
+	f.Add([]byte(`"aGVsbG8="`+"\n"), int64(5))
+	f.Add([]byte(`"aGVs\u0062G8="`+"\n"), int64(5))
+	f.Add([]byte(`"aGVsbG8`), int64(5))
+	f.Add([]byte(`  "" `), int64(1))
+	f.Add([]byte(`"\`), int64(1))
+
+	f.Fuzz(func(t *testing.T, input []byte, size int64) {
+		if size <= 0 || size > 1<<20 {
+			return
+		}
+
+		// Arbitrary input must never panic or hang, and any successful decode must
+		// produce exactly size bytes.
+		br := newBodyReader(bufio.NewReaderSize(bytes.NewReader(input), 16), size)
+		got, err := io.ReadAll(br)
+		waitErr := br.wait()
+		if err == nil {
+			if waitErr != nil {
+				t.Fatalf("ReadAll succeeded but wait returned %v", waitErr)
+			}
+			if int64(len(got)) != size {
+				t.Fatalf("decoded %d bytes, expected %d", len(got), size)
+			}
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// daemonStartTimeout bounds how long a client waits for the daemon it started to
+// listen on its socket.
+const daemonStartTimeout = 10 * time.Second
+
+// RunDaemon serves go commands that connect to the Unix socket at socketPath
+// through daemon clients. All of them share the backend, including its
+// connections and pending uploads, the local cache and the statistics. The
+// daemon stops when it's interrupted or when no client has been connected for
+// idleTimeout, if positive. It then closes the backend, which waits for pending
+// uploads, and prints the statistics of all clients if enabled.
+func (cp *CacheProg) RunDaemon(socketPath string, idleTimeout time.Duration) error {
+	listener, err := listenDaemonSocket(socketPath)
+	if err != nil {
+		return err
+	}
+	cp.logger.Info("daemon listening", "socket", socketPath, "idleTimeout", idleTimeout)
+	cp.start()
+
+	var (
+		stop     = make(chan struct{})
+		stopOnce sync.Once
+		stopFunc = func() { stopOnce.Do(func() { close(stop) }) }
+
+		clients sync.WaitGroup
+		mu      sync.Mutex
+		active  int
+		idle    *time.Timer
+	)
+	if idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() {
+			cp.logger.Info("daemon idle, stopping", "idleTimeout", idleTimeout)
+			stopFunc()
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	statsSignals := make(chan os.Signal, 1)
+	notifyStatsSignal(statsSignals)
+	defer signal.Stop(statsSignals)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cp.logger.Info("daemon received signal, stopping", "signal", sig)
+				stopFunc()
+			case <-statsSignals:
+				cp.writeStats(os.Stderr)
+			case <-stop:
+				// Closing the listener makes Accept return.
+				listener.Close()
+				return
+			}
+		}
+	}()
+
+	var acceptErr error
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				acceptErr = fmt.Errorf("failed to accept client: %w", err)
+				stopFunc()
+			}
+			break
+		}
+
+		mu.Lock()
+		active++
+		if idle != nil {
+			idle.Stop()
+		}
+		mu.Unlock()
+
+		cp.daemonClients.Add(1)
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			defer func() {
+				c.Close()
+				mu.Lock()
+				active--
+				if active == 0 && idle != nil {
+					idle.Reset(idleTimeout)
+				}
+				mu.Unlock()
+			}()
+			if err := cp.serve(newConn(c, c), false); err != nil {
+				cp.logger.Warn("failed to serve daemon client", "error", err)
+			}
+		}()
+	}
+
+	// Let the connected go commands finish, and then close the backend the way a
+	// single go command would.
+	clients.Wait()
+	if _, err := cp.handleRequest(&Request{Command: CmdClose}); err != nil {
+		cp.logger.Error("failed to close backend", "error", err)
+	}
+	cp.finish()
+	return acceptErr
+}
+
+// defaultDaemonSocket returns the socket of the daemon for the configuration in
+// fs, in a directory of the current user. Clients with a different configuration,
+// such as another cache directory or bucket, use a different daemon.
+func defaultDaemonSocket(fs *flag.FlagSet) string {
+	h := sha256.New()
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "daemon" && f.Name != "daemon-socket" {
+			fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value)
+		}
+	})
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("gobuildcache-%d", os.Getuid()))
+	return filepath.Join(dir, fmt.Sprintf("daemon-%x.sock", h.Sum(nil)[:8]))
+}
+
+// lockDaemonSocket locks the lock file next to socketPath, which is held while
+// checking for a daemon listening on socketPath and replacing its socket, so that
+// two daemons never both find no daemon and the second one removes the socket of
+// the first.
+func lockDaemonSocket(socketPath string) (*flock.Flock, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if err := checkDaemonDir(filepath.Dir(socketPath)); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(socketPath + ".lock")
+	ctx, cancel := context.WithTimeout(context.Background(), daemonStartTimeout)
+	defer cancel()
+	locked, err := fileLock.TryLockContext(ctx, 10*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock socket: %w", err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("failed to lock socket: timeout")
+	}
+	return fileLock, nil
+}
+
+// listenDaemonSocket listens on the Unix socket at socketPath, unless another
+// daemon is listening on it already.
+func listenDaemonSocket(socketPath string) (net.Listener, error) {
+	fileLock, err := lockDaemonSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
+
+	if c, err := net.Dial("unix", socketPath); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", socketPath)
+	}
+	// The socket of a daemon that didn't exit cleanly is left behind.
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	// Only the user running the daemon may use its cache.
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// runDaemonClient connects the go command on stdin and stdout to the daemon
+// listening on socketPath. If there is none, it starts one with daemonArgs, which
+// are the flags of the daemon subcommand, and waits for it to listen.
+func runDaemonClient(socketPath string, daemonArgs []string) error {
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		if c, err = connectOrStartDaemon(socketPath, daemonArgs); err != nil {
+			return err
+		}
+	}
+	defer c.Close()
+	return proxyDaemonConn(c.(*net.UnixConn), os.Stdin, os.Stdout)
+}
+
+// connectOrStartDaemon connects to the daemon listening on socketPath, starting
+// one with daemonArgs if there is none. The socket's lock is released before
+// waiting for the daemon, which takes it to listen. Clients that check while a
+// daemon is still starting start another one, but only one of them listens and
+// the others exit.
+func connectOrStartDaemon(socketPath string, daemonArgs []string) (net.Conn, error) {
+	fileLock, err := lockDaemonSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("unix", socketPath)
+	if err == nil {
+		fileLock.Unlock()
+		return c, nil
+	}
+	err = startDaemon(socketPath, daemonArgs)
+	fileLock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start daemon: %w", err)
+	}
+	return waitForDaemon(socketPath, daemonStartTimeout)
+}
+
+// proxyDaemonConn copies the requests read from r to the daemon, and the daemon's
+// responses to w until the daemon closes the connection.
+func proxyDaemonConn(c *net.UnixConn, r io.Reader, w io.Writer) error {
+	go func() {
+		io.Copy(c, r)
+		// Let the daemon know if the go command went away without a close request.
+		c.CloseWrite()
+	}()
+	_, err := io.Copy(w, c)
+	return err
+}
+
+// startDaemon starts a daemon in the background with args, logging to a file next
+// to socketPath.
+func startDaemon(socketPath string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	logFile, err := os.OpenFile(socketPath+".log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open daemon log: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, append([]string{"daemon"}, args...)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	detachDaemon(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// waitForDaemon connects to the daemon listening on socketPath, waiting up to
+// timeout for it to start listening.
+func waitForDaemon(socketPath string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		c, err := net.Dial("unix", socketPath)
+		if err == nil {
+			return c, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("daemon didn't start listening on %s within %v (see %s.log): %w", socketPath, timeout, socketPath, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Processes can't be detached from their parent's session on this platform, so
+// the daemon is started as a plain child process.
+func detachDaemon(cmd *exec.Cmd) {}
+
+// There is no signal to ask for the daemon's statistics on this platform, so they
+// are only printed when it exits.
+func notifyStatsSignal(c chan<- os.Signal) {}
+
+// Directories have no owner that could be checked on this platform.
+func checkDaemonDir(dir string) error { return nil }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// daemonTestClient speaks the cacheprog protocol to a daemon, like the go command
+// does through a daemon client.
+type daemonTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestDaemon(t *testing.T, socketPath string) *daemonTestClient {
+	t.Helper()
+	conn, err := waitForDaemon(socketPath, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &daemonTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	if resp := c.response(); len(resp.KnownCommands) == 0 {
+		t.Fatalf("initial response has no known commands: %+v", resp)
+	}
+	return c
+}
+
+func (c *daemonTestClient) send(line string) {
+	c.t.Helper()
+	if _, err := fmt.Fprint(c.conn, line); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *daemonTestClient) response() Response {
+	c.t.Helper()
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatalf("failed to read response: %v", err)
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		c.t.Fatalf("invalid response %q: %v", line, err)
+	}
+	return resp
+}
+
+func TestDaemonSharesCacheBetweenClients(t *testing.T) {
+	// Unix socket paths are short, so don't use t.TempDir.
+	dir, err := os.MkdirTemp("", "gbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "d.sock")
+
+	backend := &recordingBackend{puts: make(map[string][]byte)}
+	cp, err := NewCacheProg(backend, locking.NewMemLock(), t.TempDir(), false, false, false, 0, 0, "", "", 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cp.RunDaemon(socketPath, 200*time.Millisecond)
+	}()
+
+	data := []byte("compiled output")
+	first := dialTestDaemon(t, socketPath)
+	first.send(fmt.Sprintf(`{"ID":1,"Command":"put","ActionID":"AQI=","OutputID":"qg==","BodySize":%d}`+"\n", len(data)) + encodeBody(data))
+	if resp := first.response(); resp.Err != "" || resp.DiskPath == "" {
+		t.Fatalf("PUT failed: %+v", resp)
+	}
+	first.send(`{"ID":2,"Command":"close"}` + "\n")
+	if resp := first.response(); resp.ID != 2 || resp.Err != "" {
+		t.Fatalf("close failed: %+v", resp)
+	}
+	first.conn.Close()
+
+	// A second go command hits the entry the first one stored, and the daemon is
+	// still running after the first one closed.
+	second := dialTestDaemon(t, socketPath)
+	second.send(`{"ID":1,"Command":"get","ActionID":"AQI="}` + "\n")
+	if resp := second.response(); resp.Miss || resp.Size != int64(len(data)) {
+		t.Fatalf("GET of the other client's entry: %+v", resp)
+	}
+	second.conn.Close()
+
+	// The daemon stops once it's idle, and the stats cover both clients.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("daemon failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon didn't stop when idle")
+	}
+	if cp.daemonClients.Load() != 2 || cp.putCount.Load() != 1 || cp.hitCount.Load() != 1 {
+		t.Errorf("stats: %d clients, %d PUTs, %d hits", cp.daemonClients.Load(), cp.putCount.Load(), cp.hitCount.Load())
+	}
+	backend.Lock()
+	defer backend.Unlock()
+	if _, ok := backend.puts[string(cp.generateBackendKey([]byte{1, 2}))]; !ok {
+		t.Error("entry wasn't uploaded")
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("socket wasn't removed: %v", err)
+	}
+}
+
+func TestListenDaemonSocketOnlyOnce(t *testing.T) {
+	// Unix socket paths are short, so don't use t.TempDir.
+	dir, err := os.MkdirTemp("", "gbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "d.sock")
+
+	// Daemons started at the same time don't remove each other's sockets.
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		listeners []net.Listener
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if listener, err := listenDaemonSocket(socketPath); err == nil {
+				mu.Lock()
+				listeners = append(listeners, listener)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(listeners) != 1 {
+		t.Fatalf("%d daemons listen on the socket, expected 1", len(listeners))
+	}
+	defer listeners[0].Close()
+	if _, err := listenDaemonSocket(socketPath); err == nil {
+		t.Error("a second daemon listened on the socket of a running one")
+	}
+}
+
+func TestDefaultDaemonSocket(t *testing.T) {
+	socket := func(args ...string) string {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("s3-bucket", "", "")
+		fs.String("daemon-socket", "", "")
+		fs.Bool("daemon", false, "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return defaultDaemonSocket(fs)
+	}
+	if socket("-s3-bucket=a") != socket("-s3-bucket=a", "-daemon", "-daemon-socket=/tmp/x") {
+		t.Error("the daemon flags changed the default socket")
+	}
+	if socket("-s3-bucket=a") == socket("-s3-bucket=b") {
+		t.Error("clients with different buckets share a daemon")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// detachDaemon makes the daemon started by cmd outlive the go command that
+// started its client, and keeps it from receiving the terminal's signals.
+func detachDaemon(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// notifyStatsSignal relays SIGUSR1, which makes the daemon print its statistics,
+// to c.
+func notifyStatsSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// checkDaemonDir returns an error if dir, which holds daemon sockets, belongs to
+// another user, who could replace a socket with their own daemon.
+func checkDaemonDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("socket directory %s belongs to another user", dir)
+	}
+	return nil
+}
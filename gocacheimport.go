@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// goCacheEntrySize is the size of an action entry file in the go command's
+// native cache, which holds a single line:
+//
+//	v1 <action ID> <output ID> <size> <time>
+//
+// with hex encoded SHA-256 IDs, and the size and time (Unix nanoseconds) as
+// decimals right-aligned in 20 columns.
+const goCacheEntrySize = 2 + 1 + 64 + 1 + 64 + 1 + 20 + 1 + 20 + 1
+
+// goCacheProgressInterval is how often import progress is reported.
+const goCacheProgressInterval = 2 * time.Second
+
+// goCacheEntry is an action entry from the go command's native cache.
+type goCacheEntry struct {
+	actionID []byte
+	outputID []byte
+	size     int64
+	time     time.Time
+}
+
+// parseGoCacheEntry parses the contents of an action entry file.
+func parseGoCacheEntry(data []byte) (goCacheEntry, error) {
+	var entry goCacheEntry
+	if len(data) != goCacheEntrySize || !bytes.HasPrefix(data, []byte("v1 ")) || data[len(data)-1] != '\n' {
+		return entry, fmt.Errorf("invalid entry")
+	}
+	fields := strings.Fields(string(data[3:]))
+	if len(fields) != 4 {
+		return entry, fmt.Errorf("invalid entry")
+	}
+
+	var err error
+	if entry.actionID, err = hex.DecodeString(fields[0]); err != nil {
+		return entry, fmt.Errorf("invalid action ID: %w", err)
+	}
+	if entry.outputID, err = hex.DecodeString(fields[1]); err != nil {
+		return entry, fmt.Errorf("invalid output ID: %w", err)
+	}
+	if entry.size, err = strconv.ParseInt(fields[2], 10, 64); err != nil || entry.size < 0 {
+		return entry, fmt.Errorf("invalid size %q", fields[2])
+	}
+	nanos, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return entry, fmt.Errorf("invalid time %q", fields[3])
+	}
+	entry.time = time.Unix(0, nanos)
+	return entry, nil
+}
+
+// goCacheImportStats counts the results of an import.
+type goCacheImportStats struct {
+	entries       atomic.Int64 // Action entries found
+	imported      atomic.Int64 // Entries written to the local cache
+	importedBytes atomic.Int64
+	existing      atomic.Int64 // Entries that were already in the local cache
+	invalid       atomic.Int64 // Entries that are damaged or whose output is missing
+	failed        atomic.Int64 // Entries that couldn't be written to the local cache
+	uploaded      atomic.Int64 // Entries uploaded to the backend
+	uploadedBytes atomic.Int64 // Bytes uploaded, after compression
+	uploadFailed  atomic.Int64
+}
+
+// goCacheImporter imports the entries of the go command's native cache into a
+// local cache, and optionally uploads them to a backend.
+type goCacheImporter struct {
+	lc     *localCache
+	locker locking.Group
+	// backend is nil if entries are only imported locally.
+	backend     backends.Backend
+	compression bool
+	concurrency int
+	logger      *slog.Logger
+
+	stats goCacheImportStats
+}
+
+// importDir imports every entry of the native cache at goCacheDir, processing up
+// to concurrency entries at a time. Progress is written to progress periodically.
+// Damaged entries are counted and skipped.
+func (im *goCacheImporter) importDir(goCacheDir string, progress io.Writer) error {
+	paths, err := listGoCacheEntries(goCacheDir)
+	if err != nil {
+		return err
+	}
+	im.stats.entries.Store(int64(len(paths)))
+
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan string)
+		done = make(chan struct{})
+	)
+	for range max(im.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				im.importEntry(goCacheDir, path)
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(goCacheProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Fprintf(progress, "Processed %d of %d entries (%d imported, %d uploaded)\n",
+					im.stats.imported.Load()+im.stats.existing.Load()+im.stats.invalid.Load()+im.stats.failed.Load(),
+					len(paths), im.stats.imported.Load(), im.stats.uploaded.Load())
+			}
+		}
+	}()
+
+	for _, path := range paths {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+	return nil
+}
+
+// listGoCacheEntries returns the paths of the action entry files in the native
+// cache at goCacheDir. Like ours, the native cache spreads its files over 256
+// subdirectories named after the first byte of their ID.
+func listGoCacheEntries(goCacheDir string) ([]string, error) {
+	var paths []string
+	for i := range 256 {
+		subdir := filepath.Join(goCacheDir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read %s: %w", subdir, err)
+		}
+		for _, dirEntry := range dirEntries {
+			if strings.HasSuffix(dirEntry.Name(), "-a") {
+				paths = append(paths, filepath.Join(subdir, dirEntry.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// importEntry imports the action entry at path and its output.
+func (im *goCacheImporter) importEntry(goCacheDir, path string) {
+	entry, outputPath, err := im.readEntry(goCacheDir, path)
+	if err != nil {
+		im.stats.invalid.Add(1)
+		im.logger.Debug("skipping native cache entry", "path", path, "error", err)
+		return
+	}
+
+	hexID := hex.EncodeToString(entry.actionID)
+	_, err = im.locker.DoWithLock(hexID, func() (interface{}, error) {
+		if im.lc.checkExists(entry.actionID) != nil {
+			im.stats.existing.Add(1)
+			return nil, nil
+		}
+		f, err := os.Open(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		meta := localCacheMetadata{OutputID: entry.outputID, Size: entry.size, PutTime: entry.time}
+		if _, err := im.lc.writeWithMetadata(entry.actionID, f, meta); err != nil {
+			return nil, err
+		}
+		im.stats.imported.Add(1)
+		im.stats.importedBytes.Add(entry.size)
+		return nil, nil
+	})
+	if err != nil {
+		im.stats.failed.Add(1)
+		im.logger.Warn("failed to import native cache entry", "actionID", hexID, "error", err)
+		return
+	}
+
+	if im.backend != nil {
+		if err := im.upload(entry, outputPath); err != nil {
+			im.stats.uploadFailed.Add(1)
+			im.logger.Warn("failed to upload native cache entry", "actionID", hexID, "error", err)
+		}
+	}
+}
+
+// readEntry reads and validates the action entry at path, and returns it along
+// with the path of its output file.
+func (im *goCacheImporter) readEntry(goCacheDir, path string) (goCacheEntry, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return goCacheEntry{}, "", err
+	}
+	entry, err := parseGoCacheEntry(data)
+	if err != nil {
+		return entry, "", err
+	}
+	if name := hex.EncodeToString(entry.actionID) + "-a"; filepath.Base(path) != name {
+		return entry, "", fmt.Errorf("entry for %x stored as %s", entry.actionID, filepath.Base(path))
+	}
+
+	hexOutputID := hex.EncodeToString(entry.outputID)
+	outputPath := filepath.Join(goCacheDir, hexOutputID[:2], hexOutputID+"-d")
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return entry, "", fmt.Errorf("missing output: %w", err)
+	}
+	if info.Size() != entry.size {
+		return entry, "", fmt.Errorf("output is %d bytes, entry says %d", info.Size(), entry.size)
+	}
+	return entry, outputPath, nil
+}
+
+// upload stores an imported entry in the backend, compressed like the server
+// would store it.
+func (im *goCacheImporter) upload(entry goCacheEntry, outputPath string) error {
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return err
+	}
+	n, err := putCompressed(im.backend, im.compression, entry.actionID, entry.outputID, data)
+	if err != nil {
+		return err
+	}
+	im.stats.uploaded.Add(1)
+	im.stats.uploadedBytes.Add(n)
+	return nil
+}
+
+// defaultGoCacheDir returns the location of the go command's native cache,
+// following the same rules as the go command itself.
+func defaultGoCacheDir() string {
+	if dir := os.Getenv("GOCACHE"); dir != "" && dir != "off" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-build")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// recordingBackend is a backend that records the keys and bodies of its PUTs, and
+// serves them back to GETs.
+type recordingBackend struct {
+	sync.Mutex
+	puts      map[string][]byte
+	outputIDs map[string][]byte
+	gets      int
+}
+
+func (b *recordingBackend) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.outputIDs == nil {
+		b.outputIDs = make(map[string][]byte)
+	}
+	b.puts[string(actionID)] = data
+	b.outputIDs[string(actionID)] = outputID
+	return nil
+}
+
+func (b *recordingBackend) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.gets++
+	data, ok := b.puts[string(actionID)]
+	if !ok {
+		return nil, nil, 0, nil, true, nil
+	}
+	putTime := time.Now()
+	return b.outputIDs[string(actionID)], io.NopCloser(bytes.NewReader(data)), int64(len(data)), &putTime, false, nil
+}
+
+func (b *recordingBackend) Close() error { return nil }
+func (b *recordingBackend) Clear() error { return nil }
+
+// writeGoCacheEntry writes an entry to a native cache directory the way the go
+// command does, and returns its action ID.
+func writeGoCacheEntry(t *testing.T, dir, action string, output []byte) []byte {
+	t.Helper()
+	var (
+		actionID = sha256.Sum256([]byte(action))
+		outputID = sha256.Sum256(output)
+		line     = fmt.Sprintf("v1 %x %x %20d %20d\n", actionID, outputID, len(output), time.Now().UnixNano())
+	)
+	for _, file := range []struct {
+		id   []byte
+		kind string
+		data []byte
+	}{{actionID[:], "a", []byte(line)}, {outputID[:], "d", output}} {
+		subdir := filepath.Join(dir, fmt.Sprintf("%02x", file.id[0]))
+		if err := os.MkdirAll(subdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(subdir, fmt.Sprintf("%x-%s", file.id, file.kind)), file.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return actionID[:]
+}
+
+func TestParseGoCacheEntry(t *testing.T) {
+	line := fmt.Sprintf("v1 %x %x %20d %20d\n", bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), 1234, 1700000000000000000)
+	entry, err := parseGoCacheEntry([]byte(line))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if entry.actionID[0] != 1 || entry.outputID[0] != 2 || entry.size != 1234 || entry.time.Unix() != 1700000000 {
+		t.Errorf("parsed %+v", entry)
+	}
+
+	for _, invalid := range []string{"", line[:len(line)-1], "v2" + line[2:], line[:10] + "zz" + line[12:]} {
+		if _, err := parseGoCacheEntry([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestGoCacheImport(t *testing.T) {
+	var (
+		goCacheDir = t.TempDir()
+		lc         = newTestLocalCache(t)
+		backend    = &recordingBackend{puts: make(map[string][]byte)}
+		outputs    = map[string][]byte{
+			"compile": []byte("compiled package"),
+			"link":    []byte("linked binary"),
+			"vet":     {},
+		}
+		ids = make(map[string][]byte)
+	)
+	for action, output := range outputs {
+		ids[action] = writeGoCacheEntry(t, goCacheDir, action, output)
+	}
+	// An entry whose output was removed, one whose output was truncated and a
+	// file that isn't an entry.
+	missing := writeGoCacheEntry(t, goCacheDir, "missing", []byte("gone"))
+	sum := sha256.Sum256([]byte("gone"))
+	os.Remove(filepath.Join(goCacheDir, fmt.Sprintf("%02x", sum[0]), fmt.Sprintf("%x-d", sum)))
+	writeGoCacheEntry(t, goCacheDir, "truncated", []byte("full output"))
+	sum = sha256.Sum256([]byte("full output"))
+	os.WriteFile(filepath.Join(goCacheDir, fmt.Sprintf("%02x", sum[0]), fmt.Sprintf("%x-d", sum)), []byte("full"), 0644)
+	os.WriteFile(filepath.Join(goCacheDir, "README"), []byte("not an entry"), 0644)
+
+	importer := &goCacheImporter{
+		lc:          lc,
+		locker:      locking.NewMemLock(),
+		backend:     backend,
+		concurrency: 2,
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if err := importer.importDir(goCacheDir, io.Discard); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+
+	stats := &importer.stats
+	if stats.entries.Load() != 5 || stats.imported.Load() != 3 || stats.invalid.Load() != 2 || stats.uploaded.Load() != 3 {
+		t.Errorf("entries = %d, imported = %d, invalid = %d, uploaded = %d",
+			stats.entries.Load(), stats.imported.Load(), stats.invalid.Load(), stats.uploaded.Load())
+	}
+	for action, id := range ids {
+		meta := lc.check(id)
+		if meta == nil {
+			t.Errorf("%s entry not imported", action)
+			continue
+		}
+		outputID := sha256.Sum256(outputs[action])
+		if !bytes.Equal(meta.OutputID, outputID[:]) || meta.Size != int64(len(outputs[action])) {
+			t.Errorf("%s entry imported as %+v", action, meta)
+		}
+		if data, err := os.ReadFile(lc.getPath(id)); err != nil || !bytes.Equal(data, outputs[action]) {
+			t.Errorf("%s entry contains %q (err %v)", action, data, err)
+		}
+		if uploaded := backend.puts[string(backendKey(id))]; !bytes.Equal(uploaded, outputs[action]) {
+			t.Errorf("%s entry uploaded as %q", action, uploaded)
+		}
+	}
+	if lc.check(missing) != nil {
+		t.Error("entry without output was imported")
+	}
+
+	// Importing again finds everything already cached.
+	again := &goCacheImporter{lc: lc, locker: locking.NewMemLock(), concurrency: 2, logger: importer.logger}
+	if err := again.importDir(goCacheDir, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if again.stats.existing.Load() != 3 || again.stats.imported.Load() != 0 {
+		t.Errorf("second import: existing = %d, imported = %d", again.stats.existing.Load(), again.stats.imported.Load())
+	}
+}
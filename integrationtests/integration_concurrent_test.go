@@ -1,12 +1,19 @@
 package integrationtests
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -148,3 +155,236 @@ func TestCacheIntegrationConcurrentProcesses(t *testing.T) {
 
 	t.Log("=== Cross-process deduplication test passed! ===")
 }
+
+// TestCacheIntegrationConcurrentNoTornReads runs several gobuildcache processes
+// against the same cache directory while entries are concurrently written and
+// trimmed, and verifies that every local hit points at a complete data file whose
+// contents match its output ID, even though hits are served without locking.
+func TestCacheIntegrationConcurrentNoTornReads(t *testing.T) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	workspaceDir := filepath.Join(currentDir, "..")
+
+	var (
+		buildDir     = filepath.Join(workspaceDir, "builds")
+		binaryPath   = filepath.Join(buildDir, "gobuildcache")
+		cacheDir     = filepath.Join(workspaceDir, "test-cache-torn-reads")
+		lockDir      = filepath.Join(workspaceDir, "test-locks-torn-reads")
+		numProcesses = 6
+		numEntries   = 64
+		numRounds    = 20
+	)
+	os.RemoveAll(cacheDir)
+	os.RemoveAll(lockDir)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(lockDir)
+
+	t.Log("Step 1: Compiling the binary...")
+	if err := os.MkdirAll(buildDir, 0755); err != nil {
+		t.Fatalf("Failed to create build directory: %v", err)
+	}
+	buildCmd := exec.Command("go", "build", "-o", binaryPath, ".")
+	buildCmd.Dir = workspaceDir
+	if output, err := buildCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to compile binary: %v\nOutput: %s", err, output)
+	}
+
+	// Entries of different sizes, so that writes take a while.
+	contents := make([][]byte, numEntries)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte(i), byte(i >> 8), 0x5a}, 1024*(1+i%32))
+	}
+
+	env := append(os.Environ(),
+		"BACKEND_TYPE=disk",
+		"LOCK_TYPE=fslock",
+		"LOCK_DIR="+lockDir,
+		"CACHE_DIR="+cacheDir)
+
+	t.Logf("Step 2: Running %d processes that read and write the same entries while the cache is trimmed...", numProcesses)
+	var (
+		wg        sync.WaitGroup
+		stop      = make(chan struct{})
+		trimsDone = make(chan struct{})
+		hits      atomic.Int64
+		puts      atomic.Int64
+	)
+	go func() {
+		defer close(trimsDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			trimCmd := exec.Command(binaryPath, "trim-local", "-max-size=256KB")
+			trimCmd.Env = env
+			if output, err := trimCmd.CombinedOutput(); err != nil {
+				t.Errorf("trim-local failed: %v\nOutput: %s", err, output)
+				return
+			}
+		}
+	}()
+
+	for p := 0; p < numProcesses; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+
+			client, err := startCacheProgClient(binaryPath, env)
+			if err != nil {
+				t.Errorf("process %d: %v", p, err)
+				return
+			}
+			defer client.close()
+
+			for round := 0; round < numRounds; round++ {
+				for n := 0; n < numEntries; n++ {
+					i := (n*7 + p*13 + round) % numEntries
+					actionID := sha256.Sum256([]byte(fmt.Sprintf("action-%d", i)))
+					outputID := sha256.Sum256(contents[i])
+
+					resp, err := client.request(cacheProgRequest{Command: "get", ActionID: actionID[:]}, nil)
+					if err != nil {
+						t.Errorf("process %d: GET failed: %v", p, err)
+						return
+					}
+					if resp.Miss {
+						if _, err := client.request(cacheProgRequest{
+							Command:  "put",
+							ActionID: actionID[:],
+							OutputID: outputID[:],
+							BodySize: int64(len(contents[i])),
+						}, contents[i]); err != nil {
+							t.Errorf("process %d: PUT failed: %v", p, err)
+							return
+						}
+						puts.Add(1)
+						continue
+					}
+
+					hits.Add(1)
+					if !bytes.Equal(resp.OutputID, outputID[:]) || resp.Size != int64(len(contents[i])) {
+						t.Errorf("process %d: entry %d: got output ID %x and size %d", p, i, resp.OutputID, resp.Size)
+						continue
+					}
+					data, err := os.ReadFile(resp.DiskPath)
+					if os.IsNotExist(err) {
+						// Trimmed since the GET, which the go command treats as a miss.
+						continue
+					}
+					if err != nil {
+						t.Errorf("process %d: failed to read %s: %v", p, resp.DiskPath, err)
+						continue
+					}
+					if sha256.Sum256(data) != outputID {
+						t.Errorf("process %d: torn read of entry %d: read %d bytes, expected %d", p, i, len(data), len(contents[i]))
+					}
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(stop)
+	<-trimsDone
+
+	if hits.Load() == 0 {
+		t.Fatal("no local hits, so nothing was verified")
+	}
+	t.Logf("✓ Verified %d hits (%d PUTs) without torn reads", hits.Load(), puts.Load())
+}
+
+type cacheProgRequest struct {
+	ID       int64
+	Command  string
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+}
+
+type cacheProgResponse struct {
+	ID       int64
+	Err      string
+	Miss     bool
+	OutputID []byte
+	Size     int64
+	DiskPath string
+}
+
+// cacheProgClient speaks the GOCACHEPROG protocol to a gobuildcache process, one
+// request at a time.
+type cacheProgClient struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	nextID int64
+}
+
+func startCacheProgClient(binaryPath string, env []string) (*cacheProgClient, error) {
+	cmd := exec.Command(binaryPath)
+	cmd.Env = env
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	client := &cacheProgClient{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	// The first response lists the supported commands.
+	if _, err := client.readResponse(); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("failed to read initial response: %w", err)
+	}
+	return client, nil
+}
+
+func (c *cacheProgClient) request(req cacheProgRequest, body []byte) (cacheProgResponse, error) {
+	c.nextID++
+	req.ID = c.nextID
+	line, err := json.Marshal(req)
+	if err != nil {
+		return cacheProgResponse{}, err
+	}
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		line = append(append(line, '\n'), encoded...)
+	}
+	if _, err := c.stdin.Write(append(line, '\n')); err != nil {
+		return cacheProgResponse{}, err
+	}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		return resp, err
+	}
+	if resp.ID != req.ID {
+		return resp, fmt.Errorf("got response for request %d, expected %d", resp.ID, req.ID)
+	}
+	if resp.Err != "" {
+		return resp, errors.New(resp.Err)
+	}
+	return resp, nil
+}
+
+func (c *cacheProgClient) readResponse() (cacheProgResponse, error) {
+	var resp cacheProgResponse
+	line, err := c.stdout.ReadBytes('\n')
+	if err != nil {
+		return resp, err
+	}
+	return resp, json.Unmarshal(line, &resp)
+}
+
+func (c *cacheProgClient) close() error {
+	c.request(cacheProgRequest{Command: "close"}, nil)
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
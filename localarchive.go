@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// A local cache archive is an LZ4 compressed tar stream. The LZ4 frame carries a
+// checksum of the whole stream, and each entry also records the SHA-256 of its
+// data, which is verified before the entry is imported. The first member,
+// localArchiveMagic, identifies the archive and its format; each further member
+// is an entry named after its hex action ID, with its data as contents and its
+// metadata in PAX records.
+const (
+	localArchiveMagic   = "GOBUILDCACHE"
+	localArchiveFormat  = "1"
+	localArchiveOutput  = "GOBUILDCACHE.outputid"
+	localArchivePutTime = "GOBUILDCACHE.puttime"
+	localArchiveUsed    = "GOBUILDCACHE.lastused"
+	localArchiveSum     = "GOBUILDCACHE.sha256"
+)
+
+// errArchiveEntryChanged is returned by writeArchiveEntry if an entry's data
+// doesn't match its metadata, which happens if it was replaced while being
+// exported.
+var errArchiveEntryChanged = errors.New("entry changed while being exported")
+
+// archiveStats holds the results of exporting or importing an archive.
+type archiveStats struct {
+	Entries int64 // Entries in the cache or archive
+	Bytes   int64
+	// Copied is the number of entries exported or imported, and CopiedBytes
+	// their size.
+	Copied      int64
+	CopiedBytes int64
+	// Skipped is the number of entries that weren't used recently enough to be
+	// exported, or that were already in the cache when importing.
+	Skipped int64
+}
+
+// exportArchive writes the entries of the local cache that were used within
+// usedWithin of now (or all of them if usedWithin is zero) to w as an archive.
+//
+// Entries are never modified in place, only replaced by renaming, so the cache
+// can be exported while it's in use without holding any locks.
+func (lc *localCache) exportArchive(w io.Writer, usedWithin time.Duration, now time.Time) (archiveStats, error) {
+	var stats archiveStats
+	zw := lz4.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	magic := &tar.Header{Name: localArchiveMagic, Mode: 0644, Size: int64(len(localArchiveFormat)), ModTime: now}
+	if err := tw.WriteHeader(magic); err != nil {
+		return stats, err
+	}
+	if _, err := tw.Write([]byte(localArchiveFormat)); err != nil {
+		return stats, err
+	}
+
+	entries, err := lc.listEntries()
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		hexID := hex.EncodeToString(entry.actionID)
+		meta, dataPath, err := lc.exportMetadata(entry.actionID, entry.legacy)
+		if err != nil {
+			// Damaged, or removed since the directory was read.
+			lc.logger.Debug("skipping local cache entry", "actionID", hexID, "error", err)
+			continue
+		}
+		stats.Entries++
+		stats.Bytes += meta.Size
+		if usedWithin > 0 && now.Sub(meta.LastUsed) > usedWithin {
+			stats.Skipped++
+			continue
+		}
+		if err := writeArchiveEntry(tw, hexID, dataPath, meta); err != nil {
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, errArchiveEntryChanged) {
+				lc.logger.Debug("skipping local cache entry", "actionID", hexID, "error", err)
+				continue
+			}
+			return stats, err
+		}
+		stats.Copied++
+		stats.CopiedBytes += meta.Size
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, zw.Close()
+}
+
+// exportMetadata returns the metadata and data path of an entry in either local
+// layout.
+func (lc *localCache) exportMetadata(actionID []byte, legacy bool) (*localCacheMetadata, string, error) {
+	if legacy {
+		meta, err := lc.readLegacyMetadata(actionID)
+		return meta, lc.legacyDataPath(actionID), err
+	}
+	meta, err := lc.readMetadata(actionID)
+	return meta, lc.actionIDToPath(actionID), err
+}
+
+// writeArchiveEntry writes an entry with the data file at dataPath to tw.
+func writeArchiveEntry(tw *tar.Writer, hexID, dataPath string, meta *localCacheMetadata) error {
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The checksum goes in the header, so the data is read twice.
+	h := sha256.New()
+	if n, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read %s: %w", dataPath, err)
+	} else if n != meta.Size {
+		return fmt.Errorf("%w: %s is %d bytes, metadata says %d", errArchiveEntryChanged, dataPath, n, meta.Size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:    hexID,
+		Mode:    0644,
+		Size:    meta.Size,
+		ModTime: meta.PutTime,
+		Format:  tar.FormatPAX,
+		PAXRecords: map[string]string{
+			localArchiveOutput:  hex.EncodeToString(meta.OutputID),
+			localArchivePutTime: strconv.FormatInt(meta.PutTime.UnixNano(), 10),
+			localArchiveUsed:    strconv.FormatInt(meta.LastUsed.UnixNano(), 10),
+			localArchiveSum:     hex.EncodeToString(h.Sum(nil)),
+		},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, f, meta.Size); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", dataPath, err)
+	}
+	return nil
+}
+
+// importArchive imports the entries of an archive written by exportArchive into
+// the local cache. Entries that are already cached are skipped.
+//
+// Each entry is written while holding its lock from locker, and like any other
+// write it's published by renaming it into place once its checksum has been
+// verified, so archives can be imported while the cache is in use. If the
+// archive turns out to be damaged, importArchive returns an error, but the
+// entries imported up to that point are intact.
+func (lc *localCache) importArchive(r io.Reader, locker locking.Group) (archiveStats, error) {
+	var stats archiveStats
+	tr := tar.NewReader(lz4.NewReader(r))
+	header, err := tr.Next()
+	if err != nil || header.Name != localArchiveMagic {
+		return stats, fmt.Errorf("not a gobuildcache archive")
+	}
+	format, err := io.ReadAll(io.LimitReader(tr, 16))
+	if err != nil || string(format) != localArchiveFormat {
+		return stats, fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read archive: %w", err)
+		}
+		actionID, meta, sum, err := parseArchiveHeader(header)
+		if err != nil {
+			return stats, fmt.Errorf("invalid archive entry %s: %w", header.Name, err)
+		}
+		stats.Entries++
+		stats.Bytes += meta.Size
+
+		_, err = locker.DoWithLock(header.Name, func() (interface{}, error) {
+			if lc.checkExists(actionID) != nil {
+				stats.Skipped++
+				return nil, nil
+			}
+			body := &verifyingReader{r: tr, h: sha256.New(), sum: sum}
+			if _, err := lc.writeWithMetadata(actionID, body, meta); err != nil {
+				return nil, err
+			}
+			stats.Copied++
+			stats.CopiedBytes += meta.Size
+			return nil, nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("failed to import %s: %w", header.Name, err)
+		}
+	}
+	return stats, nil
+}
+
+// parseArchiveHeader returns the action ID, metadata and data checksum of an
+// archive entry.
+func parseArchiveHeader(header *tar.Header) ([]byte, localCacheMetadata, []byte, error) {
+	var meta localCacheMetadata
+	actionID, err := hex.DecodeString(header.Name)
+	if err != nil || len(actionID) == 0 {
+		return nil, meta, nil, fmt.Errorf("invalid action ID")
+	}
+	if meta.OutputID, err = hex.DecodeString(header.PAXRecords[localArchiveOutput]); err != nil {
+		return nil, meta, nil, fmt.Errorf("invalid output ID: %w", err)
+	}
+	sum, err := hex.DecodeString(header.PAXRecords[localArchiveSum])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, meta, nil, fmt.Errorf("invalid checksum")
+	}
+	for key, t := range map[string]*time.Time{localArchivePutTime: &meta.PutTime, localArchiveUsed: &meta.LastUsed} {
+		nanos, err := strconv.ParseInt(header.PAXRecords[key], 10, 64)
+		if err != nil {
+			return nil, meta, nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*t = time.Unix(0, nanos)
+	}
+	meta.Size = header.Size
+	return actionID, meta, sum, nil
+}
+
+// verifyingReader returns an error instead of io.EOF if the data it read doesn't
+// match the expected SHA-256.
+type verifyingReader struct {
+	r   io.Reader
+	h   hash.Hash
+	sum []byte
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.h.Sum(nil), v.sum) {
+		return n, fmt.Errorf("checksum mismatch")
+	}
+	return n, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestLocalCacheArchiveRoundTrip(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		var (
+			recent  = []byte{0x01, 0x01}
+			stale   = []byte{0x02, 0x02}
+			legacy  = []byte{0x03, 0x03}
+			putTime = time.Unix(1700000000, 123)
+			data    = []byte("recently used output")
+		)
+		meta := localCacheMetadata{OutputID: []byte{0xaa}, Size: int64(len(data)), PutTime: putTime, LastUsed: time.Now()}
+		if _, err := lc.writeWithMetadata(recent, bytes.NewReader(data), meta); err != nil {
+			t.Fatal(err)
+		}
+		writeTestEntry(t, lc, stale, 10, 48*time.Hour)
+		writeLegacyEntry(t, lc, legacy, []byte("old"))
+
+		var archive bytes.Buffer
+		stats, err := lc.exportArchive(&archive, 24*time.Hour, time.Now())
+		if err != nil {
+			t.Fatalf("export failed: %v", err)
+		}
+		if stats.Entries != 3 || stats.Copied != 2 || stats.Skipped != 1 {
+			t.Errorf("export stats = %+v, expected 2 of 3 entries", stats)
+		}
+
+		imported := newTestLocalCache(t)
+		stats, err = imported.importArchive(bytes.NewReader(archive.Bytes()), locking.NewMemLock())
+		if err != nil {
+			t.Fatalf("import failed: %v", err)
+		}
+		if stats.Entries != 2 || stats.Copied != 2 || stats.Skipped != 0 {
+			t.Errorf("import stats = %+v, expected 2 entries", stats)
+		}
+		got := imported.check(recent)
+		if got == nil || !bytes.Equal(got.OutputID, meta.OutputID) || !got.PutTime.Equal(putTime) {
+			t.Fatalf("imported entry has metadata %+v, expected %+v", got, meta)
+		}
+		if contents, err := os.ReadFile(imported.getPath(recent)); err != nil || !bytes.Equal(contents, data) {
+			t.Errorf("imported entry contains %q (err %v)", contents, err)
+		}
+		// Legacy entries are imported in the current layout.
+		if imported.check(legacy) == nil || imported.check(stale) != nil {
+			t.Error("expected only the legacy and recent entries to be imported")
+		}
+
+		// Entries that are already cached are skipped.
+		stats, err = imported.importArchive(bytes.NewReader(archive.Bytes()), locking.NewMemLock())
+		if err != nil || stats.Copied != 0 || stats.Skipped != 2 {
+			t.Errorf("second import: stats = %+v, err = %v", stats, err)
+		}
+	})
+}
+
+func TestLocalCacheArchiveDetectsCorruption(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		actionID = []byte{0x04, 0x04}
+		data     = []byte("output that gets corrupted")
+	)
+	meta := localCacheMetadata{OutputID: []byte{0xaa}, Size: int64(len(data)), PutTime: time.Now(), LastUsed: time.Now()}
+	if _, err := lc.writeWithMetadata(actionID, bytes.NewReader(data), meta); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if _, err := lc.exportArchive(&archive, 0, time.Now()); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	// Corrupt the entry's data and recompress the archive, so that only the
+	// entry's own checksum catches it.
+	raw, err := io.ReadAll(lz4.NewReader(&archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(raw, data)
+	if i < 0 {
+		t.Fatal("entry data not found in archive")
+	}
+	raw[i] ^= 0x01
+	var corrupted bytes.Buffer
+	zw := lz4.NewWriter(&corrupted)
+	zw.Write(raw)
+	zw.Close()
+
+	imported := newTestLocalCache(t)
+	_, err = imported.importArchive(&corrupted, locking.NewMemLock())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if imported.check(actionID) != nil {
+		t.Error("corrupted entry was imported")
+	}
+
+	if _, err := imported.importArchive(strings.NewReader("not an archive"), locking.NewMemLock()); err == nil {
+		t.Error("expected error importing garbage")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,6 +19,18 @@ import (
 type localCache struct {
 	cacheDir string // Absolute path to cache directory
 	logger   *slog.Logger
+
+	// xattrs is true if entry headers are stored in extended attributes of the
+	// data files rather than in header files next to them. Entries linked to a
+	// shared object keep their header in a header file either way.
+	xattrs bool
+
+	// index holds the metadata of known entries, so that hits don't need to read
+	// headers from disk.
+	index *localIndex
+
+	// dedup counts writes that were deduplicated by linking existing objects.
+	dedup localDedupStats
 }
 
 // localCacheMetadata holds metadata for a cached entry.
@@ -25,6 +38,13 @@ type localCacheMetadata struct {
 	OutputID []byte
 	Size     int64
 	PutTime  time.Time
+
+	// LastUsed is when the entry was last used. It's refreshed by check.
+	LastUsed time.Time
+
+	// headerFile is true if the header is stored in a header file rather than
+	// an extended attribute. It's not part of the header itself.
+	headerFile bool
 }
 
 // newLocalCache creates a new local cache instance.
@@ -70,45 +90,36 @@ func newLocalCache(cacheDir string, logger *slog.Logger) (*localCache, error) {
 		return nil, err
 	}
 
-	return &localCache{
+	lc := &localCache{
 		cacheDir: absCacheDir,
 		logger:   logger,
-	}, nil
-}
-
-// writeMetadata writes metadata for a cache entry.
-func (lc *localCache) writeMetadata(actionID []byte, meta localCacheMetadata) error {
-	metaPath := lc.metadataPath(actionID)
-
-	// Format: outputID:hex\nsize:num\ntime:unix\n
-	content := fmt.Sprintf("outputID:%s\nsize:%d\ntime:%d\n",
-		hex.EncodeToString(meta.OutputID),
-		meta.Size,
-		meta.PutTime.Unix())
-
-	// Write to temp file first for atomic operation.
-	tmpPath := metaPath + ".tmp"
-	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
-		return fmt.Errorf("failed to write temp metadata: %w", err)
+		xattrs:   supportsXattrs(absCacheDir),
+		index:    newLocalIndex(),
 	}
-
-	// Then atomically rename. This prevents any partial metadata files
-	// from ever existing, although it increases the number of syscalls
-	// we need to perform.
-	if err := os.Rename(tmpPath, metaPath); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to rename metadata: %w", err)
+	if err := lc.loadIndex(); err != nil {
+		// The index is populated lazily instead.
+		logger.Warn("failed to load local cache index", "error", err)
 	}
-
-	return nil
+	return lc, nil
 }
 
-// readMetadata reads metadata for a cache entry.
+// readLegacyMetadata reads the text metadata file of an entry in the previous
+// local layout.
 // Returns an error if metadata doesn't exist or is corrupted.
-func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error) {
-	metaPath := lc.metadataPath(actionID)
+func (lc *localCache) readLegacyMetadata(actionID []byte) (*localCacheMetadata, error) {
+	metaPath := lc.legacyMetadataPath(actionID)
+
+	f, err := os.Open(metaPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	defer f.Close()
 
-	data, err := os.ReadFile(metaPath)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat metadata: %w", err)
+	}
+	data, err := io.ReadAll(f)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read metadata: %w", err)
 	}
@@ -142,76 +153,200 @@ func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error)
 		OutputID: outputID,
 		Size:     size,
 		PutTime:  time.Unix(putTimeUnix, 0),
+		LastUsed: info.ModTime(),
 	}, nil
 }
 
-// Write atomically writes data from a reader to the local cache.
+// readMetadata reads the header of a cache entry.
+// Returns an error if the entry doesn't exist or its header is missing or corrupted.
+func (lc *localCache) readMetadata(actionID []byte) (*localCacheMetadata, error) {
+	meta, err := lc.readHeader(lc.actionIDToPath(actionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// WriteWithMetadata atomically writes data from a reader to the local cache,
+// along with its metadata.
 // Returns the absolute path to the cached file.
-func (lc *localCache) write(actionID []byte, body io.Reader) (string, error) {
-	diskPath := lc.actionIDToPath(actionID)
+func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta localCacheMetadata) (string, error) {
+	return lc.writeEntry(actionID, meta, func(tmpPath string, header []byte) error {
+		return lc.writeTemp(tmpPath, body, meta, header)
+	})
+}
 
-	// Write to temp file first for atomic operation.
-	tmpPath := diskPath + ".tmp"
-	tmpFile, err := os.Create(tmpPath)
+// stagedBody is the data of an entry written to a temp file in the local cache
+// before the lock for the entry is held.
+type stagedBody struct {
+	path string
+	size int64
+	sum  []byte // SHA-256 of the data
+}
+
+// stage writes body to a new temp file beside the entry for actionID, so that
+// it can be consumed without holding the entry's lock and then published by
+// writeStaged without copying it again. The caller must remove the temp file.
+func (lc *localCache) stage(actionID []byte, body io.Reader) (*stagedBody, error) {
+	diskPath := lc.actionIDToPath(actionID)
+	tmpFile, err := os.CreateTemp(filepath.Dir(diskPath), filepath.Base(diskPath)+".*.tmp")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
-	defer os.Remove(tmpPath) // Clean up if something goes wrong
-
-	// Copy data to temp file.
-	_, err = io.Copy(tmpFile, body)
+	staged := &stagedBody{path: tmpFile.Name()}
+	h := sha256.New()
+	staged.size, err = io.Copy(io.MultiWriter(tmpFile, h), body)
 	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to write to temp file: %w", err)
+		os.Remove(staged.path)
+		return nil, fmt.Errorf("failed to write to temp file: %w", err)
 	}
-	if closeErr != nil {
-		return "", fmt.Errorf("failed to close temp file: %w", closeErr)
+	staged.sum = h.Sum(nil)
+	return staged, nil
+}
+
+// writeStaged atomically publishes the data staged by stage as the entry for
+// actionID, along with its metadata, like writeWithMetadata.
+func (lc *localCache) writeStaged(actionID []byte, staged *stagedBody, meta localCacheMetadata) (string, error) {
+	return lc.writeEntry(actionID, meta, func(tmpPath string, header []byte) error {
+		if lc.xattrs {
+			f, err := os.OpenFile(staged.path, os.O_WRONLY, 0)
+			if err != nil {
+				return fmt.Errorf("failed to open temp file: %w", err)
+			}
+			err = fsetxattr(f, localHeaderXattr, header)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to set header: %w", err)
+			}
+		}
+		if err := os.Rename(staged.path, tmpPath); err != nil {
+			return fmt.Errorf("failed to rename temp file: %w", err)
+		}
+		lc.storeObject(tmpPath, meta.OutputID, staged.sum)
+		return nil
+	})
+}
+
+// writeEntry publishes the entry for actionID, whose data is written to a temp
+// file by writeTemp unless there's an object with the same output to link to.
+func (lc *localCache) writeEntry(actionID []byte, meta localCacheMetadata, writeTemp func(tmpPath string, header []byte) error) (string, error) {
+	if meta.LastUsed.IsZero() {
+		meta.LastUsed = time.Now()
+	}
+	header, err := encodeLocalHeader(meta)
+	if err != nil {
+		return "", err
+	}
+
+	diskPath := lc.actionIDToPath(actionID)
+	lc.dedup.writes.Add(1)
+	lc.dedup.bytes.Add(meta.Size)
+
+	// Write to temp file first for atomic operation, or link it to an existing
+	// object with the same output, in which case body isn't read at all.
+	tmpPath := diskPath + ".tmp"
+	defer os.Remove(tmpPath) // Clean up if something goes wrong
+	linked := lc.linkObject(tmpPath, meta)
+	if linked {
+		lc.dedup.linkedWrites.Add(1)
+		lc.dedup.linkedBytes.Add(meta.Size)
+	} else if err := writeTemp(tmpPath, header); err != nil {
+		return "", err
+	}
+
+	// A header file left by a previous write of the entry would take precedence
+	// over the extended attribute. Unreadable header files are removed by check,
+	// so there can only be one if the index says so.
+	if lc.xattrs {
+		if prev, ok := lc.lookup(actionID); ok && prev.headerFile {
+			if err := os.Remove(lc.headerPath(actionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("failed to remove header: %w", err)
+			}
+		}
 	}
 
 	// Then atomically rename the temp file to the final destination.
 	// This prevents any partial cache files from ever existing, although
 	// it increases the number of syscalls we need to perform.
-	//
-	// NOTE: I'm not sure this is necessary. Even if we write a partial data
-	// file, if we don't write the metadata file, then the data file will
-	// never be observed. Similarly, there's no worry of data races because
-	// localcache.go is running with mutual exclusion over a given action ID
-	// as implemented in server.go. That said, I'm leaving this in for now
-	// because I think it's safer and probably doesn't hurt performance much.
 	if err := os.Rename(tmpPath, diskPath); err != nil {
 		return "", fmt.Errorf("failed to rename cache file: %w", err)
 	}
 
+	// Without extended attributes the header goes in its own file, and so does the
+	// header of an entry linked to an object, whose extended attributes are shared
+	// with the other entries linked to it. It's written after the data so that a
+	// header never refers to a missing data file. Until then, a linked entry has
+	// the header of the object, which has the same output ID and size.
+	meta.headerFile = !lc.xattrs || linked
+	if meta.headerFile {
+		if err := lc.writeHeaderFile(diskPath, header); err != nil {
+			lc.logger.Warn("failed to write local cache metadata",
+				"actionID", hex.EncodeToString(actionID),
+				"error", err)
+			// Continue - data is cached, just missing metadata
+		}
+	}
+
+	lc.remember(actionID, meta)
+
 	// diskPath is already absolute (cacheDir is absolute)
 	return diskPath, nil
 }
 
-// WriteWithMetadata writes data and metadata to the local cache.
-// Returns the absolute path to the cached file.
-func (lc *localCache) writeWithMetadata(actionID []byte, body io.Reader, meta localCacheMetadata) (string, error) {
-	// Write data
-	diskPath, err := lc.write(actionID, body)
+// writeTemp writes body to the temp file at tmpPath, along with its header if
+// headers are stored in extended attributes, and makes it the object for its
+// output.
+func (lc *localCache) writeTemp(tmpPath string, body io.Reader, meta localCacheMetadata, header []byte) error {
+	tmpFile, err := os.Create(tmpPath)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 
-	// Write metadata
-	if err := lc.writeMetadata(actionID, meta); err != nil {
-		lc.logger.Warn("failed to write local cache metadata",
-			"actionID", hex.EncodeToString(actionID),
-			"error", err)
-		// Continue - data is cached, just missing metadata
+	// Copy data to temp file, and attach the header to it before it becomes
+	// visible so that data and metadata are published by a single rename.
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, h), body)
+	if err == nil && lc.xattrs {
+		if xattrErr := fsetxattr(tmpFile, localHeaderXattr, header); xattrErr != nil {
+			err = fmt.Errorf("failed to set header: %w", xattrErr)
+		}
+	}
+	closeErr := tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write to temp file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close temp file: %w", closeErr)
 	}
 
-	return diskPath, nil
+	lc.storeObject(tmpPath, meta.OutputID, h.Sum(nil))
+	return nil
 }
 
 // Check checks if a file exists in the local cache and returns its metadata.
 // Returns nil if not found, and logs a warning if metadata is missing/corrupted.
+// Entries in the previous local layout are migrated to the current one.
+//
+// Entries found in the index are returned without touching the disk, so for a
+// short while after another process removes an entry, check may still return it.
 func (lc *localCache) check(actionID []byte) *localCacheMetadata {
-	// Try to read metadata directly (avoids extra Stat syscall)
-	// If the data file doesn't exist, the metadata file likely won't either
+	if meta, ok := lc.lookup(actionID); ok {
+		if lc.markUsed(actionID, meta) {
+			lc.remember(actionID, *meta)
+		}
+		return meta
+	}
+
 	meta, err := lc.readMetadata(actionID)
+	if errors.Is(err, os.ErrNotExist) {
+		meta, err = lc.migrateLegacy(actionID)
+	} else if err == nil {
+		err = lc.checkSize(actionID, meta)
+	}
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			// Neither data nor metadata exists - this is a cache miss
@@ -223,24 +358,144 @@ func (lc *localCache) check(actionID []byte) *localCacheMetadata {
 			"actionID", hex.EncodeToString(actionID),
 			"error", err,
 		)
-
-		// Metadata is missing or corrupted but data file might exist
-		// Check if data file exists
-		diskPath := lc.actionIDToPath(actionID)
-		if _, statErr := os.Stat(diskPath); statErr == nil {
-			// Data file exists but metadata is missing/corrupted
-			lc.logger.Warn(
-				"local cache file exists but metadata is missing/corrupted",
-				"actionID", hex.EncodeToString(actionID),
-				"error", err,
-			)
+		// The entry is written again after the miss, and a bad header file would
+		// take precedence over the new entry's extended attribute.
+		if lc.xattrs {
+			os.Remove(lc.headerPath(actionID))
 		}
 		return nil
 	}
 
+	lc.markUsed(actionID, meta)
+	lc.remember(actionID, *meta)
 	return meta
 }
 
+// checkUnlocked is like check, but safe to call without holding the entry's lock.
+// Entries are published by renaming complete files into place, so if an entry's
+// header can be read, its data file is complete.
+//
+// checkUnlocked never writes to an entry, except to refresh its last-use time in an
+// extended attribute, which is atomic. It returns nil for anything but a plain hit,
+// such as entries that need to be migrated or whose last-use time must be
+// refreshed in a header file, which should be handled by check under the lock.
+// Looking for the header file only costs a stat once per localUseInterval.
+func (lc *localCache) checkUnlocked(actionID []byte) *localCacheMetadata {
+	// Don't re-add an entry that was forgotten while we read it.
+	version := lc.indexVersion()
+
+	meta, ok := lc.lookup(actionID)
+	if !ok {
+		var err error
+		if meta, err = lc.readMetadata(actionID); err != nil {
+			return nil
+		}
+		if lc.checkSize(actionID, meta) != nil {
+			return nil
+		}
+	}
+	if time.Since(meta.LastUsed) >= localUseInterval {
+		if !lc.xattrs || fileExists(lc.headerPath(actionID)) {
+			return nil
+		}
+		lc.markUsed(actionID, meta)
+	}
+	lc.rememberUnlessForgotten(actionID, *meta, version)
+	return meta
+}
+
+// checkSize returns an error if the data file of an entry read from disk doesn't
+// have the size in its header, such as when the header belongs to an earlier
+// write of the entry. Indexed entries were checked when they were read.
+func (lc *localCache) checkSize(actionID []byte, meta *localCacheMetadata) error {
+	info, err := os.Stat(lc.actionIDToPath(actionID))
+	if err != nil {
+		// Not a plain miss: the header exists without its data.
+		return fmt.Errorf("failed to stat data: %v", err)
+	}
+	if info.Size() != meta.Size {
+		return fmt.Errorf("data size %d doesn't match header size %d", info.Size(), meta.Size)
+	}
+	return nil
+}
+
+// checkExists is like check, but also verifies that the data file of an indexed
+// entry still exists. It's used before writing an entry so that a stale index
+// can't prevent a removed entry from being written again.
+func (lc *localCache) checkExists(actionID []byte) *localCacheMetadata {
+	if _, ok := lc.lookup(actionID); ok {
+		if _, err := os.Stat(lc.actionIDToPath(actionID)); err != nil {
+			lc.forget(actionID)
+		}
+	}
+	return lc.check(actionID)
+}
+
+// migrateLegacy moves an entry in the previous local layout to the current one
+// and returns its metadata. It returns an error wrapping os.ErrNotExist if there's
+// no such entry.
+func (lc *localCache) migrateLegacy(actionID []byte) (*localCacheMetadata, error) {
+	meta, err := lc.readLegacyMetadata(actionID)
+	if err != nil {
+		return nil, err
+	}
+	legacyPath := lc.legacyDataPath(actionID)
+	info, err := os.Stat(legacyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat legacy data: %w", err)
+	}
+	if info.Size() != meta.Size {
+		return nil, fmt.Errorf("legacy data size %d doesn't match metadata size %d", info.Size(), meta.Size)
+	}
+
+	header, err := encodeLocalHeader(*meta)
+	if err != nil {
+		return nil, err
+	}
+	diskPath := lc.actionIDToPath(actionID)
+	if lc.xattrs {
+		if err := setxattr(legacyPath, localHeaderXattr, header); err != nil {
+			return nil, &os.PathError{Op: "setxattr", Path: legacyPath, Err: err}
+		}
+	}
+	if err := os.Rename(legacyPath, diskPath); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy data: %w", err)
+	}
+	if !lc.xattrs {
+		if err := lc.writeHeaderFile(diskPath, header); err != nil {
+			return nil, err
+		}
+		meta.headerFile = true
+	}
+	if err := os.Remove(lc.legacyMetadataPath(actionID)); err != nil {
+		lc.logger.Debug("failed to remove legacy local cache metadata",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+	}
+	return meta, nil
+}
+
+// markUsed records that an entry was just used so that trimming evicts the least
+// recently used entries first. To avoid a write on every hit, the last-use time is
+// only refreshed once it's more than localUseInterval old. It returns true if the
+// last-use time was refreshed.
+func (lc *localCache) markUsed(actionID []byte, meta *localCacheMetadata) bool {
+	now := time.Now()
+	if now.Sub(meta.LastUsed) < localUseInterval {
+		return false
+	}
+	updated := *meta
+	updated.LastUsed = now
+	if err := lc.writeHeader(actionID, updated); err != nil {
+		lc.logger.Debug("failed to update local cache last-use time",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		return false
+	}
+	meta.LastUsed = now
+	return true
+}
+
 // actionIDToPath converts an actionID to a local cache file path.
 // Files are organized into 256 subdirectories (00-ff) based on the first byte
 // of the action ID, similar to Go's build cache structure.
@@ -248,13 +503,15 @@ func (lc *localCache) actionIDToPath(actionID []byte) string {
 	hexActionID := hex.EncodeToString(actionID)
 	// Use first two hex characters (first byte) of action ID as subdirectory name
 	subdir := hexActionID[:2]
-	hexID := fileFormatVersion + hexActionID
+	hexID := localEntryVersion + hexActionID
 	return filepath.Join(lc.cacheDir, subdir, hexID)
 }
 
-// metadataPath returns the path to the metadata file for an actionID.
-func (lc *localCache) metadataPath(actionID []byte) string {
-	return lc.actionIDToPath(actionID) + ".meta"
+// headerPath returns the path to the header file for an actionID. It's used on
+// filesystems without extended attribute support, and for entries linked to a
+// shared object.
+func (lc *localCache) headerPath(actionID []byte) string {
+	return lc.actionIDToPath(actionID) + localHeaderSuffix
 }
 
 // GetPath returns the absolute path for an actionID in the local cache.
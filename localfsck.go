@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// Kinds of problems found by fsck.
+const (
+	fsckOrphanedTemp    = "orphaned-temp"
+	fsckMissingMetadata = "missing-metadata"
+	fsckCorruptMetadata = "corrupt-metadata"
+	fsckMissingData     = "missing-data"
+	fsckSizeMismatch    = "size-mismatch"
+)
+
+// fsckTempAge is how old a temp file must be before fsck considers it orphaned.
+// Younger temp files may belong to a write that is still in progress.
+const fsckTempAge = 10 * time.Minute
+
+// fsckMode selects what fsck does about the problems it finds.
+type fsckMode int
+
+const (
+	// fsckReportOnly only reports problems.
+	fsckReportOnly fsckMode = iota
+	// fsckRepair rebuilds missing or corrupt metadata from the data file and
+	// deletes whatever can't be repaired.
+	fsckRepair
+	// fsckDelete deletes every file involved in a problem.
+	fsckDelete
+)
+
+// fsckProblem describes a single problem found by fsck.
+type fsckProblem struct {
+	Kind     string `json:"kind"`
+	ActionID string `json:"actionID,omitempty"`
+	Path     string `json:"path"`
+	Detail   string `json:"detail,omitempty"`
+	// Fix is "repaired" or "deleted" if the problem was fixed, and empty otherwise.
+	Fix string `json:"fix,omitempty"`
+}
+
+// fsckReport holds the results of fsck.
+type fsckReport struct {
+	Entries  int64         `json:"entries"`
+	Problems []fsckProblem `json:"problems"`
+	// LegacyEntries is the number of intact entries in the previous local layout,
+	// and Migrated the number of those that were migrated to the current one.
+	LegacyEntries int64 `json:"legacyEntries"`
+	Migrated      int64 `json:"migrated"`
+}
+
+// unfixed returns the number of problems that were not fixed.
+func (r fsckReport) unfixed() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if problem.Fix == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// fsck checks every entry in the local cache for orphaned temp files, data
+// without metadata, metadata without data, and data whose size doesn't match its
+// metadata. Depending on mode, it also fixes the problems it finds, and in repair
+// mode it migrates entries in the previous local layout to the current one.
+//
+// Each entry is checked while holding its lock from locker, so that a concurrent
+// write isn't mistaken for a missing metadata file.
+func (lc *localCache) fsck(locker locking.Group, mode fsckMode, now time.Time) (fsckReport, error) {
+	report := fsckReport{Problems: []fsckProblem{}}
+	for i := range 256 {
+		subdir := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return report, fmt.Errorf("failed to read cache directory %s: %w", subdir, err)
+		}
+
+		var hexIDs []string
+		seen := make(map[string]bool)
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if strings.HasSuffix(name, ".tmp") {
+				if problem := lc.fsckTemp(filepath.Join(subdir, name), mode, now); problem != nil {
+					report.Problems = append(report.Problems, *problem)
+				}
+				continue
+			}
+			file, ok := parseLocalFileName(name)
+			if !ok || seen[file.hexID] {
+				continue
+			}
+			seen[file.hexID] = true
+			hexIDs = append(hexIDs, file.hexID)
+		}
+		sort.Strings(hexIDs)
+
+		for _, hexID := range hexIDs {
+			_, err := locker.DoWithLock(hexID, func() (interface{}, error) {
+				actionID, _ := hex.DecodeString(hexID)
+				return nil, lc.fsckEntry(actionID, mode, &report)
+			})
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if len(report.Problems) > report.unfixed() || report.Migrated > 0 {
+		if err := lc.bumpGeneration(); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// fsckTemp checks a temp file and removes it if it's orphaned and mode allows it.
+func (lc *localCache) fsckTemp(path string, mode fsckMode, now time.Time) *fsckProblem {
+	info, err := os.Stat(path)
+	if err != nil || now.Sub(info.ModTime()) < fsckTempAge {
+		// Renamed or removed since the directory was read, or still being written.
+		return nil
+	}
+
+	problem := &fsckProblem{
+		Kind:   fsckOrphanedTemp,
+		Path:   path,
+		Detail: fmt.Sprintf("%s, last modified %s", formatBytes(info.Size()), info.ModTime().Format(time.RFC3339)),
+	}
+	if mode != fsckReportOnly {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			problem.Detail += fmt.Sprintf("; failed to remove: %v", err)
+		} else {
+			problem.Fix = "deleted"
+		}
+	}
+	return problem
+}
+
+// fsckEntry checks a single cache entry in both the current and the previous
+// local layout, and adds the results to report.
+func (lc *localCache) fsckEntry(actionID []byte, mode fsckMode, report *fsckReport) error {
+	var (
+		hexID      = hex.EncodeToString(actionID)
+		dataPath   = lc.actionIDToPath(actionID)
+		legacyPath = lc.legacyDataPath(actionID)
+		found      bool
+	)
+	addProblem := func(problem *fsckProblem, err error) error {
+		if problem != nil {
+			problem.ActionID = hexID
+			report.Problems = append(report.Problems, *problem)
+		}
+		return err
+	}
+
+	dataInfo, err := statIfExists(dataPath)
+	if err != nil {
+		return err
+	}
+	if dataInfo != nil || fileExists(lc.headerPath(actionID)) {
+		found = true
+		meta, metaErr := lc.readMetadata(actionID)
+		if err := addProblem(lc.fsckFiles(dataPath, lc.headerPath(actionID), dataInfo, meta, metaErr, mode)); err != nil {
+			return err
+		}
+	}
+
+	legacyInfo, err := statIfExists(legacyPath)
+	if err != nil {
+		return err
+	}
+	if legacyInfo != nil || fileExists(lc.legacyMetadataPath(actionID)) {
+		found = true
+		meta, metaErr := lc.readLegacyMetadata(actionID)
+		if errors.Is(metaErr, os.ErrNotExist) {
+			metaErr = errLocalHeaderMissing
+		}
+		problem, err := lc.fsckFiles(legacyPath, lc.legacyMetadataPath(actionID), legacyInfo, meta, metaErr, mode)
+		if err := addProblem(problem, err); err != nil {
+			return err
+		}
+		if problem == nil {
+			report.LegacyEntries++
+			if mode == fsckRepair {
+				if err := lc.fsckMigrate(actionID); err != nil {
+					return err
+				}
+				report.Migrated++
+			}
+		}
+	}
+
+	if found {
+		report.Entries++
+	}
+	return nil
+}
+
+// fsckFiles checks the data file of an entry against its metadata, which is
+// stored at metaPath unless it's in an extended attribute. It returns nil if the
+// entry is fine.
+func (lc *localCache) fsckFiles(dataPath, metaPath string, dataInfo os.FileInfo, meta *localCacheMetadata, metaErr error, mode fsckMode) (*fsckProblem, error) {
+	problem := &fsckProblem{Path: dataPath}
+	switch {
+	case dataInfo == nil:
+		problem.Kind = fsckMissingData
+		problem.Path = metaPath
+		if mode != fsckReportOnly {
+			return problem, lc.fsckRemove(problem, metaPath)
+		}
+	case metaErr != nil:
+		problem.Kind = fsckCorruptMetadata
+		problem.Detail = metaErr.Error()
+		if errors.Is(metaErr, errLocalHeaderMissing) {
+			problem.Kind = fsckMissingMetadata
+			problem.Detail = ""
+		}
+		switch mode {
+		case fsckRepair:
+			if err := lc.rebuildMetadata(dataPath, dataInfo); err != nil {
+				return problem, fmt.Errorf("failed to rebuild metadata for %s: %w", dataPath, err)
+			}
+			problem.Fix = "repaired"
+		case fsckDelete:
+			return problem, lc.fsckRemove(problem, metaPath, dataPath)
+		}
+	case meta.Size != dataInfo.Size():
+		problem.Kind = fsckSizeMismatch
+		problem.Detail = fmt.Sprintf("metadata size %d, data size %d", meta.Size, dataInfo.Size())
+		// The data is presumably truncated or otherwise damaged, so there's nothing
+		// to repair it from.
+		if mode != fsckReportOnly {
+			return problem, lc.fsckRemove(problem, metaPath, dataPath)
+		}
+	default:
+		return nil, nil
+	}
+	return problem, nil
+}
+
+// fsckMigrate migrates an intact entry in the previous local layout. If the
+// entry also exists in the current layout, the legacy files are removed instead.
+func (lc *localCache) fsckMigrate(actionID []byte) error {
+	if _, err := lc.readMetadata(actionID); err == nil {
+		for _, path := range []string{lc.legacyMetadataPath(actionID), lc.legacyDataPath(actionID)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+		}
+		return nil
+	}
+	if _, err := lc.migrateLegacy(actionID); err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", lc.legacyDataPath(actionID), err)
+	}
+	return nil
+}
+
+// fsckRemove removes paths in order and marks problem as fixed.
+func (lc *localCache) fsckRemove(problem *fsckProblem, paths ...string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	problem.Fix = "deleted"
+	return nil
+}
+
+// rebuildMetadata recreates the metadata of the entry whose data file is at
+// dataPath, migrating it to the current layout if needed. The go command uses the
+// SHA-256 of an output as its output ID, so it can be recomputed from the data.
+func (lc *localCache) rebuildMetadata(dataPath string, dataInfo os.FileInfo) error {
+	file, _ := parseLocalFileName(filepath.Base(dataPath))
+	actionID, err := hex.DecodeString(file.hexID)
+	if err != nil {
+		return err
+	}
+
+	if file.legacy {
+		if _, err := lc.readMetadata(actionID); err == nil {
+			// Already migrated, so the legacy files are just left over.
+			for _, path := range []string{lc.legacyMetadataPath(actionID), dataPath} {
+				if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if file.legacy {
+		if err := os.Rename(dataPath, lc.actionIDToPath(actionID)); err != nil {
+			return err
+		}
+		if err := os.Remove(lc.legacyMetadataPath(actionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return lc.writeHeader(actionID, localCacheMetadata{
+		OutputID: h.Sum(nil),
+		Size:     size,
+		PutTime:  dataInfo.ModTime(),
+		LastUsed: dataInfo.ModTime(),
+	})
+}
+
+// statIfExists stats path, returning nil if it doesn't exist.
+func statIfExists(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return info, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
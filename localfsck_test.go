@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+const fsckLegacyEntry = "legacy"
+
+// writeDamagedEntries writes one healthy entry, one intact entry in the previous
+// layout and one entry for each kind of problem fsck detects, and returns their
+// action IDs by problem kind.
+func writeDamagedEntries(t *testing.T, lc *localCache) map[string][]byte {
+	t.Helper()
+	ids := map[string][]byte{
+		"healthy":           {0x10, 0x01},
+		fsckLegacyEntry:     {0x60, 0x06},
+		fsckMissingMetadata: {0x20, 0x02},
+		fsckCorruptMetadata: {0x30, 0x03},
+		fsckMissingData:     {0x40, 0x04},
+		fsckSizeMismatch:    {0x50, 0x05},
+	}
+	data := []byte("some build output")
+	meta := localCacheMetadata{OutputID: []byte{0xaa}, Size: int64(len(data)), PutTime: time.Now()}
+	for _, kind := range []string{"healthy", fsckCorruptMetadata, fsckSizeMismatch} {
+		if _, err := lc.writeWithMetadata(ids[kind], bytes.NewReader(data), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLegacyEntry(t, lc, ids[fsckLegacyEntry], data)
+
+	os.WriteFile(lc.actionIDToPath(ids[fsckMissingMetadata]), data, 0644)
+	writeRawHeader(t, lc, ids[fsckCorruptMetadata], []byte("garbage"))
+	writeLegacyEntry(t, lc, ids[fsckMissingData], data)
+	os.Remove(lc.legacyDataPath(ids[fsckMissingData]))
+	os.WriteFile(lc.actionIDToPath(ids[fsckSizeMismatch]), data[:5], 0644)
+	if lc.xattrs {
+		// Rewriting the file dropped its header.
+		writeRawHeader(t, lc, ids[fsckSizeMismatch], mustEncodeHeader(t, meta))
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"v3deadbeef.tmp", "v3deadbeef.hdr.tmp"} {
+		path := filepath.Join(lc.cacheDir, "de", name)
+		os.WriteFile(path, []byte("partial"), 0644)
+		os.Chtimes(path, old, old)
+	}
+	// A recent temp file may still be being written, so it's not reported.
+	os.WriteFile(filepath.Join(lc.cacheDir, "de", "v3deadbe00.tmp"), []byte("partial"), 0644)
+
+	return ids
+}
+
+func problemKinds(report fsckReport) map[string]int {
+	kinds := make(map[string]int)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	return kinds
+}
+
+// forEachHeaderStorage runs test against a local cache that stores headers in
+// extended attributes, if the filesystem supports them, and one that uses header
+// files.
+func forEachHeaderStorage(t *testing.T, test func(t *testing.T, lc *localCache)) {
+	t.Run("xattr", func(t *testing.T) {
+		lc := newTestLocalCache(t)
+		if !lc.xattrs {
+			t.Skip("extended attributes are not supported")
+		}
+		test(t, lc)
+	})
+	t.Run("file", func(t *testing.T) {
+		lc := newTestLocalCache(t)
+		lc.xattrs = false
+		test(t, lc)
+	})
+}
+
+func TestLocalCacheFsckReportOnly(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		ids := writeDamagedEntries(t, lc)
+
+		report, err := lc.fsck(locking.NewMemLock(), fsckReportOnly, time.Now())
+		if err != nil {
+			t.Fatalf("fsck failed: %v", err)
+		}
+		if report.Entries != 6 || report.LegacyEntries != 1 || report.Migrated != 0 {
+			t.Errorf("report = %+v, expected 6 entries of which 1 is legacy", report)
+		}
+		expected := map[string]int{
+			fsckOrphanedTemp:    2,
+			fsckMissingMetadata: 1,
+			fsckCorruptMetadata: 1,
+			fsckMissingData:     1,
+			fsckSizeMismatch:    1,
+		}
+		kinds := problemKinds(report)
+		for kind, n := range expected {
+			if kinds[kind] != n {
+				t.Errorf("found %d %s problems, expected %d", kinds[kind], kind, n)
+			}
+		}
+		if report.unfixed() != 6 {
+			t.Errorf("%d problems unfixed, expected 6", report.unfixed())
+		}
+
+		// Nothing was changed.
+		if _, err := os.Stat(lc.legacyMetadataPath(ids[fsckMissingData])); err != nil {
+			t.Errorf("report-only fsck removed metadata: %v", err)
+		}
+	})
+}
+
+func TestLocalCacheFsckRepair(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		ids := writeDamagedEntries(t, lc)
+
+		report, err := lc.fsck(locking.NewMemLock(), fsckRepair, time.Now())
+		if err != nil {
+			t.Fatalf("fsck failed: %v", err)
+		}
+		if report.unfixed() != 0 {
+			t.Errorf("%d problems unfixed after repair: %+v", report.unfixed(), report.Problems)
+		}
+		if report.Migrated != 1 {
+			t.Errorf("migrated %d entries, expected 1", report.Migrated)
+		}
+
+		// Metadata is rebuilt from the data, with the output ID recomputed.
+		for _, kind := range []string{fsckMissingMetadata, fsckCorruptMetadata} {
+			meta, err := lc.readMetadata(ids[kind])
+			if err != nil {
+				t.Errorf("%s entry not repaired: %v", kind, err)
+				continue
+			}
+			sum := sha256.Sum256([]byte("some build output"))
+			if !bytes.Equal(meta.OutputID, sum[:]) || meta.Size != int64(len("some build output")) {
+				t.Errorf("%s entry repaired with outputID %x and size %d", kind, meta.OutputID, meta.Size)
+			}
+		}
+		if _, err := os.Stat(lc.legacyMetadataPath(ids[fsckMissingData])); !os.IsNotExist(err) {
+			t.Errorf("metadata without data not deleted: %v", err)
+		}
+		if _, err := os.Stat(lc.actionIDToPath(ids[fsckSizeMismatch])); !os.IsNotExist(err) {
+			t.Errorf("entry with size mismatch not deleted: %v", err)
+		}
+		for _, kind := range []string{"healthy", fsckLegacyEntry} {
+			if _, err := lc.readMetadata(ids[kind]); err != nil {
+				t.Errorf("%s entry not readable after repair: %v", kind, err)
+			}
+		}
+		if _, err := os.Stat(lc.legacyDataPath(ids[fsckLegacyEntry])); !os.IsNotExist(err) {
+			t.Errorf("legacy data file left behind after migration: %v", err)
+		}
+
+		// A second run finds nothing but the recent temp file, which it leaves alone.
+		report, err = lc.fsck(locking.NewMemLock(), fsckRepair, time.Now())
+		if err != nil || len(report.Problems) != 0 || report.LegacyEntries != 0 {
+			t.Errorf("second fsck: report = %+v, err = %v", report, err)
+		}
+		if _, err := os.Stat(filepath.Join(lc.cacheDir, "de", "v3deadbe00.tmp")); err != nil {
+			t.Errorf("recent temp file was removed: %v", err)
+		}
+	})
+}
+
+func TestLocalCacheFsckDelete(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		ids := writeDamagedEntries(t, lc)
+
+		report, err := lc.fsck(locking.NewMemLock(), fsckDelete, time.Now())
+		if err != nil {
+			t.Fatalf("fsck failed: %v", err)
+		}
+		if report.unfixed() != 0 {
+			t.Errorf("%d problems unfixed after delete", report.unfixed())
+		}
+		for kind, id := range ids {
+			paths := []string{
+				lc.actionIDToPath(id),
+				lc.headerPath(id),
+				lc.legacyDataPath(id),
+				lc.legacyMetadataPath(id),
+			}
+			var remaining int
+			for _, path := range paths {
+				if _, err := os.Stat(path); err == nil {
+					remaining++
+				}
+			}
+			switch kind {
+			case "healthy", fsckLegacyEntry:
+				if remaining == 0 {
+					t.Errorf("%s entry was removed", kind)
+				}
+			default:
+				if remaining != 0 {
+					t.Errorf("%s entry not deleted", kind)
+				}
+			}
+		}
+	})
+}
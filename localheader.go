@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// localEntryVersion prefixes the file names of local cache entries. It's bumped
+	// independently of fileFormatVersion, which versions backend keys.
+	localEntryVersion = "v3"
+
+	// localLegacyVersion prefixes entries in the previous local layout, where each
+	// data file had a text ".meta" file next to it. They're migrated to the current
+	// layout on their first hit, or all at once by fsck -repair.
+	localLegacyVersion = "v2"
+
+	// localHeaderXattr is the extended attribute that holds the header of an entry.
+	localHeaderXattr = "user.gobuildcache.v3"
+
+	// localHeaderSuffix is appended to the data file path to get the path of the
+	// header file on filesystems without extended attribute support.
+	localHeaderSuffix = ".hdr"
+)
+
+// localHeaderMagic starts every local entry header.
+var localHeaderMagic = [4]byte{'G', 'B', 'C', 'E'}
+
+const (
+	localHeaderFormat = 1
+
+	// localHeaderFixedSize is the size of a header without its output ID.
+	localHeaderFixedSize = 32 + 4
+
+	// localCodecRaw means the data file holds the output as-is. The go command reads
+	// data files directly, so it's the only codec for now.
+	localCodecRaw = 0
+)
+
+// errLocalHeaderMissing is returned when a data file exists but has no header.
+var errLocalHeaderMissing = errors.New("local cache entry has no header")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// A local cache entry is a single data file with the exact contents of the cached
+// output, so its path can be handed to the go command as-is. Its metadata is kept
+// in a small binary header, stored in an extended attribute of the data file when
+// the filesystem supports it and in a header file next to it otherwise:
+//
+//	offset  size  field
+//	0       4     magic "GBCE"
+//	4       1     format (1)
+//	5       1     codec of the data file (0 = raw)
+//	6       1     length of the output ID
+//	7       1     reserved
+//	8       8     size of the output
+//	16      8     put time (Unix nanoseconds)
+//	24      8     last use (Unix nanoseconds)
+//	32      n     output ID
+//	32+n    4     CRC-32C of the preceding bytes
+//
+// All integers are little endian. encodeLocalHeader encodes meta as such a header.
+func encodeLocalHeader(meta localCacheMetadata) ([]byte, error) {
+	if len(meta.OutputID) > 255 {
+		return nil, fmt.Errorf("output ID too long: %d bytes", len(meta.OutputID))
+	}
+	buf := make([]byte, localHeaderFixedSize+len(meta.OutputID))
+	copy(buf, localHeaderMagic[:])
+	buf[4] = localHeaderFormat
+	buf[5] = localCodecRaw
+	buf[6] = byte(len(meta.OutputID))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(meta.Size))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(meta.PutTime.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(meta.LastUsed.UnixNano()))
+	n := 32 + copy(buf[32:], meta.OutputID)
+	binary.LittleEndian.PutUint32(buf[n:], crc32.Checksum(buf[:n], crc32c))
+	return buf, nil
+}
+
+// decodeLocalHeader decodes a local entry header.
+func decodeLocalHeader(buf []byte) (*localCacheMetadata, error) {
+	if len(buf) < localHeaderFixedSize || [4]byte(buf[:4]) != localHeaderMagic {
+		return nil, fmt.Errorf("invalid header")
+	}
+	if buf[4] != localHeaderFormat {
+		return nil, fmt.Errorf("unsupported header format %d", buf[4])
+	}
+	if buf[5] != localCodecRaw {
+		return nil, fmt.Errorf("unsupported codec %d", buf[5])
+	}
+	n := 32 + int(buf[6])
+	if len(buf) != n+4 {
+		return nil, fmt.Errorf("invalid header length %d", len(buf))
+	}
+	if crc32.Checksum(buf[:n], crc32c) != binary.LittleEndian.Uint32(buf[n:]) {
+		return nil, fmt.Errorf("header checksum mismatch")
+	}
+	return &localCacheMetadata{
+		OutputID: append([]byte(nil), buf[32:n]...),
+		Size:     int64(binary.LittleEndian.Uint64(buf[8:])),
+		PutTime:  time.Unix(0, int64(binary.LittleEndian.Uint64(buf[16:]))),
+		LastUsed: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[24:]))),
+	}, nil
+}
+
+// readHeader reads the header of the entry whose data file is at dataPath. It
+// returns an error wrapping os.ErrNotExist if the data file doesn't exist, and
+// errLocalHeaderMissing if it exists but has no header.
+//
+// A header file takes precedence over the extended attribute, because entries
+// linked to a shared object keep their header in a header file: the attribute
+// belongs to the object's inode and so to every entry linked to it.
+func (lc *localCache) readHeader(dataPath string) (*localCacheMetadata, error) {
+	data, err := os.ReadFile(dataPath + localHeaderSuffix)
+	if err == nil {
+		meta, err := decodeLocalHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		meta.headerFile = true
+		return meta, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if !lc.xattrs {
+		if _, statErr := os.Stat(dataPath); statErr == nil {
+			return nil, errLocalHeaderMissing
+		}
+		return nil, err
+	}
+
+	var attr [localHeaderFixedSize + 256]byte
+	n, err := getxattr(dataPath, localHeaderXattr, attr[:])
+	if err != nil {
+		if isXattrMissing(err) {
+			return nil, errLocalHeaderMissing
+		}
+		return nil, &os.PathError{Op: "getxattr", Path: dataPath, Err: err}
+	}
+	return decodeLocalHeader(attr[:n])
+}
+
+// writeHeaderFile writes the header of the entry whose data file is at dataPath
+// to a header file. The header is written to a uniquely named temp file and
+// renamed so readers never see a partial header.
+func (lc *localCache) writeHeaderFile(dataPath string, header []byte) error {
+	headerPath := dataPath + localHeaderSuffix
+	tmpFile, err := os.CreateTemp(filepath.Dir(headerPath), filepath.Base(headerPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp header: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(header)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temp header: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), headerPath); err != nil {
+		return fmt.Errorf("failed to rename header: %w", err)
+	}
+	return nil
+}
+
+// writeHeader replaces the header of an existing entry.
+func (lc *localCache) writeHeader(actionID []byte, meta localCacheMetadata) error {
+	header, err := encodeLocalHeader(meta)
+	if err != nil {
+		return err
+	}
+	dataPath := lc.actionIDToPath(actionID)
+	if lc.xattrs && !fileExists(dataPath+localHeaderSuffix) {
+		// Replacing an extended attribute is atomic.
+		if err := setxattr(dataPath, localHeaderXattr, header); err != nil {
+			return &os.PathError{Op: "setxattr", Path: dataPath, Err: err}
+		}
+		return nil
+	}
+	return lc.writeHeaderFile(dataPath, header)
+}
+
+// supportsXattrs reports whether the filesystem of dir supports the extended
+// attributes used for entry headers.
+func supportsXattrs(dir string) bool {
+	f, err := os.CreateTemp(dir, "xattr-probe-*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := fsetxattr(f, localHeaderXattr, localHeaderMagic[:]); err != nil {
+		return false
+	}
+	var buf [len(localHeaderMagic)]byte
+	n, err := getxattr(f.Name(), localHeaderXattr, buf[:])
+	return err == nil && n == len(buf)
+}
+
+// legacyDataPath returns the path of the data file of an entry in the previous
+// local layout.
+func (lc *localCache) legacyDataPath(actionID []byte) string {
+	hexActionID := fmt.Sprintf("%x", actionID)
+	return filepath.Join(lc.cacheDir, hexActionID[:2], localLegacyVersion+hexActionID)
+}
+
+// legacyMetadataPath returns the path of the metadata file of an entry in the
+// previous local layout.
+func (lc *localCache) legacyMetadataPath(actionID []byte) string {
+	return lc.legacyDataPath(actionID) + ".meta"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func mustEncodeHeader(t *testing.T, meta localCacheMetadata) []byte {
+	t.Helper()
+	header, err := encodeLocalHeader(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+// writeRawHeader replaces the header of an entry with header.
+func writeRawHeader(t *testing.T, lc *localCache, actionID, header []byte) {
+	t.Helper()
+	if lc.xattrs && !fileExists(lc.headerPath(actionID)) {
+		if err := setxattr(lc.actionIDToPath(actionID), localHeaderXattr, header); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err := os.WriteFile(lc.headerPath(actionID), header, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeLegacyEntry writes an entry in the previous local layout.
+func writeLegacyEntry(t *testing.T, lc *localCache, actionID, data []byte) {
+	t.Helper()
+	meta := fmt.Sprintf("outputID:%x\nsize:%d\ntime:%d\n", []byte{0xbb}, len(data), time.Now().Unix())
+	if err := os.WriteFile(lc.legacyDataPath(actionID), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lc.legacyMetadataPath(actionID), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalHeaderRoundTrip(t *testing.T) {
+	meta := localCacheMetadata{
+		OutputID: bytes.Repeat([]byte{0xab}, 32),
+		Size:     1 << 40,
+		PutTime:  time.Unix(1700000000, 123),
+		LastUsed: time.Unix(1800000000, 456),
+	}
+	header := mustEncodeHeader(t, meta)
+	if len(header) != localHeaderFixedSize+32 {
+		t.Errorf("header is %d bytes, expected %d", len(header), localHeaderFixedSize+32)
+	}
+
+	decoded, err := decodeLocalHeader(header)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !bytes.Equal(decoded.OutputID, meta.OutputID) || decoded.Size != meta.Size ||
+		!decoded.PutTime.Equal(meta.PutTime) || !decoded.LastUsed.Equal(meta.LastUsed) {
+		t.Errorf("decoded %+v, expected %+v", decoded, meta)
+	}
+
+	for i := range header {
+		corrupted := bytes.Clone(header)
+		corrupted[i] ^= 0x01
+		if _, err := decodeLocalHeader(corrupted); err == nil {
+			t.Errorf("flipping a bit in byte %d was not detected", i)
+		}
+	}
+	if _, err := decodeLocalHeader(header[:len(header)-1]); err == nil {
+		t.Error("truncated header was not detected")
+	}
+}
+
+func TestLocalCacheWriteAndCheck(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		actionID := []byte{0x11, 0x22}
+		data := []byte("compiled package")
+		meta := localCacheMetadata{OutputID: []byte{0xcc, 0xdd}, Size: int64(len(data)), PutTime: time.Unix(1700000000, 0)}
+
+		if lc.check(actionID) != nil {
+			t.Fatal("expected miss before write")
+		}
+		diskPath, err := lc.writeWithMetadata(actionID, bytes.NewReader(data), meta)
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+
+		// The go command reads the data file directly, so it must hold exactly the output.
+		contents, err := os.ReadFile(diskPath)
+		if err != nil || !bytes.Equal(contents, data) {
+			t.Errorf("data file contains %q (err %v), expected %q", contents, err, data)
+		}
+		_, err = os.Stat(lc.headerPath(actionID))
+		if hasHeaderFile := err == nil; hasHeaderFile == lc.xattrs {
+			t.Errorf("header file exists = %v with xattrs = %v", hasHeaderFile, lc.xattrs)
+		}
+
+		got := lc.check(actionID)
+		if got == nil {
+			t.Fatal("expected hit after write")
+		}
+		if !bytes.Equal(got.OutputID, meta.OutputID) || got.Size != meta.Size || !got.PutTime.Equal(meta.PutTime) {
+			t.Errorf("check returned %+v, expected %+v", got, meta)
+		}
+
+		writeRawHeader(t, lc, actionID, []byte("garbage"))
+		lc.forget(actionID)
+		if lc.check(actionID) != nil {
+			t.Error("expected miss for corrupt header")
+		}
+	})
+}
+
+func TestLocalCacheMigratesLegacyEntries(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		actionID := []byte{0x33, 0x44}
+		data := []byte("output from an older version")
+		writeLegacyEntry(t, lc, actionID, data)
+
+		meta := lc.check(actionID)
+		if meta == nil {
+			t.Fatal("expected hit for legacy entry")
+		}
+		if !bytes.Equal(meta.OutputID, []byte{0xbb}) || meta.Size != int64(len(data)) {
+			t.Errorf("check returned %+v", meta)
+		}
+
+		contents, err := os.ReadFile(lc.getPath(actionID))
+		if err != nil || !bytes.Equal(contents, data) {
+			t.Errorf("migrated data file contains %q (err %v)", contents, err)
+		}
+		for _, path := range []string{lc.legacyDataPath(actionID), lc.legacyMetadataPath(actionID)} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("legacy file %s left behind: %v", path, err)
+			}
+		}
+		if _, err := lc.readMetadata(actionID); err != nil {
+			t.Errorf("migrated entry has no header: %v", err)
+		}
+	})
+}
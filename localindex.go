@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// localMetaDir holds the files of a local cache directory that aren't entries.
+	// It's hidden so that the directory looks empty after a clear.
+	localMetaDir = ".gobuildcache"
+
+	// localIndexFile holds a snapshot of the in-memory index of a local cache, so
+	// that a new process starts with a warm index.
+	localIndexFile = "index.bin"
+
+	// localGenerationFile holds a random token that's replaced whenever entries are
+	// removed from the local cache. Processes sharing the directory drop their
+	// in-memory index when it changes.
+	localGenerationFile = "generation"
+
+	// localIndexCheckInterval is how often the generation is checked. Until another
+	// process's removal is noticed, a GET may return the path of a removed entry,
+	// which the go command treats as a miss.
+	localIndexCheckInterval = time.Second
+)
+
+// localIndexMagic starts every index file.
+var localIndexMagic = [4]byte{'G', 'B', 'C', 'I'}
+
+const localIndexFormat = 2
+
+// localIndex is an in-memory index of local cache entries, keyed by action ID.
+// Entries are added on the first check of an action ID and whenever an entry is
+// written. Entries written by other processes are picked up lazily, and the
+// index is dropped whenever the generation of the cache directory changes.
+type localIndex struct {
+	sync.RWMutex
+	entries    map[string]localCacheMetadata
+	generation string
+	// version is incremented whenever entries are removed from the index.
+	version uint64
+
+	checkMu   sync.Mutex
+	lastCheck atomic.Int64 // Unix nanoseconds
+}
+
+func newLocalIndex() *localIndex {
+	return &localIndex{entries: make(map[string]localCacheMetadata)}
+}
+
+// lookup returns the indexed metadata of an entry.
+func (lc *localCache) lookup(actionID []byte) (*localCacheMetadata, bool) {
+	lc.refreshIndex()
+
+	lc.index.RLock()
+	meta, ok := lc.index.entries[string(actionID)]
+	lc.index.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return &meta, true
+}
+
+// remember adds or replaces the indexed metadata of an entry.
+func (lc *localCache) remember(actionID []byte, meta localCacheMetadata) {
+	lc.index.Lock()
+	lc.index.entries[string(actionID)] = meta
+	lc.index.Unlock()
+}
+
+// rememberUnlessForgotten is like remember, but does nothing if any entry was
+// removed from the index since indexVersion returned version. It's used when
+// the entry's lock isn't held, so that an entry that was just evicted isn't
+// added back.
+func (lc *localCache) rememberUnlessForgotten(actionID []byte, meta localCacheMetadata, version uint64) {
+	lc.index.Lock()
+	if lc.index.version == version {
+		lc.index.entries[string(actionID)] = meta
+	}
+	lc.index.Unlock()
+}
+
+// indexVersion returns the current version of the index.
+func (lc *localCache) indexVersion() uint64 {
+	lc.index.RLock()
+	defer lc.index.RUnlock()
+	return lc.index.version
+}
+
+// forget removes an entry from the index.
+func (lc *localCache) forget(actionID []byte) {
+	lc.index.Lock()
+	delete(lc.index.entries, string(actionID))
+	lc.index.version++
+	lc.index.Unlock()
+}
+
+// refreshIndex drops the index if entries were removed by another process since it
+// was last checked. It checks at most once per localIndexCheckInterval.
+func (lc *localCache) refreshIndex() {
+	idx := lc.index
+	if time.Since(time.Unix(0, idx.lastCheck.Load())) < localIndexCheckInterval {
+		return
+	}
+	// Only one request needs to do the check.
+	if !idx.checkMu.TryLock() {
+		return
+	}
+	defer idx.checkMu.Unlock()
+	idx.lastCheck.Store(time.Now().UnixNano())
+
+	generation, err := readLocalGeneration(lc.cacheDir)
+	if err != nil {
+		lc.logger.Debug("failed to read local cache generation", "error", err)
+		return
+	}
+
+	idx.Lock()
+	defer idx.Unlock()
+	if generation != idx.generation {
+		lc.logger.Debug("local cache generation changed, dropping index",
+			"entries", len(idx.entries))
+		clear(idx.entries)
+		idx.generation = generation
+		idx.version++
+	}
+}
+
+// bumpGeneration records that entries were removed from the local cache, so that
+// other processes drop their index. This process's index is kept, so the caller
+// must forget the removed entries itself.
+func (lc *localCache) bumpGeneration() error {
+	lc.index.Lock()
+	defer lc.index.Unlock()
+
+	generation, err := bumpLocalGeneration(lc.cacheDir)
+	if err != nil {
+		return err
+	}
+	lc.index.generation = generation
+	return nil
+}
+
+// readLocalGeneration returns the generation of a local cache directory. A cache
+// directory without a generation file has an empty generation.
+func readLocalGeneration(cacheDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, localMetaDir, localGenerationFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// bumpLocalGeneration replaces the generation of a local cache directory with a
+// new random one and returns it.
+func bumpLocalGeneration(cacheDir string) (string, error) {
+	var token [8]byte
+	rand.Read(token[:])
+	generation := strconv.FormatUint(binary.LittleEndian.Uint64(token[:]), 16)
+
+	if err := os.MkdirAll(filepath.Join(cacheDir, localMetaDir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	path := filepath.Join(cacheDir, localMetaDir, localGenerationFile)
+	tmpPath := fmt.Sprintf("%s.%s.tmp", path, generation)
+	if err := os.WriteFile(tmpPath, []byte(generation+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write generation: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to rename generation: %w", err)
+	}
+	return generation, nil
+}
+
+// The index file stores the generation it was written at, followed by the
+// action ID and entry header (see encodeLocalHeader) of each indexed entry:
+//
+//	magic "GBCI", format (1 byte), generation length (1 byte), generation
+//	entry count (4 bytes)
+//	for each entry: action ID length (1 byte), action ID, header length (2 bytes), header,
+//	  flags (1 byte, 1 if the header is stored in a header file)
+//	CRC-32C of the preceding bytes (4 bytes)
+//
+// All integers are little endian. saveIndex writes the index in this format.
+func (lc *localCache) saveIndex() error {
+	var buf bytes.Buffer
+	lc.index.RLock()
+	buf.Write(localIndexMagic[:])
+	buf.WriteByte(localIndexFormat)
+	buf.WriteByte(byte(len(lc.index.generation)))
+	buf.WriteString(lc.index.generation)
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(lc.index.entries))))
+	for actionID, meta := range lc.index.entries {
+		header, err := encodeLocalHeader(meta)
+		if err != nil || len(actionID) > 255 {
+			lc.index.RUnlock()
+			return fmt.Errorf("failed to encode index entry %x: %v", actionID, err)
+		}
+		buf.WriteByte(byte(len(actionID)))
+		buf.WriteString(actionID)
+		buf.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(header))))
+		buf.Write(header)
+		var flags byte
+		if meta.headerFile {
+			flags = 1
+		}
+		buf.WriteByte(flags)
+	}
+	lc.index.RUnlock()
+	buf.Write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(buf.Bytes(), crc32c)))
+
+	dir := filepath.Join(lc.cacheDir, localMetaDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	path := filepath.Join(dir, localIndexFile)
+	tmp, err := os.CreateTemp(dir, localIndexFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename index: %w", err)
+	}
+	return nil
+}
+
+// loadIndex populates the in-memory index from the index file. The file is
+// ignored if entries were removed from the cache since it was written.
+func (lc *localCache) loadIndex() error {
+	generation, err := readLocalGeneration(lc.cacheDir)
+	if err != nil {
+		return err
+	}
+	lc.index.Lock()
+	defer lc.index.Unlock()
+	lc.index.generation = generation
+	lc.index.lastCheck.Store(time.Now().UnixNano())
+
+	data, err := os.ReadFile(filepath.Join(lc.cacheDir, localMetaDir, localIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fileGeneration, entries, err := decodeLocalIndex(data)
+	if err != nil {
+		return fmt.Errorf("invalid index file: %w", err)
+	}
+	if fileGeneration != generation {
+		return nil
+	}
+	lc.index.entries = entries
+	return nil
+}
+
+// decodeLocalIndex decodes an index file written by saveIndex.
+func decodeLocalIndex(data []byte) (string, map[string]localCacheMetadata, error) {
+	if len(data) < len(localIndexMagic)+2+4+4 || [4]byte(data[:4]) != localIndexMagic {
+		return "", nil, fmt.Errorf("bad magic")
+	}
+	if data[4] != localIndexFormat {
+		return "", nil, fmt.Errorf("unsupported format %d", data[4])
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, crc32c) != binary.LittleEndian.Uint32(sum) {
+		return "", nil, fmt.Errorf("checksum mismatch")
+	}
+
+	r := bufio.NewReader(bytes.NewReader(body[5:]))
+	readBytes := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+
+	genLen, err := r.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	generation, err := readBytes(int(genLen))
+	if err != nil {
+		return "", nil, err
+	}
+	countBytes, err := readBytes(4)
+	if err != nil {
+		return "", nil, err
+	}
+	count := binary.LittleEndian.Uint32(countBytes)
+
+	entries := make(map[string]localCacheMetadata, count)
+	for range count {
+		idLen, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		actionID, err := readBytes(int(idLen))
+		if err != nil {
+			return "", nil, err
+		}
+		headerLen, err := readBytes(2)
+		if err != nil {
+			return "", nil, err
+		}
+		header, err := readBytes(int(binary.LittleEndian.Uint16(headerLen)))
+		if err != nil {
+			return "", nil, err
+		}
+		meta, err := decodeLocalHeader(header)
+		if err != nil {
+			return "", nil, err
+		}
+		flags, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		meta.headerFile = flags&1 != 0
+		entries[string(actionID)] = *meta
+	}
+	return string(generation), entries, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// openTestLocalCache opens another local cache on the same directory as lc, like
+// a second process sharing it would.
+func openTestLocalCache(t *testing.T, lc *localCache) *localCache {
+	t.Helper()
+	other, err := newLocalCache(lc.cacheDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to open local cache: %v", err)
+	}
+	return other
+}
+
+// expireIndexCheck makes the next lookup check the generation of the cache.
+func expireIndexCheck(lc *localCache) {
+	lc.index.lastCheck.Store(0)
+}
+
+func TestLocalIndexHitDoesNotReadDisk(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		actionID = []byte{0x01, 0x02}
+	)
+	writeTestEntry(t, lc, actionID, 10, 0)
+
+	// Corrupting the header on disk doesn't affect indexed entries.
+	writeRawHeader(t, lc, actionID, []byte("garbage"))
+	meta := lc.check(actionID)
+	if meta == nil || meta.Size != 10 {
+		t.Fatalf("expected indexed hit, got %+v", meta)
+	}
+}
+
+func TestLocalIndexCoherentAcrossProcesses(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		other    = openTestLocalCache(t, lc)
+		actionID = []byte{0x03, 0x04}
+	)
+	// Used recently enough that a hit doesn't refresh its last-use time.
+	writeTestEntry(t, lc, actionID, 10, localUseInterval/2)
+
+	// Entries written by other processes are picked up lazily.
+	if other.check(actionID) == nil {
+		t.Fatal("expected other process to see the entry")
+	}
+
+	// lc evicts the entry, which other notices on its next generation check.
+	stats, err := lc.trim(locking.NewMemLock(), backends.TrimPolicy{UnusedFor: localUseInterval / 4}, time.Now())
+	if err != nil || stats.EvictedEntries != 1 {
+		t.Fatalf("trim: stats = %+v, err = %v", stats, err)
+	}
+	if lc.check(actionID) != nil {
+		t.Error("evicted entry still indexed by the trimming process")
+	}
+	expireIndexCheck(other)
+	if other.check(actionID) != nil {
+		t.Error("evicted entry still indexed by the other process")
+	}
+
+	// Trimming doesn't drop the index of the trimming process itself.
+	kept := []byte{0x05, 0x06}
+	writeTestEntry(t, lc, kept, 10, 0)
+	writeRawHeader(t, lc, kept, []byte("garbage"))
+	expireIndexCheck(lc)
+	if lc.check(kept) == nil {
+		t.Error("index of the trimming process was dropped")
+	}
+}
+
+func TestLocalIndexCheckExists(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		actionID = []byte{0x07, 0x08}
+	)
+	writeTestEntry(t, lc, actionID, 10, 0)
+
+	// Removed without going through the cache, so the generation is unchanged.
+	os.Remove(lc.actionIDToPath(actionID))
+	if lc.check(actionID) == nil {
+		t.Error("expected stale indexed hit from check")
+	}
+	if lc.checkExists(actionID) != nil {
+		t.Error("expected checkExists to notice the removed data file")
+	}
+}
+
+func TestLocalIndexSaveAndLoad(t *testing.T) {
+	lc := newTestLocalCache(t)
+	var ids [][]byte
+	for i := range 3 {
+		id := []byte{0x10, byte(i)}
+		ids = append(ids, id)
+		writeTestEntry(t, lc, id, 10+i, 0)
+	}
+	if err := lc.saveIndex(); err != nil {
+		t.Fatalf("failed to save index: %v", err)
+	}
+
+	loaded := openTestLocalCache(t, lc)
+	if len(loaded.index.entries) != 3 {
+		t.Fatalf("loaded %d entries, expected 3", len(loaded.index.entries))
+	}
+	for i, id := range ids {
+		meta, ok := loaded.lookup(id)
+		if !ok || meta.Size != int64(10+i) || !bytes.Equal(meta.OutputID, []byte{0xaa}) {
+			t.Errorf("entry %d: got %+v", i, meta)
+		}
+	}
+
+	// An index saved before entries were removed is ignored.
+	if err := clearLocalCache(lc.cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := openTestLocalCache(t, lc); len(loaded.index.entries) != 0 {
+		t.Errorf("loaded %d entries from a stale index", len(loaded.index.entries))
+	}
+}
+
+func TestLocalCacheCheckUnlocked(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		var (
+			other  = openTestLocalCache(t, lc)
+			recent = []byte{0x20, 0x01}
+			stale  = []byte{0x20, 0x02}
+			legacy = []byte{0x20, 0x03}
+		)
+		other.xattrs = lc.xattrs
+		writeTestEntry(t, lc, recent, 10, 0)
+		writeTestEntry(t, lc, stale, 10, 2*localUseInterval)
+		writeLegacyEntry(t, lc, legacy, []byte("old"))
+
+		// Unindexed entries are read from disk and then indexed.
+		if meta := other.checkUnlocked(recent); meta == nil || meta.Size != 10 {
+			t.Fatalf("expected hit, got %+v", meta)
+		}
+		if _, ok := other.lookup(recent); !ok {
+			t.Error("hit was not indexed")
+		}
+
+		// Updating the last-use time of a header file or migrating an entry requires
+		// the lock.
+		meta := other.checkUnlocked(stale)
+		if lc.xattrs {
+			if meta == nil || time.Since(meta.LastUsed) >= localUseInterval {
+				t.Errorf("expected hit that refreshes the last use, got %+v", meta)
+			}
+		} else if meta != nil {
+			t.Errorf("expected miss for stale entry with a header file, got %+v", meta)
+		}
+		if meta := other.checkUnlocked(legacy); meta != nil {
+			t.Errorf("expected miss for legacy entry, got %+v", meta)
+		}
+		if _, err := os.Stat(lc.legacyDataPath(legacy)); err != nil {
+			t.Errorf("legacy entry was migrated without the lock: %v", err)
+		}
+
+		// An entry whose data doesn't have the size in its header is a miss.
+		truncated := []byte{0x20, 0x04}
+		writeTestEntry(t, lc, truncated, 10, 0)
+		if err := os.Truncate(lc.actionIDToPath(truncated), 5); err != nil {
+			t.Fatal(err)
+		}
+		if meta := other.checkUnlocked(truncated); meta != nil {
+			t.Errorf("expected miss for truncated entry, got %+v", meta)
+		}
+
+		// An entry forgotten while it's being read isn't added back.
+		version := other.indexVersion()
+		other.forget(recent)
+		other.rememberUnlessForgotten(recent, localCacheMetadata{Size: 10}, version)
+		if _, ok := other.lookup(recent); ok {
+			t.Error("forgotten entry was added back to the index")
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// localObjectPrefix prefixes the file names of local objects. An object holds an
+// output keyed by its output ID, and the data files of entries with that output
+// are hardlinks to it, so identical outputs of different actions are stored once.
+// Objects live in the same 256 subdirectories as entries, chosen by the first
+// byte of the output ID.
+const localObjectPrefix = "o"
+
+// localDedupStats counts the outputs written to the local cache, and how many of
+// them were linked to an existing object instead of being written again.
+type localDedupStats struct {
+	writes       atomic.Int64
+	bytes        atomic.Int64
+	linkedWrites atomic.Int64
+	linkedBytes  atomic.Int64
+}
+
+// ratio returns the number of bytes written to the local cache per byte actually
+// stored, which is 1 without any deduplication.
+func (s *localDedupStats) ratio() float64 {
+	total, linked := s.bytes.Load(), s.linkedBytes.Load()
+	if total == linked {
+		return 1
+	}
+	return float64(total) / float64(total-linked)
+}
+
+// objectPath returns the path of the object for an output ID.
+func (lc *localCache) objectPath(outputID []byte) string {
+	hexOutputID := hex.EncodeToString(outputID)
+	return filepath.Join(lc.cacheDir, hexOutputID[:2], localObjectPrefix+hexOutputID)
+}
+
+// linkObject creates path as a hardlink to the object for meta.OutputID. It
+// returns false if there's no such object or it can't be linked, in which case
+// the output needs to be written out.
+func (lc *localCache) linkObject(path string, meta localCacheMetadata) bool {
+	if len(meta.OutputID) == 0 {
+		return false
+	}
+	objPath := lc.objectPath(meta.OutputID)
+	info, err := os.Stat(objPath)
+	if err != nil || info.Size() != meta.Size {
+		return false
+	}
+	os.Remove(path)
+	if err := os.Link(objPath, path); err != nil {
+		// The object was removed by trimming since the stat, or the filesystem
+		// doesn't support hardlinks.
+		lc.logger.Debug("failed to link local cache object",
+			"outputID", hex.EncodeToString(meta.OutputID),
+			"error", err)
+		return false
+	}
+	return true
+}
+
+// storeObject makes the data file at path the object for outputID, unless there
+// already is one. sum is the SHA-256 of the data; the go command uses it as the
+// output ID, so outputs with any other output ID aren't shared with other entries.
+func (lc *localCache) storeObject(path string, outputID, sum []byte) {
+	if len(outputID) == 0 || !bytes.Equal(outputID, sum) {
+		return
+	}
+	if err := os.Link(path, lc.objectPath(outputID)); err != nil && !errors.Is(err, os.ErrExist) {
+		lc.logger.Debug("failed to store local cache object",
+			"outputID", hex.EncodeToString(outputID),
+			"error", err)
+	}
+}
+
+// removeUnreferencedObjects removes the objects that no entry links to anymore,
+// and returns the number of bytes freed.
+//
+// An entry may be linked to an object concurrently. If the object is removed
+// first, linking fails and the entry is written out instead, and otherwise the
+// entry keeps its own link to the data.
+func (lc *localCache) removeUnreferencedObjects() (int64, error) {
+	var freed int64
+	for i := range 256 {
+		subdir := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return freed, fmt.Errorf("failed to read cache directory %s: %w", subdir, err)
+		}
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if !isLocalObjectName(name) {
+				continue
+			}
+			info, err := dirEntry.Info()
+			if err != nil || linkCount(info) > 1 {
+				continue
+			}
+			if err := os.Remove(filepath.Join(subdir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return freed, fmt.Errorf("failed to remove object %s: %w", name, err)
+			}
+			freed += info.Size()
+		}
+	}
+	return freed, nil
+}
+
+// isLocalObjectName reports whether name is the file name of an object.
+func isLocalObjectName(name string) bool {
+	hexID, ok := strings.CutPrefix(name, localObjectPrefix)
+	if !ok || hexID == "" {
+		return false
+	}
+	_, err := hex.DecodeString(hexID)
+	return err == nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+// errReader fails the test if an output that should have been deduplicated is
+// read.
+type errReader struct{ t *testing.T }
+
+func (r errReader) Read([]byte) (int, error) {
+	r.t.Error("body of a deduplicated write was read")
+	return 0, errors.New("unexpected read")
+}
+
+// writeOutput writes data as the output of actionID, with its SHA-256 as the
+// output ID like the go command uses.
+func writeOutput(t *testing.T, lc *localCache, actionID, data []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	meta := localCacheMetadata{OutputID: sum[:], Size: int64(len(data)), PutTime: time.Now()}
+	path, err := lc.writeWithMetadata(actionID, bytes.NewReader(data), meta)
+	if err != nil {
+		t.Fatalf("failed to write entry: %v", err)
+	}
+	return path
+}
+
+func TestLocalCacheDedupLinksIdenticalOutputs(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		data := bytes.Repeat([]byte("identical output "), 100)
+		sum := sha256.Sum256(data)
+		first := writeOutput(t, lc, []byte{0x01, 0x01}, data)
+
+		meta := localCacheMetadata{OutputID: sum[:], Size: int64(len(data)), PutTime: time.Now()}
+		second, err := lc.writeWithMetadata([]byte{0x02, 0x02}, errReader{t}, meta)
+		if err != nil {
+			t.Fatalf("failed to write deduplicated entry: %v", err)
+		}
+
+		firstInfo, _ := os.Stat(first)
+		secondInfo, _ := os.Stat(second)
+		if !os.SameFile(firstInfo, secondInfo) {
+			t.Error("entries with the same output are not linked")
+		}
+		for _, actionID := range [][]byte{{0x01, 0x01}, {0x02, 0x02}} {
+			contents, err := os.ReadFile(lc.getPath(actionID))
+			if err != nil || !bytes.Equal(contents, data) {
+				t.Errorf("entry %x contains %d bytes (err %v)", actionID, len(contents), err)
+			}
+			if meta, err := lc.readMetadata(actionID); err != nil || !bytes.Equal(meta.OutputID, sum[:]) {
+				t.Errorf("entry %x has header %+v (err %v)", actionID, meta, err)
+			}
+		}
+
+		if lc.dedup.linkedWrites.Load() != 1 || lc.dedup.ratio() != 2 {
+			t.Errorf("linked %d writes with ratio %.2f, expected 1 with ratio 2",
+				lc.dedup.linkedWrites.Load(), lc.dedup.ratio())
+		}
+	})
+}
+
+func TestLocalCacheDedupKeepsHeadersPerEntry(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		var (
+			data     = []byte("shared output")
+			sum      = sha256.Sum256(data)
+			first    = localCacheMetadata{OutputID: sum[:], Size: int64(len(data)), PutTime: time.Unix(1600000000, 0), LastUsed: time.Unix(1600000000, 0)}
+			second   = localCacheMetadata{OutputID: sum[:], Size: int64(len(data)), PutTime: time.Unix(1650000000, 0), LastUsed: time.Unix(1650000000, 0)}
+			firstID  = []byte{0x01, 0x01}
+			secondID = []byte{0x02, 0x02}
+		)
+		if _, err := lc.writeWithMetadata(firstID, bytes.NewReader(data), first); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lc.writeWithMetadata(secondID, errReader{t}, second); err != nil {
+			t.Fatal(err)
+		}
+		// Using the linked entry doesn't refresh the first one.
+		lc.markUsed(secondID, &second)
+
+		for _, tt := range []struct {
+			actionID []byte
+			putTime  time.Time
+			used     bool
+		}{
+			{firstID, first.PutTime, false},
+			{secondID, second.PutTime, true},
+		} {
+			meta, err := lc.readMetadata(tt.actionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !meta.PutTime.Equal(tt.putTime) || meta.LastUsed.After(tt.putTime) != tt.used {
+				t.Errorf("entry %x has put time %v and last use %v", tt.actionID, meta.PutTime, meta.LastUsed)
+			}
+		}
+	})
+}
+
+func TestLocalCacheRewriteReplacesHeaderFile(t *testing.T) {
+	lc := newTestLocalCache(t)
+	if !lc.xattrs {
+		t.Skip("extended attributes are not supported")
+	}
+	var (
+		data     = []byte("shared output")
+		sum      = sha256.Sum256(data)
+		meta     = localCacheMetadata{OutputID: sum[:], Size: int64(len(data)), PutTime: time.Now()}
+		actionID = []byte{0x02, 0x02}
+	)
+	for _, id := range [][]byte{{0x01, 0x01}, actionID} {
+		if _, err := lc.writeWithMetadata(id, bytes.NewReader(data), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !fileExists(lc.headerPath(actionID)) {
+		t.Fatal("linked entry has no header file")
+	}
+	if err := lc.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process that indexed the linked entry knows to remove its header
+	// file when writing a different output.
+	var (
+		other    = openTestLocalCache(t, lc)
+		rewrite  = []byte("new output")
+		rewrites = localCacheMetadata{OutputID: []byte{0xbb}, Size: int64(len(rewrite)), PutTime: time.Now()}
+	)
+	if _, err := other.writeWithMetadata(actionID, bytes.NewReader(rewrite), rewrites); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(lc.headerPath(actionID)) {
+		t.Error("header file of the previous write was left behind")
+	}
+	if got, err := lc.readMetadata(actionID); err != nil || got.Size != rewrites.Size {
+		t.Errorf("rewritten entry has metadata %+v, err %v", got, err)
+	}
+}
+
+func TestLocalCacheDedupRequiresMatchingOutputID(t *testing.T) {
+	lc := newTestLocalCache(t)
+	data := []byte("output with a made-up output ID")
+	meta := localCacheMetadata{OutputID: []byte{0xaa}, Size: int64(len(data)), PutTime: time.Now()}
+	for _, actionID := range [][]byte{{0x01, 0x01}, {0x02, 0x02}} {
+		if _, err := lc.writeWithMetadata(actionID, bytes.NewReader(data), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(lc.objectPath(meta.OutputID)); !os.IsNotExist(err) {
+		t.Errorf("stored an object for an output that doesn't match its output ID: %v", err)
+	}
+	if lc.dedup.linkedWrites.Load() != 0 {
+		t.Errorf("linked %d writes", lc.dedup.linkedWrites.Load())
+	}
+}
+
+func TestLocalCacheTrimReferenceAware(t *testing.T) {
+	forEachHeaderStorage(t, func(t *testing.T, lc *localCache) {
+		var (
+			shared = bytes.Repeat([]byte{0x5a}, 4096)
+			unique = bytes.Repeat([]byte{0xa5}, 4096)
+			ids    = [][]byte{{0x01, 0x01}, {0x02, 0x02}, {0x03, 0x03}}
+		)
+		for _, id := range ids {
+			writeOutput(t, lc, id, shared)
+		}
+		writeOutput(t, lc, []byte{0x04, 0x04}, unique)
+
+		// Shared outputs are only counted once.
+		entries, err := lc.scanEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+		}
+		if total < 2*4096 || total > 2*4096+1024 {
+			t.Errorf("entries add up to %d bytes, expected about %d", total, 2*4096)
+		}
+
+		// The object is kept while any entry links to it.
+		for _, id := range ids[:2] {
+			entry := backends.TrimEntry{Key: hex.EncodeToString(id), LastUsed: time.Now().Add(time.Hour)}
+			if evicted, err := lc.evict(locking.NewMemLock(), entry); !evicted || err != nil {
+				t.Fatalf("failed to evict entry: %v", err)
+			}
+		}
+		if freed, err := lc.removeUnreferencedObjects(); freed != 0 || err != nil {
+			t.Errorf("removed %d bytes of referenced objects (err %v)", freed, err)
+		}
+		if contents, err := os.ReadFile(lc.getPath(ids[2])); err != nil || !bytes.Equal(contents, shared) {
+			t.Errorf("remaining entry contains %d bytes (err %v)", len(contents), err)
+		}
+
+		// Trimming everything removes the objects too.
+		if _, err := lc.trim(locking.NewMemLock(), backends.TrimPolicy{MaxSize: 1}, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{shared, unique} {
+			sum := sha256.Sum256(data)
+			if _, err := os.Stat(lc.objectPath(sum[:])); !os.IsNotExist(err) {
+				t.Errorf("unreferenced object not removed: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+)
+
+// pushProgressInterval is how often push progress is reported.
+const pushProgressInterval = 2 * time.Second
+
+// pushStats counts the results of a push.
+type pushStats struct {
+	entries       atomic.Int64 // Entries found in the local cache
+	present       atomic.Int64 // Entries the backend already has
+	uploaded      atomic.Int64 // Entries uploaded to the backend
+	uploadedBytes atomic.Int64 // Bytes uploaded, after compression
+	skipped       atomic.Int64 // Entries that are damaged or were removed while pushing
+	failed        atomic.Int64 // Entries that couldn't be checked or uploaded
+}
+
+// processed returns the number of entries that have been dealt with.
+func (s *pushStats) processed() int64 {
+	return s.present.Load() + s.uploaded.Load() + s.skipped.Load() + s.failed.Load()
+}
+
+// localPusher uploads the entries of a local cache that are missing from a
+// backend, such as entries whose upload failed while the backend was down.
+type localPusher struct {
+	lc          *localCache
+	backend     backends.Backend
+	compression bool
+	concurrency int
+	logger      *slog.Logger
+
+	stats pushStats
+}
+
+// localEntry identifies an entry in a local cache directory listing.
+type localEntry struct {
+	actionID []byte
+	legacy   bool
+}
+
+// push checks every entry of the local cache against the backend and uploads the
+// missing ones, processing up to concurrency entries at a time. Progress is
+// written to progress periodically.
+//
+// Entries are read without holding their lock. Entries are only ever replaced by
+// renaming, so a concurrent write or eviction at worst makes an entry be skipped.
+func (p *localPusher) push(progress io.Writer) error {
+	entries, err := p.lc.listEntries()
+	if err != nil {
+		return err
+	}
+	p.stats.entries.Store(int64(len(entries)))
+
+	var (
+		wg    sync.WaitGroup
+		jobs  = make(chan localEntry)
+		done  = make(chan struct{})
+		start = time.Now()
+	)
+	for range max(p.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				p.pushEntry(entry)
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(pushProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				processed := p.stats.processed()
+				fmt.Fprintf(progress, "Processed %d of %d entries (%d uploaded, %s), ETA %s\n",
+					processed, len(entries), p.stats.uploaded.Load(), formatBytes(p.stats.uploadedBytes.Load()),
+					pushETA(time.Since(start), processed, int64(len(entries))))
+			}
+		}
+	}()
+
+	for _, entry := range entries {
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+	return nil
+}
+
+// pushETA estimates the time left to process total entries, given that processed
+// entries took elapsed.
+func pushETA(elapsed time.Duration, processed, total int64) string {
+	if processed == 0 {
+		return "unknown"
+	}
+	remaining := time.Duration(float64(elapsed) / float64(processed) * float64(total-processed))
+	return remaining.Round(time.Second).String()
+}
+
+// pushEntry uploads a single entry if the backend doesn't have it.
+func (p *localPusher) pushEntry(entry localEntry) {
+	hexID := hex.EncodeToString(entry.actionID)
+	meta, dataPath, err := p.lc.exportMetadata(entry.actionID, entry.legacy)
+	if err != nil {
+		p.stats.skipped.Add(1)
+		p.logger.Debug("skipping local cache entry", "actionID", hexID, "error", err)
+		return
+	}
+
+	exists, err := backends.Exists(p.backend, backendKey(entry.actionID))
+	if err != nil {
+		p.stats.failed.Add(1)
+		p.logger.Warn("failed to check backend for entry", "actionID", hexID, "error", err)
+		return
+	}
+	if exists {
+		p.stats.present.Add(1)
+		return
+	}
+
+	data, err := os.ReadFile(dataPath)
+	if err == nil && int64(len(data)) != meta.Size {
+		err = fmt.Errorf("data is %d bytes, metadata says %d", len(data), meta.Size)
+	}
+	if err != nil {
+		p.stats.skipped.Add(1)
+		p.logger.Debug("skipping local cache entry", "actionID", hexID, "error", err)
+		return
+	}
+	n, err := putCompressed(p.backend, p.compression, entry.actionID, meta.OutputID, data)
+	if err != nil {
+		p.stats.failed.Add(1)
+		p.logger.Warn("failed to upload entry", "actionID", hexID, "error", err)
+		return
+	}
+	p.stats.uploaded.Add(1)
+	p.stats.uploadedBytes.Add(n)
+}
+
+// putCompressed stores data in backend under the backend key of actionID,
+// compressed like the server would store it, and returns the number of bytes
+// stored.
+func putCompressed(backend backends.Backend, compression bool, actionID, outputID, data []byte) (int64, error) {
+	if compression && len(data) > 0 {
+		var err error
+		if data, err = compressData(data); err != nil {
+			return 0, err
+		}
+	}
+	if err := backend.Put(backendKey(actionID), outputID, bytes.NewReader(data), int64(len(data))); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// listEntries returns the entries of the local cache in either layout.
+func (lc *localCache) listEntries() ([]localEntry, error) {
+	var entries []localEntry
+	for i := range 256 {
+		subdir := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read cache directory %s: %w", subdir, err)
+		}
+		for _, dirEntry := range dirEntries {
+			file, ok := parseLocalFileName(dirEntry.Name())
+			if !ok || file.metadata {
+				continue
+			}
+			actionID, _ := hex.DecodeString(file.hexID)
+			entries = append(entries, localEntry{actionID: actionID, legacy: file.legacy})
+		}
+	}
+	return entries, nil
+}
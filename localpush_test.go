@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLocalCachePush(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		backend  = &recordingBackend{puts: make(map[string][]byte)}
+		uploaded = []byte{0x01, 0x01}
+		present  = []byte{0x02, 0x02}
+		legacy   = []byte{0x03, 0x03}
+		data     = bytes.Repeat([]byte("build output "), 100)
+	)
+	meta := localCacheMetadata{OutputID: []byte{0xaa}, Size: int64(len(data)), PutTime: time.Now()}
+	for _, actionID := range [][]byte{uploaded, present} {
+		if _, err := lc.writeWithMetadata(actionID, bytes.NewReader(data), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLegacyEntry(t, lc, legacy, []byte("old"))
+	backend.puts[string(backendKey(present))] = []byte("already uploaded")
+
+	pusher := &localPusher{
+		lc:          lc,
+		backend:     backend,
+		compression: true,
+		concurrency: 2,
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if err := pusher.push(io.Discard); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	stats := &pusher.stats
+	if stats.entries.Load() != 3 || stats.uploaded.Load() != 2 || stats.present.Load() != 1 || stats.failed.Load() != 0 {
+		t.Errorf("stats: %d entries, %d uploaded, %d present, %d failed", stats.entries.Load(),
+			stats.uploaded.Load(), stats.present.Load(), stats.failed.Load())
+	}
+
+	// Entries are stored under the server's keys, compressed like the server does.
+	stored, ok := backend.puts[string(backendKey(uploaded))]
+	if !ok {
+		t.Fatal("entry was not uploaded")
+	}
+	if decompressed, err := decompressData(stored); err != nil || !bytes.Equal(decompressed, data) {
+		t.Errorf("uploaded entry decompresses to %d bytes (err %v), expected %d", len(decompressed), err, len(data))
+	}
+	if string(backend.puts[string(backendKey(present))]) != "already uploaded" {
+		t.Error("entry the backend already had was uploaded again")
+	}
+	if _, ok := backend.puts[string(backendKey(legacy))]; !ok {
+		t.Error("legacy entry was not uploaded")
+	}
+
+	// Everything is present on the second run.
+	again := &localPusher{lc: lc, backend: backend, concurrency: 1, logger: pusher.logger}
+	if err := again.push(io.Discard); err != nil || again.stats.uploaded.Load() != 0 || again.stats.present.Load() != 3 {
+		t.Errorf("second push: %d uploaded, %d present, err = %v", again.stats.uploaded.Load(), again.stats.present.Load(), err)
+	}
+}
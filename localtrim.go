@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	// localUseInterval is how stale the recorded last-use time of a local cache
+	// entry may get before a hit refreshes it. Like the go command's own cache, we
+	// accept imprecise last-use times in exchange for not writing to the filesystem
+	// on every hit.
+	localUseInterval = 1 * time.Hour
+
+	// localTrimInterval is the minimum time between two automatic trims of the
+	// same cache directory, across all processes sharing it.
+	localTrimInterval = 1 * time.Hour
+
+	localTrimLockFile  = "trim.lock"
+	localTrimStampFile = "trim.txt"
+)
+
+// errTrimInProgress is returned by trim when another process is already trimming
+// the same cache directory.
+var errTrimInProgress = errors.New("local cache is being trimmed by another process")
+
+// maybeTrim trims the local cache if it hasn't been trimmed (by this or any other
+// process) within localTrimInterval. It returns zero stats if trimming was skipped.
+func (lc *localCache) maybeTrim(locker locking.Group, policy backends.TrimPolicy) (backends.TrimStats, error) {
+	if lastTrim, err := lc.lastTrimTime(); err == nil && time.Since(lastTrim) < localTrimInterval {
+		return backends.TrimStats{}, nil
+	}
+	stats, err := lc.trim(locker, policy, time.Now())
+	if err == errTrimInProgress {
+		lc.logger.Debug("another process is trimming the local cache, skipping")
+		return stats, nil
+	}
+	return stats, err
+}
+
+// trim removes the entries selected by policy. An entry's creation time is when
+// its data was written locally, and its last-use time is tracked by check.
+//
+// Only one process trims a cache directory at a time; if another process is
+// already trimming, trim returns errTrimInProgress. Each entry is evicted while
+// holding its lock from locker so that it can't race with a concurrent GET or PUT
+// for the same action ID.
+func (lc *localCache) trim(locker locking.Group, policy backends.TrimPolicy, now time.Time) (backends.TrimStats, error) {
+	var stats backends.TrimStats
+
+	fileLock := flock.New(filepath.Join(lc.cacheDir, localTrimLockFile))
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		return stats, fmt.Errorf("failed to acquire trim lock: %w", err)
+	}
+	if !locked {
+		return stats, errTrimInProgress
+	}
+	defer fileLock.Unlock()
+
+	entries, err := lc.scanEntries()
+	if err != nil {
+		return stats, err
+	}
+
+	evict, keep := policy.Select(entries, now)
+	stats.Add(keep, false)
+	if policy.DryRun {
+		stats.Add(evict, true)
+		return stats, nil
+	}
+
+	for _, entry := range evict {
+		evicted, err := lc.evict(locker, entry)
+		if err != nil {
+			lc.logger.Warn("failed to evict local cache entry",
+				"actionID", entry.Key,
+				"error", err)
+		}
+		stats.Add([]backends.TrimEntry{entry}, evicted)
+	}
+	// Evicting entries only removes their links to objects, so objects that are
+	// no longer linked to any entry are removed afterwards.
+	if freed, err := lc.removeUnreferencedObjects(); err != nil {
+		lc.logger.Warn("failed to remove unreferenced local cache objects", "error", err)
+	} else if freed > 0 {
+		lc.logger.Debug("removed unreferenced local cache objects", "bytes", freed)
+	}
+	if stats.EvictedEntries > 0 {
+		if err := lc.bumpGeneration(); err != nil {
+			lc.logger.Warn("failed to update local cache generation", "error", err)
+		}
+	}
+
+	stamp := []byte(strconv.FormatInt(now.Unix(), 10) + "\n")
+	if err := os.WriteFile(filepath.Join(lc.cacheDir, localTrimStampFile), stamp, 0644); err != nil {
+		lc.logger.Warn("failed to record local cache trim time", "error", err)
+	}
+
+	return stats, nil
+}
+
+// evict removes an entry from the local cache. It returns false without removing
+// anything if the entry was used after it was scanned.
+func (lc *localCache) evict(locker locking.Group, entry backends.TrimEntry) (bool, error) {
+	actionID, err := hex.DecodeString(entry.Key)
+	if err != nil {
+		return false, err
+	}
+
+	v, err := locker.DoWithLock(entry.Key, func() (interface{}, error) {
+		if lastUsed, ok := lc.lastUsed(actionID); ok && lastUsed.After(entry.LastUsed) {
+			return false, nil
+		}
+
+		// Remove the metadata first so that the entry stops being visible to check
+		// before its data disappears. Headers stored in extended attributes go away
+		// with the data file.
+		paths := []string{
+			lc.headerPath(actionID),
+			lc.actionIDToPath(actionID),
+			lc.legacyMetadataPath(actionID),
+			lc.legacyDataPath(actionID),
+		}
+		lc.forget(actionID)
+		for i, path := range paths {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return i > 0, err
+			}
+		}
+		return true, nil
+	})
+	if v == nil {
+		return false, err
+	}
+	return v.(bool), err
+}
+
+// lastUsed returns when an entry was last used, if it exists and has metadata.
+func (lc *localCache) lastUsed(actionID []byte) (time.Time, bool) {
+	if meta, err := lc.readMetadata(actionID); err == nil {
+		return meta.LastUsed, true
+	}
+	if info, err := os.Stat(lc.legacyMetadataPath(actionID)); err == nil {
+		return info.ModTime(), true
+	}
+	return time.Time{}, false
+}
+
+// scanEntries lists every entry in the local cache, keyed by hex action ID,
+// including entries in the previous local layout that haven't been migrated yet.
+// The size of an entry includes its header or metadata file. Entries without
+// metadata use the modification time of their data file as the last-use time.
+//
+// Data files shared by several entries through an object are split evenly
+// between them, so that the sizes of all entries add up to the space they use.
+func (lc *localCache) scanEntries() ([]backends.TrimEntry, error) {
+	var entries []backends.TrimEntry
+	for i := range 256 {
+		subdir := filepath.Join(lc.cacheDir, fmt.Sprintf("%02x", i))
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read cache directory %s: %w", subdir, err)
+		}
+
+		var (
+			byID     = make(map[string]*backends.TrimEntry)
+			dataTime = make(map[string]time.Time)
+		)
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+			file, ok := parseLocalFileName(name)
+			if !ok {
+				continue
+			}
+			info, err := dirEntry.Info()
+			if err != nil {
+				// Removed since the directory was read.
+				continue
+			}
+
+			entry, ok := byID[file.hexID]
+			if !ok {
+				entry = &backends.TrimEntry{Key: file.hexID}
+				byID[file.hexID] = entry
+			}
+			var (
+				used time.Time
+				size = info.Size()
+			)
+			switch {
+			case file.legacy && file.metadata:
+				used = info.ModTime()
+			case !file.legacy && !file.metadata:
+				meta, err := lc.readHeader(filepath.Join(subdir, name))
+				if err == nil {
+					used = meta.LastUsed
+				}
+				size = lc.sharedSize(info, meta)
+			}
+			entry.Size += size
+			if used.After(entry.LastUsed) {
+				entry.LastUsed = used
+			}
+			if !file.metadata {
+				entry.Created = info.ModTime()
+				dataTime[file.hexID] = info.ModTime()
+			}
+		}
+
+		for hexID, entry := range byID {
+			if entry.LastUsed.IsZero() {
+				entry.LastUsed = dataTime[hexID]
+			}
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// sharedSize returns the share of the data file described by info that's
+// attributed to one of the entries linked to it. meta is the entry's header, or
+// nil if it has none.
+func (lc *localCache) sharedSize(info os.FileInfo, meta *localCacheMetadata) int64 {
+	links := int64(linkCount(info))
+	if links > 1 && meta != nil && len(meta.OutputID) > 0 {
+		// The object itself isn't an entry.
+		if objInfo, err := os.Stat(lc.objectPath(meta.OutputID)); err == nil && os.SameFile(info, objInfo) {
+			links--
+		}
+	}
+	if links <= 1 {
+		return info.Size()
+	}
+	return (info.Size() + links - 1) / links
+}
+
+// localFileName describes a file in one of the local cache subdirectories.
+type localFileName struct {
+	hexID string
+	// legacy is true for files in the previous local layout.
+	legacy bool
+	// metadata is true for header files and legacy metadata files.
+	metadata bool
+}
+
+// parseLocalFileName parses the name of a (non-temp) file in a local cache
+// subdirectory. It returns false for files that don't belong to an entry.
+func parseLocalFileName(name string) (localFileName, bool) {
+	var file localFileName
+	switch {
+	case strings.HasPrefix(name, localEntryVersion):
+		name, file.metadata = strings.CutSuffix(name[len(localEntryVersion):], localHeaderSuffix)
+	case strings.HasPrefix(name, localLegacyVersion):
+		name, file.metadata = strings.CutSuffix(name[len(localLegacyVersion):], ".meta")
+		file.legacy = true
+	default:
+		return file, false
+	}
+	if _, err := hex.DecodeString(name); err != nil || name == "" {
+		return file, false
+	}
+	file.hexID = name
+	return file, true
+}
+
+// lastTrimTime returns when the local cache was last trimmed.
+func (lc *localCache) lastTrimTime() (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(lc.cacheDir, localTrimStampFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	unix, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid trim time: %w", err)
+	}
+	return time.Unix(unix, 0), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+
+	"github.com/gofrs/flock"
+)
+
+func newTestLocalCache(t *testing.T) *localCache {
+	t.Helper()
+	lc, err := newLocalCache(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create local cache: %v", err)
+	}
+	return lc
+}
+
+// writeTestEntry writes an entry of the given size to the local cache and
+// backdates its last use by age.
+func writeTestEntry(t *testing.T, lc *localCache, actionID []byte, size int, age time.Duration) {
+	t.Helper()
+	meta := localCacheMetadata{
+		OutputID: []byte{0xaa},
+		Size:     int64(size),
+		PutTime:  time.Now(),
+		LastUsed: time.Now().Add(-age),
+	}
+	if _, err := lc.writeWithMetadata(actionID, bytes.NewReader(make([]byte, size)), meta); err != nil {
+		t.Fatalf("failed to write entry: %v", err)
+	}
+}
+
+func entryExists(lc *localCache, actionID []byte) bool {
+	_, dataErr := os.Stat(lc.actionIDToPath(actionID))
+	_, metaErr := lc.readMetadata(actionID)
+	return dataErr == nil && metaErr == nil
+}
+
+func TestLocalCacheTrimMaxAge(t *testing.T) {
+	var (
+		lc    = newTestLocalCache(t)
+		fresh = []byte{0x01, 0x01}
+		stale = []byte{0x02, 0x02}
+	)
+	writeTestEntry(t, lc, fresh, 100, time.Hour)
+	writeTestEntry(t, lc, stale, 100, 48*time.Hour)
+
+	stats, err := lc.trim(locking.NewMemLock(), backends.TrimPolicy{UnusedFor: 24 * time.Hour}, time.Now())
+	if err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if stats.Entries != 2 || stats.EvictedEntries != 1 {
+		t.Errorf("stats = %+v, expected 1 of 2 entries to be evicted", stats)
+	}
+	if !entryExists(lc, fresh) {
+		t.Error("fresh entry was evicted")
+	}
+	if entryExists(lc, stale) {
+		t.Error("stale entry was not evicted")
+	}
+	if lc.check(stale) != nil {
+		t.Error("evicted entry is still visible to check")
+	}
+}
+
+func TestLocalCacheTrimMaxSizeLRU(t *testing.T) {
+	lc := newTestLocalCache(t)
+
+	// Entries i=0..4, where entry 0 is the least recently used.
+	var ids [][]byte
+	for i := range 5 {
+		id := []byte{byte(i), 0xff}
+		ids = append(ids, id)
+		writeTestEntry(t, lc, id, 1000, time.Duration(5-i)*time.Hour)
+	}
+
+	// Using an entry refreshes its last-use time, so it survives the trim.
+	if meta := lc.check(ids[0]); meta == nil {
+		t.Fatal("expected hit for entry 0")
+	}
+
+	entries, err := lc.scanEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entrySize := entries[0].Size
+
+	stats, err := lc.trim(locking.NewMemLock(), backends.TrimPolicy{MaxSize: 3 * entrySize}, time.Now())
+	if err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if stats.EvictedEntries != 2 || stats.EvictedBytes != 2*entrySize {
+		t.Errorf("stats = %+v, expected 2 evicted entries of %d bytes", stats, entrySize)
+	}
+	if remaining := stats.Bytes - stats.EvictedBytes; remaining != 3*entrySize {
+		t.Errorf("remaining bytes = %d, expected %d", remaining, 3*entrySize)
+	}
+
+	for i, expected := range []bool{true, false, false, true, true} {
+		if exists := entryExists(lc, ids[i]); exists != expected {
+			t.Errorf("entry %d exists = %v, expected %v", i, exists, expected)
+		}
+	}
+}
+
+func TestLocalCacheTrimDataWithoutMetadata(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		actionID = []byte{0x03}
+	)
+	if err := os.WriteFile(lc.actionIDToPath(actionID), []byte("orphaned data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(lc.actionIDToPath(actionID), old, old)
+
+	stats, err := lc.trim(locking.NewMemLock(), backends.TrimPolicy{UnusedFor: 24 * time.Hour}, time.Now())
+	if err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if stats.EvictedEntries != 1 {
+		t.Errorf("evicted %d entries, expected 1", stats.EvictedEntries)
+	}
+	if _, err := os.Stat(lc.actionIDToPath(actionID)); !os.IsNotExist(err) {
+		t.Errorf("expected data file to be removed, got %v", err)
+	}
+}
+
+func TestLocalCacheTrimConcurrentProcess(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		actionID = []byte{0x04}
+	)
+	writeTestEntry(t, lc, actionID, 100, 48*time.Hour)
+
+	// Simulate another process holding the trim lock.
+	other := flock.New(filepath.Join(lc.cacheDir, localTrimLockFile))
+	if locked, err := other.TryLock(); err != nil || !locked {
+		t.Fatalf("failed to acquire trim lock: %v", err)
+	}
+
+	policy := backends.TrimPolicy{UnusedFor: time.Hour}
+	if _, err := lc.trim(locking.NewMemLock(), policy, time.Now()); err != errTrimInProgress {
+		t.Fatalf("expected errTrimInProgress, got %v", err)
+	}
+	if !entryExists(lc, actionID) {
+		t.Error("trimmed while another process held the trim lock")
+	}
+	if stats, err := lc.maybeTrim(locking.NewMemLock(), policy); err != nil || stats.EvictedEntries != 0 {
+		t.Errorf("maybeTrim: stats = %+v, err = %v, expected it to be skipped", stats, err)
+	}
+
+	other.Unlock()
+	if stats, _ := lc.trim(locking.NewMemLock(), policy, time.Now()); stats.EvictedEntries != 1 {
+		t.Errorf("evicted %d entries after the lock was released, expected 1", stats.EvictedEntries)
+	}
+}
+
+func TestLocalCacheMaybeTrimInterval(t *testing.T) {
+	lc := newTestLocalCache(t)
+	writeTestEntry(t, lc, []byte{0x05}, 100, 48*time.Hour)
+
+	stats, err := lc.maybeTrim(locking.NewMemLock(), backends.TrimPolicy{UnusedFor: time.Hour})
+	if err != nil || stats.EvictedEntries != 1 {
+		t.Fatalf("first trim: stats = %+v, err = %v", stats, err)
+	}
+
+	// A second trim right away is skipped even though this entry is stale.
+	writeTestEntry(t, lc, []byte{0x06}, 100, 48*time.Hour)
+	stats, err = lc.maybeTrim(locking.NewMemLock(), backends.TrimPolicy{UnusedFor: time.Hour})
+	if err != nil || stats.EvictedEntries != 0 {
+		t.Errorf("second trim: stats = %+v, err = %v, expected it to be skipped", stats, err)
+	}
+}
+
+func TestLocalCacheCheckMarksUsed(t *testing.T) {
+	var (
+		lc       = newTestLocalCache(t)
+		recent   = []byte{0x07}
+		outdated = []byte{0x08}
+	)
+	writeTestEntry(t, lc, recent, 10, time.Minute)
+	writeTestEntry(t, lc, outdated, 10, 2*localUseInterval)
+
+	before := time.Now()
+	for _, id := range [][]byte{recent, outdated} {
+		if lc.check(id) == nil {
+			t.Fatalf("expected hit for %x", id)
+		}
+	}
+
+	// Only entries whose last-use time is older than localUseInterval are touched.
+	meta, _ := lc.readMetadata(recent)
+	if !meta.LastUsed.Before(before) {
+		t.Error("recently used entry was touched")
+	}
+	meta, _ = lc.readMetadata(outdated)
+	if meta.LastUsed.Before(before) {
+		t.Errorf("last-use time of outdated entry not refreshed: %v", meta.LastUsed)
+	}
+}
+
+func TestLocalCacheTrimDryRunAndOlderThan(t *testing.T) {
+	var (
+		lc      = newTestLocalCache(t)
+		recent  = []byte{0x09}
+		written = []byte{0x0a}
+	)
+	writeTestEntry(t, lc, recent, 100, 0)
+	writeTestEntry(t, lc, written, 100, 0)
+
+	// written was created long ago, but used recently.
+	old := time.Now().Add(-72 * time.Hour)
+	os.Chtimes(lc.actionIDToPath(written), old, old)
+
+	policy := backends.TrimPolicy{OlderThan: 48 * time.Hour, DryRun: true}
+	stats, err := lc.trim(locking.NewMemLock(), policy, time.Now())
+	if err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if stats.Entries != 2 || stats.EvictedEntries != 1 {
+		t.Errorf("stats = %+v, expected 1 of 2 entries to be selected", stats)
+	}
+	if !entryExists(lc, written) {
+		t.Error("dry run removed an entry")
+	}
+	if _, err := lc.lastTrimTime(); err == nil {
+		t.Error("dry run recorded a trim time")
+	}
+
+	policy.DryRun = false
+	if _, err := lc.trim(locking.NewMemLock(), policy, time.Now()); err != nil {
+		t.Fatalf("trim failed: %v", err)
+	}
+	if entryExists(lc, written) || !entryExists(lc, recent) {
+		t.Error("expected only the old entry to be removed")
+	}
+}
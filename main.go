@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/richardartoul/gobuildcache/pkg/backends"
 	"github.com/richardartoul/gobuildcache/pkg/locking"
@@ -26,6 +32,68 @@ var (
 	errorRate    float64
 	compression  bool
 	asyncBackend bool
+
+	s3MultipartThreshold int64
+	s3PartSize           int64
+	s3Concurrency        int
+
+	s3Endpoint        string
+	s3Region          string
+	s3PathStyle       bool
+	s3Profile         string
+	s3CredentialsFile string
+	s3ConfigFile      string
+	s3RoleARN         string
+	s3ExternalID      string
+	s3ConnectTimeout  time.Duration
+	s3RequestTimeout  time.Duration
+	s3MaxIdleConns    int
+	s3SkipBucketCheck bool
+
+	s3Encryption      string
+	s3KMSKeyID        string
+	s3CustomerKeyFile string
+	s3StorageClass    string
+	s3Tags            string
+	s3ACL             string
+	s3SkipExisting    string
+	s3TrackAccess     bool
+	remoteCAS         bool
+
+	localMaxSize int64
+	localMaxAge  time.Duration
+
+	manifestName     string
+	prefetchManifest string
+
+	negativeCacheTTL    time.Duration
+	negativeCacheShared bool
+
+	keyFilterEnabled bool
+	keyFilterMaxAge  time.Duration
+
+	daemonClient      bool
+	daemonSocket      string
+	daemonIdleTimeout time.Duration
+
+	packEnabled   bool
+	packThreshold int64
+	packSize      int64
+
+	remoteURL     string
+	remoteToken   string
+	remoteTimeout time.Duration
+
+	reapiURL                 string
+	reapiInstance            string
+	reapiHeaders             string
+	reapiByteStreamThreshold int64
+
+	peerList    string
+	peerSRV     string
+	peerListen  string
+	peerToken   string
+	peerTimeout time.Duration
 )
 
 func main() {
@@ -43,6 +111,39 @@ func main() {
 		case "clear-remote":
 			runClearRemoteCommand()
 			return
+		case "trim-local":
+			runTrimLocalCommand()
+			return
+		case "trim-remote":
+			runTrimRemoteCommand()
+			return
+		case "fsck":
+			runFsckCommand()
+			return
+		case "import-gocache":
+			runImportGoCacheCommand()
+			return
+		case "push":
+			runPushCommand()
+			return
+		case "repack":
+			runRepackCommand()
+			return
+		case "daemon":
+			runServerCommand(os.Args[2:], true)
+			return
+		case "build-key-filter":
+			runBuildKeyFilterCommand()
+			return
+		case "serve":
+			runServeCommand()
+			return
+		case "export":
+			runExportCommand()
+			return
+		case "import":
+			runImportCommand()
+			return
 		case "help", "-h", "--help":
 			printHelp()
 			return
@@ -54,10 +155,12 @@ func main() {
 	}
 
 	// No subcommand or starts with -, run the server
-	runServerCommand()
+	runServerCommand(os.Args[1:], false)
 }
 
-func runServerCommand() {
+// runServerCommand runs the server, or the daemon if asDaemon is true, which
+// takes the same flags.
+func runServerCommand(args []string, asDaemon bool) {
 	// Get defaults from environment variables.
 	var (
 		serverFlags         = flag.NewFlagSet("server", flag.ExitOnError)
@@ -73,11 +176,34 @@ func runServerCommand() {
 		errorRateDefault    = getEnvFloat("ERROR_RATE", 0.0)
 		compressionDefault  = getEnvBool("COMPRESSION", true)
 		asyncBackendDefault = getEnvBool("ASYNC_BACKEND", true)
+		localMaxSizeDefault = getEnvBytes("LOCAL_MAX_SIZE", 0)
+		localMaxAgeDefault  = getEnvDuration("LOCAL_MAX_AGE", 0)
+
+		s3Defaults                  = backends.DefaultS3Options()
+		s3MultipartThresholdDefault = getEnvBytes("S3_MULTIPART_THRESHOLD", s3Defaults.MultipartThreshold)
+		s3PartSizeDefault           = getEnvBytes("S3_PART_SIZE", s3Defaults.PartSize)
+		s3ConcurrencyDefault        = getEnvInt("S3_CONCURRENCY", s3Defaults.Concurrency)
+		s3TrackAccessDefault        = getEnvBool("S3_TRACK_ACCESS", false)
+		remoteCASDefault            = getEnvBool("REMOTE_CAS", false)
+		manifestDefault             = getEnv("MANIFEST", "")
+		prefetchManifestDefault     = getEnv("PREFETCH_MANIFEST", "")
+		negativeCacheTTLDefault     = getEnvDuration("NEGATIVE_CACHE_TTL", 30*time.Second)
+		negativeCacheSharedDefault  = getEnvBool("NEGATIVE_CACHE_SHARED", false)
+		keyFilterDefault            = getEnvBool("KEY_FILTER", false)
+		keyFilterMaxAgeDefault      = getEnvDuration("KEY_FILTER_MAX_AGE", 2*time.Hour)
+		daemonDefault               = getEnvBool("DAEMON", false)
+		daemonSocketDefault         = getEnv("DAEMON_SOCKET", "")
+		daemonIdleTimeoutDefault    = getEnvDuration("DAEMON_IDLE_TIMEOUT", 15*time.Minute)
+		peersDefault                = getEnv("PEERS", "")
+		peersSRVDefault             = getEnv("PEERS_SRV", "")
+		peerListenDefault           = getEnv("PEER_LISTEN", ":7070")
+		peerTokenDefault            = getEnv("PEER_TOKEN", "")
+		peerTimeoutDefault          = getEnvDuration("PEER_TIMEOUT", 2*time.Second)
 	)
 	serverFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
 	serverFlags.BoolVar(&printStats, "stats", printStatsDefault, "Print cache statistics on exit (env: PRINT_STATS)")
 	serverFlags.BoolVar(&quiet, "quiet", quietDefault, "Suppress informational messages (env: QUIET)")
-	serverFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3 (env: BACKEND_TYPE)")
+	serverFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, remote, reapi (env: BACKEND_TYPE)")
 	serverFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
 	serverFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
 	serverFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
@@ -86,17 +212,49 @@ func runServerCommand() {
 	serverFlags.Float64Var(&errorRate, "error-rate", errorRateDefault, "Error injection rate (0.0-1.0) for testing error handling (env: ERROR_RATE)")
 	serverFlags.BoolVar(&compression, "compression", compressionDefault, "Enable LZ4 compression for backend storage (env: COMPRESSION)")
 	serverFlags.BoolVar(&asyncBackend, "async-backend", asyncBackendDefault, "Enable async backend writer for non-blocking PUT operations (env: ASYNC_BACKEND)")
+	serverFlags.Var(newByteSizeValue(&localMaxSize, localMaxSizeDefault), "local-max-size", "Trim the local cache to this size, evicting least recently used entries first, 0 for unlimited (env: LOCAL_MAX_SIZE)")
+	serverFlags.Var(newDurationValue(&localMaxAge, localMaxAgeDefault), "local-max-age", "Evict local cache entries that haven't been used for this long, 0 to disable (env: LOCAL_MAX_AGE)")
+	serverFlags.Var(newByteSizeValue(&s3MultipartThreshold, s3MultipartThresholdDefault), "s3-multipart-threshold", "Object size at which S3 transfers are split into parallel parts, 0 to disable (env: S3_MULTIPART_THRESHOLD)")
+	serverFlags.Var(newByteSizeValue(&s3PartSize, s3PartSizeDefault), "s3-part-size", "Part size for S3 multipart uploads and ranged downloads (env: S3_PART_SIZE)")
+	serverFlags.IntVar(&s3Concurrency, "s3-concurrency", s3ConcurrencyDefault, "Maximum parallel part transfers per S3 object (env: S3_CONCURRENCY)")
+	serverFlags.BoolVar(&s3TrackAccess, "s3-track-access", s3TrackAccessDefault, "Publish access logs of S3 cache hits so trim-remote can remove entries by last use (env: S3_TRACK_ACCESS)")
+	serverFlags.BoolVar(&remoteCAS, "remote-cas", remoteCASDefault, "Store remote entries as small action index objects plus output blobs shared by identical outputs (env: REMOTE_CAS)")
+	serverFlags.StringVar(&manifestName, "manifest", manifestDefault, "Add the action IDs requested during the run to the build manifest with this name, e.g. a branch or job name (env: MANIFEST)")
+	serverFlags.StringVar(&prefetchManifest, "prefetch-manifest", prefetchManifestDefault, "Download the entries of the build manifest with this name into the local cache at startup (env: PREFETCH_MANIFEST)")
+	serverFlags.Var(newDurationValue(&negativeCacheTTL, negativeCacheTTLDefault), "negative-cache-ttl", "Answer repeated GETs for entries the backend missed locally for this long, 0 to disable (env: NEGATIVE_CACHE_TTL)")
+	serverFlags.BoolVar(&negativeCacheShared, "negative-cache-shared", negativeCacheSharedDefault, "Share backend misses with other processes using the same cache directory (env: NEGATIVE_CACHE_SHARED)")
+	serverFlags.BoolVar(&keyFilterEnabled, "key-filter", keyFilterDefault, "Download the key filter published by build-key-filter at startup and answer definite misses without a backend request (env: KEY_FILTER)")
+	serverFlags.Var(newDurationValue(&keyFilterMaxAge, keyFilterMaxAgeDefault), "key-filter-max-age", "Ignore key filters built longer ago than this, 0 to accept any age (env: KEY_FILTER_MAX_AGE)")
+	serverFlags.BoolVar(&daemonClient, "daemon", daemonDefault, "Forward requests to the shared daemon, starting it with the other flags if it isn't running (env: DAEMON)")
+	serverFlags.StringVar(&daemonSocket, "daemon-socket", daemonSocketDefault, "Unix socket of the shared daemon, by default one per user and configuration in the temp directory (env: DAEMON_SOCKET)")
+	serverFlags.Var(newDurationValue(&daemonIdleTimeout, daemonIdleTimeoutDefault), "daemon-idle-timeout", "Stop the daemon after no client has been connected for this long, 0 to keep it running (env: DAEMON_IDLE_TIMEOUT)")
+	serverFlags.StringVar(&peerList, "peers", peersDefault, "Comma-separated host:port addresses of peers to share local caches with, which may include this machine (env: PEERS)")
+	serverFlags.StringVar(&peerSRV, "peers-srv", peersSRVDefault, "DNS SRV record listing the peers, e.g. _gobuildcache._tcp.rack1.internal (env: PEERS_SRV)")
+	serverFlags.StringVar(&peerListen, "peer-listen", peerListenDefault, "Address to serve the local cache to peers on, read-only (env: PEER_LISTEN)")
+	serverFlags.StringVar(&peerToken, "peer-token", peerTokenDefault, "Token that peers must send, and that is sent to them (env: PEER_TOKEN)")
+	serverFlags.Var(newDurationValue(&peerTimeout, peerTimeoutDefault), "peer-timeout", "Timeout for a peer to start responding before falling back to the backend (env: PEER_TIMEOUT)")
+	registerS3ClientFlags(serverFlags)
+	registerRemoteFlags(serverFlags)
+	registerREAPIFlags(serverFlags)
+	registerS3StorageFlags(serverFlags)
+	registerPackFlags(serverFlags)
 
 	serverFlags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Run the Go build cache server.\n\n")
+		if asDaemon {
+			fmt.Fprintf(os.Stderr, "Usage: %s daemon [flags]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Run the shared Go build cache daemon, which serves the clients started with\n")
+			fmt.Fprintf(os.Stderr, "-daemon on its Unix socket. It's started by the first client if necessary.\n\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Run the Go build cache server.\n\n")
+		}
 		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
 		serverFlags.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
 		fmt.Fprintf(os.Stderr, "  DEBUG            Enable debug logging (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  PRINT_STATS      Print cache statistics on exit (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  QUIET            Suppress informational messages (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE     Backend type (disk, s3)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE     Backend type (disk, s3, remote, reapi)\n")
 		fmt.Fprintf(os.Stderr, "  LOCK_TYPE        Deduplication type (memory, fslock)\n")
 		fmt.Fprintf(os.Stderr, "  LOCK_DIR         Lock directory for fslock\n")
 		fmt.Fprintf(os.Stderr, "  CACHE_DIR        Local cache directory\n")
@@ -104,6 +262,32 @@ func runServerCommand() {
 		fmt.Fprintf(os.Stderr, "  S3_PREFIX        S3 key prefix\n")
 		fmt.Fprintf(os.Stderr, "  COMPRESSION      Enable LZ4 compression (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  ASYNC_BACKEND    Enable async backend writer (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_MAX_SIZE   Maximum local cache size (e.g. 20GB)\n")
+		fmt.Fprintf(os.Stderr, "  LOCAL_MAX_AGE    Evict local entries unused for this long (e.g. 168h)\n")
+		fmt.Fprintf(os.Stderr, "  S3_MULTIPART_THRESHOLD  Object size at which S3 transfers use parallel parts (e.g. 32MB)\n")
+		fmt.Fprintf(os.Stderr, "  S3_PART_SIZE     Part size for S3 multipart transfers (e.g. 8MB)\n")
+		fmt.Fprintf(os.Stderr, "  S3_CONCURRENCY   Maximum parallel part transfers per S3 object\n")
+		fmt.Fprintf(os.Stderr, "  S3_TRACK_ACCESS  Publish access logs of S3 cache hits (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_CAS       Store remote outputs content-addressed (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  MANIFEST         Name to upload the build manifest under\n")
+		fmt.Fprintf(os.Stderr, "  PREFETCH_MANIFEST  Name of the build manifest to prefetch\n")
+		fmt.Fprintf(os.Stderr, "  NEGATIVE_CACHE_TTL  How long backend misses are remembered (e.g. 30s)\n")
+		fmt.Fprintf(os.Stderr, "  NEGATIVE_CACHE_SHARED  Share backend misses through the cache directory (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  KEY_FILTER       Answer definite misses with the published key filter (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  KEY_FILTER_MAX_AGE  Ignore key filters older than this (e.g. 2h)\n")
+		fmt.Fprintf(os.Stderr, "  DAEMON           Forward requests to the shared daemon (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  DAEMON_SOCKET    Unix socket of the shared daemon\n")
+		fmt.Fprintf(os.Stderr, "  DAEMON_IDLE_TIMEOUT  Stop the daemon after being idle for this long (e.g. 15m)\n")
+		fmt.Fprintf(os.Stderr, "  PEERS            Comma-separated host:port addresses of peers\n")
+		fmt.Fprintf(os.Stderr, "  PEERS_SRV        DNS SRV record listing the peers\n")
+		fmt.Fprintf(os.Stderr, "  PEER_LISTEN      Address to serve the local cache to peers on\n")
+		fmt.Fprintf(os.Stderr, "  PEER_TOKEN       Token shared by the peers\n")
+		fmt.Fprintf(os.Stderr, "  PEER_TIMEOUT     Timeout for peers to start responding (e.g. 2s)\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
+		printPackEnvUsage()
 		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Run with disk backend using flags:\n")
@@ -113,11 +297,29 @@ func runServerCommand() {
 		fmt.Fprintf(os.Stderr, "  # Run with environment variables:\n")
 		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE=s3 S3_BUCKET=my-cache-bucket %s\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  # Mix environment variables and flags (flags override env):\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE=s3 %s -s3-bucket=my-cache-bucket -debug\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE=s3 %s -s3-bucket=my-cache-bucket -debug\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Run with a self-hosted S3-compatible backend:\n")
+		fmt.Fprintf(os.Stderr, "  %s -backend=s3 -s3-bucket=my-cache-bucket -s3-endpoint=http://minio:9000 -s3-region=us-east-1 -s3-path-style\n", os.Args[0])
 	}
 
-	serverFlags.Parse(os.Args[1:])
-	runServer()
+	serverFlags.Parse(args)
+	if daemonSocket == "" {
+		daemonSocket = defaultDaemonSocket(serverFlags)
+	}
+	switch {
+	case asDaemon:
+		runDaemon()
+	case daemonClient:
+		// The daemon takes the same flags, and ignores -daemon. It's given the
+		// socket explicitly in case its environment differs.
+		daemonArgs := append(slices.Clip(args), "-daemon-socket="+daemonSocket)
+		if err := runDaemonClient(daemonSocket, daemonArgs); err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to daemon: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		runServer()
+	}
 }
 
 func runClearCommand() {
@@ -131,10 +333,14 @@ func runClearCommand() {
 		s3PrefixDefault = getEnv("S3_PREFIX", "")
 	)
 	clearFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
-	clearFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3 (env: BACKEND_TYPE)")
+	clearFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk (local only), s3, remote, reapi (env: BACKEND_TYPE)")
 	clearFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
 	clearFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
 	clearFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	registerS3ClientFlags(clearFlags)
+	registerRemoteFlags(clearFlags)
+	registerREAPIFlags(clearFlags)
+	registerS3StorageFlags(clearFlags)
 
 	clearFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear [flags]\n\n", os.Args[0])
@@ -144,11 +350,15 @@ func runClearCommand() {
 		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
 		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
 		fmt.Fprintf(os.Stderr, "  PRINT_STATS    Print cache statistics on exit (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, remote, reapi)\n")
 		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
 		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
 		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
 		fmt.Fprintf(os.Stderr, "  S3_TMP_DIR     Local temp directory for S3 backend\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
 		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Clear disk cache using flags:\n")
@@ -215,6 +425,10 @@ func runClearRemoteCommand() {
 	clearRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3 (env: BACKEND_TYPE)")
 	clearRemoteFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
 	clearRemoteFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	registerS3ClientFlags(clearRemoteFlags)
+	registerRemoteFlags(clearRemoteFlags)
+	registerREAPIFlags(clearRemoteFlags)
+	registerS3StorageFlags(clearRemoteFlags)
 
 	clearRemoteFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s clear-remote [flags]\n\n", os.Args[0])
@@ -223,9 +437,13 @@ func runClearRemoteCommand() {
 		clearRemoteFlags.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
 		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
-		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3)\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, remote, reapi)\n")
 		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
 		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
 		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Clear S3 cache using flags:\n")
@@ -255,183 +473,1436 @@ func runClearRemoteCommand() {
 	fmt.Fprintf(os.Stdout, "Remote cache cleared successfully\n")
 }
 
-func printHelp() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "A remote caching server for Go builds.\n\n")
-	fmt.Fprintf(os.Stderr, "Commands:\n")
-	fmt.Fprintf(os.Stderr, "  (no command)  Run the cache server (default)\n")
-	fmt.Fprintf(os.Stderr, "  clear         Clear both local and remote cache entries\n")
-	fmt.Fprintf(os.Stderr, "  clear-local   Clear only local cache directory\n")
-	fmt.Fprintf(os.Stderr, "  clear-remote  Clear only remote backend cache\n")
-	fmt.Fprintf(os.Stderr, "  help          Show this help message\n\n")
-	fmt.Fprintf(os.Stderr, "Configuration:\n")
-	fmt.Fprintf(os.Stderr, "  Flags can be set via command-line arguments or environment variables.\n")
-	fmt.Fprintf(os.Stderr, "  Command-line flags take precedence over environment variables.\n\n")
-	fmt.Fprintf(os.Stderr, "Run '%s [command] -h' for more information about a command.\n", os.Args[0])
-}
+func runTrimLocalCommand() {
+	// Get defaults from environment variables.
+	var (
+		trimLocalFlags  = flag.NewFlagSet("trim-local", flag.ExitOnError)
+		debugDefault    = getEnvBool("DEBUG", false)
+		lockTypeDefault = getEnv("LOCK_TYPE", "fslock")
+		lockDirDefault  = getEnv("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+		cacheDirDefault = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		policy          backends.TrimPolicy
+	)
+	trimLocalFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	trimLocalFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
+	trimLocalFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
+	trimLocalFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	registerTrimPolicyFlags(trimLocalFlags, &policy)
 
-func runServer() {
-	// Create backend
-	backend, err := createBackend()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+	trimLocalFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s trim-local [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Remove old or least recently used entries from the local cache directory.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		trimLocalFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_TYPE      Deduplication type (memory, fslock)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR       Lock directory for fslock\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		printTrimPolicyEnvUsage()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Show what trimming the local cache to 10GB would remove:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-local -max-size=10GB -dry-run\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Keep only entries used within the last 7 days:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-local -keep-used-within=7d\n", os.Args[0])
+	}
+
+	trimLocalFlags.Parse(os.Args[2:])
+	if policy.IsZero() {
+		fmt.Fprintf(os.Stderr, "Error: at least one of -older-than, -keep-used-within or -max-size is required\n")
 		os.Exit(1)
 	}
-	defer backend.Close()
 
 	lockingGroup, err := createLockingGroup()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
 		os.Exit(1)
 	}
-
-	prog, err := NewCacheProg(backend, lockingGroup, cacheDir, debug, printStats, compression)
+	lc, err := newLocalCache(cacheDir, newLogger())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating cache program: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
 		os.Exit(1)
 	}
-	if err := prog.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error running cache program: %v\n", err)
+
+	stats, err := lc.trim(lockingGroup, policy, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error trimming local cache: %v\n", err)
 		os.Exit(1)
 	}
+	printTrimStats("local cache", stats, policy.DryRun)
 }
 
-func runClear() {
-	// Create backend
-	backend, err := createBackend()
+func runTrimRemoteCommand() {
+	// Get defaults from environment variables.
+	var (
+		trimRemoteFlags  = flag.NewFlagSet("trim-remote", flag.ExitOnError)
+		debugDefault     = getEnvBool("DEBUG", false)
+		cacheDirDefault  = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		backendDefault   = getEnv("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		s3BucketDefault  = getEnv("S3_BUCKET", "")
+		s3PrefixDefault  = getEnv("S3_PREFIX", "gobuildcache/")
+		remoteCASDefault = getEnvBool("REMOTE_CAS", false)
+		policy           backends.TrimPolicy
+	)
+	trimRemoteFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	trimRemoteFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory, where pack indexes are cached (env: CACHE_DIR)")
+	trimRemoteFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: disk, s3 (env: BACKEND_TYPE)")
+	trimRemoteFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	trimRemoteFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	trimRemoteFlags.BoolVar(&remoteCAS, "remote-cas", remoteCASDefault, "The cache stores remote entries content-addressed (env: REMOTE_CAS)")
+	registerS3ClientFlags(trimRemoteFlags)
+	registerRemoteFlags(trimRemoteFlags)
+	registerREAPIFlags(trimRemoteFlags)
+	registerS3StorageFlags(trimRemoteFlags)
+	registerPackFlags(trimRemoteFlags)
+	registerTrimPolicyFlags(trimRemoteFlags, &policy)
+
+	trimRemoteFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s trim-remote [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Remove old or least recently used entries from the remote backend cache (e.g., S3).\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		trimRemoteFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (disk, s3, remote, reapi)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_CAS     The cache stores remote entries content-addressed (true/false)\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
+		printPackEnvUsage()
+		printTrimPolicyEnvUsage()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Show what trimming the S3 cache to 500GB would remove:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-remote -backend=s3 -s3-bucket=my-cache-bucket -max-size=500GB -dry-run\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Remove entries uploaded more than 14 days ago:\n")
+		fmt.Fprintf(os.Stderr, "  %s trim-remote -backend=s3 -s3-bucket=my-cache-bucket -older-than=14d\n", os.Args[0])
+	}
+
+	trimRemoteFlags.Parse(os.Args[2:])
+	if policy.IsZero() {
+		fmt.Fprintf(os.Stderr, "Error: at least one of -older-than, -keep-used-within or -max-size is required\n")
+		os.Exit(1)
+	}
+
+	// Trim the storage layout directly: the key filter and the other wrappers
+	// added by createBackend don't store entries of their own.
+	backend, err := createLayoutBackend()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
 		os.Exit(1)
 	}
 	defer backend.Close()
 
-	// Clear the backend (remote storage)
-	if err := backend.Clear(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error clearing backend cache: %v\n", err)
+	trimmer, ok := backend.(backends.Trimmer)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: backend %s does not support trimming\n", backendType)
+		os.Exit(1)
+	}
+	// Key filter deltas are only needed until the next filter is built, and the
+	// ones written since the current filter was built are still needed.
+	filterStats, err := backends.LoadKeyFilterStats(backend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading key filter: %v\n", err)
+		os.Exit(1)
+	}
+	policy.IsEntry = func(key []byte) bool {
+		return isEntryKey(key) || backends.IsMergedKeyFilterDelta(key, filterStats.BuiltAt)
+	}
+	stats, err := trimmer.Trim(policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error trimming backend cache: %v\n", err)
 		os.Exit(1)
 	}
+	printTrimStats("remote cache", stats, policy.DryRun)
+	if stats.Entries == 0 && stats.Skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: found %d objects but no cache entries; check -s3-prefix and the storage layout flags\n", stats.Skipped)
+	}
+}
 
-	// Clear the local cache directory
-	if err := clearLocalCache(cacheDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Error clearing local cache: %v\n", err)
+func runFsckCommand() {
+	// Get defaults from environment variables.
+	var (
+		fsckFlags       = flag.NewFlagSet("fsck", flag.ExitOnError)
+		debugDefault    = getEnvBool("DEBUG", false)
+		lockTypeDefault = getEnv("LOCK_TYPE", "fslock")
+		lockDirDefault  = getEnv("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+		cacheDirDefault = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		repair          bool
+		deleteDamaged   bool
+		jsonOutput      bool
+	)
+	fsckFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	fsckFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
+	fsckFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
+	fsckFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	fsckFlags.BoolVar(&repair, "repair", false, "Rebuild missing or corrupt metadata and delete anything that can't be repaired")
+	fsckFlags.BoolVar(&deleteDamaged, "delete", false, "Delete every damaged entry and orphaned temp file")
+	fsckFlags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	fsckFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fsck [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Check the local cache directory for orphaned temp files, data without metadata,\n")
+		fmt.Fprintf(os.Stderr, "metadata without data and size mismatches, and optionally fix them.\n")
+		fmt.Fprintf(os.Stderr, "Exits with status 1 if any problems are left unfixed.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		fsckFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_TYPE      Deduplication type (memory, fslock)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR       Lock directory for fslock\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Report problems without changing anything:\n")
+		fmt.Fprintf(os.Stderr, "  %s fsck\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Repair what can be repaired and print the result as JSON:\n")
+		fmt.Fprintf(os.Stderr, "  %s fsck -repair -json\n", os.Args[0])
+	}
+
+	fsckFlags.Parse(os.Args[2:])
+	if repair && deleteDamaged {
+		fmt.Fprintf(os.Stderr, "Error: -repair and -delete are mutually exclusive\n")
 		os.Exit(1)
 	}
+	mode := fsckReportOnly
+	if repair {
+		mode = fsckRepair
+	} else if deleteDamaged {
+		mode = fsckDelete
+	}
 
-	fmt.Fprintf(os.Stdout, "Cache cleared successfully\n")
-}
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
 
-// clearLocalCache removes all entries from the local cache directory.
-func clearLocalCache(cacheDir string) error {
-	// Remove the entire directory and recreate it
-	// os.RemoveAll is idempotent - it doesn't error if path doesn't exist
-	if err := os.RemoveAll(cacheDir); err != nil {
-		return fmt.Errorf("failed to remove cache directory: %w", err)
+	report, err := lc.fsck(lockingGroup, mode, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking local cache: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Recreate the directory
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to recreate cache directory: %w", err)
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding report: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		for _, problem := range report.Problems {
+			line := fmt.Sprintf("%s: %s", problem.Kind, problem.Path)
+			if problem.Detail != "" {
+				line += " (" + problem.Detail + ")"
+			}
+			if problem.Fix != "" {
+				line += ": " + problem.Fix
+			}
+			fmt.Fprintln(os.Stdout, line)
+		}
+		fmt.Fprintf(os.Stdout, "Checked %d entries: %d problems, %d fixed\n",
+			report.Entries, len(report.Problems), len(report.Problems)-report.unfixed())
 	}
 
-	return nil
+	if report.unfixed() > 0 {
+		os.Exit(1)
+	}
 }
 
-func createBackend() (backends.Backend, error) {
-	backendType = strings.ToLower(backendType)
+// registerTrimPolicyFlags registers the flags shared by the trim commands.
+func registerTrimPolicyFlags(fs *flag.FlagSet, policy *backends.TrimPolicy) {
+	var (
+		olderThanDefault      = getEnvDuration("TRIM_OLDER_THAN", 0)
+		keepUsedWithinDefault = getEnvDuration("TRIM_KEEP_USED_WITHIN", 0)
+		maxSizeDefault        = getEnvBytes("TRIM_MAX_SIZE", 0)
+		dryRunDefault         = getEnvBool("TRIM_DRY_RUN", false)
+	)
+	fs.Var(newDurationValue(&policy.OlderThan, olderThanDefault), "older-than", "Remove entries created longer ago than this, e.g. 14d (env: TRIM_OLDER_THAN)")
+	fs.Var(newDurationValue(&policy.UnusedFor, keepUsedWithinDefault), "keep-used-within", "Remove entries that haven't been used within this duration, e.g. 7d (env: TRIM_KEEP_USED_WITHIN)")
+	fs.Var(newByteSizeValue(&policy.MaxSize, maxSizeDefault), "max-size", "Remove least recently used entries until the cache is no larger than this, e.g. 10GB (env: TRIM_MAX_SIZE)")
+	fs.BoolVar(&policy.DryRun, "dry-run", dryRunDefault, "Only report what would be removed (env: TRIM_DRY_RUN)")
+}
 
-	var backend backends.Backend
-	var err error
+// printTrimPolicyEnvUsage prints the environment variables for registerTrimPolicyFlags.
+func printTrimPolicyEnvUsage() {
+	fmt.Fprintf(os.Stderr, "  TRIM_OLDER_THAN        Remove entries created longer ago than this\n")
+	fmt.Fprintf(os.Stderr, "  TRIM_KEEP_USED_WITHIN  Remove entries not used within this duration\n")
+	fmt.Fprintf(os.Stderr, "  TRIM_MAX_SIZE          Trim least recently used entries down to this size\n")
+	fmt.Fprintf(os.Stderr, "  TRIM_DRY_RUN           Only report what would be removed (true/false)\n")
+}
 
-	switch backendType {
-	case "disk":
-		// Use no-op backend - local caching is handled by server.go
-		backend = backends.NewNoop()
+// printTrimStats prints the result of a trim command.
+func printTrimStats(what string, stats backends.TrimStats, dryRun bool) {
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(os.Stdout, "Scanned %s: %d entries (%s)\n", what, stats.Entries, formatBytes(stats.Bytes))
+	fmt.Fprintf(os.Stdout, "%s: %d entries (%s)\n", verb, stats.EvictedEntries, formatBytes(stats.EvictedBytes))
+	fmt.Fprintf(os.Stdout, "Remaining: %d entries (%s)\n",
+		stats.Entries-stats.EvictedEntries, formatBytes(stats.Bytes-stats.EvictedBytes))
+}
 
-	case "s3":
-		if s3Bucket == "" {
-			return nil, fmt.Errorf("S3 bucket is required for S3 backend (set via -s3-bucket flag or S3_BUCKET env var)")
-		}
+func runImportGoCacheCommand() {
+	// Get defaults from environment variables.
+	var (
+		importFlags        = flag.NewFlagSet("import-gocache", flag.ExitOnError)
+		debugDefault       = getEnvBool("DEBUG", false)
+		backendDefault     = getEnv("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		lockTypeDefault    = getEnv("LOCK_TYPE", "fslock")
+		lockDirDefault     = getEnv("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+		cacheDirDefault    = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		s3BucketDefault    = getEnv("S3_BUCKET", "")
+		s3PrefixDefault    = getEnv("S3_PREFIX", "gobuildcache/")
+		compressionDefault = getEnvBool("COMPRESSION", true)
+		remoteCASDefault   = getEnvBool("REMOTE_CAS", false)
+		goCacheDir         string
+		upload             bool
+		concurrency        int
+	)
+	importFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	importFlags.StringVar(&goCacheDir, "gocache", defaultGoCacheDir(), "Native Go build cache directory to import (env: GOCACHE)")
+	importFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
+	importFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
+	importFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	importFlags.BoolVar(&upload, "upload", false, "Also upload the imported entries to the backend")
+	importFlags.IntVar(&concurrency, "concurrency", getEnvInt("IMPORT_CONCURRENCY", 16), "Maximum number of entries imported in parallel (env: IMPORT_CONCURRENCY)")
+	importFlags.StringVar(&backendType, "backend", backendDefault, "Backend type for -upload: disk, s3 (env: BACKEND_TYPE)")
+	importFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	importFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	importFlags.BoolVar(&compression, "compression", compressionDefault, "Compress uploaded entries like the server does (env: COMPRESSION)")
+	importFlags.BoolVar(&remoteCAS, "remote-cas", remoteCASDefault, "Upload entries in the content-addressed remote layout (env: REMOTE_CAS)")
+	registerS3ClientFlags(importFlags)
+	registerRemoteFlags(importFlags)
+	registerREAPIFlags(importFlags)
+	registerS3StorageFlags(importFlags)
+	registerPackFlags(importFlags)
 
-		backend, err = backends.NewS3(s3Bucket, s3Prefix)
+	importFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import-gocache [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Import the entries of the go command's native build cache (GOCACHE) into the\n")
+		fmt.Fprintf(os.Stderr, "local cache directory, and optionally upload them to the backend.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		importFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG               Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  GOCACHE             Native Go build cache directory\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_TYPE           Deduplication type (memory, fslock)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR            Lock directory for fslock\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR           Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  IMPORT_CONCURRENCY  Maximum number of entries imported in parallel\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE        Backend type (disk, s3, remote, reapi)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET           S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX           S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  COMPRESSION         Enable LZ4 compression (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_CAS          Store remote outputs content-addressed (true/false)\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
+		printPackEnvUsage()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Import the default GOCACHE into the local cache:\n")
+		fmt.Fprintf(os.Stderr, "  %s import-gocache\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Import a specific directory and upload it to S3:\n")
+		fmt.Fprintf(os.Stderr, "  %s import-gocache -gocache=$HOME/.cache/go-build -upload -backend=s3 -s3-bucket=my-cache-bucket\n", os.Args[0])
+	}
 
-	default:
-		return nil, fmt.Errorf("unknown backend type: %s (supported: disk, s3)", backendType)
+	importFlags.Parse(os.Args[2:])
+	if goCacheDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: no native cache directory, set -gocache\n")
+		os.Exit(1)
 	}
 
+	lockingGroup, err := createLockingGroup()
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
 	}
-
-	// Wrap with error backend if error rate is configured
-	if errorRate > 0 {
-		backend = backends.NewError(backend, errorRate)
-		if !quiet {
-			fmt.Fprintf(os.Stderr, "[INFO] Error injection enabled with rate: %.2f%%\n", errorRate*100)
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+	importer := &goCacheImporter{
+		lc:          lc,
+		locker:      lockingGroup,
+		compression: compression,
+		concurrency: concurrency,
+		logger:      newLogger(),
+	}
+	if upload {
+		backend, err := createBackend()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+			os.Exit(1)
 		}
+		importer.backend = backend
 	}
 
-	// Wrap with async backend if enabled
-	if asyncBackend {
-		// Create logger for async backend
-		logLevel := slog.LevelInfo
-		if debug {
-			logLevel = slog.LevelDebug
-		}
-		if quiet {
-			logLevel = slog.LevelWarn
-		}
-		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: logLevel,
-		}))
-		backend = backends.NewAsyncBackendWriter(backend, logger)
-		if !quiet {
-			fmt.Fprintf(os.Stderr, "[INFO] Async backend writer enabled\n")
+	if err := importer.importDir(goCacheDir, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing %s: %v\n", goCacheDir, err)
+		os.Exit(1)
+	}
+	if importer.backend != nil {
+		// Closing the backend flushes buffered uploads such as pending packs.
+		if err := importer.backend.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing backend: %v\n", err)
+			os.Exit(1)
 		}
 	}
-
-	// Wrap with debug backend if debug mode is enabled
-	if debug {
-		backend = backends.NewDebug(backend)
+	if err := lc.saveIndex(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save local cache index: %v\n", err)
 	}
 
-	return backend, nil
+	stats := &importer.stats
+	fmt.Fprintf(os.Stdout, "Imported %d of %d entries (%s), %d already cached, %d invalid, %d failed\n",
+		stats.imported.Load(), stats.entries.Load(), formatBytes(stats.importedBytes.Load()),
+		stats.existing.Load(), stats.invalid.Load(), stats.failed.Load())
+	if upload {
+		fmt.Fprintf(os.Stdout, "Uploaded %d entries (%s), %d failed\n",
+			stats.uploaded.Load(), formatBytes(stats.uploadedBytes.Load()), stats.uploadFailed.Load())
+	}
+	if stats.failed.Load() > 0 || stats.uploadFailed.Load() > 0 {
+		os.Exit(1)
+	}
 }
 
-func createLockingGroup() (locking.Group, error) {
-	lockingType = strings.ToLower(lockingType)
+func runPushCommand() {
+	// Get defaults from environment variables.
+	var (
+		pushFlags          = flag.NewFlagSet("push", flag.ExitOnError)
+		debugDefault       = getEnvBool("DEBUG", false)
+		backendDefault     = getEnv("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		cacheDirDefault    = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		s3BucketDefault    = getEnv("S3_BUCKET", "")
+		s3PrefixDefault    = getEnv("S3_PREFIX", "gobuildcache/")
+		compressionDefault = getEnvBool("COMPRESSION", true)
+		remoteCASDefault   = getEnvBool("REMOTE_CAS", false)
+		concurrency        int
+	)
+	pushFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	pushFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	pushFlags.IntVar(&concurrency, "concurrency", getEnvInt("PUSH_CONCURRENCY", 16), "Maximum number of entries checked and uploaded in parallel (env: PUSH_CONCURRENCY)")
+	pushFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: s3 (env: BACKEND_TYPE)")
+	pushFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	pushFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	pushFlags.BoolVar(&compression, "compression", compressionDefault, "Compress uploaded entries like the server does (env: COMPRESSION)")
+	pushFlags.BoolVar(&remoteCAS, "remote-cas", remoteCASDefault, "Upload entries in the content-addressed remote layout (env: REMOTE_CAS)")
+	registerS3ClientFlags(pushFlags)
+	registerRemoteFlags(pushFlags)
+	registerREAPIFlags(pushFlags)
+	registerS3StorageFlags(pushFlags)
+	registerPackFlags(pushFlags)
 
-	switch lockingType {
-	case "memory", "":
-		// Default: in-memory singleflight
-		return locking.NewMemLock(), nil
+	pushFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s push [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Upload the entries of the local cache directory that are missing from the\n")
+		fmt.Fprintf(os.Stderr, "backend, such as entries whose upload failed while the backend was unreachable.\n")
+		fmt.Fprintf(os.Stderr, "The cache can be in use while it's pushed.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		pushFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG             Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR         Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  PUSH_CONCURRENCY  Maximum number of entries processed in parallel\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE      Backend type (s3)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET         S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX         S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  COMPRESSION       Enable LZ4 compression (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_CAS        Store remote outputs content-addressed (true/false)\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
+		printPackEnvUsage()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Upload whatever S3 is missing after an outage:\n")
+		fmt.Fprintf(os.Stderr, "  %s push -backend=s3 -s3-bucket=my-cache-bucket\n", os.Args[0])
+	}
 
-	case "fslock", "fs":
-		// Filesystem-backed deduplication
-		group, err := locking.NewFlockGroup(lockDir)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create fslock group: %w", err)
-		}
-		return group, nil
+	pushFlags.Parse(os.Args[2:])
+	if strings.ToLower(backendType) == "disk" {
+		fmt.Fprintf(os.Stderr, "Error: the disk backend only stores entries locally, so there is nothing to push to\n")
+		os.Exit(1)
+	}
 
-	case "noop":
-		// No deduplication (useful for testing)
-		return locking.NewNoOpGroup(), nil
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+	backend, err := createBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
 
-	default:
-		return nil, fmt.Errorf("unknown locking type: %s (supported: memory, fslock, noop)", lockingType)
+	pusher := &localPusher{
+		lc:          lc,
+		backend:     backend,
+		compression: compression,
+		concurrency: concurrency,
+		logger:      newLogger(),
+	}
+	if err := pusher.push(os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Error pushing %s: %v\n", cacheDir, err)
+		os.Exit(1)
+	}
+	// Closing the backend flushes buffered uploads such as pending packs.
+	if err := backend.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing backend: %v\n", err)
+		os.Exit(1)
 	}
-}
 
-// getEnv gets an environment variable or returns a default value.
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	stats := &pusher.stats
+	fmt.Fprintf(os.Stdout, "Uploaded %d of %d entries (%s), %d already in the backend, %d skipped, %d failed\n",
+		stats.uploaded.Load(), stats.entries.Load(), formatBytes(stats.uploadedBytes.Load()),
+		stats.present.Load(), stats.skipped.Load(), stats.failed.Load())
+	if stats.failed.Load() > 0 {
+		os.Exit(1)
 	}
-	return defaultValue
 }
 
-// getEnvBool gets a boolean environment variable or returns a default value.
-// Accepts: true, false, 1, 0, yes, no (case insensitive).
+func runRepackCommand() {
+	// Get defaults from environment variables.
+	var (
+		repackFlags     = flag.NewFlagSet("repack", flag.ExitOnError)
+		debugDefault    = getEnvBool("DEBUG", false)
+		backendDefault  = getEnv("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		cacheDirDefault = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		s3BucketDefault = getEnv("S3_BUCKET", "")
+		s3PrefixDefault = getEnv("S3_PREFIX", "gobuildcache/")
+		packDefaults    = backends.DefaultPackOptions()
+	)
+	repackFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	repackFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory, where pack indexes are cached (env: CACHE_DIR)")
+	repackFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: s3 (env: BACKEND_TYPE)")
+	repackFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	repackFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	repackFlags.Var(newByteSizeValue(&packSize, getEnvBytes("PACK_SIZE", packDefaults.PackSize)), "pack-size", "Size of the pack files to write (env: PACK_SIZE)")
+	registerS3ClientFlags(repackFlags)
+	registerRemoteFlags(repackFlags)
+	registerREAPIFlags(repackFlags)
+	registerS3StorageFlags(repackFlags)
+
+	repackFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s repack [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Compact the pack files written with -pack. Packs that are less than half full or\n")
+		fmt.Fprintf(os.Stderr, "mostly hold superseded entries are rewritten into full packs and deleted, and\n")
+		fmt.Fprintf(os.Stderr, "pack indexes whose pack was trimmed are removed.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		repackFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (s3)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  PACK_SIZE      Size of the pack files to write\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Compact the packs in S3, e.g. from a nightly job:\n")
+		fmt.Fprintf(os.Stderr, "  %s repack -backend=s3 -s3-bucket=my-cache-bucket\n", os.Args[0])
+	}
+
+	repackFlags.Parse(os.Args[2:])
+
+	storage, err := createStorageBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	pack := backends.NewPack(storage, backends.PackOptions{
+		PackSize: packSize,
+		IndexDir: filepath.Join(cacheDir, localMetaDir, "packs"),
+	}, newLogger())
+	stats, err := pack.Repack()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error repacking: %v\n", err)
+		os.Exit(1)
+	}
+	written := pack.PackStats().Packs
+	fmt.Fprintf(os.Stdout, "Repacked %d of %d packs into %d: moved %d entries (%s), dropped %s of superseded entries\n",
+		stats.Repacked, stats.Packs, written, stats.Objects, formatBytes(stats.Bytes), formatBytes(stats.DroppedBytes))
+	if stats.Missing > 0 {
+		fmt.Fprintf(os.Stdout, "Removed %d pack indexes whose pack no longer exists\n", stats.Missing)
+	}
+}
+
+func runBuildKeyFilterCommand() {
+	// Get defaults from environment variables.
+	var (
+		filterFlags              = flag.NewFlagSet("build-key-filter", flag.ExitOnError)
+		debugDefault             = getEnvBool("DEBUG", false)
+		backendDefault           = getEnv("BACKEND_TYPE", getEnv("BACKEND", "disk"))
+		cacheDirDefault          = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		s3BucketDefault          = getEnv("S3_BUCKET", "")
+		s3PrefixDefault          = getEnv("S3_PREFIX", "gobuildcache/")
+		remoteCASDefault         = getEnvBool("REMOTE_CAS", false)
+		falsePositiveRateDefault = getEnvFloat("KEY_FILTER_FALSE_POSITIVE_RATE", backends.DefaultKeyFilterFalsePositiveRate)
+		falsePositiveRate        float64
+	)
+	filterFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	filterFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory, where pack indexes are cached (env: CACHE_DIR)")
+	filterFlags.StringVar(&backendType, "backend", backendDefault, "Backend type: s3, remote (env: BACKEND_TYPE)")
+	filterFlags.StringVar(&s3Bucket, "s3-bucket", s3BucketDefault, "S3 bucket name (required for s3 backend) (env: S3_BUCKET)")
+	filterFlags.StringVar(&s3Prefix, "s3-prefix", s3PrefixDefault, "S3 key prefix (optional) (env: S3_PREFIX)")
+	filterFlags.BoolVar(&remoteCAS, "remote-cas", remoteCASDefault, "The cache stores remote entries content-addressed (env: REMOTE_CAS)")
+	filterFlags.Float64Var(&falsePositiveRate, "false-positive-rate", falsePositiveRateDefault, "Share of absent keys that the filter reports as possibly present (env: KEY_FILTER_FALSE_POSITIVE_RATE)")
+	registerS3ClientFlags(filterFlags)
+	registerRemoteFlags(filterFlags)
+	registerREAPIFlags(filterFlags)
+	registerS3StorageFlags(filterFlags)
+	registerPackFlags(filterFlags)
+
+	filterFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s build-key-filter [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "List every key in the backend and publish a bloom filter of them. Servers run\n")
+		fmt.Fprintf(os.Stderr, "with -key-filter download it at startup and answer GETs for keys that it\n")
+		fmt.Fprintf(os.Stderr, "doesn't contain without a backend request. Use the same -remote-cas and -pack\n")
+		fmt.Fprintf(os.Stderr, "settings as the servers.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		filterFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  BACKEND_TYPE   Backend type (s3)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET      S3 bucket name\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX      S3 key prefix\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_CAS     The cache stores remote entries content-addressed (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  KEY_FILTER_FALSE_POSITIVE_RATE  False positive rate of the filter (e.g. 0.01)\n")
+		printS3ClientEnvUsage()
+		printRemoteEnvUsage()
+		printREAPIEnvUsage()
+		printS3StorageEnvUsage()
+		printPackEnvUsage()
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Publish the key filter, e.g. from a job that runs every 30 minutes:\n")
+		fmt.Fprintf(os.Stderr, "  %s build-key-filter -backend=s3 -s3-bucket=my-cache-bucket\n", os.Args[0])
+	}
+
+	filterFlags.Parse(os.Args[2:])
+
+	backend, err := createLayoutBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating backend: %v\n", err)
+		os.Exit(1)
+	}
+
+	stats, err := backends.BuildKeyFilter(backend, falsePositiveRate)
+	// Close explicitly, so that a packed filter is written out.
+	if closeErr := backend.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building key filter: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Published a key filter of %d keys (%s)\n", stats.Keys, formatBytes(stats.Bytes))
+}
+
+func runServeCommand() {
+	// Get defaults from environment variables.
+	var (
+		serveFlags        = flag.NewFlagSet("serve", flag.ExitOnError)
+		debugDefault      = getEnvBool("DEBUG", false)
+		printStatsDefault = getEnvBool("PRINT_STATS", true)
+		lockTypeDefault   = getEnv("LOCK_TYPE", "fslock")
+		lockDirDefault    = getEnv("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+		cacheDirDefault   = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		listenDefault     = getEnv("SERVE_LISTEN", ":8080")
+		maxSizeDefault    = getEnvBytes("SERVE_MAX_SIZE", 0)
+		tokensFileDefault = getEnv("SERVE_TOKENS_FILE", "")
+		tlsCertDefault    = getEnv("SERVE_TLS_CERT", "")
+		tlsKeyDefault     = getEnv("SERVE_TLS_KEY", "")
+		listen            string
+		maxSize           int64
+		tokensFile        string
+		tlsCert           string
+		tlsKey            string
+	)
+	serveFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	serveFlags.BoolVar(&printStats, "stats", printStatsDefault, "Print per-client statistics on exit (env: PRINT_STATS)")
+	serveFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
+	serveFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
+	serveFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Cache directory to serve (env: CACHE_DIR)")
+	serveFlags.StringVar(&listen, "listen", listenDefault, "Address to listen on (env: SERVE_LISTEN)")
+	serveFlags.Var(newByteSizeValue(&maxSize, maxSizeDefault), "max-size", "Evict the least recently used entries once the cache grows past this size, 0 for unlimited (env: SERVE_MAX_SIZE)")
+	serveFlags.StringVar(&tokensFile, "tokens-file", tokensFileDefault, "File with one \"<client name> <token>\" pair per line; clients must send one of the tokens (env: SERVE_TOKENS_FILE)")
+	serveFlags.StringVar(&tlsCert, "tls-cert", tlsCertDefault, "TLS certificate file, to serve HTTPS (env: SERVE_TLS_CERT)")
+	serveFlags.StringVar(&tlsKey, "tls-key", tlsKeyDefault, "TLS key file, to serve HTTPS (env: SERVE_TLS_KEY)")
+
+	serveFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Serve a cache directory over HTTP, so that servers run with -backend=remote\n")
+		fmt.Fprintf(os.Stderr, "and -remote-url can share it as their backend.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		serveFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG              Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  PRINT_STATS        Print per-client statistics on exit (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_TYPE          Deduplication type (memory, fslock)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR           Lock directory for fslock\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR          Cache directory to serve\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_LISTEN       Address to listen on\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_MAX_SIZE     Maximum cache size (e.g. 500GB)\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_TOKENS_FILE  File with client names and tokens\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_TLS_CERT     TLS certificate file\n")
+		fmt.Fprintf(os.Stderr, "  SERVE_TLS_KEY      TLS key file\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Serve up to 200GB to clients with a token:\n")
+		fmt.Fprintf(os.Stderr, "  %s serve -cache-dir=/var/cache/gobuildcache -max-size=200GB -tokens-file=/etc/gobuildcache/tokens\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  # Use it from a build machine:\n")
+		fmt.Fprintf(os.Stderr, "  REMOTE_TOKEN=... %s -backend=remote -remote-url=http://cache:8080\n", os.Args[0])
+	}
+
+	serveFlags.Parse(os.Args[2:])
+	if (tlsCert == "") != (tlsKey == "") {
+		fmt.Fprintf(os.Stderr, "Error: -tls-cert and -tls-key must be set together\n")
+		os.Exit(1)
+	}
+
+	logger := newLogger()
+	var tokens map[string]string
+	if tokensFile != "" {
+		var err error
+		if tokens, err = loadServeTokens(tokensFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading tokens: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		logger.Warn("no tokens file configured, anyone who can reach the server can use the cache")
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+	lc, err := newLocalCache(cacheDir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening cache directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	s := newCacheServer(lc, lockingGroup, tokens, maxSize, logger)
+	err = s.listenAndServe(listen, tlsCert, tlsKey)
+	if printStats {
+		s.writeStats(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving cache: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runExportCommand() {
+	// Get defaults from environment variables.
+	var (
+		exportFlags     = flag.NewFlagSet("export", flag.ExitOnError)
+		debugDefault    = getEnvBool("DEBUG", false)
+		cacheDirDefault = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+		usedWithin      time.Duration
+	)
+	exportFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	exportFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+	exportFlags.Var(newDurationValue(&usedWithin, getEnvDuration("EXPORT_USED_WITHIN", 0)), "used-within", "Only export entries used within this duration, e.g. 7d, 0 for all (env: EXPORT_USED_WITHIN)")
+
+	exportFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [flags] ARCHIVE\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Export the local cache directory to a compressed, checksummed archive, or to\n")
+		fmt.Fprintf(os.Stderr, "standard output if ARCHIVE is \"-\". The cache can be in use while it's exported.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		exportFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG               Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR           Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "  EXPORT_USED_WITHIN  Only export entries used within this duration\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Export the entries used in the last week:\n")
+		fmt.Fprintf(os.Stderr, "  %s export -used-within=7d gobuildcache.tar.lz4\n", os.Args[0])
+	}
+
+	exportFlags.Parse(os.Args[2:])
+	if exportFlags.NArg() != 1 {
+		exportFlags.Usage()
+		os.Exit(2)
+	}
+
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	var (
+		path = exportFlags.Arg(0)
+		out  = os.Stdout
+		// Write to a temp file so that a failed export doesn't leave a truncated
+		// archive behind.
+		tmpPath = path + ".tmp"
+	)
+	if path != "-" {
+		out, err = os.Create(tmpPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	stats, err := lc.exportArchive(out, usedWithin, time.Now())
+	if path != "-" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+	}
+	if err != nil {
+		if path != "-" {
+			os.Remove(tmpPath)
+		}
+		fmt.Fprintf(os.Stderr, "Error exporting local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The archive may be going to standard output.
+	fmt.Fprintf(os.Stderr, "Exported %d of %d entries (%s), skipped %d not used within %s\n",
+		stats.Copied, stats.Entries, formatBytes(stats.CopiedBytes), stats.Skipped, usedWithin)
+}
+
+func runImportCommand() {
+	// Get defaults from environment variables.
+	var (
+		importFlags     = flag.NewFlagSet("import", flag.ExitOnError)
+		debugDefault    = getEnvBool("DEBUG", false)
+		lockTypeDefault = getEnv("LOCK_TYPE", "fslock")
+		lockDirDefault  = getEnv("LOCK_DIR", filepath.Join(os.TempDir(), "gobuildcache", "locks"))
+		cacheDirDefault = getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "gobuildcache", "cache"))
+	)
+	importFlags.BoolVar(&debug, "debug", debugDefault, "Enable debug logging to stderr (env: DEBUG)")
+	importFlags.StringVar(&lockingType, "lock-type", lockTypeDefault, "Locking type: memory (in-memory), fslock (filesystem) (env: LOCK_TYPE)")
+	importFlags.StringVar(&lockDir, "lock-dir", lockDirDefault, "Lock directory for fslock (env: LOCK_DIR)")
+	importFlags.StringVar(&cacheDir, "cache-dir", cacheDirDefault, "Local cache directory (env: CACHE_DIR)")
+
+	importFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import [flags] ARCHIVE\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Import an archive written by export into the local cache directory, reading\n")
+		fmt.Fprintf(os.Stderr, "from standard input if ARCHIVE is \"-\". Entries that are already cached are\n")
+		fmt.Fprintf(os.Stderr, "skipped, and the cache can be in use while the archive is imported.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags (can also be set via environment variables):\n")
+		importFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nEnvironment Variables:\n")
+		fmt.Fprintf(os.Stderr, "  DEBUG          Enable debug logging (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_TYPE      Deduplication type (memory, fslock)\n")
+		fmt.Fprintf(os.Stderr, "  LOCK_DIR       Lock directory for fslock\n")
+		fmt.Fprintf(os.Stderr, "  CACHE_DIR      Local cache directory\n")
+		fmt.Fprintf(os.Stderr, "\nNote: Command-line flags take precedence over environment variables.\n")
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Restore an archive saved by a previous CI run:\n")
+		fmt.Fprintf(os.Stderr, "  %s import gobuildcache.tar.lz4\n", os.Args[0])
+	}
+
+	importFlags.Parse(os.Args[2:])
+	if importFlags.NArg() != 1 {
+		importFlags.Usage()
+		os.Exit(2)
+	}
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+	lc, err := newLocalCache(cacheDir, newLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	in := os.Stdin
+	if path := importFlags.Arg(0); path != "-" {
+		in, err = os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+	stats, err := lc.importArchive(bufio.NewReader(in), lockingGroup)
+	if saveErr := lc.saveIndex(); saveErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save local cache index: %v\n", saveErr)
+	}
+	fmt.Fprintf(os.Stdout, "Imported %d of %d entries (%s), %d already cached\n",
+		stats.Copied, stats.Entries, formatBytes(stats.CopiedBytes), stats.Skipped)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing archive: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "A remote caching server for Go builds.\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  (no command)    Run the cache server (default)\n")
+	fmt.Fprintf(os.Stderr, "  clear           Clear both local and remote cache entries\n")
+	fmt.Fprintf(os.Stderr, "  clear-local     Clear only local cache directory\n")
+	fmt.Fprintf(os.Stderr, "  clear-remote    Clear only remote backend cache\n")
+	fmt.Fprintf(os.Stderr, "  trim-local      Remove old or least recently used local cache entries\n")
+	fmt.Fprintf(os.Stderr, "  trim-remote     Remove old or least recently used remote cache entries\n")
+	fmt.Fprintf(os.Stderr, "  fsck            Check the local cache directory for damaged entries\n")
+	fmt.Fprintf(os.Stderr, "  import-gocache  Import entries from the go command's native cache\n")
+	fmt.Fprintf(os.Stderr, "  push            Upload local cache entries missing from the backend\n")
+	fmt.Fprintf(os.Stderr, "  repack          Compact the pack files in the backend\n")
+	fmt.Fprintf(os.Stderr, "  daemon          Run the shared daemon used by servers started with -daemon\n")
+	fmt.Fprintf(os.Stderr, "  build-key-filter  Publish a filter of the keys in the backend for instant misses\n")
+	fmt.Fprintf(os.Stderr, "  serve           Serve a cache directory over HTTP for the remote backend\n")
+	fmt.Fprintf(os.Stderr, "  export          Export the local cache to an archive\n")
+	fmt.Fprintf(os.Stderr, "  import          Import a local cache archive\n")
+	fmt.Fprintf(os.Stderr, "  help            Show this help message\n\n")
+	fmt.Fprintf(os.Stderr, "Configuration:\n")
+	fmt.Fprintf(os.Stderr, "  Flags can be set via command-line arguments or environment variables.\n")
+	fmt.Fprintf(os.Stderr, "  Command-line flags take precedence over environment variables.\n\n")
+	fmt.Fprintf(os.Stderr, "Run '%s [command] -h' for more information about a command.\n", os.Args[0])
+}
+
+func runServer() {
+	// Create backend
+	backend, err := createBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+
+	peers, err := createPeerGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring peers: %v\n", err)
+		os.Exit(1)
+	}
+
+	prog, err := NewCacheProg(backend, lockingGroup, cacheDir, debug, printStats, compression, localMaxSize, localMaxAge, manifestName, prefetchManifest,
+		negativeCacheTTL, negativeCacheShared, peers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache program: %v\n", err)
+		os.Exit(1)
+	}
+	if err := prog.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running cache program: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runDaemon() {
+	backend, err := createBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	lockingGroup, err := createLockingGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating lock group: %v\n", err)
+		os.Exit(1)
+	}
+
+	peers, err := createPeerGroup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring peers: %v\n", err)
+		os.Exit(1)
+	}
+
+	prog, err := NewCacheProg(backend, lockingGroup, cacheDir, debug, printStats, compression, localMaxSize, localMaxAge, manifestName, prefetchManifest,
+		negativeCacheTTL, negativeCacheShared, peers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache program: %v\n", err)
+		os.Exit(1)
+	}
+	if err := prog.RunDaemon(daemonSocket, daemonIdleTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running daemon: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runClear() {
+	// Create backend
+	backend, err := createBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache backend: %v\n", err)
+		os.Exit(1)
+	}
+	defer backend.Close()
+
+	// Clear the backend (remote storage)
+	if err := backend.Clear(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error clearing backend cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Clear the local cache directory
+	if err := clearLocalCache(cacheDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error clearing local cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "Cache cleared successfully\n")
+}
+
+// clearLocalCache removes all entries from the local cache directory.
+func clearLocalCache(cacheDir string) error {
+	// Remove the entire directory and recreate it
+	// os.RemoveAll is idempotent - it doesn't error if path doesn't exist
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return fmt.Errorf("failed to remove cache directory: %w", err)
+	}
+
+	// Recreate the directory
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to recreate cache directory: %w", err)
+	}
+
+	// Make running processes drop their index of the removed entries.
+	if _, err := bumpLocalGeneration(cacheDir); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func createBackend() (backends.Backend, error) {
+	backend, err := createLayoutBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	// Answer GETs for keys that the published key filter doesn't contain. This
+	// wraps the layout so that the filter holds the keys the server asks for.
+	if keyFilterEnabled {
+		backend = backends.NewKeyFilter(backend, keyFilterMaxAge, isEntryKey, newLogger())
+	}
+
+	// Wrap with error backend if error rate is configured
+	if errorRate > 0 {
+		backend = backends.NewError(backend, errorRate)
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "[INFO] Error injection enabled with rate: %.2f%%\n", errorRate*100)
+		}
+	}
+
+	// Wrap with async backend if enabled
+	if asyncBackend {
+		backend = backends.NewAsyncBackendWriter(backend, newLogger())
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "[INFO] Async backend writer enabled\n")
+		}
+	}
+
+	// Wrap with debug backend if debug mode is enabled
+	if debug {
+		backend = backends.NewDebug(backend)
+	}
+
+	return backend, nil
+}
+
+// createLayoutBackend creates the storage backend wrapped in the layers that
+// decide how entries are laid out in it, so that its keys are the ones the
+// server uses.
+func createLayoutBackend() (backends.Backend, error) {
+	backend, err := createStorageBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	// Pack small objects if enabled. Like CAS, this has to wrap the storage backend
+	// so that it can read ranges and list pack indexes, and CAS goes on top so that
+	// small blobs are packed too.
+	if packEnabled {
+		backend = backends.NewPack(backend, backends.PackOptions{
+			Threshold: packThreshold,
+			PackSize:  packSize,
+			IndexDir:  filepath.Join(cacheDir, localMetaDir, "packs"),
+		}, newLogger())
+	}
+
+	// Store outputs content-addressed if enabled. This has to wrap the storage
+	// backend directly so that it can check for existing blobs.
+	if remoteCAS {
+		backend = backends.NewCAS(backend)
+	}
+	return backend, nil
+}
+
+// createStorageBackend creates the backend selected by backendType, without any
+// of the wrappers added by createBackend.
+func createStorageBackend() (backends.Backend, error) {
+	backendType = strings.ToLower(backendType)
+
+	var backend backends.Backend
+	var err error
+
+	switch backendType {
+	case "disk":
+		// Use no-op backend - local caching is handled by server.go
+		backend = backends.NewNoop()
+
+	case "s3":
+		if s3Bucket == "" {
+			return nil, fmt.Errorf("S3 bucket is required for S3 backend (set via -s3-bucket flag or S3_BUCKET env var)")
+		}
+
+		var customerKey []byte
+		if s3CustomerKeyFile != "" {
+			customerKey, err = readCustomerKey(s3CustomerKeyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tags, err := parseTags(s3Tags)
+		if err != nil {
+			return nil, err
+		}
+
+		backend, err = backends.NewS3(s3Bucket, s3Prefix, backends.S3Options{
+			Endpoint:           s3Endpoint,
+			Region:             s3Region,
+			UsePathStyle:       s3PathStyle,
+			Profile:            s3Profile,
+			CredentialsFile:    s3CredentialsFile,
+			ConfigFile:         s3ConfigFile,
+			RoleARN:            s3RoleARN,
+			ExternalID:         s3ExternalID,
+			ConnectTimeout:     s3ConnectTimeout,
+			RequestTimeout:     s3RequestTimeout,
+			MaxIdleConns:       s3MaxIdleConns,
+			SkipBucketCheck:    s3SkipBucketCheck,
+			Encryption:         strings.ToLower(s3Encryption),
+			KMSKeyID:           s3KMSKeyID,
+			CustomerKey:        customerKey,
+			StorageClass:       s3StorageClass,
+			Tags:               tags,
+			ACL:                s3ACL,
+			SkipExisting:       strings.ToLower(s3SkipExisting),
+			TrackAccess:        s3TrackAccess,
+			MultipartThreshold: s3MultipartThreshold,
+			PartSize:           s3PartSize,
+			Concurrency:        s3Concurrency,
+		})
+
+	case "remote":
+		if remoteURL == "" {
+			return nil, fmt.Errorf("remote URL is required for remote backend (set via -remote-url flag or REMOTE_URL env var)")
+		}
+		backend, err = backends.NewRemote(remoteURL, backends.RemoteOptions{
+			Token:          remoteToken,
+			RequestTimeout: remoteTimeout,
+		})
+
+	case "reapi":
+		if reapiURL == "" {
+			return nil, fmt.Errorf("REAPI URL is required for reapi backend (set via -reapi-url flag or REAPI_URL env var)")
+		}
+		headers, err := parseKeyValues(reapiHeaders, "REAPI header")
+		if err != nil {
+			return nil, err
+		}
+		backend, err = backends.NewREAPI(reapiURL, backends.REAPIOptions{
+			InstanceName:        reapiInstance,
+			Headers:             headers,
+			ByteStreamThreshold: reapiByteStreamThreshold,
+			RequestTimeout:      remoteTimeout,
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown backend type: %s (supported: disk, s3, remote, reapi)", backendType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// registerS3ClientFlags registers the flags that control how the S3 client connects
+// and authenticates. They're shared by every command that talks to the backend.
+func registerS3ClientFlags(fs *flag.FlagSet) {
+	var (
+		endpointDefault        = getEnv("S3_ENDPOINT", "")
+		regionDefault          = getEnv("S3_REGION", "")
+		pathStyleDefault       = getEnvBool("S3_PATH_STYLE", false)
+		profileDefault         = getEnv("S3_PROFILE", "")
+		credentialsFileDefault = getEnv("S3_CREDENTIALS_FILE", "")
+		configFileDefault      = getEnv("S3_CONFIG_FILE", "")
+		roleARNDefault         = getEnv("S3_ROLE_ARN", "")
+		externalIDDefault      = getEnv("S3_EXTERNAL_ID", "")
+		connectTimeoutDefault  = getEnvDuration("S3_CONNECT_TIMEOUT", 0)
+		requestTimeoutDefault  = getEnvDuration("S3_REQUEST_TIMEOUT", 0)
+		maxIdleConnsDefault    = getEnvInt("S3_MAX_IDLE_CONNS", backends.DefaultS3Options().MaxIdleConns)
+		skipBucketCheckDefault = getEnvBool("S3_SKIP_BUCKET_CHECK", false)
+	)
+	fs.StringVar(&s3Endpoint, "s3-endpoint", endpointDefault, "S3 endpoint URL, e.g. for Tigris or MinIO (env: S3_ENDPOINT)")
+	fs.StringVar(&s3Region, "s3-region", regionDefault, "S3 region, defaults to the AWS SDK's region resolution (env: S3_REGION)")
+	fs.BoolVar(&s3PathStyle, "s3-path-style", pathStyleDefault, "Use path-style S3 addressing (env: S3_PATH_STYLE)")
+	fs.StringVar(&s3Profile, "s3-profile", profileDefault, "Named AWS profile to load credentials and config from (env: S3_PROFILE)")
+	fs.StringVar(&s3CredentialsFile, "s3-credentials-file", credentialsFileDefault, "Path to an AWS shared credentials file (env: S3_CREDENTIALS_FILE)")
+	fs.StringVar(&s3ConfigFile, "s3-config-file", configFileDefault, "Path to an AWS shared config file (env: S3_CONFIG_FILE)")
+	fs.StringVar(&s3RoleARN, "s3-role-arn", roleARNDefault, "IAM role ARN to assume for S3 access (env: S3_ROLE_ARN)")
+	fs.StringVar(&s3ExternalID, "s3-external-id", externalIDDefault, "External ID to use when assuming -s3-role-arn (env: S3_EXTERNAL_ID)")
+	fs.DurationVar(&s3ConnectTimeout, "s3-connect-timeout", connectTimeoutDefault, "Timeout for establishing S3 connections, 0 for the SDK default (env: S3_CONNECT_TIMEOUT)")
+	fs.DurationVar(&s3RequestTimeout, "s3-request-timeout", requestTimeoutDefault, "Timeout for a complete S3 request including the body, 0 for none (env: S3_REQUEST_TIMEOUT)")
+	fs.IntVar(&s3MaxIdleConns, "s3-max-idle-conns", maxIdleConnsDefault, "Maximum idle keep-alive connections to S3 (env: S3_MAX_IDLE_CONNS)")
+	fs.BoolVar(&s3SkipBucketCheck, "s3-skip-bucket-check", skipBucketCheckDefault, "Skip the HeadBucket access check at startup (env: S3_SKIP_BUCKET_CHECK)")
+}
+
+// printS3ClientEnvUsage prints the environment variables for registerS3ClientFlags.
+func printS3ClientEnvUsage() {
+	fmt.Fprintf(os.Stderr, "  S3_ENDPOINT          S3 endpoint URL\n")
+	fmt.Fprintf(os.Stderr, "  S3_REGION            S3 region\n")
+	fmt.Fprintf(os.Stderr, "  S3_PATH_STYLE        Use path-style addressing (true/false)\n")
+	fmt.Fprintf(os.Stderr, "  S3_PROFILE           Named AWS profile\n")
+	fmt.Fprintf(os.Stderr, "  S3_CREDENTIALS_FILE  AWS shared credentials file\n")
+	fmt.Fprintf(os.Stderr, "  S3_CONFIG_FILE       AWS shared config file\n")
+	fmt.Fprintf(os.Stderr, "  S3_ROLE_ARN          IAM role ARN to assume\n")
+	fmt.Fprintf(os.Stderr, "  S3_EXTERNAL_ID       External ID for role assumption\n")
+	fmt.Fprintf(os.Stderr, "  S3_CONNECT_TIMEOUT   Connection timeout (e.g. 5s)\n")
+	fmt.Fprintf(os.Stderr, "  S3_REQUEST_TIMEOUT   Request timeout (e.g. 2m)\n")
+	fmt.Fprintf(os.Stderr, "  S3_MAX_IDLE_CONNS    Maximum idle connections\n")
+	fmt.Fprintf(os.Stderr, "  S3_SKIP_BUCKET_CHECK Skip the startup HeadBucket check (true/false)\n")
+}
+
+// registerS3StorageFlags registers the flags that control how objects are stored
+// in S3: encryption, storage class, tags and ACLs.
+func registerS3StorageFlags(fs *flag.FlagSet) {
+	var (
+		encryptionDefault      = getEnv("S3_SSE", "")
+		kmsKeyIDDefault        = getEnv("S3_SSE_KMS_KEY_ID", "")
+		customerKeyFileDefault = getEnv("S3_SSE_C_KEY_FILE", "")
+		storageClassDefault    = getEnv("S3_STORAGE_CLASS", "")
+		tagsDefault            = getEnv("S3_TAGS", "")
+		aclDefault             = getEnv("S3_ACL", "")
+		skipExistingDefault    = getEnv("S3_SKIP_EXISTING", "")
+	)
+	fs.StringVar(&s3Encryption, "s3-sse", encryptionDefault, "Server-side encryption for S3 objects: sse-s3, sse-kms, sse-c (env: S3_SSE)")
+	fs.StringVar(&s3KMSKeyID, "s3-sse-kms-key-id", kmsKeyIDDefault, "KMS key ID or ARN for sse-kms encryption (env: S3_SSE_KMS_KEY_ID)")
+	fs.StringVar(&s3CustomerKeyFile, "s3-sse-c-key-file", customerKeyFileDefault, "File containing the 256-bit key for sse-c encryption, raw or base64 (env: S3_SSE_C_KEY_FILE)")
+	fs.StringVar(&s3StorageClass, "s3-storage-class", storageClassDefault, "Storage class for S3 objects, e.g. STANDARD_IA (env: S3_STORAGE_CLASS)")
+	fs.StringVar(&s3Tags, "s3-tags", tagsDefault, "Comma-separated key=value tags for S3 objects; values may reference env vars like ${GITHUB_RUN_ID} (env: S3_TAGS)")
+	fs.StringVar(&s3ACL, "s3-acl", aclDefault, "Canned ACL for S3 objects, e.g. bucket-owner-full-control (env: S3_ACL)")
+	fs.StringVar(&s3SkipExisting, "s3-skip-existing", skipExistingDefault, "Skip uploading objects that already exist in S3: if-none-match (conditional writes) or head (env: S3_SKIP_EXISTING)")
+}
+
+// registerPackFlags registers the flags for packing small objects, which apply to
+// every command that uploads entries.
+func registerPackFlags(fs *flag.FlagSet) {
+	var (
+		defaults         = backends.DefaultPackOptions()
+		enabledDefault   = getEnvBool("PACK", false)
+		thresholdDefault = getEnvBytes("PACK_THRESHOLD", defaults.Threshold)
+		sizeDefault      = getEnvBytes("PACK_SIZE", defaults.PackSize)
+	)
+	fs.BoolVar(&packEnabled, "pack", enabledDefault, "Upload small entries in pack files and read them back with ranged GETs (env: PACK)")
+	fs.Var(newByteSizeValue(&packThreshold, thresholdDefault), "pack-threshold", "Largest entry that is packed, after compression (env: PACK_THRESHOLD)")
+	fs.Var(newByteSizeValue(&packSize, sizeDefault), "pack-size", "Size at which a pack file is uploaded (env: PACK_SIZE)")
+}
+
+// registerRemoteFlags registers the flags of the remote backend, which stores
+// entries on a server started with the serve command.
+func registerRemoteFlags(fs *flag.FlagSet) {
+	var (
+		urlDefault     = getEnv("REMOTE_URL", "")
+		tokenDefault   = getEnv("REMOTE_TOKEN", "")
+		timeoutDefault = getEnvDuration("REMOTE_TIMEOUT", 5*time.Minute)
+	)
+	fs.StringVar(&remoteURL, "remote-url", urlDefault, "URL of the cache server for the remote backend, e.g. http://cache:8080 (env: REMOTE_URL)")
+	fs.StringVar(&remoteToken, "remote-token", tokenDefault, "Token to authenticate to the cache server with (env: REMOTE_TOKEN)")
+	fs.DurationVar(&remoteTimeout, "remote-timeout", timeoutDefault, "Timeout for a complete request to the cache server, 0 for none (env: REMOTE_TIMEOUT)")
+}
+
+// printRemoteEnvUsage prints the environment variables for registerRemoteFlags.
+func printRemoteEnvUsage() {
+	fmt.Fprintf(os.Stderr, "  REMOTE_URL           URL of the cache server\n")
+	fmt.Fprintf(os.Stderr, "  REMOTE_TOKEN         Token for the cache server\n")
+	fmt.Fprintf(os.Stderr, "  REMOTE_TIMEOUT       Request timeout for the cache server (e.g. 5m)\n")
+}
+
+// registerREAPIFlags registers the flags of the reapi backend, which stores
+// entries in the action cache and CAS of a Remote Execution API server.
+func registerREAPIFlags(fs *flag.FlagSet) {
+	var (
+		urlDefault       = getEnv("REAPI_URL", "")
+		instanceDefault  = getEnv("REAPI_INSTANCE", "")
+		headersDefault   = getEnv("REAPI_HEADERS", "")
+		thresholdDefault = getEnvBytes("REAPI_BYTESTREAM_THRESHOLD", backends.DefaultREAPIOptions().ByteStreamThreshold)
+	)
+	fs.StringVar(&reapiURL, "reapi-url", urlDefault, "URL of the REAPI server for the reapi backend, e.g. grpcs://remote.buildbuddy.io (env: REAPI_URL)")
+	fs.StringVar(&reapiInstance, "reapi-instance", instanceDefault, "REAPI instance name (env: REAPI_INSTANCE)")
+	fs.StringVar(&reapiHeaders, "reapi-headers", headersDefault, "Headers sent with every REAPI request, e.g. x-buildbuddy-api-key=${API_KEY} (env: REAPI_HEADERS)")
+	fs.Var(newByteSizeValue(&reapiByteStreamThreshold, thresholdDefault), "reapi-bytestream-threshold", "Size above which blobs are streamed with ByteStream instead of batch requests (env: REAPI_BYTESTREAM_THRESHOLD)")
+}
+
+// printREAPIEnvUsage prints the environment variables for registerREAPIFlags.
+func printREAPIEnvUsage() {
+	fmt.Fprintf(os.Stderr, "  REAPI_URL            URL of the REAPI server (grpc:// or grpcs://)\n")
+	fmt.Fprintf(os.Stderr, "  REAPI_INSTANCE       REAPI instance name\n")
+	fmt.Fprintf(os.Stderr, "  REAPI_HEADERS        Request headers (key=value,key2=${ENV_VAR})\n")
+	fmt.Fprintf(os.Stderr, "  REAPI_BYTESTREAM_THRESHOLD  Size above which blobs use ByteStream (e.g. 1MB)\n")
+}
+
+// printPackEnvUsage prints the environment variables for registerPackFlags.
+func printPackEnvUsage() {
+	fmt.Fprintf(os.Stderr, "  PACK                 Upload small entries in pack files (true/false)\n")
+	fmt.Fprintf(os.Stderr, "  PACK_THRESHOLD       Largest entry that is packed (e.g. 64KB)\n")
+	fmt.Fprintf(os.Stderr, "  PACK_SIZE            Size at which a pack file is uploaded (e.g. 8MB)\n")
+}
+
+// printS3StorageEnvUsage prints the environment variables for registerS3StorageFlags.
+func printS3StorageEnvUsage() {
+	fmt.Fprintf(os.Stderr, "  S3_SSE               Server-side encryption (sse-s3, sse-kms, sse-c)\n")
+	fmt.Fprintf(os.Stderr, "  S3_SSE_KMS_KEY_ID    KMS key ID for sse-kms\n")
+	fmt.Fprintf(os.Stderr, "  S3_SSE_C_KEY_FILE    Key file for sse-c\n")
+	fmt.Fprintf(os.Stderr, "  S3_STORAGE_CLASS     Storage class for objects\n")
+	fmt.Fprintf(os.Stderr, "  S3_TAGS              Object tags (key=value,key2=${ENV_VAR})\n")
+	fmt.Fprintf(os.Stderr, "  S3_ACL               Canned ACL for objects\n")
+	fmt.Fprintf(os.Stderr, "  S3_SKIP_EXISTING     Skip uploading existing objects (if-none-match, head)\n")
+}
+
+// parseTags parses a comma-separated list of key=value object tags. Environment
+// variable references in values (e.g. ${GITHUB_RUN_ID}) are expanded so that the
+// same configuration can tag objects with per-run information.
+func parseTags(s string) (map[string]string, error) {
+	return parseKeyValues(s, "S3 tag")
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs, expanding
+// environment variable references in values. kind names a pair in errors.
+func parseKeyValues(s, kind string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid %s %q (expected key=value)", kind, pair)
+		}
+		pairs[key] = os.ExpandEnv(strings.TrimSpace(value))
+	}
+	return pairs, nil
+}
+
+// readCustomerKey reads an SSE-C key from a file containing either the raw
+// 32-byte key or its base64 encoding.
+func readCustomerKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSE-C key file: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("SSE-C key file must contain a 32-byte key or its base64 encoding")
+	}
+	return key, nil
+}
+
+// newLogger creates a logger for stderr that respects the debug and quiet flags.
+func newLogger() *slog.Logger {
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
+	}
+	if quiet {
+		logLevel = slog.LevelWarn
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+}
+
+// createPeerGroup creates the peer group configured by -peers and -peers-srv, or
+// returns nil if neither is set.
+func createPeerGroup() (*peerGroup, error) {
+	if peerList == "" && peerSRV == "" {
+		return nil, nil
+	}
+	peers, err := resolvePeers(peerList, peerSRV)
+	if err != nil {
+		return nil, err
+	}
+	return newPeerGroup(peerListen, peers, peerToken, peerTimeout, newLogger())
+}
+
+func createLockingGroup() (locking.Group, error) {
+	lockingType = strings.ToLower(lockingType)
+
+	switch lockingType {
+	case "memory", "":
+		// Default: in-memory singleflight
+		return locking.NewMemLock(), nil
+
+	case "fslock", "fs":
+		// Filesystem-backed deduplication
+		group, err := locking.NewFlockGroup(lockDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create fslock group: %w", err)
+		}
+		return group, nil
+
+	case "noop":
+		// No deduplication (useful for testing)
+		return locking.NewNoOpGroup(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown locking type: %s (supported: memory, fslock, noop)", lockingType)
+	}
+}
+
+// getEnv gets an environment variable or returns a default value.
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvBool gets a boolean environment variable or returns a default value.
+// Accepts: true, false, 1, 0, yes, no (case insensitive).
 func getEnvBool(key string, defaultValue bool) bool {
 	value := strings.ToLower(os.Getenv(key))
 	if value == "" {
@@ -452,3 +1923,143 @@ func getEnvFloat(key string, defaultValue float64) float64 {
 	}
 	return f
 }
+
+// getEnvInt gets an integer environment variable or returns a default value.
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	return i
+}
+
+// getEnvDuration gets a duration environment variable (e.g. "30s") or returns a
+// default value.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := parseDuration(value)
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
+
+// getEnvBytes gets a byte size environment variable (e.g. "64MB") or returns a
+// default value.
+func getEnvBytes(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := parseBytes(value)
+	if err != nil {
+		return defaultValue
+	}
+	return b
+}
+
+// parseBytes parses a human-readable byte count such as "512", "64KB", "1.5 GB"
+// or "10GiB". Units are powers of 1024, matching formatBytes.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+
+	number, unit := s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+
+	var multiplier float64
+	switch strings.TrimSuffix(strings.TrimSuffix(unit, "IB"), "B") {
+	case "":
+		multiplier = 1
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid byte size unit: %q", s)
+	}
+
+	return int64(n * multiplier), nil
+}
+
+// parseDuration parses a duration like time.ParseDuration, but also accepts a
+// number of days such as "7d" or "1.5d", which is more natural for cache
+// retention periods.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// durationValue is a flag.Value that accepts durations with an optional day suffix.
+type durationValue time.Duration
+
+func newDurationValue(p *time.Duration, defaultValue time.Duration) *durationValue {
+	*p = defaultValue
+	return (*durationValue)(p)
+}
+
+func (d *durationValue) String() string {
+	if d == nil {
+		return ""
+	}
+	return time.Duration(*d).String()
+}
+
+func (d *durationValue) Set(s string) error {
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+// byteSizeValue is a flag.Value that accepts human-readable byte sizes.
+type byteSizeValue int64
+
+func newByteSizeValue(p *int64, defaultValue int64) *byteSizeValue {
+	*p = defaultValue
+	return (*byteSizeValue)(p)
+}
+
+func (b *byteSizeValue) String() string {
+	if b == nil {
+		return ""
+	}
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSizeValue) Set(s string) error {
+	v, err := parseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSizeValue(v)
+	return nil
+}
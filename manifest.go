@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A build manifest lists the action IDs requested during a run, so that a later
+// run can download them into the local cache before the go command asks for them
+// one at a time. It's stored in the backend under a name chosen by the user, such
+// as a branch or job name, in the same way as an entry:
+//
+//	gobuildcache-manifest v1
+//	<hex action ID>
+//	...
+const manifestHeader = "gobuildcache-manifest v1"
+
+// manifestPrefetchConcurrency is how many manifest entries are downloaded in
+// parallel.
+const manifestPrefetchConcurrency = 16
+
+// manifestKey returns the backend key of the manifest called name. Action IDs are
+// hex encoded in backend keys, so it can't collide with an entry.
+func manifestKey(name string) []byte {
+	return []byte(fileFormatVersion + "manifest/" + name)
+}
+
+// encodeManifest encodes a manifest listing actionIDs, which are hex encoded.
+func encodeManifest(actionIDs []string) []byte {
+	sorted := append([]string(nil), actionIDs...)
+	sort.Strings(sorted)
+	var buf bytes.Buffer
+	buf.WriteString(manifestHeader + "\n")
+	for _, id := range sorted {
+		buf.WriteString(id + "\n")
+	}
+	return buf.Bytes()
+}
+
+// decodeManifest decodes a manifest written by encodeManifest.
+func decodeManifest(data []byte) ([][]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		return nil, fmt.Errorf("not a build manifest")
+	}
+	var actionIDs [][]byte
+	for scanner.Scan() {
+		actionID, err := hex.DecodeString(scanner.Text())
+		if err != nil || len(actionID) == 0 {
+			return nil, fmt.Errorf("invalid action ID %q", scanner.Text())
+		}
+		actionIDs = append(actionIDs, actionID)
+	}
+	return actionIDs, scanner.Err()
+}
+
+// uploadManifest adds the action IDs requested so far to the manifest called
+// cp.manifestName, compressed like an entry. The manifest is read and written
+// back, so runs that share a name all contribute to it. Action IDs that the
+// backend didn't have when they were prefetched are dropped, so that entries
+// leave the manifest once they're trimmed.
+func (cp *CacheProg) uploadManifest() error {
+	existing, err := cp.fetchManifest(cp.manifestName)
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest to merge: %w", err)
+	}
+	merged := make(map[string]bool, len(existing))
+	cp.prefetch.Lock()
+	for _, actionID := range existing {
+		if id := hex.EncodeToString(actionID); !cp.prefetch.missed[id] {
+			merged[id] = true
+		}
+	}
+	cp.prefetch.Unlock()
+	cp.seenActionIDs.Lock()
+	for id := range cp.seenActionIDs.ids {
+		merged[id] = true
+	}
+	cp.seenActionIDs.Unlock()
+	actionIDs := make([]string, 0, len(merged))
+	for id := range merged {
+		actionIDs = append(actionIDs, id)
+	}
+
+	data := encodeManifest(actionIDs)
+	// The content hash stands in for the output ID, like the go command's.
+	sum := sha256.Sum256(data)
+	if cp.compression {
+		if data, err = compressData(data); err != nil {
+			return err
+		}
+	}
+	if err := cp.backend.Put(manifestKey(cp.manifestName), sum[:], bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	cp.logger.Debug("uploaded build manifest", "name", cp.manifestName, "entries", len(actionIDs))
+	return nil
+}
+
+// fetchManifest downloads the manifest called name. A missing manifest is empty.
+func (cp *CacheProg) fetchManifest(name string) ([][]byte, error) {
+	_, body, size, _, miss, err := cp.backend.Get(manifestKey(name))
+	if err != nil || miss {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if cp.compression && size > 0 {
+		if data, err = decompressData(data); err != nil {
+			return nil, fmt.Errorf("failed to decompress manifest: %w", err)
+		}
+	}
+	return decodeManifest(data)
+}
+
+// startPrefetch downloads the entries of the manifest cp.prefetchManifest into
+// the local cache in the background, until stopPrefetch is called. Each entry is
+// fetched while holding its lock, so a GET for an entry that's being prefetched
+// waits for it and then finds it in the local cache.
+func (cp *CacheProg) startPrefetch() {
+	cp.prefetch.stop = make(chan struct{})
+	cp.prefetch.done = make(chan struct{})
+	if cp.prefetchManifest == "" {
+		close(cp.prefetch.done)
+		return
+	}
+
+	go func() {
+		defer close(cp.prefetch.done)
+		start := time.Now()
+		actionIDs, err := cp.fetchManifest(cp.prefetchManifest)
+		if err != nil {
+			cp.logger.Warn("failed to fetch build manifest", "name", cp.prefetchManifest, "error", err)
+			return
+		}
+		cp.prefetchManifestEntries.Store(int64(len(actionIDs)))
+
+		var (
+			wg   sync.WaitGroup
+			jobs = make(chan []byte)
+		)
+		for range manifestPrefetchConcurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for actionID := range jobs {
+					cp.prefetchEntry(actionID)
+				}
+			}()
+		}
+	feed:
+		for _, actionID := range actionIDs {
+			select {
+			case jobs <- actionID:
+			case <-cp.prefetch.stop:
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		cp.latencyTracker.Record("manifest_prefetch", time.Since(start))
+		cp.logger.Debug("prefetched build manifest", "name", cp.prefetchManifest,
+			"entries", len(actionIDs), "prefetched", cp.prefetchedEntries.Load(), "duration", time.Since(start))
+	}()
+}
+
+// stopPrefetch stops prefetching and waits for the downloads in progress.
+func (cp *CacheProg) stopPrefetch() {
+	if cp.prefetch.stop == nil {
+		return
+	}
+	close(cp.prefetch.stop)
+	<-cp.prefetch.done
+	cp.prefetch.stop = nil
+}
+
+// prefetchEntry downloads a single entry into the local cache unless it's already
+// there.
+func (cp *CacheProg) prefetchEntry(actionID []byte) {
+	_, err := cp.locker.DoWithLock(hex.EncodeToString(actionID), func() (interface{}, error) {
+		if cp.localCache.check(actionID) != nil {
+			cp.prefetchCachedEntries.Add(1)
+			return nil, nil
+		}
+		result, err := cp.fetchFromBackend(actionID)
+		if err != nil {
+			return nil, err
+		}
+		if result.miss {
+			cp.prefetchMissedEntries.Add(1)
+			cp.prefetch.Lock()
+			if cp.prefetch.missed == nil {
+				cp.prefetch.missed = make(map[string]bool)
+			}
+			cp.prefetch.missed[hex.EncodeToString(actionID)] = true
+			cp.prefetch.Unlock()
+			return nil, nil
+		}
+		cp.prefetchedEntries.Add(1)
+		cp.prefetchedBytes.Add(result.size)
+		return nil, nil
+	})
+	if err != nil {
+		cp.logger.Debug("failed to prefetch entry", "actionID", hex.EncodeToString(actionID), "error", err)
+	}
+}
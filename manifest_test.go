@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	ids := []string{"0202", "0101"}
+	decoded, err := decodeManifest(encodeManifest(ids))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(decoded) != 2 || !bytes.Equal(decoded[0], []byte{0x01, 0x01}) || !bytes.Equal(decoded[1], []byte{0x02, 0x02}) {
+		t.Errorf("decoded %x, expected sorted action IDs", decoded)
+	}
+
+	for _, data := range []string{"", "0101\n", manifestHeader + "\nnot hex\n"} {
+		if _, err := decodeManifest([]byte(data)); err == nil {
+			t.Errorf("decoding %q succeeded", data)
+		}
+	}
+}
+
+// newTestCacheProg returns a CacheProg on a fresh local cache.
+func newTestCacheProg(t *testing.T, backend *recordingBackend, manifestName, prefetchManifest string) *CacheProg {
+	t.Helper()
+	cp, err := NewCacheProg(backend, locking.NewMemLock(), t.TempDir(), false, false, true, 0, 0, manifestName, prefetchManifest, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestCacheProgPrefetchManifest(t *testing.T) {
+	var (
+		backend   = &recordingBackend{puts: make(map[string][]byte)}
+		recording = newTestCacheProg(t, backend, "main", "")
+		actionIDs [][]byte
+	)
+	for i := range 20 {
+		var (
+			actionID = []byte{0x10, byte(i)}
+			data     = []byte(fmt.Sprintf("output %d", i))
+			sum      = sha256.Sum256(data)
+		)
+		actionIDs = append(actionIDs, actionID)
+		recording.trackActionID(actionID)
+		if _, err := putCompressed(backend, true, actionID, sum[:], data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Requested, but the backend doesn't have it.
+	recording.trackActionID([]byte{0x20, 0x00})
+	if err := recording.uploadManifest(); err != nil {
+		t.Fatalf("failed to upload manifest: %v", err)
+	}
+
+	cp := newTestCacheProg(t, backend, "", "main")
+	cp.startPrefetch()
+	<-cp.prefetch.done
+	cp.stopPrefetch()
+
+	if cp.prefetchManifestEntries.Load() != 21 || cp.prefetchedEntries.Load() != 20 || cp.prefetchMissedEntries.Load() != 1 {
+		t.Errorf("prefetched %d of %d entries with %d misses, expected 20 of 21 with 1 miss",
+			cp.prefetchedEntries.Load(), cp.prefetchManifestEntries.Load(), cp.prefetchMissedEntries.Load())
+	}
+	for i, actionID := range actionIDs {
+		if cp.localCache.check(actionID) == nil {
+			t.Fatalf("entry %d not in the local cache", i)
+		}
+		data, err := os.ReadFile(cp.localCache.getPath(actionID))
+		if err != nil || string(data) != fmt.Sprintf("output %d", i) {
+			t.Errorf("entry %d contains %q (err %v)", i, data, err)
+		}
+	}
+
+	// A missing manifest prefetches nothing.
+	cp = newTestCacheProg(t, backend, "", "other-branch")
+	cp.startPrefetch()
+	cp.stopPrefetch()
+	if cp.prefetchManifestEntries.Load() != 0 {
+		t.Errorf("missing manifest had %d entries", cp.prefetchManifestEntries.Load())
+	}
+}
+
+func TestCacheProgMergesManifests(t *testing.T) {
+	var (
+		backend = &recordingBackend{puts: make(map[string][]byte)}
+		data    = []byte("output")
+		sum     = sha256.Sum256(data)
+		kept    = []byte{0x10, 0x01}
+		trimmed = []byte{0x10, 0x02}
+		added   = []byte{0x10, 0x03}
+	)
+	if _, err := putCompressed(backend, true, kept, sum[:], data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Runs that share a manifest name add to it instead of replacing it.
+	for _, actionID := range [][]byte{kept, trimmed} {
+		cp := newTestCacheProg(t, backend, "main", "")
+		cp.trackActionID(actionID)
+		if err := cp.uploadManifest(); err != nil {
+			t.Fatalf("failed to upload manifest: %v", err)
+		}
+	}
+	cp := newTestCacheProg(t, backend, "main", "main")
+	if actionIDs, err := cp.fetchManifest("main"); err != nil || len(actionIDs) != 2 {
+		t.Fatalf("manifest has %x (err %v), expected both runs' action IDs", actionIDs, err)
+	}
+
+	// Entries that the backend no longer has leave the manifest.
+	cp.startPrefetch()
+	<-cp.prefetch.done
+	cp.stopPrefetch()
+	cp.trackActionID(added)
+	if err := cp.uploadManifest(); err != nil {
+		t.Fatalf("failed to upload manifest: %v", err)
+	}
+	actionIDs, err := cp.fetchManifest("main")
+	if err != nil || len(actionIDs) != 2 || !bytes.Equal(actionIDs[0], kept) || !bytes.Equal(actionIDs[1], added) {
+		t.Errorf("manifest has %x (err %v), expected %x and %x", actionIDs, err, kept, added)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// negativeCacheDir is the directory in the local cache directory that holds the
+// miss markers shared between processes.
+const negativeCacheDir = "negative"
+
+// negativeCache remembers backend misses for a short time, so that repeated GETs
+// for an action ID the go command is still building don't go back to the
+// backend. The go command PUTs the output shortly after a miss, which removes the
+// entry again.
+//
+// Misses are kept in memory, or as empty marker files whose modification time is
+// the time of the miss if they're shared with other processes using the same
+// cache directory. A PUT from any of them then removes the marker.
+type negativeCache struct {
+	ttl time.Duration
+	dir string // Marker file directory, or empty if misses are kept in memory
+
+	mu     sync.Mutex
+	misses map[string]time.Time // Maps hex action IDs to when the miss happened
+}
+
+// newNegativeCache creates a negative cache that remembers misses for ttl, or
+// not at all if ttl isn't positive. If shared is true, misses are recorded as
+// marker files in cacheDir instead, and expired markers left behind by earlier
+// runs are removed.
+func newNegativeCache(ttl time.Duration, cacheDir string, shared bool) (*negativeCache, error) {
+	nc := &negativeCache{ttl: ttl, misses: make(map[string]time.Time)}
+	if ttl <= 0 || !shared {
+		return nc, nil
+	}
+
+	nc.dir = filepath.Join(cacheDir, negativeCacheDir)
+	if err := os.MkdirAll(nc.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create negative cache directory: %w", err)
+	}
+	dirEntries, err := os.ReadDir(nc.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read negative cache directory: %w", err)
+	}
+	now := time.Now()
+	for _, dirEntry := range dirEntries {
+		if info, err := dirEntry.Info(); err == nil && now.Sub(info.ModTime()) >= ttl {
+			os.Remove(filepath.Join(nc.dir, dirEntry.Name()))
+		}
+	}
+	return nc, nil
+}
+
+// enabled returns whether misses are remembered at all.
+func (nc *negativeCache) enabled() bool {
+	return nc.ttl > 0
+}
+
+// contains returns whether a miss for actionID was recorded less than the TTL
+// before now.
+func (nc *negativeCache) contains(actionID []byte, now time.Time) bool {
+	if !nc.enabled() {
+		return false
+	}
+	key := hex.EncodeToString(actionID)
+
+	if nc.dir != "" {
+		info, err := os.Stat(filepath.Join(nc.dir, key))
+		if err != nil {
+			return false
+		}
+		if now.Sub(info.ModTime()) >= nc.ttl {
+			os.Remove(filepath.Join(nc.dir, key))
+			return false
+		}
+		return true
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	missTime, ok := nc.misses[key]
+	if ok && now.Sub(missTime) >= nc.ttl {
+		delete(nc.misses, key)
+		return false
+	}
+	return ok
+}
+
+// add records a miss for actionID at now.
+func (nc *negativeCache) add(actionID []byte, now time.Time) error {
+	if !nc.enabled() {
+		return nil
+	}
+	key := hex.EncodeToString(actionID)
+
+	if nc.dir == "" {
+		nc.mu.Lock()
+		nc.misses[key] = now
+		nc.mu.Unlock()
+		return nil
+	}
+
+	path := filepath.Join(nc.dir, key)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		return fmt.Errorf("failed to write miss marker: %w", err)
+	}
+	return os.Chtimes(path, now, now)
+}
+
+// remove forgets a miss for actionID, and returns whether there was one.
+func (nc *negativeCache) remove(actionID []byte) (bool, error) {
+	if !nc.enabled() {
+		return false, nil
+	}
+	key := hex.EncodeToString(actionID)
+
+	if nc.dir == "" {
+		nc.mu.Lock()
+		defer nc.mu.Unlock()
+		_, removed := nc.misses[key]
+		delete(nc.misses, key)
+		return removed, nil
+	}
+
+	err := os.Remove(filepath.Join(nc.dir, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to remove miss marker: %w", err)
+	}
+	return true, nil
+}
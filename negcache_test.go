@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestNegativeCache(t *testing.T) {
+	var (
+		actionID = []byte{0x01, 0x02}
+		now      = time.Now()
+	)
+	for _, shared := range []bool{false, true} {
+		dir := t.TempDir()
+		nc, err := newNegativeCache(time.Minute, dir, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nc.contains(actionID, now) {
+			t.Errorf("shared=%v: empty cache contains a miss", shared)
+		}
+		if err := nc.add(actionID, now); err != nil {
+			t.Fatal(err)
+		}
+		if !nc.contains(actionID, now.Add(30*time.Second)) {
+			t.Errorf("shared=%v: miss was forgotten before the TTL", shared)
+		}
+		if nc.contains(actionID, now.Add(time.Minute)) {
+			t.Errorf("shared=%v: miss was remembered after the TTL", shared)
+		}
+
+		if err := nc.add(actionID, now); err != nil {
+			t.Fatal(err)
+		}
+		if removed, err := nc.remove(actionID); !removed || err != nil {
+			t.Errorf("shared=%v: remove = %v, %v", shared, removed, err)
+		}
+		if nc.contains(actionID, now) {
+			t.Errorf("shared=%v: removed miss is still remembered", shared)
+		}
+	}
+
+	// Shared misses are seen by other processes, and expired markers are removed
+	// at startup.
+	dir := t.TempDir()
+	first, err := newNegativeCache(time.Minute, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.add(actionID, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.add([]byte{0x03}, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	second, err := newNegativeCache(time.Minute, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.contains(actionID, now) {
+		t.Error("shared miss isn't seen by another process")
+	}
+	if _, err := os.Stat(filepath.Join(dir, negativeCacheDir, "03")); !os.IsNotExist(err) {
+		t.Errorf("expired marker wasn't removed: %v", err)
+	}
+}
+
+func TestCacheProgNegativeCache(t *testing.T) {
+	var (
+		backend  = &recordingBackend{puts: make(map[string][]byte)}
+		actionID = []byte{0x10, 0x20}
+		data     = []byte("output")
+	)
+	cp, err := NewCacheProg(backend, locking.NewMemLock(), t.TempDir(), false, false, true, 0, 0, "", "", time.Minute, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		resp, err := cp.handleGet(&Request{Command: CmdGet, ActionID: actionID})
+		if err != nil || !resp.Miss {
+			t.Fatalf("GET: miss = %v, err = %v", resp.Miss, err)
+		}
+	}
+	if backend.gets != 1 || cp.negativeCacheHits.Load() != 2 {
+		t.Errorf("%d backend GETs and %d negative cache hits, expected 1 and 2", backend.gets, cp.negativeCacheHits.Load())
+	}
+
+	req := &Request{Command: CmdPut, ActionID: actionID, OutputID: []byte{0xaa}, Body: bytes.NewReader(data), BodySize: int64(len(data))}
+	if _, err := cp.handlePut(req); err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	if cp.negativeCacheInvalidations.Load() != 1 {
+		t.Errorf("PUT invalidated %d misses, expected 1", cp.negativeCacheInvalidations.Load())
+	}
+	if cp.negativeCache.contains(actionID, time.Now()) {
+		t.Error("miss is remembered after a PUT")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+const (
+	// peerRingReplicas is the number of points each peer has on the hash ring, so
+	// that keys are spread evenly and only a peer's share moves when it leaves.
+	peerRingReplicas = 100
+
+	// peerBackoff is how long a peer that failed a request is skipped for.
+	peerBackoff = 30 * time.Second
+)
+
+// peerGroup shares local caches between the machines of a build farm. Every
+// member serves its local cache read-only over HTTP, and on a local miss asks the
+// peer that owns the action ID on a consistent hash ring before falling back to
+// the backend. Entries from peers are only accepted if their data hashes to their
+// output ID, which the go command sets to the SHA-256 of the output.
+type peerGroup struct {
+	listenAddr string
+	token      string
+	logger     *slog.Logger
+
+	ring    *hashRing
+	self    string // This process's address on the ring, empty if it isn't on it
+	clients map[string]*backends.Remote
+
+	// listener is where the local cache is served, if it's set before serve.
+	listener net.Listener
+	server   *http.Server
+	handler  *cacheServer
+
+	mu   sync.Mutex
+	down map[string]time.Time // Peers skipped until the given time
+
+	hits     atomic.Int64
+	hitBytes atomic.Int64
+	misses   atomic.Int64
+	rejected atomic.Int64 // Entries whose data didn't match their output ID
+	errors   atomic.Int64
+}
+
+// newPeerGroup creates a peer group of the peers at the given host:port
+// addresses, which may include this process's own listenAddr. Requests to peers
+// carry token, and time out if the peer doesn't respond within timeout.
+func newPeerGroup(listenAddr string, peers []string, token string, timeout time.Duration, logger *slog.Logger) (*peerGroup, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers configured")
+	}
+	g := &peerGroup{
+		listenAddr: listenAddr,
+		token:      token,
+		logger:     logger,
+		ring:       newHashRing(peers),
+		clients:    make(map[string]*backends.Remote),
+		down:       make(map[string]time.Time),
+	}
+	for _, peer := range peers {
+		if g.self == "" && isLocalPeer(peer, listenAddr) {
+			g.self = peer
+			continue
+		}
+		client, err := backends.NewRemote("http://"+peer, backends.RemoteOptions{
+			Token:                 token,
+			ResponseHeaderTimeout: timeout,
+			SkipHealthCheck:       true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %w", peer, err)
+		}
+		g.clients[peer] = client
+	}
+	logger.Debug("configured peers", "peers", len(peers), "self", g.self)
+	return g, nil
+}
+
+// resolvePeers returns the comma-separated static peers, plus the targets of the
+// DNS SRV record srvName if it's set, as host:port addresses.
+func resolvePeers(static, srvName string) ([]string, error) {
+	var peers []string
+	for _, peer := range strings.Split(static, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			if _, _, err := net.SplitHostPort(peer); err != nil {
+				return nil, fmt.Errorf("invalid peer %q: %w", peer, err)
+			}
+			peers = append(peers, peer)
+		}
+	}
+	if srvName != "" {
+		_, records, err := net.LookupSRV("", "", srvName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up peers: %w", err)
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			peers = append(peers, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+	}
+	return peers, nil
+}
+
+// isLocalPeer reports whether peer refers to this machine on the port of
+// listenAddr.
+func isLocalPeer(peer, listenAddr string) bool {
+	peerHost, peerPort, err := net.SplitHostPort(peer)
+	if err != nil {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil || peerPort != listenPort {
+		return false
+	}
+	if peerHost == listenHost {
+		return true
+	}
+	peerIPs, err := net.LookupIP(peerHost)
+	if err != nil {
+		return false
+	}
+	localAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range peerIPs {
+		for _, addr := range localAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serve serves the local cache to the other peers in the background. If another
+// process on this machine already does, for example with a different cache
+// directory, this one only asks peers.
+func (g *peerGroup) serve(lc *localCache, locker locking.Group) {
+	if g.listener == nil {
+		listener, err := net.Listen("tcp", g.listenAddr)
+		if err != nil {
+			g.logger.Debug("not serving the local cache to peers", "addr", g.listenAddr, "error", err)
+			return
+		}
+		g.listener = listener
+	}
+
+	var tokens map[string]string
+	if g.token != "" {
+		tokens = map[string]string{g.token: "peer"}
+	}
+	g.handler = newCacheServer(lc, locker, tokens, 0, g.logger)
+	g.handler.readOnly = true
+	g.server = &http.Server{Handler: g.handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := g.server.Serve(g.listener); !errors.Is(err, http.ErrServerClosed) {
+			g.logger.Warn("failed to serve the local cache to peers", "error", err)
+		}
+	}()
+}
+
+// close stops serving the local cache, letting running requests finish.
+func (g *peerGroup) close() {
+	if g.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.server.Shutdown(ctx); err != nil {
+		g.logger.Debug("failed to stop serving the local cache to peers", "error", err)
+	}
+}
+
+// served returns the number of entries served to other peers.
+func (g *peerGroup) served() int64 {
+	if g.handler == nil {
+		return 0
+	}
+	var hits int64
+	for _, client := range g.handler.stats().Clients {
+		hits += client.Hits
+	}
+	return hits
+}
+
+// get asks the peer that owns actionID for its entry and writes it to lc. The
+// data is hashed as it's streamed to the local cache, so an entry that doesn't
+// match its output ID never becomes visible there. It returns false if this
+// process owns the entry, the peer doesn't have it or it can't be used.
+func (g *peerGroup) get(actionID []byte, lc *localCache) (meta localCacheMetadata, diskPath string, ok bool) {
+	peer := g.ring.lookup(actionID)
+	client := g.clients[peer]
+	if client == nil || g.isDown(peer) {
+		return meta, "", false
+	}
+
+	outputID, body, size, putTime, miss, err := client.Get(actionID)
+	if err == nil && miss {
+		g.misses.Add(1)
+		return meta, "", false
+	}
+	var verified *peerBodyReader
+	if err == nil {
+		meta = localCacheMetadata{OutputID: outputID, Size: size, PutTime: *putTime}
+		verified = &peerBodyReader{r: body, h: sha256.New(), outputID: outputID, size: size}
+		diskPath, err = lc.writeWithMetadata(actionID, verified, meta)
+		body.Close()
+	}
+	switch {
+	case errors.Is(err, errPeerOutputMismatch):
+		g.rejected.Add(1)
+		g.logger.Warn("rejected entry from peer whose data doesn't match its output ID",
+			"peer", peer, "actionID", hex.EncodeToString(actionID), "outputID", hex.EncodeToString(outputID))
+		return meta, "", false
+	case verified == nil || verified.err != nil:
+		if verified != nil {
+			err = verified.err
+		}
+		g.errors.Add(1)
+		g.markDown(peer)
+		g.logger.Warn("failed to get entry from peer", "peer", peer, "actionID", hex.EncodeToString(actionID), "error", err)
+		return meta, "", false
+	case err != nil:
+		g.logger.Warn("failed to write to local cache after peer hit", "actionID", hex.EncodeToString(actionID), "error", err)
+		return meta, "", false
+	}
+	g.hits.Add(1)
+	g.hitBytes.Add(size)
+	return meta, diskPath, true
+}
+
+// errPeerOutputMismatch is returned by a peerBodyReader whose data doesn't hash
+// to its output ID.
+var errPeerOutputMismatch = errors.New("data doesn't match its output ID")
+
+// peerBodyReader reads the body of an entry from a peer, and fails at the end of
+// it if it doesn't have the expected size or SHA-256. Errors reading the body
+// itself are kept in err, to tell them apart from local write errors.
+type peerBodyReader struct {
+	r        io.Reader
+	h        hash.Hash
+	outputID []byte
+	size     int64
+	read     int64
+	err      error
+}
+
+func (p *peerBodyReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.h.Write(b[:n])
+	p.read += int64(n)
+	switch {
+	case err == io.EOF && p.read != p.size:
+		p.err = fmt.Errorf("read %d bytes, expected %d", p.read, p.size)
+		return n, p.err
+	case err == io.EOF && !bytes.Equal(p.h.Sum(nil), p.outputID):
+		return n, errPeerOutputMismatch
+	case err != nil && err != io.EOF:
+		p.err = err
+	}
+	return n, err
+}
+
+func (g *peerGroup) isDown(peer string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Now().Before(g.down[peer])
+}
+
+func (g *peerGroup) markDown(peer string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.down[peer] = time.Now().Add(peerBackoff)
+}
+
+// fetchFromPeer gets an entry that's missing locally from its peer and writes it
+// to the local cache. It returns nil if peers are disabled or didn't provide the
+// entry. The caller must hold the lock for actionID.
+func (cp *CacheProg) fetchFromPeer(actionID []byte) *getResult {
+	if cp.peers == nil {
+		return nil
+	}
+	peerGetStart := time.Now()
+	meta, diskPath, ok := cp.peers.get(actionID, cp.localCache)
+	cp.latencyTracker.Record("get_peer", time.Since(peerGetStart))
+	if !ok {
+		return nil
+	}
+	return &getResult{
+		outputID: meta.OutputID,
+		diskPath: diskPath,
+		size:     meta.Size,
+		putTime:  &meta.PutTime,
+		fromPeer: true,
+	}
+}
+
+// hashRing assigns keys to peers by consistent hashing.
+type hashRing struct {
+	points []uint64 // Sorted
+	owners map[uint64]string
+}
+
+func newHashRing(peers []string) *hashRing {
+	r := &hashRing{owners: make(map[uint64]string)}
+	for _, peer := range peers {
+		for i := range peerRingReplicas {
+			point := ringHash([]byte(peer + "#" + strconv.Itoa(i)))
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+			r.owners[point] = peer
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// lookup returns the peer that owns key: the one with the first point at or
+// after the key's hash.
+func (r *hashRing) lookup(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func ringHash(data []byte) uint64 {
+	sum := sha256.Sum256(data)
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func TestHashRing(t *testing.T) {
+	peers := []string{"a:7070", "b:7070", "c:7070"}
+	ring := newHashRing(peers)
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := range 3000 {
+		key := fmt.Sprintf("action %d", i)
+		owner := ring.lookup([]byte(key))
+		owners[key] = owner
+		counts[owner]++
+	}
+	for _, peer := range peers {
+		if counts[peer] < 600 || counts[peer] > 1400 {
+			t.Errorf("peer %s owns %d of 3000 keys", peer, counts[peer])
+		}
+	}
+
+	// Only the keys of a peer that leaves move.
+	smaller := newHashRing(peers[:2])
+	for key, owner := range owners {
+		if owner != "c:7070" && smaller.lookup([]byte(key)) != owner {
+			t.Fatalf("key %q moved from %s after c left", key, owner)
+		}
+	}
+}
+
+// newTestPeer creates a cache program that's a member of a peer group listening
+// on listener.
+func newTestPeer(t *testing.T, listener net.Listener, peers []string) (*CacheProg, *recordingBackend) {
+	t.Helper()
+	group, err := newPeerGroup(listener.Addr().String(), peers, "secret", time.Second, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	group.listener = listener
+	backend := &recordingBackend{puts: make(map[string][]byte)}
+	cp, err := NewCacheProg(backend, locking.NewMemLock(), t.TempDir(), false, false, false, 0, 0, "", "", 0, false, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.start()
+	t.Cleanup(cp.finish)
+	return cp, backend
+}
+
+func TestPeerSharing(t *testing.T) {
+	var listeners []net.Listener
+	var peers []string
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		peers = append(peers, l.Addr().String())
+	}
+	a, _ := newTestPeer(t, listeners[0], peers)
+	b, backendB := newTestPeer(t, listeners[1], peers)
+	if a.peers.self != peers[0] || b.peers.self != peers[1] {
+		t.Fatalf("peers didn't find themselves on the ring: %q, %q", a.peers.self, b.peers.self)
+	}
+
+	// keyOwnedBy returns an action ID that the ring assigns to peer.
+	keyOwnedBy := func(peer string, n int) []byte {
+		for i := n; ; i++ {
+			key := []byte(fmt.Sprintf("action %d", i))
+			if a.peers.ring.lookup(key) == peer {
+				return key
+			}
+		}
+	}
+	put := func(cp *CacheProg, actionID, outputID, data []byte) {
+		t.Helper()
+		req := &Request{Command: CmdPut, ActionID: actionID, OutputID: outputID, Body: bytes.NewReader(data), BodySize: int64(len(data))}
+		if _, err := cp.handlePut(req); err != nil {
+			t.Fatalf("PUT failed: %v", err)
+		}
+	}
+
+	// B misses an entry that A has, and gets it from A instead of its backend.
+	data := []byte("compiled output")
+	sum := sha256.Sum256(data)
+	shared := keyOwnedBy(peers[0], 0)
+	put(a, shared, sum[:], data)
+	resp, err := b.handleGet(&Request{Command: CmdGet, ActionID: shared})
+	if err != nil || resp.Miss || resp.Size != int64(len(data)) {
+		t.Fatalf("GET of the peer's entry: %+v, %v", resp, err)
+	}
+	if b.peerHits.Load() != 1 || backendB.gets != 0 {
+		t.Errorf("%d peer hits and %d backend GETs, expected 1 and 0", b.peerHits.Load(), backendB.gets)
+	}
+	if a.peers.served() != 1 {
+		t.Errorf("A served %d entries, expected 1", a.peers.served())
+	}
+
+	// Data that doesn't hash to its output ID is rejected.
+	corrupt := keyOwnedBy(peers[0], 1000)
+	put(a, corrupt, []byte{0xaa}, data)
+	if resp, err := b.handleGet(&Request{Command: CmdGet, ActionID: corrupt}); err != nil || !resp.Miss {
+		t.Errorf("GET of a corrupt peer entry: %+v, %v", resp, err)
+	}
+	if b.peers.rejected.Load() != 1 || backendB.gets != 1 {
+		t.Errorf("%d rejected entries and %d backend GETs, expected 1 of each", b.peers.rejected.Load(), backendB.gets)
+	}
+	if b.localCache.check(corrupt) != nil {
+		t.Error("rejected peer entry was written to the local cache")
+	}
+
+	// B owns its own keys, so it doesn't ask A for them.
+	own := keyOwnedBy(peers[1], 0)
+	if resp, err := b.handleGet(&Request{Command: CmdGet, ActionID: own}); err != nil || !resp.Miss {
+		t.Errorf("GET of an absent entry: %+v, %v", resp, err)
+	}
+	if b.peers.misses.Load() != 0 || backendB.gets != 2 {
+		t.Errorf("%d peer misses and %d backend GETs, expected 0 and 2", b.peers.misses.Load(), backendB.gets)
+	}
+}
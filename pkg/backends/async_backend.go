@@ -145,3 +145,28 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+// PutSkipStats forwards to the underlying backend.
+func (abw *AsyncBackendWriter) PutSkipStats() (skipped, bytesSaved int64) {
+	return putSkipStats(abw.backend)
+}
+
+// Trim forwards to the underlying backend.
+func (abw *AsyncBackendWriter) Trim(policy TrimPolicy) (TrimStats, error) {
+	return trim(abw.backend, policy)
+}
+
+// Exists forwards to the underlying backend.
+func (abw *AsyncBackendWriter) Exists(actionID []byte) (bool, error) {
+	return Exists(abw.backend, actionID)
+}
+
+// PackStats forwards to the underlying backend.
+func (abw *AsyncBackendWriter) PackStats() PackStats {
+	return packStats(abw.backend)
+}
+
+// KeyFilterStats forwards to the underlying backend.
+func (abw *AsyncBackendWriter) KeyFilterStats() KeyFilterStats {
+	return keyFilterStats(abw.backend)
+}
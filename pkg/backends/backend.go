@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"fmt"
 	"io"
 	"time"
 )
@@ -36,3 +37,84 @@ type Backend interface {
 	// Clear removes all entries from the cache backend storage.
 	Clear() error
 }
+
+// PutSkipReporter is implemented by backends that can skip uploading objects that
+// already exist in the backend storage. Wrappers forward it to the backend they wrap.
+type PutSkipReporter interface {
+	// PutSkipStats returns the number of PUTs that were skipped because the object
+	// already existed, and the number of body bytes that didn't have to be uploaded.
+	PutSkipStats() (skipped, bytesSaved int64)
+}
+
+// ExistenceChecker is implemented by backends that can check whether an object
+// exists without fetching it.
+type ExistenceChecker interface {
+	// Exists reports whether an object is stored under actionID.
+	Exists(actionID []byte) (bool, error)
+}
+
+// RangeGetter is implemented by backends that can read part of an object without
+// fetching all of it.
+type RangeGetter interface {
+	// GetRange returns length bytes of the object stored under actionID, starting
+	// at offset. Returns miss=true and body=nil if the object doesn't exist.
+	GetRange(actionID []byte, offset, length int64) (body io.ReadCloser, miss bool, err error)
+}
+
+// Lister is implemented by backends that can list the objects they store.
+type Lister interface {
+	// List returns the keys of all objects whose key starts with prefix.
+	List(prefix []byte) ([][]byte, error)
+}
+
+// Deleter is implemented by backends that can delete individual objects.
+type Deleter interface {
+	// Delete removes the objects stored under actionIDs. Objects that don't
+	// exist are ignored.
+	Delete(actionIDs [][]byte) error
+}
+
+// getRange reads part of an object in backend, using its RangeGetter if it has
+// one and discarding the rest of the object otherwise.
+func getRange(backend Backend, actionID []byte, offset, length int64) (io.ReadCloser, bool, error) {
+	if r, ok := backend.(RangeGetter); ok {
+		return r.GetRange(actionID, offset, length)
+	}
+	_, body, _, _, miss, err := backend.Get(actionID)
+	if err != nil || miss {
+		return nil, miss, err
+	}
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, false, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, length), body}, false, nil
+}
+
+// Exists reports whether an object is stored under actionID in backend, using its
+// ExistenceChecker if it has one and fetching the object otherwise.
+func Exists(backend Backend, actionID []byte) (bool, error) {
+	if checker, ok := backend.(ExistenceChecker); ok {
+		return checker.Exists(actionID)
+	}
+	_, body, _, _, miss, err := backend.Get(actionID)
+	if err != nil {
+		return false, err
+	}
+	if !miss {
+		body.Close()
+	}
+	return !miss, nil
+}
+
+// putSkipStats returns the PUT skip stats of backend, or zeros if it doesn't
+// implement PutSkipReporter.
+func putSkipStats(backend Backend) (skipped, bytesSaved int64) {
+	if r, ok := backend.(PutSkipReporter); ok {
+		return r.PutSkipStats()
+	}
+	return 0, 0
+}
@@ -0,0 +1,289 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// casIndexPrefix and casBlobPrefix namespace the two kinds of objects stored by
+	// CAS, so that they never collide with each other or with entries stored
+	// without it.
+	casIndexPrefix = "index/"
+	casBlobPrefix  = "blob/"
+
+	// casMaxIndexSize bounds how much of an index object is read.
+	casMaxIndexSize = 4096
+)
+
+// CAS wraps a Backend and stores entries content-addressed, in two levels: a
+// small index object per action ID that records the output ID, size and put
+// time of its output, and a blob per output ID that holds the output itself.
+// Blobs are only uploaded if they don't exist yet, so actions with identical
+// outputs share a single blob, and PUTs of an output that's already stored only
+// upload the index object.
+//
+// Trimming selects index objects like entries, and only removes a blob once no
+// remaining index object points to it, so that no entry is left without its blob.
+type CAS struct {
+	backend Backend
+
+	// knownBlobs records the output IDs of blobs that are known to exist, because
+	// this process fetched, checked or uploaded them.
+	knownBlobs sync.Map
+
+	skippedPuts  atomic.Int64
+	skippedBytes atomic.Int64
+}
+
+// NewCAS creates a content-addressed wrapper around an existing backend.
+func NewCAS(backend Backend) *CAS {
+	return &CAS{backend: backend}
+}
+
+// Put uploads the blob for outputID unless it already exists, and then the index
+// object for actionID.
+func (c *CAS) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	blobKey := casBlobKey(outputID)
+	exists, err := c.blobExists(outputID)
+	if err != nil {
+		return fmt.Errorf("failed to check for blob: %w", err)
+	}
+	if exists {
+		c.skippedPuts.Add(1)
+		c.skippedBytes.Add(bodySize)
+	} else {
+		if err := c.backend.Put(blobKey, outputID, body, bodySize); err != nil {
+			return fmt.Errorf("failed to upload blob: %w", err)
+		}
+		c.knownBlobs.Store(string(outputID), struct{}{})
+	}
+
+	index := encodeCASIndex(outputID, bodySize, time.Now())
+	if err := c.backend.Put(casIndexKey(actionID), outputID, bytes.NewReader(index), int64(len(index))); err != nil {
+		return fmt.Errorf("failed to upload index: %w", err)
+	}
+	return nil
+}
+
+// Get looks up the index object for actionID and returns the blob it points to.
+// The returned size is that of the blob.
+func (c *CAS) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	outputID, putTime, miss, err := c.readIndex(actionID)
+	if err != nil || miss {
+		return nil, nil, 0, nil, miss, err
+	}
+
+	_, body, size, _, miss, err := c.backend.Get(casBlobKey(outputID))
+	if err != nil {
+		return nil, nil, 0, nil, false, fmt.Errorf("failed to get blob: %w", err)
+	}
+	if miss {
+		// The blob was trimmed.
+		c.knownBlobs.Delete(string(outputID))
+		return nil, nil, 0, nil, true, nil
+	}
+	c.knownBlobs.Store(string(outputID), struct{}{})
+	return outputID, body, size, &putTime, false, nil
+}
+
+// Exists reports whether both the index object for actionID and the blob it
+// points to exist.
+func (c *CAS) Exists(actionID []byte) (bool, error) {
+	outputID, _, miss, err := c.readIndex(actionID)
+	if err != nil || miss {
+		return false, err
+	}
+	return c.blobExists(outputID)
+}
+
+// List returns the action IDs starting with prefix that have an index object.
+// Blobs are left out.
+func (c *CAS) List(prefix []byte) ([][]byte, error) {
+	lister, ok := c.backend.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("backend does not support listing objects")
+	}
+	keys, err := lister.List(casIndexKey(prefix))
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = key[len(casIndexPrefix):]
+	}
+	return keys, nil
+}
+
+// readIndex reads and decodes the index object for actionID.
+func (c *CAS) readIndex(actionID []byte) (outputID []byte, putTime time.Time, miss bool, err error) {
+	_, indexBody, _, _, miss, err := c.backend.Get(casIndexKey(actionID))
+	if err != nil || miss {
+		return nil, time.Time{}, miss, err
+	}
+	data, err := io.ReadAll(io.LimitReader(indexBody, casMaxIndexSize))
+	indexBody.Close()
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("failed to read index: %w", err)
+	}
+	outputID, putTime, err = decodeCASIndex(data)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("invalid index for %x: %w", actionID, err)
+	}
+	return outputID, putTime, false, nil
+}
+
+// blobExists reports whether the blob for outputID exists.
+func (c *CAS) blobExists(outputID []byte) (bool, error) {
+	if _, ok := c.knownBlobs.Load(string(outputID)); ok {
+		return true, nil
+	}
+	exists, err := Exists(c.backend, casBlobKey(outputID))
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		c.knownBlobs.Store(string(outputID), struct{}{})
+	}
+	return exists, nil
+}
+
+// Close closes the underlying backend.
+func (c *CAS) Close() error {
+	return c.backend.Close()
+}
+
+// Clear passes through to the underlying backend.
+func (c *CAS) Clear() error {
+	c.knownBlobs.Clear()
+	return c.backend.Clear()
+}
+
+// PutSkipStats returns the blob uploads that were skipped because the blob
+// already existed, plus those skipped by the underlying backend.
+func (c *CAS) PutSkipStats() (skipped, bytesSaved int64) {
+	skipped, bytesSaved = putSkipStats(c.backend)
+	return skipped + c.skippedPuts.Load(), bytesSaved + c.skippedBytes.Load()
+}
+
+// Trim removes index objects according to policy, and blobs that no remaining
+// index object points to. Blobs are selected by their own times like entries, but
+// kept as long as an index object that isn't removed points to them.
+func (c *CAS) Trim(policy TrimPolicy) (TrimStats, error) {
+	c.knownBlobs.Clear()
+	return trimWithLayout(c, policy)
+}
+
+func (c *CAS) trimBackend() Backend {
+	return c.backend
+}
+
+// trimCandidates turns index objects into entries that need the blob they point
+// to, and blobs into shared objects.
+func (c *CAS) trimCandidates(objects []TrimEntry) ([]trimCandidate, error) {
+	candidates, err := layoutCandidates(c.backend, objects)
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		var (
+			candidate = &candidates[i]
+			outputIDs = candidate.outputIDs
+			entries   [][]byte
+			indexKeys [][]byte
+		)
+		for _, key := range candidate.entries {
+			switch {
+			case bytes.HasPrefix(key, []byte(casIndexPrefix)):
+				entries = append(entries, key[len(casIndexPrefix):])
+				indexKeys = append(indexKeys, key)
+			case bytes.HasPrefix(key, []byte(casBlobPrefix)):
+				candidate.provides = append(candidate.provides, string(key))
+			default:
+				entries = append(entries, key)
+			}
+		}
+		candidate.entries = entries
+		candidate.outputIDs = nil
+		if len(indexKeys) == 0 {
+			continue
+		}
+		candidate.needs = func() ([]string, error) {
+			needs := make([]string, 0, len(indexKeys))
+			for _, key := range indexKeys {
+				// The output ID is only read from the index object if the wrapped
+				// backend doesn't know it already.
+				outputID, ok := outputIDs[string(key)]
+				if !ok {
+					var miss bool
+					outputID, _, miss, err = c.readIndex(key[len(casIndexPrefix):])
+					if err != nil {
+						return nil, err
+					}
+					if miss {
+						continue
+					}
+				}
+				needs = append(needs, string(casBlobKey(outputID)))
+			}
+			return needs, nil
+		}
+	}
+	return candidates, nil
+}
+
+// PackStats forwards to the underlying backend.
+func (c *CAS) PackStats() PackStats {
+	return packStats(c.backend)
+}
+
+func casIndexKey(actionID []byte) []byte {
+	return append([]byte(casIndexPrefix), actionID...)
+}
+
+func casBlobKey(outputID []byte) []byte {
+	return []byte(casBlobPrefix + hex.EncodeToString(outputID))
+}
+
+// encodeCASIndex encodes an index object, which holds one field per line:
+//
+//	outputID:<hex>
+//	size:<bytes>
+//	time:<Unix nanoseconds>
+func encodeCASIndex(outputID []byte, size int64, putTime time.Time) []byte {
+	return fmt.Appendf(nil, "outputID:%x\nsize:%d\ntime:%d\n", outputID, size, putTime.UnixNano())
+}
+
+// decodeCASIndex decodes an index object, returning its output ID and put time.
+func decodeCASIndex(data []byte) ([]byte, time.Time, error) {
+	var (
+		outputID []byte
+		putTime  time.Time
+	)
+	for _, line := range strings.Split(string(data), "\n") {
+		field, value, _ := strings.Cut(line, ":")
+		switch field {
+		case "outputID":
+			var err error
+			if outputID, err = hex.DecodeString(value); err != nil {
+				return nil, putTime, fmt.Errorf("invalid output ID: %w", err)
+			}
+		case "time":
+			nanos, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, putTime, fmt.Errorf("invalid time: %w", err)
+			}
+			putTime = time.Unix(0, nanos)
+		}
+	}
+	if len(outputID) == 0 {
+		return nil, putTime, fmt.Errorf("missing output ID")
+	}
+	return outputID, putTime, nil
+}
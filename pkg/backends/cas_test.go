@@ -0,0 +1,184 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCASSharesBlobs(t *testing.T) {
+	const size = 4096
+
+	var (
+		client   = newFakeS3Client()
+		data     = randomBytes(t, size)
+		outputID = []byte{0xaa, 0xbb}
+	)
+	// Two runners with actions that produce the same output.
+	first, second := NewCAS(newTestS3(client, S3Options{})), NewCAS(newTestS3(client, S3Options{}))
+	if err := first.Put([]byte{0x01}, outputID, bytes.NewReader(data), size); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := second.Put([]byte{0x02}, outputID, bytes.NewReader(data), size); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// One blob and two index objects.
+	if puts := client.putCalls.Load(); puts != 3 {
+		t.Errorf("issued %d PUTs, expected 3", puts)
+	}
+	var stored int
+	for _, obj := range client.objects {
+		stored += len(obj.data)
+	}
+	if stored > size+2*100 {
+		t.Errorf("stored %d bytes for a %d byte output", stored, size)
+	}
+	if skipped, saved := second.PutSkipStats(); skipped != 1 || saved != size {
+		t.Errorf("skip stats = (%d, %d), expected (1, %d)", skipped, saved, size)
+	}
+
+	for _, actionID := range [][]byte{{0x01}, {0x02}} {
+		gotOutputID, body, gotSize, putTime, miss, err := second.Get(actionID)
+		if err != nil || miss {
+			t.Fatalf("Get failed: miss=%v, err=%v", miss, err)
+		}
+		got, _ := io.ReadAll(body)
+		body.Close()
+		if !bytes.Equal(got, data) || gotSize != size || !bytes.Equal(gotOutputID, outputID) || putTime == nil {
+			t.Errorf("Get(%x) returned %d bytes, size %d, outputID %x, putTime %v", actionID, len(got), gotSize, gotOutputID, putTime)
+		}
+	}
+
+	if _, _, _, _, miss, err := second.Get([]byte{0x03}); err != nil || !miss {
+		t.Errorf("expected miss for unknown action: miss=%v, err=%v", miss, err)
+	}
+
+	// Listing returns the action IDs, without the blob.
+	if keys, err := second.List(nil); err != nil || len(keys) != 2 || !bytes.Equal(keys[0], []byte{0x01}) && !bytes.Equal(keys[1], []byte{0x01}) {
+		t.Errorf("listed %x (err %v), expected the two action IDs", keys, err)
+	}
+}
+
+func TestCASMissingBlobIsMiss(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = NewCAS(newTestS3(client, S3Options{}))
+	)
+	if err := backend.Put([]byte{0x01}, []byte{0xaa}, bytes.NewReader([]byte("output")), 6); err != nil {
+		t.Fatal(err)
+	}
+	blobKey := newTestS3(client, S3Options{}).actionIDToKey(casBlobKey([]byte{0xaa}))
+	if _, ok := client.objects[blobKey]; !ok {
+		t.Fatalf("blob not stored under %s", blobKey)
+	}
+	// Trimmed separately from the index object.
+	delete(client.objects, blobKey)
+
+	if _, _, _, _, miss, err := NewCAS(newTestS3(client, S3Options{})).Get([]byte{0x01}); err != nil || !miss {
+		t.Errorf("expected miss for index without blob: miss=%v, err=%v", miss, err)
+	}
+}
+
+func TestCASIndexRoundTrip(t *testing.T) {
+	index := encodeCASIndex([]byte{0x01, 0x02}, 10, time.Unix(1700000000, 5))
+	outputID, putTime, err := decodeCASIndex(index)
+	if err != nil || !bytes.Equal(outputID, []byte{0x01, 0x02}) || !putTime.Equal(time.Unix(1700000000, 5)) {
+		t.Errorf("decoded %x, %v, %v", outputID, putTime, err)
+	}
+	if _, _, err := decodeCASIndex([]byte("size:10\n")); err == nil {
+		t.Error("expected error for index without output ID")
+	}
+}
+
+func TestCASTrimKeepsReferencedBlobs(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		s3      = newTestS3(client, S3Options{})
+		backend = NewCAS(s3)
+		now     = time.Now()
+	)
+	put := func(actionID, outputID []byte) {
+		t.Helper()
+		if err := backend.Put(actionID, outputID, bytes.NewReader([]byte("output")), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	age := func(key []byte, age time.Duration) {
+		client.objects[s3.actionIDToKey(key)].modified = now.Add(-age)
+	}
+	// An old entry whose blob a recent entry shares, and an old entry with its
+	// own blob.
+	put([]byte{0x01}, []byte{0xaa})
+	put([]byte{0x02}, []byte{0xaa})
+	put([]byte{0x03}, []byte{0xbb})
+	age(casIndexKey([]byte{0x01}), 30*24*time.Hour)
+	age(casIndexKey([]byte{0x03}), 30*24*time.Hour)
+	age(casBlobKey([]byte{0xaa}), 30*24*time.Hour)
+	age(casBlobKey([]byte{0xbb}), 30*24*time.Hour)
+
+	stats, err := backend.Trim(TrimPolicy{OlderThan: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if stats.Entries != 5 || stats.EvictedEntries != 3 {
+		t.Errorf("stats = %+v, expected 3 of 5 objects to be evicted", stats)
+	}
+	for key, expected := range map[string]bool{
+		string(casIndexKey([]byte{0x01})): false,
+		string(casIndexKey([]byte{0x02})): true,
+		string(casIndexKey([]byte{0x03})): false,
+		string(casBlobKey([]byte{0xaa})):  true,
+		string(casBlobKey([]byte{0xbb})):  false,
+	} {
+		if _, exists := client.objects[s3.actionIDToKey([]byte(key))]; exists != expected {
+			t.Errorf("%s exists = %v after trim, expected %v", key, exists, expected)
+		}
+	}
+	if _, _, _, _, miss, err := NewCAS(newTestS3(client, S3Options{})).Get([]byte{0x02}); err != nil || miss {
+		t.Errorf("entry sharing a trimmed entry's blob: miss = %v, err = %v", miss, err)
+	}
+}
+
+func TestCASTrimOnlyEntries(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		s3      = newTestS3(client, S3Options{})
+		backend = NewCAS(s3)
+		old     = time.Now().Add(-30 * 24 * time.Hour)
+	)
+	// An entry and a manifest, keyed like the server keys them.
+	for _, object := range []struct{ actionID, outputID string }{
+		{actionID: "v2aa", outputID: "entry"},
+		{actionID: "v2manifest/main", outputID: "manifest"},
+	} {
+		if err := backend.Put([]byte(object.actionID), []byte(object.outputID), bytes.NewReader([]byte("output")), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, object := range client.objects {
+		object.modified = old
+	}
+
+	stats, err := backend.Trim(TrimPolicy{
+		OlderThan: 24 * time.Hour,
+		IsEntry:   func(key []byte) bool { return !bytes.HasPrefix(key, []byte("v2manifest/")) },
+	})
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if stats.Entries != 3 || stats.EvictedEntries != 2 || stats.Skipped != 1 {
+		t.Errorf("stats = %+v, expected the entry and its blob to be evicted and the manifest skipped", stats)
+	}
+	for key, expected := range map[string]bool{
+		string(casIndexKey([]byte("v2aa"))):            false,
+		string(casBlobKey([]byte("entry"))):            false,
+		string(casIndexKey([]byte("v2manifest/main"))): true,
+		string(casBlobKey([]byte("manifest"))):         true,
+	} {
+		if _, exists := client.objects[s3.actionIDToKey([]byte(key))]; exists != expected {
+			t.Errorf("%s exists = %v after trim, expected %v", key, exists, expected)
+		}
+	}
+}
@@ -97,3 +97,27 @@ func (d *Debug) Clear() error {
 	return nil
 }
 
+// PutSkipStats forwards to the underlying backend.
+func (d *Debug) PutSkipStats() (skipped, bytesSaved int64) {
+	return putSkipStats(d.backend)
+}
+
+// Trim forwards to the underlying backend.
+func (d *Debug) Trim(policy TrimPolicy) (TrimStats, error) {
+	return trim(d.backend, policy)
+}
+
+// Exists forwards to the underlying backend.
+func (d *Debug) Exists(actionID []byte) (bool, error) {
+	return Exists(d.backend, actionID)
+}
+
+// PackStats forwards to the underlying backend.
+func (d *Debug) PackStats() PackStats {
+	return packStats(d.backend)
+}
+
+// KeyFilterStats forwards to the underlying backend.
+func (d *Debug) KeyFilterStats() KeyFilterStats {
+	return keyFilterStats(d.backend)
+}
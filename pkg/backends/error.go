@@ -90,3 +90,28 @@ func (e *Error) Clear() error {
 func (e *Error) GetStats() (putErrors, getErrors, closeErrors, clearErrors int64) {
 	return e.putErrors.Load(), e.getErrors.Load(), e.closeErrors.Load(), e.clearErrors.Load()
 }
+
+// PutSkipStats forwards to the underlying backend.
+func (e *Error) PutSkipStats() (skipped, bytesSaved int64) {
+	return putSkipStats(e.backend)
+}
+
+// Trim forwards to the underlying backend.
+func (e *Error) Trim(policy TrimPolicy) (TrimStats, error) {
+	return trim(e.backend, policy)
+}
+
+// Exists forwards to the underlying backend.
+func (e *Error) Exists(actionID []byte) (bool, error) {
+	return Exists(e.backend, actionID)
+}
+
+// PackStats forwards to the underlying backend.
+func (e *Error) PackStats() PackStats {
+	return packStats(e.backend)
+}
+
+// KeyFilterStats forwards to the underlying backend.
+func (e *Error) KeyFilterStats() KeyFilterStats {
+	return keyFilterStats(e.backend)
+}
@@ -0,0 +1,612 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// keyFilterKey is where the published key filter is stored. Entry keys are hex
+	// encoded, so it never collides with one.
+	keyFilterKey = "keyfilter"
+
+	keyFilterHeader = "gobuildcache-keyfilter v1\n"
+
+	// keyFilterDeltaPrefix prefixes the delta objects that list keys stored since
+	// a filter was built. Their names start with when they were written.
+	keyFilterDeltaPrefix = "keyfilter-delta/"
+
+	keyFilterDeltaHeader = "gobuildcache-keyfilter-delta v1\n"
+
+	// keyFilterDeltaInterval is how often the keys stored by a KeyFilter are
+	// written to a delta while it's open. Whatever is left is written when it's
+	// closed.
+	keyFilterDeltaInterval = 10 * time.Second
+
+	// keyFilterDeltaConcurrency bounds how many deltas are downloaded in parallel.
+	keyFilterDeltaConcurrency = 16
+
+	// keyFilterDeltaRefreshInterval bounds how often a filtered miss makes
+	// KeyFilter look for deltas written by other processes.
+	keyFilterDeltaRefreshInterval = 30 * time.Second
+
+	// keyFilterClockSkew is how long before a filter was built the deltas merged
+	// into it may have been written, to allow for clocks that are behind.
+	keyFilterClockSkew = 5 * time.Minute
+
+	// DefaultKeyFilterFalsePositiveRate is the share of absent keys that a key
+	// filter built by BuildKeyFilter reports as possibly present.
+	DefaultKeyFilterFalsePositiveRate = 0.01
+)
+
+// KeyFilterStats describes the key filter of a KeyFilter and what it saved.
+type KeyFilterStats struct {
+	Keys         int64     // Keys in the filter, 0 if none was loaded
+	Bytes        int64     // Size of the encoded filter
+	BuiltAt      time.Time // When the backend was listed to build the filter
+	FilteredGets int64     // GETs answered as misses without a backend request
+}
+
+// KeyFilterStatsReporter is implemented by backends that filter GETs with a key
+// filter. Wrappers forward it to the backend they wrap.
+type KeyFilterStatsReporter interface {
+	KeyFilterStats() KeyFilterStats
+}
+
+// keyFilterStats returns the key filter stats of backend, or zeros if it doesn't
+// implement KeyFilterStatsReporter.
+func keyFilterStats(backend Backend) KeyFilterStats {
+	if r, ok := backend.(KeyFilterStatsReporter); ok {
+		return r.KeyFilterStats()
+	}
+	return KeyFilterStats{}
+}
+
+// KeyFilter wraps a Backend and answers GETs for keys that are definitely not
+// stored without asking the backend. It downloads a bloom filter of every key in
+// the backend, published by BuildKeyFilter, when it's created. Keys the filter
+// might contain, including false positives, are looked up as usual.
+//
+// Keys stored after the filter was built are listed in delta objects, which every
+// KeyFilter writes every keyFilterDeltaInterval and when it's closed, and merges
+// into its filter when it's created. Before reporting a key the filter doesn't
+// contain as a miss, KeyFilter merges the deltas written by other processes since,
+// at most once per keyFilterDeltaRefreshInterval, so it works best with a backend
+// that implements Lister. Filters older than the maximum age are ignored.
+type KeyFilter struct {
+	backend Backend
+	isEntry func(key []byte) bool
+	logger  *slog.Logger
+
+	mu     sync.RWMutex
+	filter *bloomFilter // nil if no filter was loaded
+	stats  KeyFilterStats
+	// pending holds the keys stored by this process that haven't been written to
+	// a delta yet.
+	pending [][]byte
+	stop    chan struct{} // nil if no filter was loaded
+	done    chan struct{}
+
+	// deltas holds the keys of the deltas merged into the filter, and
+	// deltasRefreshed when they were last listed.
+	deltaRefreshMu  sync.Mutex
+	deltas          map[string]bool
+	deltasRefreshed time.Time
+
+	filteredGets atomic.Int64
+}
+
+// NewKeyFilter creates a filtering wrapper around an existing backend and loads
+// the key filter stored in it, unless it was built more than maxAge ago. A zero
+// maxAge accepts filters of any age. Only keys for which isEntry returns true are
+// filtered, so that objects that are replaced in place, such as manifests, are
+// always looked up. A nil isEntry filters every key.
+func NewKeyFilter(backend Backend, maxAge time.Duration, isEntry func(key []byte) bool, logger *slog.Logger) *KeyFilter {
+	k := &KeyFilter{backend: backend, isEntry: isEntry, logger: logger, deltas: make(map[string]bool)}
+	filter, stats, err := loadKeyFilter(backend)
+	switch {
+	case err != nil:
+		logger.Warn("failed to load key filter", "error", err)
+	case filter == nil:
+		logger.Debug("no key filter found")
+	case maxAge > 0 && time.Since(stats.BuiltAt) > maxAge:
+		logger.Warn("ignoring stale key filter", "builtAt", stats.BuiltAt, "maxAge", maxAge)
+	default:
+		k.filter, k.stats = filter, stats
+		if err := k.refreshDeltas(); err != nil {
+			// Without the deltas, keys stored since the filter was built would be
+			// reported as misses.
+			logger.Warn("ignoring key filter whose deltas can't be loaded", "error", err)
+			k.filter, k.stats = nil, KeyFilterStats{}
+			break
+		}
+		logger.Debug("loaded key filter", "keys", stats.Keys, "bytes", stats.Bytes, "builtAt", stats.BuiltAt, "deltas", len(k.deltas))
+		k.stop, k.done = make(chan struct{}), make(chan struct{})
+		go k.runDeltaWriter()
+	}
+	return k
+}
+
+// mayContain reports whether key might be stored in the backend, according to
+// the deltas merged so far.
+func (k *KeyFilter) mayContain(key []byte) bool {
+	if k.isEntry != nil && !k.isEntry(key) {
+		return true
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.filter == nil || k.filter.mayContain(key)
+}
+
+// absent reports whether key is definitely not stored in the backend. Keys the
+// filter doesn't contain are checked again after merging the deltas written
+// since they were last listed.
+func (k *KeyFilter) absent(key []byte) bool {
+	if k.mayContain(key) {
+		return false
+	}
+	if err := k.refreshDeltas(); err != nil {
+		k.logger.Debug("failed to refresh key filter deltas", "error", err)
+		return false
+	}
+	return !k.mayContain(key)
+}
+
+// refreshDeltas lists the deltas in the backend and merges the ones that were
+// written since the filter was built and haven't been merged yet. It does nothing
+// if they were listed less than keyFilterDeltaRefreshInterval ago.
+func (k *KeyFilter) refreshDeltas() error {
+	lister, ok := k.backend.(Lister)
+	if !ok {
+		return fmt.Errorf("backend does not support listing objects")
+	}
+	k.deltaRefreshMu.Lock()
+	defer k.deltaRefreshMu.Unlock()
+	if time.Since(k.deltasRefreshed) < keyFilterDeltaRefreshInterval {
+		return nil
+	}
+
+	refreshed := time.Now()
+	deltaKeys, err := lister.List([]byte(keyFilterDeltaPrefix))
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	builtAt := k.stats.BuiltAt
+	k.mu.RUnlock()
+
+	var unmerged [][]byte
+	for _, deltaKey := range deltaKeys {
+		writtenAt, ok := parseKeyFilterDeltaKey(deltaKey)
+		if ok && !k.deltas[string(deltaKey)] && !writtenAt.Before(builtAt.Add(-keyFilterClockSkew)) {
+			unmerged = append(unmerged, deltaKey)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, keyFilterDeltaConcurrency)
+	)
+	for _, deltaKey := range unmerged {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			keys, err := loadKeyFilterDelta(k.backend, deltaKey)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to load key filter delta %s: %w", deltaKey, err)
+				}
+				return
+			}
+			k.mu.Lock()
+			for _, key := range keys {
+				k.filter.add(key)
+			}
+			k.mu.Unlock()
+			k.deltas[string(deltaKey)] = true
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	k.deltasRefreshed = refreshed
+	return nil
+}
+
+// Put passes through to the underlying backend and adds actionID to the filter,
+// so that this process finds it, and to the next delta, so that other processes
+// do.
+func (k *KeyFilter) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	if err := k.backend.Put(actionID, outputID, body, bodySize); err != nil {
+		return err
+	}
+	if k.isEntry != nil && !k.isEntry(actionID) {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.filter != nil {
+		k.filter.add(actionID)
+		k.pending = append(k.pending, bytes.Clone(actionID))
+	}
+	return nil
+}
+
+// runDeltaWriter periodically writes the pending keys to a delta until the
+// filter is closed.
+func (k *KeyFilter) runDeltaWriter() {
+	defer close(k.done)
+
+	ticker := time.NewTicker(keyFilterDeltaInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Failed keys are retried on the next tick, and reported by Close if
+			// they can't be written until then.
+			if err := k.writeDelta(); err != nil {
+				k.logger.Debug("failed to write key filter delta", "error", err)
+			}
+		case <-k.stop:
+			return
+		}
+	}
+}
+
+// writeDelta writes the pending keys to a new delta.
+func (k *KeyFilter) writeDelta() error {
+	k.mu.Lock()
+	keys := k.pending
+	k.pending = nil
+	k.mu.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var (
+		deltaKey = newKeyFilterDeltaKey(time.Now())
+		data     = encodeKeyFilterDelta(keys)
+		sum      = sha256.Sum256(data)
+	)
+	if err := k.backend.Put(deltaKey, sum[:], bytes.NewReader(data), int64(len(data))); err != nil {
+		// Retried with the next delta.
+		k.mu.Lock()
+		k.pending = append(keys, k.pending...)
+		k.mu.Unlock()
+		return fmt.Errorf("failed to store key filter delta: %w", err)
+	}
+
+	k.deltaRefreshMu.Lock()
+	k.deltas[string(deltaKey)] = true
+	k.deltaRefreshMu.Unlock()
+	return nil
+}
+
+// Get returns a miss for keys that are definitely not stored, and passes through
+// to the underlying backend otherwise.
+func (k *KeyFilter) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	if k.absent(actionID) {
+		k.filteredGets.Add(1)
+		return nil, nil, 0, nil, true, nil
+	}
+	return k.backend.Get(actionID)
+}
+
+// Exists reports false for keys that are definitely not stored, and asks the
+// underlying backend otherwise.
+func (k *KeyFilter) Exists(actionID []byte) (bool, error) {
+	if k.absent(actionID) {
+		return false, nil
+	}
+	return Exists(k.backend, actionID)
+}
+
+// Close writes the pending keys to a delta and closes the underlying backend.
+func (k *KeyFilter) Close() error {
+	var err error
+	if k.stop != nil {
+		select {
+		case <-k.stop:
+			// Already closed.
+		default:
+			close(k.stop)
+			<-k.done
+			err = k.writeDelta()
+		}
+	}
+	if closeErr := k.backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Clear passes through to the underlying backend.
+func (k *KeyFilter) Clear() error {
+	return k.backend.Clear()
+}
+
+// KeyFilterStats returns the loaded filter and the GETs it answered.
+func (k *KeyFilter) KeyFilterStats() KeyFilterStats {
+	k.mu.RLock()
+	stats := k.stats
+	k.mu.RUnlock()
+	stats.FilteredGets = k.filteredGets.Load()
+	return stats
+}
+
+// PutSkipStats forwards to the underlying backend.
+func (k *KeyFilter) PutSkipStats() (skipped, bytesSaved int64) {
+	return putSkipStats(k.backend)
+}
+
+// Trim forwards to the underlying backend. Trimmed keys stay in the filter until
+// it's rebuilt, which only costs a backend request.
+func (k *KeyFilter) Trim(policy TrimPolicy) (TrimStats, error) {
+	return trim(k.backend, policy)
+}
+
+// PackStats forwards to the underlying backend.
+func (k *KeyFilter) PackStats() PackStats {
+	return packStats(k.backend)
+}
+
+// BuildKeyFilter lists every key in backend, which must implement Lister, and
+// stores a bloom filter of them with the given false positive rate for
+// NewKeyFilter to load.
+func BuildKeyFilter(backend Backend, falsePositiveRate float64) (KeyFilterStats, error) {
+	lister, ok := backend.(Lister)
+	if !ok {
+		return KeyFilterStats{}, fmt.Errorf("backend does not support listing objects")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return KeyFilterStats{}, fmt.Errorf("false positive rate must be between 0 and 1, got %v", falsePositiveRate)
+	}
+
+	builtAt := time.Now()
+	keys, err := lister.List(nil)
+	if err != nil {
+		return KeyFilterStats{}, fmt.Errorf("failed to list keys: %w", err)
+	}
+	filter := newBloomFilter(len(keys), falsePositiveRate)
+	var (
+		count       int64
+		staleDeltas [][]byte
+	)
+	for _, key := range keys {
+		if writtenAt, ok := parseKeyFilterDeltaKey(key); ok {
+			// Deltas written before the filter was built list keys it contains.
+			if writtenAt.Before(builtAt.Add(-keyFilterClockSkew)) {
+				staleDeltas = append(staleDeltas, key)
+			}
+			continue
+		}
+		if string(key) != keyFilterKey {
+			filter.add(key)
+			count++
+		}
+	}
+
+	data := encodeKeyFilter(filter, builtAt, count)
+	sum := sha256.Sum256(data)
+	if err := backend.Put([]byte(keyFilterKey), sum[:], bytes.NewReader(data), int64(len(data))); err != nil {
+		return KeyFilterStats{}, fmt.Errorf("failed to store key filter: %w", err)
+	}
+	// Processes that loaded an older filter merged these deltas already.
+	if deleter, ok := backend.(Deleter); ok && len(staleDeltas) > 0 {
+		if err := deleter.Delete(staleDeltas); err != nil {
+			return KeyFilterStats{}, fmt.Errorf("failed to delete stale key filter deltas: %w", err)
+		}
+	}
+	return KeyFilterStats{Keys: count, Bytes: int64(len(data)), BuiltAt: builtAt}, nil
+}
+
+// IsMergedKeyFilterDelta reports whether key is the key of a delta object whose
+// keys a filter built at builtAt contains. Deltas are only needed until the next
+// filter is built, so these may be trimmed like entries. Deltas written since are
+// still needed, and none are merged into a zero builtAt.
+func IsMergedKeyFilterDelta(key []byte, builtAt time.Time) bool {
+	writtenAt, ok := parseKeyFilterDeltaKey(key)
+	return ok && !builtAt.IsZero() && writtenAt.Before(builtAt.Add(-keyFilterClockSkew))
+}
+
+// LoadKeyFilterStats returns the stats of the key filter stored in backend, or
+// zeros if there is none.
+func LoadKeyFilterStats(backend Backend) (KeyFilterStats, error) {
+	_, stats, err := loadKeyFilter(backend)
+	return stats, err
+}
+
+// newKeyFilterDeltaKey returns the key of a new delta written at now.
+func newKeyFilterDeltaKey(now time.Time) []byte {
+	var id [8]byte
+	rand.Read(id[:])
+	return []byte(fmt.Sprintf("%s%016x-%x", keyFilterDeltaPrefix, now.UnixNano(), id))
+}
+
+// parseKeyFilterDeltaKey returns when the delta stored under key was written. It
+// returns false if key isn't the key of a delta.
+func parseKeyFilterDeltaKey(key []byte) (time.Time, bool) {
+	name, ok := strings.CutPrefix(string(key), keyFilterDeltaPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	writtenAt, _, ok := strings.Cut(name, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(writtenAt, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// encodeKeyFilterDelta encodes a delta as a header line followed by one hex
+// encoded key per line.
+func encodeKeyFilterDelta(keys [][]byte) []byte {
+	buf := bytes.NewBufferString(keyFilterDeltaHeader)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%x\n", key)
+	}
+	return buf.Bytes()
+}
+
+// loadKeyFilterDelta downloads and decodes the delta stored under deltaKey. A
+// delta that was deleted since it was listed lists no keys.
+func loadKeyFilterDelta(backend Backend, deltaKey []byte) ([][]byte, error) {
+	_, body, _, _, miss, err := backend.Get(deltaKey)
+	if err != nil || miss {
+		return nil, err
+	}
+	defer body.Close()
+	r := bufio.NewReader(body)
+	if header, err := r.ReadString('\n'); err != nil || header != keyFilterDeltaHeader {
+		return nil, fmt.Errorf("not a key filter delta")
+	}
+	var keys [][]byte
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+}
+
+// loadKeyFilter downloads and decodes the key filter stored in backend. Returns a
+// nil filter if there is none.
+func loadKeyFilter(backend Backend) (*bloomFilter, KeyFilterStats, error) {
+	_, body, _, _, miss, err := backend.Get([]byte(keyFilterKey))
+	if err != nil || miss {
+		return nil, KeyFilterStats{}, err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, KeyFilterStats{}, err
+	}
+	return decodeKeyFilter(data)
+}
+
+// encodeKeyFilter encodes a key filter as a header line followed by big-endian
+// fields: the build time in Unix nanoseconds, the number of keys, the number of
+// hash functions, the number of 64-bit words and the words themselves.
+func encodeKeyFilter(filter *bloomFilter, builtAt time.Time, keys int64) []byte {
+	buf := bytes.NewBufferString(keyFilterHeader)
+	binary.Write(buf, binary.BigEndian, builtAt.UnixNano())
+	binary.Write(buf, binary.BigEndian, keys)
+	binary.Write(buf, binary.BigEndian, filter.hashes)
+	binary.Write(buf, binary.BigEndian, uint64(len(filter.bits)))
+	binary.Write(buf, binary.BigEndian, filter.bits)
+	return buf.Bytes()
+}
+
+// decodeKeyFilter decodes a key filter written by encodeKeyFilter.
+func decodeKeyFilter(data []byte) (*bloomFilter, KeyFilterStats, error) {
+	r, ok := bytes.CutPrefix(data, []byte(keyFilterHeader))
+	if !ok {
+		return nil, KeyFilterStats{}, fmt.Errorf("not a key filter")
+	}
+	const fixedSize = 8 + 8 + 4 + 8
+	if len(r) < fixedSize {
+		return nil, KeyFilterStats{}, fmt.Errorf("key filter is truncated")
+	}
+	var (
+		builtAt = int64(binary.BigEndian.Uint64(r[0:8]))
+		keys    = int64(binary.BigEndian.Uint64(r[8:16]))
+		hashes  = binary.BigEndian.Uint32(r[16:20])
+		words   = binary.BigEndian.Uint64(r[20:28])
+	)
+	r = r[fixedSize:]
+	if words == 0 || hashes == 0 || uint64(len(r)) != words*8 {
+		return nil, KeyFilterStats{}, fmt.Errorf("key filter has %d bytes of bits, expected %d words", len(r), words)
+	}
+	filter := &bloomFilter{bits: make([]uint64, words), hashes: hashes}
+	for i := range filter.bits {
+		filter.bits[i] = binary.BigEndian.Uint64(r[i*8:])
+	}
+	return filter, KeyFilterStats{Keys: keys, Bytes: int64(len(data)), BuiltAt: time.Unix(0, builtAt)}, nil
+}
+
+// bloomFilter is a bloom filter over byte strings, using double hashing of their
+// SHA-256 digest.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+// newBloomFilter creates a bloom filter sized for n keys with the given false
+// positive rate.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	n = max(n, 1)
+	bits := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := max(1, math.Round(bits/float64(n)*math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(bits)+63)/64),
+		hashes: uint32(hashes),
+	}
+}
+
+// positions calls fn with the bit positions of key.
+func (f *bloomFilter) positions(key []byte, fn func(word int, mask uint64) bool) {
+	var (
+		sum    = sha256.Sum256(key)
+		h1     = binary.LittleEndian.Uint64(sum[0:8])
+		h2     = binary.LittleEndian.Uint64(sum[8:16]) | 1
+		nbits  = uint64(len(f.bits)) * 64
+		hashes = uint64(f.hashes)
+	)
+	for i := range hashes {
+		bit := (h1 + i*h2) % nbits
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	f.positions(key, func(word int, mask uint64) bool {
+		f.bits[word] |= mask
+		return true
+	})
+}
+
+// mayContain reports whether key might have been added. False means that it
+// definitely wasn't.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	found := true
+	f.positions(key, func(word int, mask uint64) bool {
+		found = f.bits[word]&mask != 0
+		return found
+	})
+	return found
+}
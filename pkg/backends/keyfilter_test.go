@@ -0,0 +1,181 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000, 0.01)
+	for i := range 1000 {
+		filter.add([]byte(fmt.Sprintf("present %d", i)))
+	}
+	for i := range 1000 {
+		if !filter.mayContain([]byte(fmt.Sprintf("present %d", i))) {
+			t.Fatalf("filter doesn't contain key %d", i)
+		}
+	}
+	var falsePositives int
+	for i := range 10000 {
+		if filter.mayContain([]byte(fmt.Sprintf("absent %d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("%d false positives out of 10000, expected about 100", falsePositives)
+	}
+
+	builtAt := time.Unix(0, time.Now().UnixNano())
+	decoded, stats, err := decodeKeyFilter(encodeKeyFilter(filter, builtAt, 1000))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if stats.Keys != 1000 || !stats.BuiltAt.Equal(builtAt) || decoded.hashes != filter.hashes || len(decoded.bits) != len(filter.bits) {
+		t.Errorf("decoded %+v with %d hashes, expected 1000 keys built at %v", stats, decoded.hashes, builtAt)
+	}
+	if !decoded.mayContain([]byte("present 7")) {
+		t.Error("decoded filter lost a key")
+	}
+	if _, _, err := decodeKeyFilter([]byte(keyFilterHeader + "short")); err == nil {
+		t.Error("decoding a truncated filter succeeded")
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	var (
+		client = newFakeS3Client()
+		s3     = newTestS3(client, S3Options{})
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		data   = []byte("output")
+	)
+	for i := range 10 {
+		if err := s3.Put([]byte{byte(i)}, []byte{0xaa}, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := BuildKeyFilter(s3, DefaultKeyFilterFalsePositiveRate)
+	if err != nil {
+		t.Fatalf("BuildKeyFilter failed: %v", err)
+	}
+	if stats.Keys != 10 {
+		t.Errorf("filter has %d keys, expected 10", stats.Keys)
+	}
+
+	k := NewKeyFilter(s3, time.Hour, nil, logger)
+	getsBefore := client.getCalls.Load()
+	for i := range 10 {
+		if _, body, _, _, miss, err := k.Get([]byte{byte(i)}); miss || err != nil {
+			t.Errorf("Get(%d): miss = %v, err = %v", i, miss, err)
+		} else {
+			body.Close()
+		}
+	}
+	if client.getCalls.Load() != getsBefore+10 {
+		t.Errorf("%d backend GETs for present keys, expected 10", client.getCalls.Load()-getsBefore)
+	}
+
+	// Absent keys are misses without a backend request, unless they're false
+	// positives.
+	getsBefore = client.getCalls.Load()
+	for i := range 100 {
+		if _, _, _, _, miss, err := k.Get([]byte{0xff, byte(i)}); !miss || err != nil {
+			t.Errorf("Get of absent key: miss = %v, err = %v", miss, err)
+		}
+	}
+	filtered := k.KeyFilterStats().FilteredGets
+	if backendGets := client.getCalls.Load() - getsBefore; filtered < 90 || filtered+backendGets != 100 {
+		t.Errorf("%d of 100 misses filtered and %d sent to the backend", filtered, backendGets)
+	}
+
+	// Objects stored through the filter are found.
+	if err := k.Put([]byte{0xee}, []byte{0xbb}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := k.Exists([]byte{0xee}); !exists || err != nil {
+		t.Errorf("Exists after Put = %v, %v", exists, err)
+	}
+
+	// A stale filter is ignored.
+	if stats := NewKeyFilter(s3, time.Nanosecond, nil, logger).KeyFilterStats(); stats.Keys != 0 {
+		t.Errorf("stale filter with %d keys was loaded", stats.Keys)
+	}
+}
+
+func TestKeyFilterDeltas(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		s3      = newTestS3(client, S3Options{})
+		logger  = slog.New(slog.NewTextHandler(io.Discard, nil))
+		data    = []byte("output")
+		isEntry = func(key []byte) bool { return !bytes.HasPrefix(key, []byte("manifest/")) }
+	)
+	if _, err := BuildKeyFilter(s3, DefaultKeyFilterFalsePositiveRate); err != nil {
+		t.Fatalf("BuildKeyFilter failed: %v", err)
+	}
+	running := NewKeyFilter(s3, time.Hour, isEntry, logger)
+
+	// Keys stored after the filter was built are buffered, and written to a
+	// single delta when the writer is closed at the latest. They're found by
+	// processes started afterwards, and by running ones once they refresh the
+	// deltas.
+	writer := NewKeyFilter(s3, time.Hour, isEntry, logger)
+	for _, key := range [][]byte{{0x01}, {0x02}} {
+		if err := writer.Put(key, []byte{0xaa}, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if exists, err := writer.Exists(key); !exists || err != nil {
+			t.Errorf("Exists(%x) after storing it = %v, %v", key, exists, err)
+		}
+	}
+	if deltas, err := s3.List([]byte(keyFilterDeltaPrefix)); err != nil || len(deltas) != 0 {
+		t.Errorf("%d deltas written before closing (err %v), expected none", len(deltas), err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if deltas, err := s3.List([]byte(keyFilterDeltaPrefix)); err != nil || len(deltas) != 1 {
+		t.Errorf("%d deltas written by closing (err %v), expected 1", len(deltas), err)
+	}
+	started := NewKeyFilter(s3, time.Hour, isEntry, logger)
+	running.deltasRefreshed = time.Time{}
+	for _, k := range []*KeyFilter{started, running} {
+		for _, key := range [][]byte{{0x01}, {0x02}} {
+			if exists, err := k.Exists(key); !exists || err != nil {
+				t.Errorf("Exists(%x) after another process stored it = %v, %v", key, exists, err)
+			}
+		}
+	}
+
+	// Manifests are replaced in place, so they're never filtered.
+	if err := s3.Put([]byte("manifest/main"), []byte{0xbb}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := started.Exists([]byte("manifest/main")); !exists || err != nil {
+		t.Errorf("Exists of a manifest stored without a delta = %v, %v", exists, err)
+	}
+
+	// Building a filter deletes the deltas written well before it, and only those
+	// may be trimmed.
+	var (
+		stale    = encodeKeyFilterDelta([][]byte{{0x03}})
+		staleKey = newKeyFilterDeltaKey(time.Now().Add(-time.Hour))
+	)
+	if err := s3.Put(staleKey, []byte{0xcc}, bytes.NewReader(stale), int64(len(stale))); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := BuildKeyFilter(s3, DefaultKeyFilterFalsePositiveRate)
+	if err != nil {
+		t.Fatalf("BuildKeyFilter failed: %v", err)
+	}
+	deltas, err := s3.List([]byte(keyFilterDeltaPrefix))
+	if err != nil || len(deltas) != 1 {
+		t.Fatalf("%d deltas left after rebuilding the filter (err %v), expected the recent one", len(deltas), err)
+	}
+	if !IsMergedKeyFilterDelta(staleKey, stats.BuiltAt) || IsMergedKeyFilterDelta(deltas[0], stats.BuiltAt) {
+		t.Error("expected only the stale delta to be merged into the rebuilt filter")
+	}
+}
@@ -0,0 +1,829 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// packPrefix and packIndexPrefix namespace pack objects and their indexes, so
+	// that they never collide with entries.
+	packPrefix      = "pack/"
+	packIndexPrefix = "packidx/"
+
+	packIndexHeader = "gobuildcache-packindex v1"
+
+	// packIndexRefreshInterval bounds how often a miss makes Pack look for packs
+	// written by other processes.
+	packIndexRefreshInterval = 30 * time.Second
+)
+
+// PackOptions configures a Pack.
+type PackOptions struct {
+	// Threshold is the size of the largest object that is packed. Larger objects
+	// are stored in the wrapped backend as they are.
+	Threshold int64
+	// PackSize is the size at which a pack is written out.
+	PackSize int64
+	// IndexDir is a directory where pack indexes are cached between processes, so
+	// that each index is only downloaded once. Empty disables the cache.
+	IndexDir string
+}
+
+// DefaultPackOptions returns the default pack options, which pack objects of up
+// to 64KB into packs of 8MB.
+func DefaultPackOptions() PackOptions {
+	return PackOptions{
+		Threshold: 64 << 10,
+		PackSize:  8 << 20,
+	}
+}
+
+// PackStats counts the activity of a Pack.
+type PackStats struct {
+	PackedPuts  int64 // PUTs buffered into a pack
+	PackedBytes int64
+	Packs       int64 // Packs written
+	PackedGets  int64 // GETs served from a pack
+}
+
+// PackStatsReporter is implemented by backends that pack small objects. Wrappers
+// forward it to the backend they wrap.
+type PackStatsReporter interface {
+	PackStats() PackStats
+}
+
+// packStats returns the pack stats of backend, or zeros if it doesn't implement
+// PackStatsReporter.
+func packStats(backend Backend) PackStats {
+	if r, ok := backend.(PackStatsReporter); ok {
+		return r.PackStats()
+	}
+	return PackStats{}
+}
+
+// packEntry locates an object in a pack.
+type packEntry struct {
+	packID   string
+	outputID []byte
+	offset   int64
+	size     int64
+	putTime  time.Time
+}
+
+// pendingPack is a pack that hasn't been written yet.
+type pendingPack struct {
+	id      string
+	buf     bytes.Buffer
+	entries map[string]packEntry
+}
+
+func newPendingPack() *pendingPack {
+	var id [8]byte
+	rand.Read(id[:])
+	return &pendingPack{
+		// Sorting by name sorts packs by age.
+		id:      fmt.Sprintf("%016x%x", time.Now().UnixNano(), id),
+		entries: make(map[string]packEntry),
+	}
+}
+
+// Pack wraps a Backend and packs small objects, which make up most build outputs
+// but whose cost is dominated by per-request latency and pricing. Small PUTs are
+// buffered and written as a pack object holding their bodies back to back, plus a
+// pack index object listing where each of them is. GETs look objects up in the
+// pack indexes, which are downloaded once and kept in memory, and read them from
+// their pack with a ranged read.
+//
+// Pack finds the packs written by other processes by listing the pack indexes,
+// at startup and at most once per packIndexRefreshInterval after a miss, so it
+// works best with a backend that implements Lister. Buffered objects are lost if
+// the process exits without calling Close.
+type Pack struct {
+	backend Backend
+	opts    PackOptions
+	logger  *slog.Logger
+
+	mu sync.Mutex
+	// pending is the pack that PUTs are added to, and flushing holds the packs
+	// being written.
+	pending  *pendingPack
+	flushing map[string]*pendingPack
+	// index maps keys to the newest packed object stored under them, and packs
+	// holds the full index of every known pack.
+	index       map[string]packEntry
+	packs       map[string]map[string]packEntry
+	lastRefresh time.Time
+
+	packedPuts  atomic.Int64
+	packedBytes atomic.Int64
+	packsCount  atomic.Int64
+	packedGets  atomic.Int64
+}
+
+// NewPack creates a packing wrapper around an existing backend and loads the
+// indexes of the packs that are already stored in it.
+func NewPack(backend Backend, opts PackOptions, logger *slog.Logger) *Pack {
+	p := &Pack{
+		backend:  backend,
+		opts:     opts,
+		logger:   logger,
+		pending:  newPendingPack(),
+		flushing: make(map[string]*pendingPack),
+		index:    make(map[string]packEntry),
+		packs:    make(map[string]map[string]packEntry),
+	}
+	if err := p.refreshIndex(); err != nil {
+		p.logger.Warn("failed to load pack indexes", "error", err)
+	}
+	return p
+}
+
+// Put buffers objects up to the threshold size into the pending pack, writing it
+// out once it's full, and stores larger objects in the wrapped backend.
+func (p *Pack) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	if bodySize > p.opts.Threshold {
+		return p.backend.Put(actionID, outputID, body, bodySize)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, bodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	if int64(len(data)) != bodySize {
+		return fmt.Errorf("body is %d bytes, expected %d", len(data), bodySize)
+	}
+	p.packedPuts.Add(1)
+	p.packedBytes.Add(bodySize)
+
+	if full := p.add(actionID, outputID, data, time.Now()); full != nil {
+		return p.flush(full)
+	}
+	return nil
+}
+
+// add appends an object to the pending pack, and returns the pack if it's full
+// and needs to be flushed.
+func (p *Pack) add(actionID, outputID, data []byte, putTime time.Time) *pendingPack {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp := p.pending
+	pp.entries[string(actionID)] = packEntry{
+		packID:   pp.id,
+		outputID: bytes.Clone(outputID),
+		offset:   int64(pp.buf.Len()),
+		size:     int64(len(data)),
+		putTime:  putTime,
+	}
+	pp.buf.Write(data)
+	if int64(pp.buf.Len()) < p.opts.PackSize {
+		return nil
+	}
+	p.pending = newPendingPack()
+	p.flushing[pp.id] = pp
+	return pp
+}
+
+// Flush writes out the pending pack, if it holds any objects.
+func (p *Pack) Flush() error {
+	p.mu.Lock()
+	pp := p.pending
+	if len(pp.entries) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	p.pending = newPendingPack()
+	p.flushing[pp.id] = pp
+	p.mu.Unlock()
+	return p.flush(pp)
+}
+
+// flush writes pp and then its index, so that an index never refers to a pack
+// that doesn't exist, and moves its objects from pp to the index.
+func (p *Pack) flush(pp *pendingPack) error {
+	err := p.writePack(pp)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.flushing, pp.id)
+	if err != nil {
+		return fmt.Errorf("failed to write pack %s with %d objects: %w", pp.id, len(pp.entries), err)
+	}
+	p.addPackLocked(pp.id, pp.entries)
+	p.packsCount.Add(1)
+	return nil
+}
+
+func (p *Pack) writePack(pp *pendingPack) error {
+	data := pp.buf.Bytes()
+	sum := sha256.Sum256(data)
+	if err := p.backend.Put(packKey(pp.id), sum[:], bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	index := encodePackIndex(pp.entries)
+	sum = sha256.Sum256(index)
+	if err := p.backend.Put(packIndexKey(pp.id), sum[:], bytes.NewReader(index), int64(len(index))); err != nil {
+		return err
+	}
+	p.cacheIndex(pp.id, index)
+	return nil
+}
+
+// Get returns a packed object from its pack, and anything else from the wrapped
+// backend.
+func (p *Pack) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	if outputID, body, size, putTime, ok, err := p.getPacked(actionID); ok || err != nil {
+		return outputID, body, size, putTime, false, err
+	}
+	outputID, body, size, putTime, miss, err := p.backend.Get(actionID)
+	if err != nil || !miss {
+		return outputID, body, size, putTime, miss, err
+	}
+
+	// The object may have been packed by another process since the indexes were
+	// last listed.
+	if p.refreshDue() {
+		if err := p.refreshIndex(); err != nil {
+			p.logger.Debug("failed to refresh pack indexes", "error", err)
+		}
+		if outputID, body, size, putTime, ok, err := p.getPacked(actionID); ok || err != nil {
+			return outputID, body, size, putTime, false, err
+		}
+	}
+	return nil, nil, 0, nil, true, nil
+}
+
+// getPacked returns a packed object, or ok=false if actionID isn't packed.
+func (p *Pack) getPacked(actionID []byte) (outputID []byte, body io.ReadCloser, size int64, putTime *time.Time, ok bool, err error) {
+	p.mu.Lock()
+	entry, data, pending := p.lookupPendingLocked(actionID)
+	found := pending
+	if !pending {
+		entry, found = p.index[string(actionID)]
+	}
+	p.mu.Unlock()
+	if !found {
+		return nil, nil, 0, nil, false, nil
+	}
+
+	switch {
+	case pending:
+		body = io.NopCloser(bytes.NewReader(data))
+	case entry.size == 0:
+		body = io.NopCloser(bytes.NewReader(nil))
+	default:
+		var miss bool
+		body, miss, err = getRange(p.backend, packKey(entry.packID), entry.offset, entry.size)
+		if err != nil {
+			return nil, nil, 0, nil, false, fmt.Errorf("failed to read pack %s: %w", entry.packID, err)
+		}
+		if miss {
+			// Removed by repack or trimming.
+			p.mu.Lock()
+			p.removePackLocked(entry.packID)
+			p.mu.Unlock()
+			return nil, nil, 0, nil, false, nil
+		}
+	}
+	p.packedGets.Add(1)
+	return entry.outputID, body, entry.size, &entry.putTime, true, nil
+}
+
+// lookupPendingLocked returns an object that hasn't been written yet, along with a
+// copy of its data.
+func (p *Pack) lookupPendingLocked(actionID []byte) (packEntry, []byte, bool) {
+	lookup := func(pp *pendingPack) (packEntry, []byte, bool) {
+		entry, ok := pp.entries[string(actionID)]
+		if !ok {
+			return entry, nil, false
+		}
+		return entry, bytes.Clone(pp.buf.Bytes()[entry.offset : entry.offset+entry.size]), true
+	}
+	if entry, data, ok := lookup(p.pending); ok {
+		return entry, data, true
+	}
+	for _, pp := range p.flushing {
+		if entry, data, ok := lookup(pp); ok {
+			return entry, data, true
+		}
+	}
+	return packEntry{}, nil, false
+}
+
+// Exists reports whether an object is packed or stored in the wrapped backend.
+func (p *Pack) Exists(actionID []byte) (bool, error) {
+	p.mu.Lock()
+	_, _, found := p.lookupPendingLocked(actionID)
+	if !found {
+		_, found = p.index[string(actionID)]
+	}
+	p.mu.Unlock()
+	if found {
+		return true, nil
+	}
+	return Exists(p.backend, actionID)
+}
+
+// List returns the keys starting with prefix of objects that are packed, buffered
+// or stored in the wrapped backend. Pack objects and their indexes are left out.
+func (p *Pack) List(prefix []byte) ([][]byte, error) {
+	lister, ok := p.backend.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("backend does not support listing objects")
+	}
+	keys, err := lister.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.refreshIndex(); err != nil {
+		return nil, err
+	}
+
+	var (
+		listed = make([][]byte, 0, len(keys))
+		seen   = make(map[string]bool, len(keys))
+		add    = func(key string) {
+			if !seen[key] && strings.HasPrefix(key, string(prefix)) {
+				seen[key] = true
+				listed = append(listed, []byte(key))
+			}
+		}
+	)
+	for _, key := range keys {
+		if !bytes.HasPrefix(key, []byte(packPrefix)) && !bytes.HasPrefix(key, []byte(packIndexPrefix)) {
+			add(string(key))
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.index {
+		add(key)
+	}
+	for key := range p.pending.entries {
+		add(key)
+	}
+	for _, pp := range p.flushing {
+		for key := range pp.entries {
+			add(key)
+		}
+	}
+	return listed, nil
+}
+
+// refreshDue reports whether the pack indexes haven't been listed for at least
+// packIndexRefreshInterval.
+func (p *Pack) refreshDue() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Since(p.lastRefresh) >= packIndexRefreshInterval
+}
+
+// refreshIndex lists the pack indexes in the wrapped backend, loads the ones that
+// aren't known yet and forgets the packs whose index was removed.
+func (p *Pack) refreshIndex() error {
+	lister, ok := p.backend.(Lister)
+	if !ok {
+		return nil
+	}
+	p.mu.Lock()
+	p.lastRefresh = time.Now()
+	p.mu.Unlock()
+
+	keys, err := lister.List([]byte(packIndexPrefix))
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		id := strings.TrimPrefix(string(key), packIndexPrefix)
+		listed[id] = true
+
+		p.mu.Lock()
+		_, known := p.packs[id]
+		p.mu.Unlock()
+		if known {
+			continue
+		}
+		entries, err := p.loadIndex(id)
+		if err != nil {
+			p.logger.Warn("skipping invalid pack index", "pack", id, "error", err)
+			continue
+		}
+		p.mu.Lock()
+		p.addPackLocked(id, entries)
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.packs {
+		if !listed[id] {
+			p.removePackLocked(id)
+		}
+	}
+	return nil
+}
+
+// loadIndex returns the entries of a pack index, from the local index cache if
+// it's there and from the wrapped backend otherwise.
+func (p *Pack) loadIndex(id string) (map[string]packEntry, error) {
+	if p.opts.IndexDir != "" {
+		if data, err := os.ReadFile(filepath.Join(p.opts.IndexDir, id+".idx")); err == nil {
+			if entries, err := decodePackIndex(id, data); err == nil {
+				return entries, nil
+			}
+		}
+	}
+
+	_, body, _, _, miss, err := p.backend.Get(packIndexKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if miss {
+		return nil, fmt.Errorf("pack index is missing")
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodePackIndex(id, data)
+	if err != nil {
+		return nil, err
+	}
+	p.cacheIndex(id, data)
+	return entries, nil
+}
+
+// cacheIndex stores a pack index in the local index cache.
+func (p *Pack) cacheIndex(id string, data []byte) {
+	if p.opts.IndexDir == "" {
+		return
+	}
+	if err := os.MkdirAll(p.opts.IndexDir, 0755); err != nil {
+		p.logger.Debug("failed to create pack index directory", "error", err)
+		return
+	}
+	path := filepath.Join(p.opts.IndexDir, id+".idx")
+	tmp, err := os.CreateTemp(p.opts.IndexDir, id+".*.tmp")
+	if err != nil {
+		p.logger.Debug("failed to cache pack index", "pack", id, "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		p.logger.Debug("failed to cache pack index", "pack", id, "error", err)
+	}
+}
+
+// addPackLocked records the entries of a pack. Where several packs hold an object
+// with the same key, the newest one wins.
+func (p *Pack) addPackLocked(id string, entries map[string]packEntry) {
+	p.packs[id] = entries
+	for key, entry := range entries {
+		if current, ok := p.index[key]; !ok || !current.putTime.After(entry.putTime) {
+			p.index[key] = entry
+		}
+	}
+}
+
+// removePackLocked forgets a pack and drops it from the local index cache.
+func (p *Pack) removePackLocked(id string) {
+	for key := range p.packs[id] {
+		if p.index[key].packID == id {
+			delete(p.index, key)
+		}
+	}
+	delete(p.packs, id)
+	if p.opts.IndexDir != "" {
+		os.Remove(filepath.Join(p.opts.IndexDir, id+".idx"))
+	}
+}
+
+// RepackStats holds the results of Repack.
+type RepackStats struct {
+	Packs        int   // Packs found
+	Repacked     int   // Packs whose objects were moved to new packs and then deleted
+	Missing      int   // Pack indexes whose pack no longer exists, which were deleted
+	Objects      int64 // Objects moved to new packs
+	Bytes        int64
+	DroppedBytes int64 // Bytes of objects superseded by newer ones, which were dropped
+}
+
+// Repack compacts the packs in the wrapped backend, which must implement Lister
+// and Deleter. Packs that are less than half full, or in which more than half of
+// the data has been superseded by newer objects, are rewritten into full packs,
+// and then their indexes and the packs themselves are deleted. Pack indexes whose
+// pack was removed, for example by trimming, are deleted as well.
+//
+// Processes that loaded an index before it was deleted find the pack missing on
+// their next GET from it, and pick up the new packs on their next refresh.
+func (p *Pack) Repack() (RepackStats, error) {
+	var stats RepackStats
+	deleter, ok := p.backend.(Deleter)
+	if _, listable := p.backend.(Lister); !ok || !listable {
+		return stats, fmt.Errorf("backend does not support listing and deleting objects")
+	}
+	if err := p.refreshIndex(); err != nil {
+		return stats, err
+	}
+
+	type candidate struct {
+		id                    string
+		live                  []string
+		liveBytes, totalBytes int64
+	}
+	var candidates []candidate
+	p.mu.Lock()
+	stats.Packs = len(p.packs)
+	for id, entries := range p.packs {
+		c := candidate{id: id}
+		for key, entry := range entries {
+			c.totalBytes += entry.size
+			if p.index[key].packID == id {
+				c.live = append(c.live, key)
+				c.liveBytes += entry.size
+			}
+		}
+		if c.liveBytes < p.opts.PackSize/2 || c.liveBytes < c.totalBytes/2 {
+			candidates = append(candidates, c)
+		}
+	}
+	p.mu.Unlock()
+	// A single undersized pack without superseded objects would just be rewritten
+	// as is, unless it's missing and its index needs to go.
+	if len(candidates) == 1 && candidates[0].liveBytes == candidates[0].totalBytes {
+		exists, err := Exists(p.backend, packKey(candidates[0].id))
+		if err != nil || exists {
+			return stats, err
+		}
+	}
+
+	var repacked, missing []string
+	for _, c := range candidates {
+		_, body, _, _, miss, err := p.backend.Get(packKey(c.id))
+		if err != nil {
+			return stats, fmt.Errorf("failed to read pack %s: %w", c.id, err)
+		}
+		if miss {
+			missing = append(missing, c.id)
+			continue
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return stats, fmt.Errorf("failed to read pack %s: %w", c.id, err)
+		}
+
+		p.mu.Lock()
+		entries := p.packs[c.id]
+		p.mu.Unlock()
+		for _, key := range c.live {
+			entry := entries[key]
+			if entry.offset+entry.size > int64(len(data)) {
+				return stats, fmt.Errorf("pack %s is truncated", c.id)
+			}
+			if full := p.add([]byte(key), entry.outputID, data[entry.offset:entry.offset+entry.size], entry.putTime); full != nil {
+				if err := p.flush(full); err != nil {
+					return stats, err
+				}
+			}
+			stats.Objects++
+			stats.Bytes += entry.size
+		}
+		stats.DroppedBytes += c.totalBytes - c.liveBytes
+		repacked = append(repacked, c.id)
+	}
+	if err := p.Flush(); err != nil {
+		return stats, err
+	}
+
+	// Delete the indexes first, so that an index never refers to a missing pack
+	// for longer than necessary.
+	var indexKeys, packKeys [][]byte
+	for _, id := range append(repacked, missing...) {
+		indexKeys = append(indexKeys, packIndexKey(id))
+	}
+	for _, id := range repacked {
+		packKeys = append(packKeys, packKey(id))
+	}
+	if err := deleter.Delete(indexKeys); err != nil {
+		return stats, err
+	}
+	if err := deleter.Delete(packKeys); err != nil {
+		return stats, err
+	}
+	p.mu.Lock()
+	for _, id := range append(repacked, missing...) {
+		p.removePackLocked(id)
+	}
+	p.mu.Unlock()
+	stats.Repacked = len(repacked)
+	stats.Missing = len(missing)
+	return stats, nil
+}
+
+// Close writes out the pending pack and closes the underlying backend.
+func (p *Pack) Close() error {
+	flushErr := p.Flush()
+	if err := p.backend.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// Clear passes through to the underlying backend and forgets all packs.
+func (p *Pack) Clear() error {
+	p.mu.Lock()
+	for id := range p.packs {
+		p.removePackLocked(id)
+	}
+	p.pending = newPendingPack()
+	p.mu.Unlock()
+	return p.backend.Clear()
+}
+
+// PackStats returns the activity of the packer.
+func (p *Pack) PackStats() PackStats {
+	return PackStats{
+		PackedPuts:  p.packedPuts.Load(),
+		PackedBytes: p.packedBytes.Load(),
+		Packs:       p.packsCount.Load(),
+		PackedGets:  p.packedGets.Load(),
+	}
+}
+
+// PutSkipStats forwards to the underlying backend.
+func (p *Pack) PutSkipStats() (skipped, bytesSaved int64) {
+	return putSkipStats(p.backend)
+}
+
+// Trim removes objects from the underlying backend according to policy. A pack
+// and its index are trimmed together, as a single entry that was created with
+// the pack and last used when either of them was, and a pack holding a live
+// object that isn't an entry, such as a manifest, is never trimmed.
+func (p *Pack) Trim(policy TrimPolicy) (TrimStats, error) {
+	if err := p.refreshIndex(); err != nil {
+		return TrimStats{}, err
+	}
+	stats, err := trimWithLayout(p, policy)
+	if err == nil && !policy.DryRun {
+		err = p.refreshIndex()
+	}
+	return stats, err
+}
+
+func (p *Pack) trimBackend() Backend {
+	return p.backend
+}
+
+// trimCandidates groups each pack with its index. The entries of a pack are the
+// objects in it that haven't been superseded by a newer pack. Packs without an
+// index and indexes without a pack hold no entries.
+func (p *Pack) trimCandidates(objects []TrimEntry) ([]trimCandidate, error) {
+	var (
+		packs  = make(map[string]*trimCandidate)
+		order  []string
+		others []TrimEntry
+	)
+	for _, object := range objects {
+		var id string
+		switch {
+		case strings.HasPrefix(object.Key, packPrefix):
+			id = strings.TrimPrefix(object.Key, packPrefix)
+		case strings.HasPrefix(object.Key, packIndexPrefix):
+			id = strings.TrimPrefix(object.Key, packIndexPrefix)
+		default:
+			others = append(others, object)
+			continue
+		}
+		candidate, ok := packs[id]
+		if !ok {
+			candidate = &trimCandidate{TrimEntry: TrimEntry{Key: string(packKey(id)), Created: object.Created}}
+			packs[id] = candidate
+			order = append(order, id)
+		}
+		candidate.Size += object.Size
+		candidate.objects = append(candidate.objects, []byte(object.Key))
+		if object.Key == string(packKey(id)) {
+			candidate.Created = object.Created
+		}
+		if object.LastUsed.After(candidate.LastUsed) {
+			candidate.LastUsed = object.LastUsed
+		}
+	}
+
+	// Packs written since the indexes were last listed.
+	for _, id := range order {
+		p.mu.Lock()
+		_, known := p.packs[id]
+		p.mu.Unlock()
+		if known || len(packs[id].objects) < 2 {
+			continue
+		}
+		entries, err := p.loadIndex(id)
+		if err != nil {
+			p.logger.Warn("skipping invalid pack index", "pack", id, "error", err)
+			continue
+		}
+		p.mu.Lock()
+		p.addPackLocked(id, entries)
+		p.mu.Unlock()
+	}
+
+	candidates, err := layoutCandidates(p.backend, others)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range order {
+		candidate := packs[id]
+		if len(candidate.objects) == 2 {
+			for key, entry := range p.packs[id] {
+				if p.index[key].packID != id {
+					continue
+				}
+				if candidate.outputIDs == nil {
+					candidate.outputIDs = make(map[string][]byte)
+				}
+				candidate.entries = append(candidate.entries, []byte(key))
+				candidate.outputIDs[key] = entry.outputID
+			}
+		}
+		candidates = append(candidates, *candidate)
+	}
+	return candidates, nil
+}
+
+func packKey(id string) []byte {
+	return []byte(packPrefix + id)
+}
+
+func packIndexKey(id string) []byte {
+	return []byte(packIndexPrefix + id)
+}
+
+// encodePackIndex encodes the index of a pack, which lists one object per line
+// after a header:
+//
+//	<hex key> <hex output ID> <offset> <size> <put time in Unix nanoseconds>
+func encodePackIndex(entries map[string]packEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(packIndexHeader + "\n")
+	for key, entry := range entries {
+		fmt.Fprintf(&buf, "%x %x %d %d %d\n", key, entry.outputID, entry.offset, entry.size, entry.putTime.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+// decodePackIndex decodes the index of the pack id.
+func decodePackIndex(id string, data []byte) (map[string]packEntry, error) {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != packIndexHeader {
+		return nil, errors.New("not a pack index")
+	}
+	entries := make(map[string]packEntry, len(lines)-1)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		key, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		entry := packEntry{packID: id}
+		if entry.outputID, err = hex.DecodeString(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid output ID: %w", err)
+		}
+		var nums [3]int64
+		for i, field := range fields[2:] {
+			if nums[i], err = strconv.ParseInt(field, 10, 64); err != nil || nums[i] < 0 {
+				return nil, fmt.Errorf("invalid number %q", field)
+			}
+		}
+		entry.offset, entry.size, entry.putTime = nums[0], nums[1], time.Unix(0, nums[2])
+		entries[string(key)] = entry
+	}
+	return entries, nil
+}
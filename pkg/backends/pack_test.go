@@ -0,0 +1,231 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPack(client *fakeS3Client, opts PackOptions) *Pack {
+	return NewPack(newTestS3(client, S3Options{}), opts, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// mustGet returns the body of the object stored under key.
+func mustGet(t *testing.T, backend Backend, key []byte) []byte {
+	t.Helper()
+	_, body, _, _, miss, err := backend.Get(key)
+	if err != nil || miss {
+		t.Fatalf("Get(%x): miss = %v, err = %v", key, miss, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// countKeys returns the number of objects in client whose key starts with the
+// hex encoding of prefix.
+func countKeys(client *fakeS3Client, prefix string) int {
+	client.Lock()
+	defer client.Unlock()
+	var n int
+	for key := range client.objects {
+		if strings.HasPrefix(key, fmt.Sprintf("test/%x", prefix)) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPackSmallObjects(t *testing.T) {
+	var (
+		client   = newFakeS3Client()
+		indexDir = t.TempDir()
+		opts     = PackOptions{Threshold: 1024, PackSize: 4096, IndexDir: indexDir}
+		p        = newTestPack(client, opts)
+		large    = randomBytes(t, 2000)
+	)
+	for i := range 10 {
+		if err := p.Put([]byte{byte(i)}, []byte{0xaa}, bytes.NewReader(randomBytes(t, 500+i)), int64(500+i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := p.Put([]byte{0xff}, []byte{0xbb}, bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// The first nine objects fill a pack, which is written along with its index.
+	// The large object is stored as is.
+	if packs, indexes := countKeys(client, packPrefix), countKeys(client, packIndexPrefix); packs != 1 || indexes != 1 {
+		t.Fatalf("found %d packs and %d indexes, expected 1 of each", packs, indexes)
+	}
+
+	// The last object is still buffered, but can be read back.
+	getsBefore := client.getCalls.Load()
+	if data := mustGet(t, p, []byte{9}); !bytes.Equal(data, randomBytes(t, 509)) {
+		t.Error("buffered object has wrong contents")
+	}
+	if client.getCalls.Load() != getsBefore {
+		t.Error("reading a buffered object issued a GET")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if packs := countKeys(client, packPrefix); packs != 2 {
+		t.Fatalf("found %d packs after Close, expected 2", packs)
+	}
+
+	// Another process finds the packs, using the cached indexes.
+	getsBefore = client.getCalls.Load()
+	other := newTestPack(client, opts)
+	if client.getCalls.Load() != getsBefore {
+		t.Error("cached pack indexes were downloaded again")
+	}
+	for i := range 10 {
+		if data := mustGet(t, other, []byte{byte(i)}); !bytes.Equal(data, randomBytes(t, 500+i)) {
+			t.Errorf("object %d has wrong contents", i)
+		}
+		if client.lastGet.Range == nil {
+			t.Errorf("object %d was not read with a ranged GET", i)
+		}
+	}
+	if data := mustGet(t, other, []byte{0xff}); !bytes.Equal(data, large) {
+		t.Error("large object has wrong contents")
+	}
+	if stats := other.PackStats(); stats.PackedGets != 10 {
+		t.Errorf("served %d GETs from packs, expected 10", stats.PackedGets)
+	}
+	if _, _, _, _, miss, err := other.Get([]byte{0xee}); !miss || err != nil {
+		t.Errorf("expected miss, got miss = %v, err = %v", miss, err)
+	}
+
+	// Listing finds packed objects but not the packs.
+	if keys, err := other.List(nil); err != nil || len(keys) != 11 {
+		t.Errorf("listed %d keys (err %v), expected 11", len(keys), err)
+	}
+}
+
+func TestPackRepack(t *testing.T) {
+	var (
+		client = newFakeS3Client()
+		opts   = PackOptions{Threshold: 1024, PackSize: 4096}
+		p      = newTestPack(client, opts)
+	)
+	// Three small packs, the last of which supersedes an object in the first.
+	for i := range 3 {
+		for j := range 2 {
+			key := []byte{byte(i), byte(j)}
+			if i == 2 && j == 1 {
+				key = []byte{0, 0}
+			}
+			data := []byte(fmt.Sprintf("pack %d object %d", i, j))
+			if err := p.Put(key, []byte{0xaa}, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := newTestPack(client, opts).Repack()
+	if err != nil {
+		t.Fatalf("Repack failed: %v", err)
+	}
+	if stats.Packs != 3 || stats.Repacked != 3 || stats.Objects != 5 || stats.DroppedBytes != int64(len("pack 0 object 0")) {
+		t.Errorf("stats = %+v, expected 3 packs with 5 live objects repacked", stats)
+	}
+	if packs, indexes := countKeys(client, packPrefix), countKeys(client, packIndexPrefix); packs != 1 || indexes != 1 {
+		t.Fatalf("found %d packs and %d indexes after repacking, expected 1 of each", packs, indexes)
+	}
+
+	fresh := newTestPack(client, opts)
+	if data := mustGet(t, fresh, []byte{0, 0}); string(data) != "pack 2 object 1" {
+		t.Errorf("superseded object has contents %q", data)
+	}
+	if data := mustGet(t, fresh, []byte{1, 1}); string(data) != "pack 1 object 1" {
+		t.Errorf("repacked object has contents %q", data)
+	}
+
+	// The index of a trimmed pack is removed.
+	client.Lock()
+	for key := range client.objects {
+		if strings.HasPrefix(key, fmt.Sprintf("test/%x", packPrefix)) {
+			delete(client.objects, key)
+		}
+	}
+	client.Unlock()
+	stats, err = newTestPack(client, opts).Repack()
+	if err != nil || stats.Missing != 1 || countKeys(client, packIndexPrefix) != 0 {
+		t.Errorf("repacking a trimmed pack: stats = %+v, err = %v", stats, err)
+	}
+}
+
+func TestPackTrim(t *testing.T) {
+	var (
+		client = newFakeS3Client()
+		opts   = PackOptions{Threshold: 1024, PackSize: 4096}
+		p      = newTestPack(client, opts)
+		s3     = p.backend.(*S3)
+		now    = time.Now()
+	)
+	// An unused pack, a pack that was used recently and a pack holding a manifest.
+	var ids []string
+	for _, keys := range [][]string{{"v201", "v202"}, {"v203"}, {"v204", "manifest/main"}} {
+		for _, key := range keys {
+			if err := p.Put([]byte(key), []byte{0xaa}, strings.NewReader("output"), 6); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, p.pending.id)
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Lock()
+	for _, object := range client.objects {
+		object.modified = now.Add(-30 * 24 * time.Hour)
+	}
+	client.Unlock()
+	if err := s3.writeAccessLog(map[string]time.Time{hex.EncodeToString(packKey(ids[1])): now.Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := TrimPolicy{
+		UnusedFor: 7 * 24 * time.Hour,
+		IsEntry:   func(key []byte) bool { return !strings.HasPrefix(string(key), "manifest/") },
+	}
+	stats, err := newTestPack(client, opts).Trim(policy)
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if stats.Entries != 2 || stats.EvictedEntries != 1 {
+		t.Errorf("stats = %+v, expected 1 of 2 unprotected packs to be evicted", stats)
+	}
+	// The index of the used pack is as old as the unused pack, but only goes with
+	// its pack.
+	for i, expected := range []bool{false, true, true} {
+		for _, key := range [][]byte{packKey(ids[i]), packIndexKey(ids[i])} {
+			client.Lock()
+			_, exists := client.objects[s3.actionIDToKey(key)]
+			client.Unlock()
+			if exists != expected {
+				t.Errorf("%s exists = %v after trim, expected %v", key, exists, expected)
+			}
+		}
+	}
+
+	fresh := newTestPack(client, opts)
+	if _, _, _, _, miss, err := fresh.Get([]byte("v201")); err != nil || !miss {
+		t.Errorf("entry of a trimmed pack: miss = %v, err = %v", miss, err)
+	}
+	if data := mustGet(t, fresh, []byte("manifest/main")); string(data) != "output" {
+		t.Errorf("manifest has contents %q", data)
+	}
+}
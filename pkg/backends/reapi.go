@@ -0,0 +1,590 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// reapiActionPrefix is hashed together with a key to form its action digest,
+	// so that Go entries never collide with the actions of other build systems.
+	reapiActionPrefix = "gobuildcache/"
+
+	// reapiOutputPrefix is the path prefix of the output file of an action result.
+	// The rest of the path is the hex encoded output ID.
+	reapiOutputPrefix = "gobuildcache/output/"
+
+	// reapiChunkSize is the size of the messages blobs are streamed in.
+	reapiChunkSize = 1 << 20
+)
+
+// REAPIOptions holds client configuration for the REAPI backend.
+type REAPIOptions struct {
+	// InstanceName is the REAPI instance to use, empty for the default one.
+	InstanceName string
+	// Headers are sent with every request, e.g. for authentication.
+	Headers map[string]string
+	// ByteStreamThreshold is the blob size above which blobs are transferred with
+	// ByteStream rather than batch requests. It must be below the server's
+	// maximum gRPC message size.
+	ByteStreamThreshold int64
+	// RequestTimeout bounds a complete request including the body, 0 for none.
+	RequestTimeout time.Duration
+}
+
+// DefaultREAPIOptions returns the default tunables for the REAPI backend.
+func DefaultREAPIOptions() REAPIOptions {
+	return REAPIOptions{ByteStreamThreshold: 1 << 20}
+}
+
+// REAPI implements Backend using the ActionCache and ContentAddressableStorage
+// services of the Bazel Remote Execution API, as served by BuildBuddy, Buildbarn
+// or bazel-remote. Every entry is an action result keyed by a digest derived from
+// its key, with a single output file that references the body in the CAS. The
+// output file's path holds the output ID, and the put time is the completion time
+// of the action result.
+//
+// Small bodies are uploaded and downloaded with batch requests, and larger ones
+// are streamed with ByteStream. Bodies that are already in the CAS aren't
+// uploaded again. The server evicts entries itself, so trimming and clearing are
+// left to it.
+type REAPI struct {
+	conn       io.Closer // nil if the connection isn't owned by the backend
+	ac         repb.ActionCacheClient
+	cas        repb.ContentAddressableStorageClient
+	byteStream bytestream.ByteStreamClient
+	opts       REAPIOptions
+	headers    []string // Alternating header names and values
+
+	skippedPuts atomic.Int64
+	bytesSaved  atomic.Int64
+}
+
+// NewREAPI creates a backend that connects to the REAPI server at target, which is
+// either grpc://host:port or grpcs://host:port for TLS.
+func NewREAPI(target string, opts REAPIOptions) (*REAPI, error) {
+	var creds credentials.TransportCredentials
+	switch {
+	case strings.HasPrefix(target, "grpcs://"):
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	case strings.HasPrefix(target, "grpc://"):
+		creds = insecure.NewCredentials()
+	default:
+		return nil, fmt.Errorf("REAPI URL must start with grpc:// or grpcs://, got %q", target)
+	}
+	_, addr, _ := strings.Cut(target, "://")
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REAPI client: %w", err)
+	}
+	r, err := newREAPI(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r.conn = conn
+	return r, nil
+}
+
+// newREAPI creates an REAPI backend around an existing connection, validating opts
+// and filling in defaults.
+func newREAPI(conn grpc.ClientConnInterface, opts REAPIOptions) (*REAPI, error) {
+	if opts.ByteStreamThreshold <= 0 {
+		opts.ByteStreamThreshold = DefaultREAPIOptions().ByteStreamThreshold
+	}
+	if opts.ByteStreamThreshold > 4<<20 {
+		return nil, fmt.Errorf("ByteStream threshold %d exceeds the default gRPC message size limit of 4MB", opts.ByteStreamThreshold)
+	}
+	r := &REAPI{
+		ac:         repb.NewActionCacheClient(conn),
+		cas:        repb.NewContentAddressableStorageClient(conn),
+		byteStream: bytestream.NewByteStreamClient(conn),
+		opts:       opts,
+	}
+	for name, value := range opts.Headers {
+		r.headers = append(r.headers, strings.ToLower(name), value)
+	}
+	return r, nil
+}
+
+// context returns the context for a request, carrying the configured headers and
+// timeout.
+func (r *REAPI) context() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if len(r.headers) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, r.headers...)
+	}
+	if r.opts.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, r.opts.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// actionDigest returns the digest that the action result for actionID is stored
+// under.
+func actionDigest(actionID []byte) *repb.Digest {
+	return blobDigest(append([]byte(reapiActionPrefix), actionID...))
+}
+
+// blobDigest returns the SHA-256 digest of data.
+func blobDigest(data []byte) *repb.Digest {
+	sum := sha256.Sum256(data)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+// resourceName returns a ByteStream resource name in the configured instance.
+func (r *REAPI) resourceName(parts ...string) string {
+	if r.opts.InstanceName != "" {
+		parts = append([]string{r.opts.InstanceName}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Put uploads the body to the CAS unless it's there already, and then stores an
+// action result referencing it. Bodies above ByteStreamThreshold are streamed
+// rather than read into memory.
+func (r *REAPI) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	var (
+		digest *repb.Digest
+		err    error
+	)
+	if bodySize <= r.opts.ByteStreamThreshold {
+		digest, err = r.putSmallBlob(body, bodySize)
+	} else {
+		digest, err = r.putLargeBlob(outputID, body, bodySize)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+	_, err = r.ac.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: r.opts.InstanceName,
+		ActionDigest: actionDigest(actionID),
+		ActionResult: &repb.ActionResult{
+			OutputFiles: []*repb.OutputFile{{
+				Path:   reapiOutputPrefix + hex.EncodeToString(outputID),
+				Digest: digest,
+			}},
+			ExecutionMetadata: &repb.ExecutedActionMetadata{
+				Worker:                   "gobuildcache",
+				WorkerCompletedTimestamp: timestamppb.Now(),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update action result: %w", err)
+	}
+	return nil
+}
+
+// putSmallBlob reads a body small enough for a batch request and uploads it to
+// the CAS, unless the CAS has it already. It returns the body's digest.
+func (r *REAPI) putSmallBlob(body io.Reader, bodySize int64) (*repb.Digest, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if int64(len(data)) != bodySize {
+		return nil, fmt.Errorf("read %d bytes of body, expected %d", len(data), bodySize)
+	}
+	digest := blobDigest(data)
+	// The empty blob is always available.
+	if digest.SizeBytes == 0 {
+		return digest, nil
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+	if skip, err := r.skipUpload(ctx, digest); err != nil || skip {
+		return digest, err
+	}
+	resp, err := r.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		InstanceName: r.opts.InstanceName,
+		Requests:     []*repb.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: data}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload blob: %w", err)
+	}
+	for _, blob := range resp.Responses {
+		if err := status.ErrorProto(blob.Status); err != nil {
+			return nil, fmt.Errorf("failed to upload blob: %w", err)
+		}
+	}
+	return digest, nil
+}
+
+// putLargeBlob streams a body to the CAS with ByteStream, unless the CAS has it
+// already, and returns its digest. A body that can be rewound is hashed first.
+// Otherwise its digest is taken from the output ID, which the go command computes
+// as the SHA-256 of the output, and it's always uploaded so that the upload fails
+// before it's finished if the body doesn't match, such as when it's compressed.
+// Other bodies are read into memory.
+func (r *REAPI) putLargeBlob(outputID []byte, body io.Reader, bodySize int64) (*repb.Digest, error) {
+	var digest *repb.Digest
+	seeker, seekable := body.(io.Seeker)
+	switch {
+	case seekable:
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+		if n != bodySize {
+			return nil, fmt.Errorf("read %d bytes of body, expected %d", n, bodySize)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind body: %w", err)
+		}
+		digest = &repb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: bodySize}
+	case len(outputID) == sha256.Size:
+		digest = &repb.Digest{Hash: hex.EncodeToString(outputID), SizeBytes: bodySize}
+		body = &digestReader{r: body, h: sha256.New(), want: outputID, remaining: bodySize}
+	default:
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+		if int64(len(data)) != bodySize {
+			return nil, fmt.Errorf("read %d bytes of body, expected %d", len(data), bodySize)
+		}
+		digest, body = blobDigest(data), bytes.NewReader(data)
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+	if _, verify := body.(*digestReader); !verify {
+		if skip, err := r.skipUpload(ctx, digest); err != nil || skip {
+			return digest, err
+		}
+	}
+	if err := r.writeBlob(ctx, digest, body); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// skipUpload reports whether the CAS has the blob with digest already, in which
+// case it doesn't need to be uploaded, and records the skipped upload.
+func (r *REAPI) skipUpload(ctx context.Context, digest *repb.Digest) (bool, error) {
+	exists, err := r.blobExists(ctx, digest)
+	if err != nil || !exists {
+		return false, err
+	}
+	r.skippedPuts.Add(1)
+	r.bytesSaved.Add(digest.SizeBytes)
+	return true, nil
+}
+
+// blobExists reports whether the CAS has the blob with digest.
+func (r *REAPI) blobExists(ctx context.Context, digest *repb.Digest) (bool, error) {
+	missing, err := r.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName: r.opts.InstanceName,
+		BlobDigests:  []*repb.Digest{digest},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to find missing blobs: %w", err)
+	}
+	return len(missing.MissingBlobDigests) == 0, nil
+}
+
+// writeBlob streams the blob read from body to the CAS with ByteStream. If
+// reading body fails, the upload is abandoned before it's finished.
+func (r *REAPI) writeBlob(ctx context.Context, digest *repb.Digest, body io.Reader) error {
+	uploadID, err := newUploadID()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := r.byteStream.Write(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start blob upload: %w", err)
+	}
+	var (
+		name = r.resourceName("uploads", uploadID, "blobs", digest.Hash, fmt.Sprint(digest.SizeBytes))
+		buf  = make([]byte, reapiChunkSize)
+	)
+	for offset := int64(0); offset < digest.SizeBytes; offset += reapiChunkSize {
+		end := offset + reapiChunkSize
+		if end > digest.SizeBytes {
+			end = digest.SizeBytes
+		}
+		chunk := buf[:end-offset]
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			// Canceling the stream abandons the upload.
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		req := &bytestream.WriteRequest{
+			WriteOffset: offset,
+			FinishWrite: end == digest.SizeBytes,
+			Data:        chunk,
+		}
+		// Only the first request needs the resource name.
+		if offset == 0 {
+			req.ResourceName = name
+		}
+		if err := stream.Send(req); err != nil {
+			if err == io.EOF {
+				// The server ended the upload early, e.g. because it has the blob
+				// already. CloseAndRecv returns its status, and the rest of a body
+				// that's being verified is still checked.
+				if _, err := io.Copy(io.Discard, body); err != nil {
+					return fmt.Errorf("failed to read body: %w", err)
+				}
+				break
+			}
+			return fmt.Errorf("failed to upload blob: %w", err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return fmt.Errorf("failed to upload blob: %w", err)
+	}
+	if resp.CommittedSize != digest.SizeBytes {
+		return fmt.Errorf("server committed %d bytes of blob, expected %d", resp.CommittedSize, digest.SizeBytes)
+	}
+	return nil
+}
+
+// digestReader reads a body of a known size, and fails instead of returning its
+// last bytes if the body doesn't have the expected SHA-256.
+type digestReader struct {
+	r         io.Reader
+	h         hash.Hash
+	want      []byte
+	remaining int64
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	if d.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	d.remaining -= int64(n)
+	if d.remaining == 0 && !bytes.Equal(d.h.Sum(nil), d.want) {
+		return 0, fmt.Errorf("body doesn't match its output ID")
+	}
+	if err == io.EOF && d.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// newUploadID returns a random UUID for a ByteStream upload.
+func newUploadID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Get retrieves the action result stored under actionID and the body it
+// references. An action result whose body was evicted from the CAS is a miss.
+// Returns the body as an io.ReadCloser that must be closed by the caller.
+func (r *REAPI) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	result, err := r.ac.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName: r.opts.InstanceName,
+		ActionDigest: actionDigest(actionID),
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil, 0, nil, true, nil
+	}
+	if err != nil {
+		return nil, nil, 0, nil, true, fmt.Errorf("failed to get action result: %w", err)
+	}
+
+	outputID, digest := resultOutput(result)
+	if digest == nil {
+		// Not an action result stored by gobuildcache.
+		return nil, nil, 0, nil, true, nil
+	}
+	putTime := time.Now()
+	if completed := result.GetExecutionMetadata().GetWorkerCompletedTimestamp(); completed != nil {
+		putTime = completed.AsTime()
+	}
+
+	body, miss, err := r.readBlob(digest)
+	if err != nil || miss {
+		return nil, nil, 0, nil, true, err
+	}
+	return outputID, body, digest.SizeBytes, &putTime, false, nil
+}
+
+// resultOutput returns the output ID and body digest of an action result stored
+// by gobuildcache, or a nil digest for other action results.
+func resultOutput(result *repb.ActionResult) ([]byte, *repb.Digest) {
+	for _, file := range result.OutputFiles {
+		if hexID, ok := strings.CutPrefix(file.Path, reapiOutputPrefix); ok && file.Digest != nil {
+			if outputID, err := hex.DecodeString(hexID); err == nil {
+				return outputID, file.Digest
+			}
+		}
+	}
+	return nil, nil
+}
+
+// readBlob returns the contents of a blob in the CAS, or miss=true if it doesn't
+// exist.
+func (r *REAPI) readBlob(digest *repb.Digest) (io.ReadCloser, bool, error) {
+	if digest.SizeBytes == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), false, nil
+	}
+
+	ctx, cancel := r.context()
+	if digest.SizeBytes <= r.opts.ByteStreamThreshold {
+		defer cancel()
+		resp, err := r.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+			InstanceName: r.opts.InstanceName,
+			Digests:      []*repb.Digest{digest},
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read blob: %w", err)
+		}
+		if len(resp.Responses) != 1 {
+			return nil, false, fmt.Errorf("server returned %d blobs, expected 1", len(resp.Responses))
+		}
+		blob := resp.Responses[0]
+		if err := status.ErrorProto(blob.Status); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, true, nil
+			}
+			return nil, false, fmt.Errorf("failed to read blob: %w", err)
+		}
+		if int64(len(blob.Data)) != digest.SizeBytes {
+			return nil, false, fmt.Errorf("server returned %d bytes of blob, expected %d", len(blob.Data), digest.SizeBytes)
+		}
+		return io.NopCloser(bytes.NewReader(blob.Data)), false, nil
+	}
+
+	// The stream stays open until the body is closed.
+	stream, err := r.byteStream.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: r.resourceName("blobs", digest.Hash, fmt.Sprint(digest.SizeBytes)),
+	})
+	if err != nil {
+		cancel()
+		return nil, false, fmt.Errorf("failed to read blob: %w", err)
+	}
+	// Errors such as a missing blob are only returned with the first response.
+	first, err := stream.Recv()
+	if err != nil {
+		cancel()
+		if status.Code(err) == codes.NotFound {
+			return nil, true, nil
+		}
+		return nil, false, fmt.Errorf("failed to read blob: %w", err)
+	}
+	return &byteStreamReader{stream: stream, buf: first.Data, remaining: digest.SizeBytes, cancel: cancel}, false, nil
+}
+
+// byteStreamReader reads a blob from a ByteStream read, and fails if the stream
+// ends before the whole blob was received.
+type byteStreamReader struct {
+	stream    bytestream.ByteStream_ReadClient
+	buf       []byte
+	remaining int64
+	cancel    context.CancelFunc
+}
+
+func (b *byteStreamReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		resp, err := b.stream.Recv()
+		if err == io.EOF {
+			if b.remaining != 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read blob: %w", err)
+		}
+		b.buf = resp.Data
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.remaining -= int64(n)
+	return n, nil
+}
+
+func (b *byteStreamReader) Close() error {
+	b.cancel()
+	return nil
+}
+
+// Exists reports whether an action result is stored under actionID and its body
+// is in the CAS, like Get, without downloading the body.
+func (r *REAPI) Exists(actionID []byte) (bool, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	result, err := r.ac.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName: r.opts.InstanceName,
+		ActionDigest: actionDigest(actionID),
+	})
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get action result: %w", err)
+	}
+	_, digest := resultOutput(result)
+	if digest == nil {
+		return false, nil
+	}
+	if digest.SizeBytes == 0 {
+		return true, nil
+	}
+	return r.blobExists(ctx, digest)
+}
+
+// PutSkipStats returns the number of bodies that weren't uploaded because the CAS
+// had them already, and the number of bytes that didn't have to be uploaded.
+func (r *REAPI) PutSkipStats() (skipped, bytesSaved int64) {
+	return r.skippedPuts.Load(), r.bytesSaved.Load()
+}
+
+// Close closes the connection to the server.
+func (r *REAPI) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// Clear is not supported, since the REAPI has no way to list or delete entries.
+func (r *REAPI) Clear() error {
+	return fmt.Errorf("clearing an REAPI cache is not supported, the server evicts entries itself")
+}
@@ -0,0 +1,286 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeREAPIServer is an in-process stand-in for an REAPI server, implementing the
+// ActionCache, CAS and ByteStream services on top of maps.
+type fakeREAPIServer struct {
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedContentAddressableStorageServer
+	bytestream.UnimplementedByteStreamServer
+
+	mu           sync.Mutex
+	results      map[string]*repb.ActionResult // By instance and action digest hash
+	blobs        map[string][]byte             // By digest hash
+	batchWrites  int
+	streamWrites int
+	streamReads  int
+}
+
+func (f *fakeREAPIServer) GetActionResult(_ context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result, ok := f.results[req.InstanceName+"/"+req.ActionDigest.Hash]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such action")
+	}
+	return result, nil
+}
+
+func (f *fakeREAPIServer) UpdateActionResult(_ context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[req.InstanceName+"/"+req.ActionDigest.Hash] = req.ActionResult
+	return req.ActionResult, nil
+}
+
+func (f *fakeREAPIServer) FindMissingBlobs(_ context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, digest := range req.BlobDigests {
+		if _, ok := f.blobs[digest.Hash]; !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
+		}
+	}
+	return resp, nil
+}
+
+// store stores data if it matches hash.
+func (f *fakeREAPIServer) store(hash string, data []byte) error {
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		return status.Error(codes.InvalidArgument, "digest mismatch")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blobs[hash] = data
+	return nil
+}
+
+func (f *fakeREAPIServer) BatchUpdateBlobs(_ context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	resp := &repb.BatchUpdateBlobsResponse{}
+	for _, blob := range req.Requests {
+		f.mu.Lock()
+		f.batchWrites++
+		f.mu.Unlock()
+		st := status.Convert(f.store(blob.Digest.Hash, blob.Data))
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{Digest: blob.Digest, Status: st.Proto()})
+	}
+	return resp, nil
+}
+
+func (f *fakeREAPIServer) BatchReadBlobs(_ context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, digest := range req.Digests {
+		blob := &repb.BatchReadBlobsResponse_Response{Digest: digest, Status: &rpcstatus.Status{}}
+		if data, ok := f.blobs[digest.Hash]; ok {
+			blob.Data = data
+		} else {
+			blob.Status = status.New(codes.NotFound, "no such blob").Proto()
+		}
+		resp.Responses = append(resp.Responses, blob)
+	}
+	return resp, nil
+}
+
+func (f *fakeREAPIServer) Write(stream bytestream.ByteStream_WriteServer) error {
+	var (
+		name string
+		data []byte
+	)
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			name = req.ResourceName
+		}
+		if req.WriteOffset != int64(len(data)) {
+			return status.Errorf(codes.InvalidArgument, "write at offset %d after %d bytes", req.WriteOffset, len(data))
+		}
+		data = append(data, req.Data...)
+		if req.FinishWrite {
+			break
+		}
+	}
+	// Resource names are [{instance}/]uploads/{uuid}/blobs/{hash}/{size}.
+	parts := strings.Split(name, "/")
+	if len(parts) < 5 || parts[len(parts)-5] != "uploads" || parts[len(parts)-3] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %q", name)
+	}
+	if err := f.store(parts[len(parts)-2], data); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.streamWrites++
+	f.mu.Unlock()
+	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(len(data))})
+}
+
+func (f *fakeREAPIServer) Read(req *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	// Resource names are [{instance}/]blobs/{hash}/{size}.
+	parts := strings.Split(req.ResourceName, "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %q", req.ResourceName)
+	}
+	f.mu.Lock()
+	data, ok := f.blobs[parts[len(parts)-2]]
+	f.streamReads++
+	f.mu.Unlock()
+	if !ok {
+		return status.Error(codes.NotFound, "no such blob")
+	}
+	// Send small chunks to exercise reassembly.
+	for len(data) > 0 {
+		n := min(len(data), 1000)
+		if err := stream.Send(&bytestream.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func newTestREAPI(t *testing.T, opts REAPIOptions) (*REAPI, *fakeREAPIServer) {
+	t.Helper()
+	fake := &fakeREAPIServer{results: make(map[string]*repb.ActionResult), blobs: make(map[string][]byte)}
+	server := grpc.NewServer()
+	repb.RegisterActionCacheServer(server, fake)
+	repb.RegisterContentAddressableStorageServer(server, fake)
+	bytestream.RegisterByteStreamServer(server, fake)
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r, err := newREAPI(conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, fake
+}
+
+func TestREAPI(t *testing.T) {
+	r, fake := newTestREAPI(t, REAPIOptions{InstanceName: "ci", ByteStreamThreshold: 1024})
+
+	put := func(actionID, data []byte) []byte {
+		t.Helper()
+		sum := sha256.Sum256(data)
+		if err := r.Put(actionID, sum[:], bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		return sum[:]
+	}
+	get := func(actionID, outputID, data []byte) {
+		t.Helper()
+		gotID, body, size, putTime, miss, err := r.Get(actionID)
+		if err != nil || miss {
+			t.Fatalf("Get: miss = %v, err = %v", miss, err)
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(got, data) || !bytes.Equal(gotID, outputID) || size != int64(len(data)) || putTime == nil {
+			t.Errorf("Get returned %d bytes (err %v) with output ID %x and size %d", len(got), err, gotID, size)
+		}
+	}
+
+	// Small bodies use batch requests, large ones ByteStream.
+	small := []byte("compiled output")
+	smallID := put([]byte{1}, small)
+	get([]byte{1}, smallID, small)
+	large := bytes.Repeat([]byte("0123456789"), 500)
+	largeID := put([]byte{2}, large)
+	get([]byte{2}, largeID, large)
+	if fake.batchWrites != 1 || fake.streamWrites != 1 || fake.streamReads != 1 {
+		t.Errorf("%d batch writes, %d stream writes and %d stream reads, expected 1 of each",
+			fake.batchWrites, fake.streamWrites, fake.streamReads)
+	}
+	emptyID := put([]byte{3}, nil)
+	get([]byte{3}, emptyID, nil)
+
+	// A body that's in the CAS already isn't uploaded again.
+	put([]byte{4}, large)
+	if skipped, saved := r.PutSkipStats(); skipped != 1 || saved != int64(len(large)) || fake.streamWrites != 1 {
+		t.Errorf("skipped %d uploads saving %d bytes with %d stream writes", skipped, saved, fake.streamWrites)
+	}
+
+	if _, _, _, _, miss, err := r.Get([]byte{5}); !miss || err != nil {
+		t.Errorf("Get of absent key: miss = %v, err = %v", miss, err)
+	}
+	if exists, err := r.Exists([]byte{1}); !exists || err != nil {
+		t.Errorf("Exists = %v, %v", exists, err)
+	}
+	if exists, err := r.Exists([]byte{5}); exists || err != nil {
+		t.Errorf("Exists of absent key = %v, %v", exists, err)
+	}
+
+	// Large bodies that can't be rewound are streamed under the digest given by
+	// their output ID, and rejected before the upload finishes if they don't
+	// match it.
+	other := bytes.Repeat([]byte("9876543210"), 500)
+	otherID := sha256.Sum256(other)
+	if err := r.Put([]byte{6}, otherID[:], io.MultiReader(bytes.NewReader(other)), int64(len(other))); err != nil {
+		t.Fatalf("Put of a stream failed: %v", err)
+	}
+	get([]byte{6}, otherID[:], other)
+	if err := r.Put([]byte{7}, otherID[:], io.MultiReader(bytes.NewReader(large)), int64(len(large))); err == nil {
+		t.Error("Put of a stream that doesn't match its output ID succeeded")
+	}
+	if exists, err := r.Exists([]byte{7}); exists || err != nil {
+		t.Errorf("Exists after a rejected Put = %v, %v", exists, err)
+	}
+
+	// Entries whose body was evicted from the CAS are misses.
+	fake.mu.Lock()
+	for hash := range fake.blobs {
+		delete(fake.blobs, hash)
+	}
+	fake.mu.Unlock()
+	for _, actionID := range [][]byte{{1}, {2}} {
+		if _, _, _, _, miss, err := r.Get(actionID); !miss || err != nil {
+			t.Errorf("Get of %x with an evicted body: miss = %v, err = %v", actionID, miss, err)
+		}
+		if exists, err := r.Exists(actionID); exists || err != nil {
+			t.Errorf("Exists of %x with an evicted body = %v, %v", actionID, exists, err)
+		}
+	}
+}
+
+func TestNewREAPIInvalidURL(t *testing.T) {
+	for _, target := range []string{"localhost:8980", "http://localhost:8980"} {
+		if _, err := NewREAPI(target, DefaultREAPIOptions()); err == nil {
+			t.Errorf("NewREAPI(%q) succeeded", target)
+		}
+	}
+	if _, err := newREAPI(nil, REAPIOptions{ByteStreamThreshold: 8 << 20}); err == nil {
+		t.Errorf("a %d byte ByteStream threshold was accepted", 8<<20)
+	}
+}
@@ -0,0 +1,239 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths and headers of the HTTP API served by `gobuildcache serve`. Objects are
+// addressed by their hex encoded key, and their output ID and put time travel in
+// headers alongside the body.
+const (
+	RemoteObjectsPath = "/v1/objects/"
+	RemoteStatsPath   = "/v1/stats"
+	RemoteHealthPath  = "/healthz"
+
+	RemoteOutputIDHeader = "Gobuildcache-Output-Id"
+	RemotePutTimeHeader  = "Gobuildcache-Put-Time"
+)
+
+// RemoteOptions holds client configuration for the remote backend.
+type RemoteOptions struct {
+	// Token is sent as a bearer token with every request, if set.
+	Token string
+	// RequestTimeout bounds a complete request including the body, 0 for none.
+	RequestTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for the response headers, leaving
+	// the body to be read at any pace, 0 for none.
+	ResponseHeaderTimeout time.Duration
+	// SkipHealthCheck skips checking that the server is reachable at startup.
+	SkipHealthCheck bool
+}
+
+// Remote implements Backend using a cache server started with `gobuildcache serve`.
+// The server stores objects in a local cache directory of its own and evicts them
+// when it runs out of space, so trimming and clearing are left to it.
+type Remote struct {
+	baseURL string
+	opts    RemoteOptions
+	client  *http.Client
+}
+
+// NewRemote creates a backend that stores objects on the cache server at baseURL,
+// e.g. "http://cache.internal:8080", and checks that the server is healthy.
+func NewRemote(baseURL string, opts RemoteOptions) (*Remote, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("remote URL must start with http:// or https://, got %q", baseURL)
+	}
+	r := &Remote{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.RequestTimeout},
+	}
+	if opts.ResponseHeaderTimeout > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+		r.client.Transport = transport
+	}
+	if !opts.SkipHealthCheck {
+		resp, err := r.do(http.MethodGet, RemoteHealthPath, nil, -1, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach remote cache server: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("remote cache server is unhealthy: %s", resp.Status)
+		}
+	}
+	return r, nil
+}
+
+// do sends a request for path with the token and the given headers.
+func (r *Remote) do(method, path string, body io.Reader, bodySize int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = bodySize
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if r.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.opts.Token)
+	}
+	return r.client.Do(req)
+}
+
+// objectPath returns the path of the object stored under actionID.
+func objectPath(actionID []byte) string {
+	return RemoteObjectsPath + hex.EncodeToString(actionID)
+}
+
+// statusError returns an error describing an unexpected response, and closes its
+// body.
+func statusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if text := strings.TrimSpace(string(msg)); text != "" {
+		return fmt.Errorf("remote cache server returned %s: %s", resp.Status, text)
+	}
+	return fmt.Errorf("remote cache server returned %s", resp.Status)
+}
+
+// Put stores an object on the server.
+func (r *Remote) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
+	header := http.Header{}
+	header.Set(RemoteOutputIDHeader, hex.EncodeToString(outputID))
+	// Don't let the HTTP client close the caller's reader.
+	resp, err := r.do(http.MethodPut, objectPath(actionID), io.NopCloser(body), bodySize, header)
+	if err != nil {
+		return fmt.Errorf("failed to put remote object: %w", err)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get retrieves an object from the server.
+// Returns the object data as an io.ReadCloser that must be closed by the caller.
+func (r *Remote) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
+	resp, err := r.do(http.MethodGet, objectPath(actionID), nil, 0, nil)
+	if err != nil {
+		return nil, nil, 0, nil, true, fmt.Errorf("failed to get remote object: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil, 0, nil, true, nil
+	default:
+		return nil, nil, 0, nil, true, statusError(resp)
+	}
+
+	outputID, err := hex.DecodeString(resp.Header.Get(RemoteOutputIDHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, 0, nil, true, fmt.Errorf("remote object has invalid output ID: %w", err)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, nil, 0, nil, true, fmt.Errorf("remote object has no content length")
+	}
+	putTime := time.Now()
+	if nanos, err := strconv.ParseInt(resp.Header.Get(RemotePutTimeHeader), 10, 64); err == nil {
+		putTime = time.Unix(0, nanos)
+	}
+	return outputID, resp.Body, resp.ContentLength, &putTime, false, nil
+}
+
+// Exists reports whether an object is stored under actionID, using a HEAD request.
+func (r *Remote) Exists(actionID []byte) (bool, error) {
+	resp, err := r.do(http.MethodHead, objectPath(actionID), nil, 0, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check remote object: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return true, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return false, nil
+	default:
+		return false, statusError(resp)
+	}
+}
+
+// GetRange returns length bytes of the object stored under actionID, starting at
+// offset, using a ranged GET.
+func (r *Remote) GetRange(actionID []byte, offset, length int64) (io.ReadCloser, bool, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := r.do(http.MethodGet, objectPath(actionID), nil, 0, header)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get remote object range: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, false, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, true, nil
+	default:
+		return nil, false, statusError(resp)
+	}
+}
+
+// List returns the keys of all objects whose key starts with prefix. The server
+// responds with one hex encoded key per line.
+func (r *Remote) List(prefix []byte) ([][]byte, error) {
+	resp, err := r.do(http.MethodGet, RemoteObjectsPath+"?prefix="+hex.EncodeToString(prefix), nil, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote objects: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	defer resp.Body.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		key, err := hex.DecodeString(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("remote cache server listed invalid key %q", scanner.Text())
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read remote object list: %w", err)
+	}
+	return keys, nil
+}
+
+// Close closes idle connections to the server.
+func (r *Remote) Close() error {
+	r.client.CloseIdleConnections()
+	return nil
+}
+
+// Clear is not supported, since the server's cache directory may be shared by
+// other clients. Use clear-local on the server instead.
+func (r *Remote) Clear() error {
+	return fmt.Errorf("clearing a remote cache server is not supported, run clear-local on the server instead")
+}
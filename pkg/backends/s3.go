@@ -3,65 +3,378 @@ package backends
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
+// Server-side encryption modes for S3Options.Encryption.
+const (
+	SSENone = ""
+	SSES3   = "sse-s3"
+	SSEKMS  = "sse-kms"
+	SSEC    = "sse-c"
+)
+
+// Policies for S3Options.SkipExisting.
+const (
+	// SkipExistingNone always uploads, overwriting any existing object.
+	SkipExistingNone = ""
+	// SkipExistingConditional uploads with If-None-Match: * so that S3 rejects the
+	// write if the object already exists. Multipart uploads also check with a HEAD
+	// request first so that the parts don't have to be uploaded at all.
+	SkipExistingConditional = "if-none-match"
+	// SkipExistingHead issues a HEAD request before every upload and skips it if the
+	// object already exists. Use this for S3 implementations that don't support
+	// conditional writes.
+	SkipExistingHead = "head"
+)
+
+const (
+	// S3 allows at most 10 tags per object.
+	s3MaxTags = 10
+
+	// S3 requires every part of a multipart upload except the last to be at least 5 MiB,
+	// and allows at most 10,000 parts per upload.
+	s3MinPartSize = 5 * 1024 * 1024
+	s3MaxParts    = 10000
+)
+
+// s3Client is the subset of the S3 API used by the S3 backend. It exists so that
+// tests can substitute a fake implementation.
+type s3Client interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// S3Options holds client configuration and tunables for the S3 backend.
+//
+// Zero values defer to the AWS SDK's default behavior, so any setting that isn't
+// provided explicitly can still come from the standard AWS environment variables
+// and shared config files.
+type S3Options struct {
+	// Endpoint overrides the S3 endpoint URL, e.g. for Tigris or MinIO.
+	Endpoint string
+	// Region is the region to sign requests for.
+	Region string
+	// UsePathStyle addresses buckets as https://endpoint/bucket instead of
+	// https://bucket.endpoint, which most self-hosted S3 implementations require.
+	UsePathStyle bool
+	// Profile selects a named profile from the shared config and credentials files.
+	Profile string
+	// CredentialsFile and ConfigFile override the locations of the shared
+	// credentials and config files.
+	CredentialsFile string
+	ConfigFile      string
+	// RoleARN is an IAM role to assume using the base credentials. ExternalID is
+	// passed along with the AssumeRole request if the role's trust policy requires it.
+	RoleARN    string
+	ExternalID string
+
+	// ConnectTimeout bounds how long establishing a connection may take.
+	ConnectTimeout time.Duration
+	// RequestTimeout bounds the total time of a single HTTP request, including
+	// reading the response body. Zero means no timeout.
+	RequestTimeout time.Duration
+	// MaxIdleConns is the maximum number of idle keep-alive connections to the
+	// endpoint. Cache traffic is a large number of small requests to a single host,
+	// so keeping more connections warm avoids repeated TLS handshakes.
+	MaxIdleConns int
+
+	// SkipBucketCheck skips the HeadBucket request used to verify bucket access
+	// at startup, for credentials that aren't allowed to call it.
+	SkipBucketCheck bool
+
+	// Encryption selects server-side encryption for uploaded objects: one of
+	// SSENone, SSES3, SSEKMS or SSEC.
+	Encryption string
+	// KMSKeyID is the KMS key used with SSEKMS. If empty, the bucket's default
+	// AWS managed key is used.
+	KMSKeyID string
+	// CustomerKey is the 256-bit key used with SSEC. S3 never stores it, so it must
+	// also be provided for every GET.
+	CustomerKey []byte
+	// StorageClass is the storage class of uploaded objects, e.g. STANDARD or
+	// EXPRESS_ONEZONE. Empty uses the bucket default.
+	StorageClass string
+	// Tags are applied to every uploaded object, e.g. for cost allocation.
+	Tags map[string]string
+	// ACL is a canned ACL applied to every uploaded object, e.g.
+	// bucket-owner-full-control.
+	ACL string
+
+	// SkipExisting is the policy for avoiding uploads of objects that already exist,
+	// e.g. when many runners build the same commit: one of SkipExistingNone,
+	// SkipExistingConditional or SkipExistingHead. With any policy other than
+	// SkipExistingNone, keys that this process has already seen in the bucket are
+	// also never uploaded again.
+	SkipExisting string
+
+	// TrackAccess publishes the keys of cache hits to access log objects under the
+	// prefix, so that Trim can remove entries by when they were last used rather
+	// than by when they were uploaded.
+	TrackAccess bool
+
+	// MultipartThreshold is the object size at or above which PUTs are split into a
+	// multipart upload. While it's non-zero, GETs also request only the first part up
+	// front and fetch the rest of larger objects with parallel ranged requests. Zero
+	// disables both, so every object is transferred with a single request.
+	MultipartThreshold int64
+	// PartSize is the size of each part of a multipart upload or ranged GET. It is
+	// raised automatically if needed to respect S3's minimum part size and maximum
+	// part count.
+	PartSize int64
+	// Concurrency is the maximum number of parts transferred in parallel for a
+	// single object.
+	Concurrency int
+}
+
+// DefaultS3Options returns the default tunables for the S3 backend.
+func DefaultS3Options() S3Options {
+	return S3Options{
+		MultipartThreshold: 32 * 1024 * 1024,
+		PartSize:           8 * 1024 * 1024,
+		Concurrency:        8,
+		MaxIdleConns:       100,
+	}
+}
+
 // S3 implements Backend using AWS S3.
 // This backend only handles S3 operations; local disk caching is handled by server.go.
 type S3 struct {
-	client    *s3.Client
+	client    s3Client
 	bucket    string
 	prefix    string
+	opts      S3Options
 	ctx       context.Context
 	awsConfig aws.Config
+
+	// Request parameters derived from opts when the backend is created.
+	sseCustomerKey    *string
+	sseCustomerKeyMD5 *string
+	tagging           *string
+
+	// knownKeys records keys that are known to exist in the bucket, either because
+	// this process fetched or uploaded them, when SkipExisting is enabled.
+	knownKeys sync.Map
+
+	skippedPuts  atomic.Int64
+	skippedBytes atomic.Int64
+
+	// access batches cache hits when opts.TrackAccess is set.
+	access *s3AccessTracker
 }
 
 // NewS3 creates a new S3-based cache backend.
 // bucket is the S3 bucket name where cache files will be stored.
 // prefix is an optional prefix for all S3 keys (e.g., "cache/" or "").
-func NewS3(bucket, prefix string) (*S3, error) {
+func NewS3(bucket, prefix string, opts S3Options) (*S3, error) {
 	ctx := context.Background()
 
-	// Load AWS config from environment/credentials
-	cfg, err := config.LoadDefaultConfig(ctx)
+	// Load AWS config from environment/credentials, applying any explicit overrides.
+	cfg, err := loadAWSConfig(ctx, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		return nil, err
 	}
 
-	client := s3.NewFromConfig(cfg)
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.UsePathStyle
+	})
 
-	backend := &S3{
-		client:    client,
-		bucket:    bucket,
-		prefix:    prefix,
-		ctx:       ctx,
-		awsConfig: cfg,
+	backend, err := newS3(ctx, client, bucket, prefix, opts)
+	if err != nil {
+		return nil, err
 	}
+	backend.awsConfig = cfg
 
 	// Test bucket access
-	_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{
-		Bucket: aws.String(bucket),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to access S3 bucket %s: %w", bucket, err)
+	if !opts.SkipBucketCheck {
+		_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to access S3 bucket %s: %w", bucket, err)
+		}
 	}
 
 	return backend, nil
 }
 
+// newS3 creates an S3 backend around an existing client, validating opts and
+// filling in defaults.
+func newS3(ctx context.Context, client s3Client, bucket, prefix string, opts S3Options) (*S3, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = DefaultS3Options().PartSize
+	}
+
+	backend := &S3{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+		opts:   opts,
+		ctx:    ctx,
+	}
+
+	switch opts.Encryption {
+	case SSENone, SSES3:
+		if opts.KMSKeyID != "" {
+			return nil, fmt.Errorf("a KMS key ID requires %s encryption", SSEKMS)
+		}
+	case SSEKMS:
+	case SSEC:
+		if len(opts.CustomerKey) != 32 {
+			return nil, fmt.Errorf("%s encryption requires a 256-bit key, got %d bytes", SSEC, len(opts.CustomerKey))
+		}
+		keyMD5 := md5.Sum(opts.CustomerKey)
+		backend.sseCustomerKey = aws.String(base64.StdEncoding.EncodeToString(opts.CustomerKey))
+		backend.sseCustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(keyMD5[:]))
+	default:
+		return nil, fmt.Errorf("unknown S3 encryption mode: %s (supported: %s, %s, %s)", opts.Encryption, SSES3, SSEKMS, SSEC)
+	}
+
+	switch opts.SkipExisting {
+	case SkipExistingNone, SkipExistingConditional, SkipExistingHead:
+	default:
+		return nil, fmt.Errorf("unknown S3 skip-existing policy: %s (supported: %s, %s)", opts.SkipExisting, SkipExistingConditional, SkipExistingHead)
+	}
+
+	if len(opts.Tags) > s3MaxTags {
+		return nil, fmt.Errorf("too many S3 object tags: %d (maximum %d)", len(opts.Tags), s3MaxTags)
+	}
+	if len(opts.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range opts.Tags {
+			tags.Set(k, v)
+		}
+		backend.tagging = aws.String(tags.Encode())
+	}
+
+	if opts.TrackAccess {
+		backend.access = newS3AccessTracker()
+		go backend.runAccessTracker()
+	}
+
+	return backend, nil
+}
+
+// loadAWSConfig loads the AWS SDK configuration for the S3 backend.
+func loadAWSConfig(ctx context.Context, opts S3Options) (aws.Config, error) {
+	httpClient := awshttp.NewBuildableClient().
+		WithTimeout(opts.RequestTimeout).
+		WithTransportOptions(func(t *http.Transport) {
+			if opts.MaxIdleConns > 0 {
+				t.MaxIdleConns = opts.MaxIdleConns
+				t.MaxIdleConnsPerHost = opts.MaxIdleConns
+			}
+		})
+	if opts.ConnectTimeout > 0 {
+		httpClient = httpClient.WithDialerOptions(func(d *net.Dialer) {
+			d.Timeout = opts.ConnectTimeout
+		})
+	}
+
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithHTTPClient(httpClient),
+	}
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+	if opts.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.Profile))
+	}
+	if opts.CredentialsFile != "" {
+		loadOpts = append(loadOpts, config.WithSharedCredentialsFiles([]string{opts.CredentialsFile}))
+	}
+	if opts.ConfigFile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigFiles([]string{opts.ConfigFile}))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if opts.RoleARN != "" {
+		// The STS client uses the base credentials loaded above to assume the role.
+		// The credentials cache refreshes the role session before it expires.
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "gobuildcache"
+			if opts.ExternalID != "" {
+				o.ExternalID = aws.String(opts.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
 // Put stores an object in S3.
+// Objects at or above the multipart threshold are uploaded in parts.
 func (s *S3) Put(actionID, outputID []byte, body io.Reader, bodySize int64) error {
 	key := s.actionIDToKey(actionID)
 
+	// Prepare metadata
+	now := time.Now()
+	metadata := map[string]string{
+		"outputid": hex.EncodeToString(outputID),
+		"size":     strconv.FormatInt(bodySize, 10),
+		"time":     strconv.FormatInt(now.Unix(), 10),
+	}
+
+	if s.opts.SkipExisting != SkipExistingNone {
+		if _, ok := s.knownKeys.Load(key); ok {
+			s.recordSkippedPut(bodySize)
+			return nil
+		}
+		// HEAD first when there's no other way to avoid uploading the body, or when
+		// the body is large enough that sending it only to have it rejected would
+		// waste a lot of bandwidth.
+		if s.opts.SkipExisting == SkipExistingHead || s.useMultipart(bodySize) {
+			if s.objectExists(key) {
+				s.knownKeys.Store(key, struct{}{})
+				s.recordSkippedPut(bodySize)
+				return nil
+			}
+		}
+	}
+
+	if s.useMultipart(bodySize) && body != nil {
+		return s.putMultipart(key, metadata, body, bodySize)
+	}
+
 	// Read the body into a buffer (needed for S3 SDK)
 	var bodyData []byte
 	if bodySize > 0 && body != nil {
@@ -75,42 +388,306 @@ func (s *S3) Put(actionID, outputID []byte, body io.Reader, bodySize int64) erro
 		}
 	}
 
-	// Prepare metadata
-	now := time.Now()
-	metadata := map[string]string{
-		"outputid": hex.EncodeToString(outputID),
-		"size":     strconv.FormatInt(bodySize, 10),
-		"time":     strconv.FormatInt(now.Unix(), 10),
-	}
-
 	// Upload to S3
 	putInput := &s3.PutObjectInput{
-		Bucket:   aws.String(s.bucket),
-		Key:      aws.String(key),
-		Body:     bytes.NewReader(bodyData),
-		Metadata: metadata,
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(bodyData),
+		Metadata:             metadata,
+		ServerSideEncryption: s.serverSideEncryption(),
+		SSEKMSKeyId:          s.kmsKeyID(),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+		StorageClass:         types.StorageClass(s.opts.StorageClass),
+		Tagging:              s.tagging,
+		ACL:                  types.ObjectCannedACL(s.opts.ACL),
+		IfNoneMatch:          s.ifNoneMatch(),
 	}
 
 	_, err := s.client.PutObject(s.ctx, putInput)
+	if err != nil && s.opts.SkipExisting == SkipExistingConditional && isConditionalWriteConflict(err) {
+		// The object already exists, or another writer is uploading it right now.
+		// The SDK sends Expect: 100-continue for larger bodies, so S3 usually rejects
+		// the write before the body has been transferred. Only an existing object is
+		// remembered, since the other writer's upload may still fail.
+		if isPreconditionFailed(err) {
+			s.knownKeys.Store(key, struct{}{})
+		}
+		s.recordSkippedPut(bodySize)
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to upload to S3: %w", err)
 	}
+	if s.opts.SkipExisting != SkipExistingNone {
+		s.knownKeys.Store(key, struct{}{})
+	}
 
 	return nil
 }
 
+// putMultipart uploads body as a multipart upload, transferring up to
+// opts.Concurrency parts in parallel. Parts are read from body sequentially so
+// at most Concurrency part buffers are held in memory at once. If any part fails
+// the upload is aborted so that no orphaned parts are left behind in the bucket.
+func (s *S3) putMultipart(key string, metadata map[string]string, body io.Reader, bodySize int64) error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Metadata:             metadata,
+		ServerSideEncryption: s.serverSideEncryption(),
+		SSEKMSKeyId:          s.kmsKeyID(),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+		StorageClass:         types.StorageClass(s.opts.StorageClass),
+		Tagging:              s.tagging,
+		ACL:                  types.ObjectCannedACL(s.opts.ACL),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	var (
+		partSize  = s.partSize(bodySize)
+		numParts  = int((bodySize + partSize - 1) / partSize)
+		completed = make([]types.CompletedPart, numParts)
+		sem       = make(chan struct{}, s.opts.Concurrency)
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		uploadErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			uploadErr = err
+			cancel()
+		})
+	}
+
+	for i := range numParts {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+
+		var (
+			partNumber = int32(i + 1)
+			offset     = int64(i) * partSize
+			length     = partSize
+		)
+		if remaining := bodySize - offset; remaining < length {
+			length = remaining
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(body, data); err != nil {
+			<-sem
+			fail(fmt.Errorf("failed to read body: %w", err))
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        aws.String(s.bucket),
+				Key:           aws.String(key),
+				UploadId:      uploadID,
+				PartNumber:    aws.Int32(partNumber),
+				Body:          bytes.NewReader(data),
+				ContentLength: aws.Int64(int64(len(data))),
+
+				SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+				SSECustomerKey:       s.sseCustomerKey,
+				SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+			})
+			if err != nil {
+				fail(fmt.Errorf("failed to upload part %d: %w", partNumber, err))
+				return
+			}
+			completed[partNumber-1] = types.CompletedPart{
+				ETag:       out.ETag,
+				PartNumber: aws.Int32(partNumber),
+			}
+		}()
+	}
+	wg.Wait()
+
+	if uploadErr == nil {
+		_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+			IfNoneMatch:     s.ifNoneMatch(),
+		})
+		if err == nil {
+			if s.opts.SkipExisting != SkipExistingNone {
+				s.knownKeys.Store(key, struct{}{})
+			}
+			return nil
+		}
+		if s.opts.SkipExisting == SkipExistingConditional && isConditionalWriteConflict(err) {
+			// Someone else is uploading or finished uploading the same object first.
+			// The parts were already transferred, so nothing was saved and it isn't
+			// counted as a skipped PUT, but the upload still has to be aborted so
+			// that they're cleaned up.
+			if isPreconditionFailed(err) {
+				s.knownKeys.Store(key, struct{}{})
+			}
+			uploadErr = nil
+		} else {
+			uploadErr = fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+	}
+
+	// Use the parent context since ctx may already have been canceled.
+	_, abortErr := s.client.AbortMultipartUpload(s.ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if abortErr != nil {
+		return errors.Join(uploadErr, fmt.Errorf("failed to abort multipart upload: %w", abortErr))
+	}
+	return uploadErr
+}
+
+// objectExists reports whether key exists in the bucket. Errors other than a
+// miss are treated as "doesn't exist" so that the caller falls back to uploading.
+func (s *S3) objectExists(key string) bool {
+	_, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	return err == nil
+}
+
+// Exists reports whether an object is stored under actionID, using a HEAD request.
+func (s *S3) Exists(actionID []byte) (bool, error) {
+	_, err := s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.actionIDToKey(actionID)),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		if s.isNotFoundError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check for object: %w", err)
+	}
+	return true, nil
+}
+
+// GetRange returns length bytes of the object stored under actionID, starting at
+// offset, using a ranged GET.
+func (s *S3) GetRange(actionID []byte, offset, length int64) (io.ReadCloser, bool, error) {
+	key := s.actionIDToKey(actionID)
+	if length <= 0 {
+		exists, err := s.Exists(actionID)
+		return io.NopCloser(bytes.NewReader(nil)), !exists, err
+	}
+	result, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Range:                aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		if s.isNotFoundError(err) {
+			return nil, true, nil
+		}
+		return nil, false, fmt.Errorf("failed to get S3 object range: %w", err)
+	}
+	s.recordAccess(key)
+	return result.Body, false, nil
+}
+
+// List returns the keys of all objects whose key starts with prefix. Keys are hex
+// encoded in S3, which preserves prefixes.
+func (s *S3) List(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.actionIDToKey(prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(s.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key, err := hex.DecodeString(strings.TrimPrefix(aws.ToString(obj.Key), s.prefix))
+			if err != nil {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes the objects stored under actionIDs.
+func (s *S3) Delete(actionIDs [][]byte) error {
+	keys := make([]string, 0, len(actionIDs))
+	for _, actionID := range actionIDs {
+		keys = append(keys, s.actionIDToKey(actionID))
+	}
+	return s.deleteKeys(keys)
+}
+
+// recordSkippedPut records an upload of bodySize bytes that was skipped because
+// the object already existed.
+func (s *S3) recordSkippedPut(bodySize int64) {
+	s.skippedPuts.Add(1)
+	s.skippedBytes.Add(bodySize)
+}
+
+// PutSkipStats returns the number of uploads that were skipped because the object
+// already existed, and the number of bytes that didn't have to be uploaded.
+func (s *S3) PutSkipStats() (skipped, bytesSaved int64) {
+	return s.skippedPuts.Load(), s.skippedBytes.Load()
+}
+
 // Get retrieves an object from S3.
 // Returns the object data as an io.ReadCloser that must be closed by the caller.
 func (s *S3) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, bool, error) {
 	key := s.actionIDToKey(actionID)
 
-	// Get object from S3
+	// Get object from S3. If large objects are fetched in parallel, only ask for
+	// the first part up front. Objects smaller than a part are returned in full, and
+	// for anything larger the Content-Range header tells us the total size.
 	getInput := &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	}
+	if s.opts.MultipartThreshold > 0 {
+		getInput.Range = aws.String(fmt.Sprintf("bytes=0-%d", s.opts.PartSize-1))
 	}
 
 	result, err := s.client.GetObject(s.ctx, getInput)
+	if err != nil && getInput.Range != nil && isInvalidRangeError(err) {
+		// S3 rejects any range of an empty object, so fetch it without one.
+		getInput.Range = nil
+		result, err = s.client.GetObject(s.ctx, getInput)
+	}
 	if err != nil {
 		// Check if it's a not found error
 		if s.isNotFoundError(err) {
@@ -143,14 +720,128 @@ func (s *S3) Get(actionID []byte) ([]byte, io.ReadCloser, int64, *time.Time, boo
 	}
 	putTime := time.Unix(putTimeUnix, 0)
 
+	if s.opts.SkipExisting != SkipExistingNone {
+		s.knownKeys.Store(key, struct{}{})
+	}
+	s.recordAccess(key)
+
+	if result.ContentRange != nil {
+		totalSize, ok := parseContentRangeTotal(result.ContentRange)
+		switch {
+		case !ok:
+			// Without the total size the rest can't be split into ranges, so fetch
+			// the same version of the object again in full.
+			result.Body.Close()
+			getInput.Range = nil
+			getInput.IfMatch = result.ETag
+			full, err := s.client.GetObject(s.ctx, getInput)
+			if err != nil {
+				return nil, nil, 0, nil, true, fmt.Errorf("failed to get S3 object: %w", err)
+			}
+			return outputID, full.Body, size, &putTime, false, nil
+		case totalSize > aws.ToInt64(result.ContentLength):
+			body, err := s.getRemainingRanges(key, result, totalSize)
+			if err != nil {
+				return nil, nil, 0, nil, true, err
+			}
+			return outputID, body, size, &putTime, false, nil
+		}
+	}
+
 	// Return the S3 object body as a ReadCloser
 	// The caller is responsible for closing it
 	return outputID, result.Body, size, &putTime, false, nil
 }
 
-// Close performs cleanup operations.
+// getRemainingRanges downloads the rest of an object whose first part was already
+// fetched in first. Objects at or above opts.MultipartThreshold are fetched with
+// up to opts.Concurrency parallel ranged GETs, and the rest of smaller ones with a
+// single GET. Every range is conditional on the ETag of the first response so
+// that a concurrent overwrite of the object can never produce a mix of two
+// versions.
+func (s *S3) getRemainingRanges(key string, first *s3.GetObjectOutput, totalSize int64) (io.ReadCloser, error) {
+	defer first.Body.Close()
+
+	partSize := s.opts.PartSize
+	if totalSize < s.opts.MultipartThreshold {
+		partSize = totalSize
+	}
+
+	data := make([]byte, totalSize)
+	firstLen, err := io.ReadFull(first.Body, data[:aws.ToInt64(first.ContentLength)])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S3 object range: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	var (
+		sem     = make(chan struct{}, s.opts.Concurrency)
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		getErr  error
+	)
+	for offset := int64(firstLen); offset < totalSize; offset += partSize {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+
+		end := offset + partSize
+		if end > totalSize {
+			end = totalSize
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket:  aws.String(s.bucket),
+				Key:     aws.String(key),
+				Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+				IfMatch: first.ETag,
+
+				SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+				SSECustomerKey:       s.sseCustomerKey,
+				SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+			})
+			if err == nil {
+				_, err = io.ReadFull(result.Body, data[offset:end])
+				result.Body.Close()
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					getErr = fmt.Errorf("failed to get S3 object range %d-%d: %w", offset, end-1, err)
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if getErr != nil {
+		return nil, getErr
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Close performs cleanup operations, publishing any pending accesses.
 func (s *S3) Close() error {
-	return nil
+	if s.access == nil {
+		return nil
+	}
+	select {
+	case <-s.access.stop:
+		// Already closed.
+		return nil
+	default:
+	}
+	close(s.access.stop)
+	<-s.access.done
+	return s.flushAccessLog()
 }
 
 // Clear removes all entries from the cache in S3.
@@ -163,31 +854,224 @@ func (s *S3) Clear() error {
 
 	paginator := s3.NewListObjectsV2Paginator(s.client, listInput)
 
-	var deleteObjects []types.ObjectIdentifier
+	var keys []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(s.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+
+	return s.deleteKeys(keys)
+}
+
+// Trim removes objects according to policy.
+//
+// Objects are listed page by page. Policies without a size limit are applied to
+// each page as soon as it's listed, so memory use stays constant no matter how
+// many objects the bucket holds. A size limit has to see every object before it
+// can decide which ones to remove, so in that case the key, size and timestamps
+// of every object are held in memory until the listing is complete.
+//
+// Only objects whose key is an entry according to policy.IsEntry are trimmed,
+// so manifests, key filters and the objects of layout wrappers are left alone.
+// Layout wrappers trim their objects with trimObjects instead.
+//
+// S3 doesn't track when objects are read, so an object's last-use time is the
+// later of when it was uploaded and its last access recorded in the access logs
+// (see S3Options.TrackAccess). Unless this is a dry run, the access logs are then
+// compacted into a single log that only covers entries which still exist.
+func (s *S3) Trim(policy TrimPolicy) (TrimStats, error) {
+	var (
+		stats TrimStats
+		all   []TrimEntry
+		now   = time.Now()
+	)
+
+	accesses, logKeys, err := s.readAccessLogs()
+	if err != nil {
+		return stats, err
+	}
+	// Accesses of entries that still exist after trimming, for compacting the logs.
+	liveAccesses := make(map[string]time.Time)
+
+	apply := func(entries []TrimEntry) error {
+		evict, keep := policy.Select(entries, now)
+		if !policy.DryRun {
+			keys := make([][]byte, 0, len(evict))
+			for _, entry := range evict {
+				keys = append(keys, []byte(entry.Key))
+			}
+			if err := s.Delete(keys); err != nil {
+				return err
+			}
+			keepAccesses(liveAccesses, accesses, keep)
+		}
+		stats.Add(evict, true)
+		stats.Add(keep, false)
+		return nil
+	}
+
+	err = s.listTrimEntries(accesses, func(page []TrimEntry) error {
+		entries := page[:0]
+		for _, entry := range page {
+			if !policy.isEntry([]byte(entry.Key)) {
+				stats.Skipped++
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		if policy.MaxSize > 0 {
+			all = append(all, entries...)
+			return nil
+		}
+		return apply(entries)
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if policy.MaxSize > 0 {
+		if err := apply(all); err != nil {
+			return stats, err
+		}
+	}
+
+	if !policy.DryRun {
+		if err := s.compactAccessLogs(logKeys, liveAccesses); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// trimObjects lists every object stored by Put with its size and times, passes
+// them to plan, and deletes the objects whose keys plan returns unless dryRun is
+// set. Keys are those passed to Put, and last-use times include the accesses in
+// the access logs, which are compacted afterwards like in Trim.
+func (s *S3) trimObjects(dryRun bool, plan func(objects []TrimEntry) ([][]byte, error)) error {
+	accesses, logKeys, err := s.readAccessLogs()
+	if err != nil {
+		return err
+	}
+	var objects []TrimEntry
+	err = s.listTrimEntries(accesses, func(page []TrimEntry) error {
+		objects = append(objects, page...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys, err := plan(objects)
+	if err != nil || dryRun {
+		return err
+	}
+	if err := s.Delete(keys); err != nil {
+		return err
+	}
+
+	deleted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		deleted[string(key)] = true
+	}
+	var keep []TrimEntry
+	for _, object := range objects {
+		if !deleted[object.Key] {
+			keep = append(keep, object)
+		}
+	}
+	liveAccesses := make(map[string]time.Time)
+	keepAccesses(liveAccesses, accesses, keep)
+	return s.compactAccessLogs(logKeys, liveAccesses)
+}
+
+// listTrimEntries lists the objects stored by Put page by page, and calls fn with
+// a TrimEntry for each of them, keyed by the key passed to Put. An object's
+// last-use time is the later of its upload and its last access in accesses.
+func (s *S3) listTrimEntries(accesses map[string]time.Time, fn func(page []TrimEntry) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(s.ctx)
 		if err != nil {
 			return fmt.Errorf("failed to list S3 objects: %w", err)
 		}
 
+		entries := make([]TrimEntry, 0, len(page.Contents))
 		for _, obj := range page.Contents {
-			deleteObjects = append(deleteObjects, types.ObjectIdentifier{
-				Key: obj.Key,
+			relativeKey := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			// Access logs aren't hex encoded, so they're skipped along with anything
+			// else that wasn't stored by Put.
+			key, err := hex.DecodeString(relativeKey)
+			if err != nil {
+				continue
+			}
+
+			modified := aws.ToTime(obj.LastModified)
+			lastUsed := modified
+			if accessed := accesses[relativeKey]; accessed.After(lastUsed) {
+				lastUsed = accessed
+			}
+			entries = append(entries, TrimEntry{
+				Key:      string(key),
+				Size:     aws.ToInt64(obj.Size),
+				Created:  modified,
+				LastUsed: lastUsed,
 			})
 		}
+		if err := fn(entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepAccesses copies the accesses of the kept entries from accesses to live.
+func keepAccesses(live, accesses map[string]time.Time, keep []TrimEntry) {
+	for _, entry := range keep {
+		relativeKey := hex.EncodeToString([]byte(entry.Key))
+		if accessed, ok := accesses[relativeKey]; ok {
+			live[relativeKey] = accessed
+		}
 	}
+}
 
-	if len(deleteObjects) == 0 {
+// compactAccessLogs replaces the access logs at logKeys with a single log of the
+// accesses in live.
+func (s *S3) compactAccessLogs(logKeys []string, live map[string]time.Time) error {
+	if len(logKeys) == 0 {
 		return nil
 	}
+	// Write the compacted log before deleting the old ones so that accesses are
+	// never lost, at worst duplicated.
+	if len(live) > 0 {
+		if err := s.writeAccessLog(live); err != nil {
+			return err
+		}
+	}
+	return s.deleteKeys(logKeys)
+}
 
-	// Delete objects (S3 allows up to 1000 objects per request)
-	for i := 0; i < len(deleteObjects); i += 1000 {
+// deleteKeys deletes the given objects in batches.
+func (s *S3) deleteKeys(keys []string) error {
+	// S3 allows up to 1000 objects per request.
+	for i := 0; i < len(keys); i += 1000 {
 		end := i + 1000
-		if end > len(deleteObjects) {
-			end = len(deleteObjects)
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make([]types.ObjectIdentifier, 0, end-i)
+		for _, key := range keys[i:end] {
+			batch = append(batch, types.ObjectIdentifier{Key: aws.String(key)})
 		}
-		batch := deleteObjects[i:end]
 
 		deleteInput := &s3.DeleteObjectsInput{
 			Bucket: aws.String(s.bucket),
@@ -197,10 +1081,15 @@ func (s *S3) Clear() error {
 			},
 		}
 
-		_, err := s.client.DeleteObjects(s.ctx, deleteInput)
+		out, err := s.client.DeleteObjects(s.ctx, deleteInput)
 		if err != nil {
 			return fmt.Errorf("failed to delete S3 objects: %w", err)
 		}
+		if len(out.Errors) > 0 {
+			first := out.Errors[0]
+			return fmt.Errorf("failed to delete %d S3 objects, first error: %s: %s",
+				len(out.Errors), aws.ToString(first.Key), aws.ToString(first.Message))
+		}
 	}
 
 	return nil
@@ -215,6 +1104,101 @@ func (s *S3) actionIDToKey(actionID []byte) string {
 	return hexID
 }
 
+// serverSideEncryption returns the S3-managed encryption algorithm for uploads.
+// SSE-C is configured separately through the customer key parameters.
+func (s *S3) serverSideEncryption() types.ServerSideEncryption {
+	switch s.opts.Encryption {
+	case SSES3:
+		return types.ServerSideEncryptionAes256
+	case SSEKMS:
+		return types.ServerSideEncryptionAwsKms
+	default:
+		return ""
+	}
+}
+
+// kmsKeyID returns the KMS key ID for uploads, or nil for the default key.
+func (s *S3) kmsKeyID() *string {
+	if s.opts.Encryption != SSEKMS || s.opts.KMSKeyID == "" {
+		return nil
+	}
+	return aws.String(s.opts.KMSKeyID)
+}
+
+// ifNoneMatch returns the If-None-Match header for uploads, or nil if conditional
+// writes are disabled.
+func (s *S3) ifNoneMatch() *string {
+	if s.opts.SkipExisting != SkipExistingConditional {
+		return nil
+	}
+	return aws.String("*")
+}
+
+// sseCustomerAlgorithm returns the SSE-C algorithm, or nil if SSE-C is disabled.
+func (s *S3) sseCustomerAlgorithm() *string {
+	if s.sseCustomerKey == nil {
+		return nil
+	}
+	return aws.String("AES256")
+}
+
+// useMultipart returns whether an object of the given size should be transferred
+// in multiple parts.
+func (s *S3) useMultipart(size int64) bool {
+	return s.opts.MultipartThreshold > 0 && size >= s.opts.MultipartThreshold && size > s.partSize(size)
+}
+
+// partSize returns the part size to use for a multipart upload of the given size.
+func (s *S3) partSize(size int64) int64 {
+	partSize := max(s.opts.PartSize, s3MinPartSize)
+	if minForCount := (size + s3MaxParts - 1) / s3MaxParts; partSize < minForCount {
+		partSize = minForCount
+	}
+	return partSize
+}
+
+// parseContentRangeTotal extracts the total object size from a Content-Range
+// header of the form "bytes 0-8388607/134217728".
+func parseContentRangeTotal(contentRange *string) (int64, bool) {
+	if contentRange == nil {
+		return 0, false
+	}
+	_, total, found := strings.Cut(*contentRange, "/")
+	if !found || total == "*" {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// isConditionalWriteConflict checks if an error is S3 rejecting a conditional
+// write because the object already exists (412) or because a concurrent
+// conditional write to the same key is in progress (409).
+func isConditionalWriteConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	errMsg := err.Error()
+	return strings.Contains(errMsg, "PreconditionFailed") ||
+		strings.Contains(errMsg, "ConditionalRequestConflict")
+}
+
+// isInvalidRangeError checks if an error is S3 rejecting a ranged GET because
+// the range isn't satisfiable (416), which it does for every range of an empty
+// object.
+func isInvalidRangeError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "InvalidRange")
+}
+
+// isPreconditionFailed checks if an error is S3 rejecting a conditional write
+// because the object already exists (412).
+func isPreconditionFailed(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "PreconditionFailed")
+}
+
 // isNotFoundError checks if an error is a "not found" error from S3.
 func (s *S3) isNotFoundError(err error) bool {
 	if err == nil {
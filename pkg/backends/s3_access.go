@@ -0,0 +1,265 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// s3AccessLogDir holds access logs, relative to the backend's prefix. Cache
+	// keys are hex encoded so they can never collide with it.
+	s3AccessLogDir = "_access/"
+
+	// s3AccessLogInterval is how often pending accesses are published while the
+	// backend is open. Whatever is left is published when it's closed.
+	s3AccessLogInterval = 5 * time.Minute
+
+	// s3AccessRepublishInterval is how long an access to a key is considered fresh
+	// enough that further accesses by this process don't need to be published.
+	s3AccessRepublishInterval = time.Hour
+)
+
+// s3AccessTracker batches cache hits and publishes them to S3 as access log
+// objects, so that trimming can remove entries by when they were last used
+// instead of when they were uploaded.
+//
+// Each access log is a gzipped text file with one "<unix time> <key>" line per
+// entry, where keys are relative to the backend's prefix.
+type s3AccessTracker struct {
+	sync.Mutex
+	pending   map[string]time.Time
+	published map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newS3AccessTracker() *s3AccessTracker {
+	return &s3AccessTracker{
+		pending:   make(map[string]time.Time),
+		published: make(map[string]time.Time),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// record records an access to key at now, unless one was published recently.
+func (t *s3AccessTracker) record(key string, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if published, ok := t.published[key]; ok && now.Sub(published) < s3AccessRepublishInterval {
+		return
+	}
+	t.pending[key] = now
+}
+
+// take removes and returns all pending accesses.
+func (t *s3AccessTracker) take() map[string]time.Time {
+	t.Lock()
+	defer t.Unlock()
+	pending := t.pending
+	t.pending = make(map[string]time.Time)
+	return pending
+}
+
+// markPublished records that accesses were published, or returns them to the
+// pending set if publishing failed so that they're retried with the next batch.
+func (t *s3AccessTracker) markPublished(accesses map[string]time.Time, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	for key, accessed := range accesses {
+		if !ok {
+			if pending, exists := t.pending[key]; !exists || pending.Before(accessed) {
+				t.pending[key] = accessed
+			}
+			continue
+		}
+		t.published[key] = accessed
+	}
+}
+
+// runAccessTracker periodically publishes pending accesses until the tracker is stopped.
+func (s *S3) runAccessTracker() {
+	defer close(s.access.done)
+
+	ticker := time.NewTicker(s3AccessLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Errors are retried on the next tick, and reported by Close if they
+			// persist until then.
+			s.flushAccessLog()
+		case <-s.access.stop:
+			return
+		}
+	}
+}
+
+// recordAccess records a cache hit for the object with the given full key.
+func (s *S3) recordAccess(key string) {
+	if s.access == nil {
+		return
+	}
+	s.access.record(strings.TrimPrefix(key, s.prefix), time.Now())
+}
+
+// flushAccessLog publishes all pending accesses as a new access log object.
+func (s *S3) flushAccessLog() error {
+	accesses := s.access.take()
+	if len(accesses) == 0 {
+		return nil
+	}
+	err := s.writeAccessLog(accesses)
+	s.access.markPublished(accesses, err == nil)
+	return err
+}
+
+// writeAccessLog uploads accesses as a new access log object.
+func (s *S3) writeAccessLog(accesses map[string]time.Time) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for key, accessed := range accesses {
+		fmt.Fprintf(gz, "%d %s\n", accessed.Unix(), key)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress access log: %w", err)
+	}
+
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	key := s.prefix + s3AccessLogDir + time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix[:]) + ".gz"
+
+	_, err := s.client.PutObject(s.ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(buf.Bytes()),
+		ServerSideEncryption: s.serverSideEncryption(),
+		SSEKMSKeyId:          s.kmsKeyID(),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload access log: %w", err)
+	}
+	return nil
+}
+
+// readAccessLogs reads every access log and returns the last access time of each
+// key, along with the full keys of the access logs that were read.
+func (s *S3) readAccessLogs() (map[string]time.Time, []string, error) {
+	var logKeys []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + s3AccessLogDir),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(s.ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list access logs: %w", err)
+		}
+		for _, obj := range page.Contents {
+			logKeys = append(logKeys, aws.ToString(obj.Key))
+		}
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		accesses  = make(map[string]time.Time)
+		semaphore = make(chan struct{}, s.opts.Concurrency)
+	)
+	for _, logKey := range logKeys {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			logAccesses, err := s.readAccessLog(logKey)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for key, accessed := range logAccesses {
+				if accessed.After(accesses[key]) {
+					accesses[key] = accessed
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	return accesses, logKeys, nil
+}
+
+// readAccessLog reads a single access log object.
+func (s *S3) readAccessLog(logKey string) (map[string]time.Time, error) {
+	result, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(logKey),
+		SSECustomerAlgorithm: s.sseCustomerAlgorithm(),
+		SSECustomerKey:       s.sseCustomerKey,
+		SSECustomerKeyMD5:    s.sseCustomerKeyMD5,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access log %s: %w", logKey, err)
+	}
+	defer result.Body.Close()
+
+	gz, err := gzip.NewReader(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access log %s: %w", logKey, err)
+	}
+	accesses, err := parseAccessLog(gz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access log %s: %w", logKey, err)
+	}
+	return accesses, nil
+}
+
+// parseAccessLog parses the uncompressed contents of an access log.
+func parseAccessLog(r io.Reader) (map[string]time.Time, error) {
+	accesses := make(map[string]time.Time)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		unixStr, key, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("invalid access log line: %q", line)
+		}
+		unix, err := strconv.ParseInt(unixStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log line: %q", line)
+		}
+		if accessed := time.Unix(unix, 0); accessed.After(accesses[key]) {
+			accesses[key] = accessed
+		}
+	}
+	return accesses, scanner.Err()
+}
@@ -0,0 +1,1116 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3Object is an object stored in fakeS3Client.
+type fakeS3Object struct {
+	data     []byte
+	metadata map[string]string
+	etag     string
+	modified time.Time
+}
+
+// fakeS3Client is an in-memory implementation of s3Client that mimics the
+// behavior of S3 closely enough to exercise multipart and ranged transfers.
+type fakeS3Client struct {
+	sync.Mutex
+	objects     map[string]*fakeS3Object
+	uploads     map[string]*fakeS3Object    // Pending multipart uploads by upload ID.
+	parts       map[string]map[int32][]byte // Uploaded parts by upload ID.
+	aborted     map[string]bool             // Aborted upload IDs.
+	nextID      int
+	failPart    int32 // Part number that fails to upload, if non-zero.
+	pageSize    int   // Maximum keys per ListObjectsV2 page, if non-zero.
+	hideTotal   bool  // Return "*" as the total size in Content-Range headers.
+	conflict    bool  // Reject conditional writes with 409 as if another upload was in progress.
+	listCalls   atomic.Int64
+	getCalls    atomic.Int64
+	headCalls   atomic.Int64
+	putCalls    atomic.Int64
+	partCalls   atomic.Int64
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+
+	// The most recent request of each type, for asserting on request parameters.
+	lastPut        *s3.PutObjectInput
+	lastCreate     *s3.CreateMultipartUploadInput
+	lastUploadPart *s3.UploadPartInput
+	lastGet        *s3.GetObjectInput
+}
+
+func newFakeS3Client() *fakeS3Client {
+	return &fakeS3Client{
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]*fakeS3Object),
+		parts:   make(map[string]map[int32][]byte),
+		aborted: make(map[string]bool),
+	}
+}
+
+func (f *fakeS3Client) newETag() string {
+	f.nextID++
+	return fmt.Sprintf("\"etag-%d\"", f.nextID)
+}
+
+func (f *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.putCalls.Add(1)
+
+	f.Lock()
+	defer f.Unlock()
+	f.lastPut = params
+	if f.conflict && aws.ToString(params.IfNoneMatch) == "*" {
+		return nil, fmt.Errorf("ConditionalRequestConflict: A conflicting conditional operation is currently in progress")
+	}
+	if _, ok := f.objects[*params.Key]; ok && aws.ToString(params.IfNoneMatch) == "*" {
+		return nil, fmt.Errorf("PreconditionFailed: At least one of the pre-conditions you specified did not hold")
+	}
+	f.objects[*params.Key] = &fakeS3Object{data: data, metadata: params.Metadata, etag: f.newETag(), modified: time.Now()}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.getCalls.Add(1)
+
+	f.Lock()
+	f.lastGet = params
+	obj, ok := f.objects[*params.Key]
+	f.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", *params.Key)
+	}
+	if params.IfMatch != nil && *params.IfMatch != obj.etag {
+		return nil, fmt.Errorf("PreconditionFailed")
+	}
+
+	out := &s3.GetObjectOutput{
+		Metadata: obj.metadata,
+		ETag:     aws.String(obj.etag),
+	}
+	data := obj.data
+	if params.Range != nil {
+		var start, end int64
+		if _, err := fmt.Sscanf(*params.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", *params.Range, err)
+		}
+		// Like S3, reject ranges that start past the end, which includes every
+		// range of an empty object.
+		if start >= int64(len(data)) {
+			return nil, fmt.Errorf("api error InvalidRange: StatusCode: 416, The requested range is not satisfiable")
+		}
+		if last := int64(len(data)) - 1; end > last {
+			end = last
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		if f.hideTotal {
+			out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/*", start, end))
+		}
+		data = data[start : end+1]
+	}
+	out.ContentLength = aws.Int64(int64(len(data)))
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	return out, nil
+}
+
+func (f *fakeS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.headCalls.Add(1)
+
+	f.Lock()
+	defer f.Unlock()
+	obj, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, fmt.Errorf("NotFound: %s", *params.Key)
+	}
+	return &s3.HeadObjectOutput{
+		Metadata:      obj.metadata,
+		ETag:          aws.String(obj.etag),
+		ContentLength: aws.Int64(int64(len(obj.data))),
+	}, nil
+}
+
+func (f *fakeS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.listCalls.Add(1)
+
+	f.Lock()
+	defer f.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{}
+	if f.pageSize > 0 && len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		obj := f.objects[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeS3Client) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, obj := range params.Delete.Objects {
+		delete(f.objects, *obj.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (f *fakeS3Client) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.lastCreate = params
+	f.nextID++
+	uploadID := strconv.Itoa(f.nextID)
+	f.uploads[uploadID] = &fakeS3Object{metadata: params.Metadata}
+	f.parts[uploadID] = make(map[int32][]byte)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (f *fakeS3Client) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	f.partCalls.Add(1)
+	inflight := f.inflight.Add(1)
+	defer f.inflight.Add(-1)
+	for {
+		maxInflight := f.maxInflight.Load()
+		if inflight <= maxInflight || f.maxInflight.CompareAndSwap(maxInflight, inflight) {
+			break
+		}
+	}
+
+	if *params.PartNumber == f.failPart {
+		return nil, fmt.Errorf("simulated failure for part %d", *params.PartNumber)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != aws.ToInt64(params.ContentLength) {
+		return nil, fmt.Errorf("content length mismatch")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.lastUploadPart = params
+	f.parts[*params.UploadId][*params.PartNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("part-%d", *params.PartNumber))}, nil
+}
+
+func (f *fakeS3Client) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	upload, ok := f.uploads[*params.UploadId]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchUpload")
+	}
+	if _, ok := f.objects[*params.Key]; ok && aws.ToString(params.IfNoneMatch) == "*" {
+		return nil, fmt.Errorf("PreconditionFailed: At least one of the pre-conditions you specified did not hold")
+	}
+	var data []byte
+	for i, part := range params.MultipartUpload.Parts {
+		if *part.PartNumber != int32(i+1) || *part.ETag != fmt.Sprintf("part-%d", i+1) {
+			return nil, fmt.Errorf("InvalidPart: %d", *part.PartNumber)
+		}
+		data = append(data, f.parts[*params.UploadId][*part.PartNumber]...)
+	}
+	upload.data = data
+	upload.etag = f.newETag()
+	upload.modified = time.Now()
+	f.objects[*params.Key] = upload
+	delete(f.uploads, *params.UploadId)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3Client) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.uploads, *params.UploadId)
+	f.aborted[*params.UploadId] = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func newTestS3(client *fakeS3Client, opts S3Options) *S3 {
+	backend, err := newS3(context.Background(), client, "test-bucket", "test/", opts)
+	if err != nil {
+		panic(err)
+	}
+	return backend
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestS3PutGetRoundTrip(t *testing.T) {
+	opts := S3Options{
+		MultipartThreshold: 12 * 1024 * 1024,
+		PartSize:           s3MinPartSize,
+		Concurrency:        3,
+	}
+
+	tests := []struct {
+		name          string
+		size          int
+		expectedParts int64
+	}{
+		{"empty", 0, 0},
+		{"small", 1024, 0},
+		{"below threshold", 12*1024*1024 - 1, 0},
+		{"at threshold", 12 * 1024 * 1024, 3},
+		{"many parts", 33*1024*1024 + 17, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				client   = newFakeS3Client()
+				backend  = newTestS3(client, opts)
+				data     = randomBytes(t, tt.size)
+				actionID = []byte{0x01, 0x02}
+				outputID = []byte{0x03, 0x04}
+			)
+
+			if err := backend.Put(actionID, outputID, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if parts := client.partCalls.Load(); parts != tt.expectedParts {
+				t.Errorf("uploaded %d parts, expected %d", parts, tt.expectedParts)
+			}
+			if maxInflight := client.maxInflight.Load(); maxInflight > int64(opts.Concurrency) {
+				t.Errorf("%d parts uploaded concurrently, expected at most %d", maxInflight, opts.Concurrency)
+			}
+
+			gotOutputID, body, size, _, miss, err := backend.Get(actionID)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if miss {
+				t.Fatal("Get returned a miss")
+			}
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("body mismatch: got %d bytes, expected %d", len(got), len(data))
+			}
+			if size != int64(len(data)) {
+				t.Errorf("size = %d, expected %d", size, len(data))
+			}
+			if !bytes.Equal(gotOutputID, outputID) {
+				t.Errorf("outputID = %x, expected %x", gotOutputID, outputID)
+			}
+
+			// Empty objects are fetched again without a range after a 416, and the
+			// rest of objects below the threshold is fetched with a single GET.
+			var expectedGets int64
+			switch {
+			case tt.size == 0:
+				expectedGets = 2
+			case tt.size <= int(opts.PartSize):
+				expectedGets = 1
+			case tt.size < int(opts.MultipartThreshold):
+				expectedGets = 2
+			default:
+				expectedGets = int64((tt.size + int(opts.PartSize) - 1) / int(opts.PartSize))
+			}
+			if gets := client.getCalls.Load(); gets != expectedGets {
+				t.Errorf("issued %d GETs, expected %d", gets, expectedGets)
+			}
+		})
+	}
+}
+
+func TestS3MultipartDisabled(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{PartSize: s3MinPartSize, Concurrency: 4})
+		data    = randomBytes(t, 3*s3MinPartSize)
+	)
+
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if parts := client.partCalls.Load(); parts != 0 {
+		t.Errorf("uploaded %d parts with multipart disabled, expected 0", parts)
+	}
+
+	_, body, _, _, _, err := backend.Get([]byte{0x01})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+	if gets := client.getCalls.Load(); gets != 1 {
+		t.Errorf("issued %d GETs with multipart disabled, expected 1", gets)
+	}
+}
+
+func TestS3GetUnknownSize(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{MultipartThreshold: 2 * s3MinPartSize, PartSize: s3MinPartSize, Concurrency: 2})
+		data    = randomBytes(t, 3*s3MinPartSize)
+	)
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Without a total size in the Content-Range header, the object is fetched
+	// again in full.
+	client.hideTotal = true
+	client.getCalls.Store(0)
+	_, body, _, _, _, err := backend.Get([]byte{0x01})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes (err %v), expected %d", len(got), err, len(data))
+	}
+	if gets := client.getCalls.Load(); gets != 2 || client.lastGet.Range != nil || client.lastGet.IfMatch == nil {
+		t.Errorf("issued %d GETs ending with range %v and If-Match %v, expected 2 ending with a conditional full GET",
+			gets, aws.ToString(client.lastGet.Range), aws.ToString(client.lastGet.IfMatch))
+	}
+}
+
+func TestS3MultipartAbortOnFailure(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{
+			MultipartThreshold: s3MinPartSize,
+			PartSize:           s3MinPartSize,
+			Concurrency:        2,
+		})
+		data = randomBytes(t, 6*s3MinPartSize)
+	)
+	client.failPart = 3
+
+	err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data)))
+	if err == nil {
+		t.Fatal("expected Put to fail")
+	}
+	if !strings.Contains(err.Error(), "part 3") {
+		t.Errorf("expected error to mention the failed part, got: %v", err)
+	}
+
+	client.Lock()
+	defer client.Unlock()
+	if len(client.aborted) != 1 {
+		t.Errorf("expected 1 aborted upload, got %d", len(client.aborted))
+	}
+	if len(client.uploads) != 0 {
+		t.Errorf("expected no pending uploads, got %d", len(client.uploads))
+	}
+	if len(client.objects) != 0 {
+		t.Errorf("expected no objects after failed upload, got %d", len(client.objects))
+	}
+}
+
+func TestS3RangedGetDetectsOverwrite(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{
+			MultipartThreshold: s3MinPartSize,
+			PartSize:           1024,
+			Concurrency:        2,
+		})
+		data = randomBytes(t, 4096)
+	)
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Simulate a concurrent overwrite after the first range was fetched by
+	// swapping the ETag: the remaining ranges must fail rather than returning a
+	// mix of two object versions.
+	first, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+		Key:   aws.String("test/01"),
+		Range: aws.String("bytes=0-1023"),
+	})
+	if err != nil {
+		t.Fatalf("GetObject failed: %v", err)
+	}
+	client.Lock()
+	client.objects["test/01"].etag = "\"overwritten\""
+	client.Unlock()
+
+	if _, err := backend.getRemainingRanges("test/01", first, 4096); err == nil {
+		t.Fatal("expected ranged GET to fail after the object was overwritten")
+	}
+}
+
+func TestS3PartSize(t *testing.T) {
+	backend := newTestS3(newFakeS3Client(), S3Options{MultipartThreshold: 1, PartSize: 1024, Concurrency: 1})
+
+	if got := backend.partSize(10 * 1024 * 1024); got != s3MinPartSize {
+		t.Errorf("partSize = %d, expected minimum part size %d", got, s3MinPartSize)
+	}
+
+	huge := int64(s3MaxParts) * s3MinPartSize * 2
+	if got := backend.partSize(huge); (huge+got-1)/got > s3MaxParts {
+		t.Errorf("partSize = %d results in more than %d parts", got, s3MaxParts)
+	}
+}
+
+func TestParseContentRangeTotal(t *testing.T) {
+	tests := []struct {
+		header   *string
+		expected int64
+		ok       bool
+	}{
+		{nil, 0, false},
+		{aws.String("bytes 0-1023/4096"), 4096, true},
+		{aws.String("bytes 0-99/100"), 100, true},
+		{aws.String("bytes 0-1023/*"), 0, false},
+		{aws.String("garbage"), 0, false},
+	}
+
+	for _, tt := range tests {
+		total, ok := parseContentRangeTotal(tt.header)
+		if total != tt.expected || ok != tt.ok {
+			t.Errorf("parseContentRangeTotal(%v) = (%d, %v), expected (%d, %v)",
+				aws.ToString(tt.header), total, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestLoadAWSConfig(t *testing.T) {
+	// Make sure the ambient environment doesn't leak into the test.
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		t.Setenv(key, "")
+	}
+
+	var (
+		dir             = t.TempDir()
+		configFile      = filepath.Join(dir, "config")
+		credentialsFile = filepath.Join(dir, "credentials")
+	)
+	if err := os.WriteFile(configFile, []byte("[profile ci]\nregion = eu-west-3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(credentialsFile, []byte("[ci]\naws_access_key_id = AKIDCI\naws_secret_access_key = secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadAWSConfig(context.Background(), S3Options{
+		Profile:         "ci",
+		ConfigFile:      configFile,
+		CredentialsFile: credentialsFile,
+	})
+	if err != nil {
+		t.Fatalf("loadAWSConfig failed: %v", err)
+	}
+	if cfg.Region != "eu-west-3" {
+		t.Errorf("region = %q, expected region from profile", cfg.Region)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve credentials: %v", err)
+	}
+	if creds.AccessKeyID != "AKIDCI" {
+		t.Errorf("access key = %q, expected key from credentials file", creds.AccessKeyID)
+	}
+
+	// An explicit region takes precedence over the profile.
+	cfg, err = loadAWSConfig(context.Background(), S3Options{
+		Region:          "auto",
+		Profile:         "ci",
+		ConfigFile:      configFile,
+		CredentialsFile: credentialsFile,
+	})
+	if err != nil {
+		t.Fatalf("loadAWSConfig failed: %v", err)
+	}
+	if cfg.Region != "auto" {
+		t.Errorf("region = %q, expected explicit region", cfg.Region)
+	}
+}
+
+func TestNewS3ClientOptions(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	backend, err := NewS3("bucket", "prefix/", S3Options{
+		Endpoint:        "http://localhost:9000",
+		Region:          "us-east-1",
+		UsePathStyle:    true,
+		SkipBucketCheck: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3 failed: %v", err)
+	}
+
+	options := backend.client.(*s3.Client).Options()
+	if aws.ToString(options.BaseEndpoint) != "http://localhost:9000" {
+		t.Errorf("endpoint = %q, expected http://localhost:9000", aws.ToString(options.BaseEndpoint))
+	}
+	if !options.UsePathStyle {
+		t.Error("expected path-style addressing to be enabled")
+	}
+	if options.Region != "us-east-1" {
+		t.Errorf("region = %q, expected us-east-1", options.Region)
+	}
+}
+
+func TestS3StorageOptions(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{
+			MultipartThreshold: s3MinPartSize,
+			PartSize:           s3MinPartSize,
+			Concurrency:        2,
+			Encryption:         SSEKMS,
+			KMSKeyID:           "arn:aws:kms:us-east-1:111122223333:key/abc",
+			StorageClass:       "STANDARD_IA",
+			Tags:               map[string]string{"team": "build", "run": "1234 5"},
+			ACL:                "bucket-owner-full-control",
+		})
+		small = randomBytes(t, 1024)
+		large = randomBytes(t, 2*s3MinPartSize)
+	)
+
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(small), int64(len(small))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := backend.Put([]byte{0x03}, []byte{0x04}, bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatalf("multipart Put failed: %v", err)
+	}
+
+	put, create := client.lastPut, client.lastCreate
+	if put.ServerSideEncryption != types.ServerSideEncryptionAwsKms || create.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		t.Errorf("expected aws:kms encryption, got %q and %q", put.ServerSideEncryption, create.ServerSideEncryption)
+	}
+	if aws.ToString(put.SSEKMSKeyId) != backend.opts.KMSKeyID || aws.ToString(create.SSEKMSKeyId) != backend.opts.KMSKeyID {
+		t.Errorf("expected KMS key ID to be set on both upload types")
+	}
+	if put.StorageClass != "STANDARD_IA" || create.StorageClass != "STANDARD_IA" {
+		t.Errorf("expected STANDARD_IA storage class, got %q and %q", put.StorageClass, create.StorageClass)
+	}
+	if put.ACL != "bucket-owner-full-control" || create.ACL != "bucket-owner-full-control" {
+		t.Errorf("expected canned ACL, got %q and %q", put.ACL, create.ACL)
+	}
+	const expectedTagging = "run=1234+5&team=build"
+	if aws.ToString(put.Tagging) != expectedTagging || aws.ToString(create.Tagging) != expectedTagging {
+		t.Errorf("tagging = %q and %q, expected %q", aws.ToString(put.Tagging), aws.ToString(create.Tagging), expectedTagging)
+	}
+	if put.SSECustomerKey != nil || client.lastUploadPart.SSECustomerKey != nil {
+		t.Error("expected no SSE-C parameters with SSE-KMS")
+	}
+}
+
+func TestS3CustomerKeyEncryption(t *testing.T) {
+	var (
+		client = newFakeS3Client()
+		key    = bytes.Repeat([]byte{0xab}, 32)
+		opts   = S3Options{
+			MultipartThreshold: s3MinPartSize,
+			PartSize:           s3MinPartSize,
+			Concurrency:        2,
+			Encryption:         SSEC,
+			CustomerKey:        key,
+		}
+		backend = newTestS3(client, opts)
+		data    = randomBytes(t, 2*s3MinPartSize)
+	)
+
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	_, body, _, _, _, err := backend.Get([]byte{0x01})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	body.Close()
+
+	expectedKey := base64.StdEncoding.EncodeToString(key)
+	for name, got := range map[string]*string{
+		"CreateMultipartUpload": client.lastCreate.SSECustomerKey,
+		"UploadPart":            client.lastUploadPart.SSECustomerKey,
+		"GetObject":             client.lastGet.SSECustomerKey,
+	} {
+		if aws.ToString(got) != expectedKey {
+			t.Errorf("%s: SSE-C key not set", name)
+		}
+	}
+	if aws.ToString(client.lastGet.SSECustomerAlgorithm) != "AES256" || client.lastGet.SSECustomerKeyMD5 == nil {
+		t.Error("GetObject: expected SSE-C algorithm and key MD5 to be set")
+	}
+	if client.lastCreate.ServerSideEncryption != "" {
+		t.Errorf("expected no S3-managed encryption with SSE-C, got %q", client.lastCreate.ServerSideEncryption)
+	}
+}
+
+func TestS3StorageOptionsValidation(t *testing.T) {
+	tooManyTags := make(map[string]string)
+	for i := range s3MaxTags + 1 {
+		tooManyTags[strconv.Itoa(i)] = "v"
+	}
+
+	for name, opts := range map[string]S3Options{
+		"unknown encryption":   {Encryption: "rot13"},
+		"KMS key without KMS":  {Encryption: SSES3, KMSKeyID: "key"},
+		"SSE-C without key":    {Encryption: SSEC},
+		"SSE-C with short key": {Encryption: SSEC, CustomerKey: []byte("short")},
+		"too many tags":        {Tags: tooManyTags},
+	} {
+		if _, err := newS3(context.Background(), newFakeS3Client(), "bucket", "", opts); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestS3SkipExisting(t *testing.T) {
+	const size = 1024
+
+	tests := []struct {
+		policy        string
+		expectedPuts  int64
+		expectedHeads int64
+		expectedSkips int64
+	}{
+		// The first backend uploads, the second is rejected by the conditional
+		// write, and the third remembers the key from its earlier GET.
+		{SkipExistingConditional, 2, 0, 2},
+		// HEAD avoids the second upload entirely.
+		{SkipExistingHead, 1, 2, 2},
+		{SkipExistingNone, 3, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run("policy="+tt.policy, func(t *testing.T) {
+			var (
+				client   = newFakeS3Client()
+				opts     = S3Options{SkipExisting: tt.policy}
+				data     = randomBytes(t, size)
+				actionID = []byte{0x01}
+			)
+
+			// Two runners building the same commit.
+			first, second := newTestS3(client, opts), newTestS3(client, opts)
+			for _, backend := range []*S3{first, second} {
+				if err := backend.Put(actionID, []byte{0x02}, bytes.NewReader(data), size); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+
+			// A runner that fetched the object before uploading it again.
+			third := newTestS3(client, opts)
+			if _, body, _, _, miss, err := third.Get(actionID); err != nil || miss {
+				t.Fatalf("Get failed: miss=%v, err=%v", miss, err)
+			} else {
+				body.Close()
+			}
+			if err := third.Put(actionID, []byte{0x02}, bytes.NewReader(data), size); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+
+			if puts := client.putCalls.Load(); puts != tt.expectedPuts {
+				t.Errorf("issued %d PUTs, expected %d", puts, tt.expectedPuts)
+			}
+			if heads := client.headCalls.Load(); heads != tt.expectedHeads {
+				t.Errorf("issued %d HEADs, expected %d", heads, tt.expectedHeads)
+			}
+
+			var skipped, saved int64
+			for _, backend := range []*S3{first, second, third} {
+				s, b := backend.PutSkipStats()
+				skipped += s
+				saved += b
+			}
+			if skipped != tt.expectedSkips || saved != tt.expectedSkips*size {
+				t.Errorf("skip stats = (%d, %d), expected (%d, %d)", skipped, saved, tt.expectedSkips, tt.expectedSkips*size)
+			}
+		})
+	}
+}
+
+func TestS3SkipExistingMultipart(t *testing.T) {
+	var (
+		client = newFakeS3Client()
+		opts   = S3Options{
+			MultipartThreshold: 2 * s3MinPartSize,
+			PartSize:           s3MinPartSize,
+			Concurrency:        2,
+			SkipExisting:       SkipExistingConditional,
+		}
+		data = randomBytes(t, 3*s3MinPartSize)
+	)
+
+	// Large objects are checked with a HEAD before uploading any parts.
+	for i := 0; i < 2; i++ {
+		backend := newTestS3(client, opts)
+		if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if parts := client.partCalls.Load(); parts != 3 {
+		t.Errorf("uploaded %d parts, expected 3", parts)
+	}
+
+	// If the object appears while the parts are being uploaded, the conditional
+	// complete fails and the upload is aborted without reporting an error.
+	backend := newTestS3(client, opts)
+	uploadID := strconv.Itoa(client.nextID + 1)
+	if err := backend.putMultipart("test/01", nil, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("putMultipart failed: %v", err)
+	}
+	if !client.aborted[uploadID] {
+		t.Error("expected the conflicting upload to be aborted")
+	}
+	// The parts were transferred anyway, so nothing was skipped.
+	if skipped, _ := backend.PutSkipStats(); skipped != 0 {
+		t.Errorf("skipped %d PUTs, expected 0", skipped)
+	}
+}
+
+func TestS3SkipExistingConflict(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{SkipExisting: SkipExistingConditional})
+		data    = []byte("compiled output")
+	)
+
+	// A 409 means another writer is uploading the object, which may still fail, so
+	// the next PUT of the key is attempted again.
+	client.conflict = true
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	client.conflict = false
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if puts := client.putCalls.Load(); puts != 2 {
+		t.Errorf("issued %d PUTs, expected 2", puts)
+	}
+	if _, ok := client.objects["test/01"]; !ok {
+		t.Error("object wasn't uploaded after the conflict")
+	}
+
+	// A 412 means the object exists, so later PUTs of the key are skipped locally.
+	other := newTestS3(client, S3Options{SkipExisting: SkipExistingConditional})
+	for range 2 {
+		if err := other.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if puts := client.putCalls.Load(); puts != 3 {
+		t.Errorf("issued %d PUTs, expected 3", puts)
+	}
+}
+
+func TestPutSkipStatsThroughWrappers(t *testing.T) {
+	client := newFakeS3Client()
+	s3Backend := newTestS3(client, S3Options{SkipExisting: SkipExistingHead})
+	client.objects["test/01"] = &fakeS3Object{data: []byte("x")}
+
+	var backend Backend = NewDebug(NewError(s3Backend, 0))
+	if err := backend.Put([]byte{0x01}, []byte{0x02}, bytes.NewReader([]byte("x")), 1); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	reporter, ok := backend.(PutSkipReporter)
+	if !ok {
+		t.Fatal("wrapped backend does not implement PutSkipReporter")
+	}
+	if skipped, saved := reporter.PutSkipStats(); skipped != 1 || saved != 1 {
+		t.Errorf("skip stats = (%d, %d), expected (1, 1)", skipped, saved)
+	}
+}
+
+func TestS3Trim(t *testing.T) {
+	for _, withSizeLimit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sizeLimit=%v", withSizeLimit), func(t *testing.T) {
+			client := newFakeS3Client()
+			client.pageSize = 3
+			backend := newTestS3(client, S3Options{})
+
+			// Ten 100 byte objects, object i uploaded i days ago.
+			now := time.Now()
+			for i := range 10 {
+				client.objects[fmt.Sprintf("test/%02d", i)] = &fakeS3Object{
+					data:     make([]byte, 100),
+					modified: now.Add(-time.Duration(i) * 24 * time.Hour),
+				}
+			}
+			client.objects["other/00"] = &fakeS3Object{modified: now.Add(-365 * 24 * time.Hour)}
+
+			policy := TrimPolicy{OlderThan: 7*24*time.Hour + time.Hour, DryRun: true}
+			expectedEvicted := int64(2) // Objects 8 and 9.
+			if withSizeLimit {
+				policy.MaxSize = 500
+				expectedEvicted = 5 // Objects 5-9.
+			}
+
+			stats, err := backend.Trim(policy)
+			if err != nil {
+				t.Fatalf("dry run failed: %v", err)
+			}
+			expected := TrimStats{Entries: 10, Bytes: 1000, EvictedEntries: expectedEvicted, EvictedBytes: expectedEvicted * 100}
+			if stats != expected {
+				t.Errorf("dry run stats = %+v, expected %+v", stats, expected)
+			}
+			if len(client.objects) != 11 {
+				t.Fatalf("dry run deleted objects")
+			}
+			// Four pages of objects, plus listing the (empty) access logs.
+			if lists := client.listCalls.Load(); lists != 5 {
+				t.Errorf("listed %d pages, expected 5", lists)
+			}
+
+			policy.DryRun = false
+			if stats, err := backend.Trim(policy); err != nil || stats != expected {
+				t.Fatalf("trim: stats = %+v, err = %v, expected %+v", stats, err, expected)
+			}
+			for i := range 10 {
+				_, exists := client.objects[fmt.Sprintf("test/%02d", i)]
+				if exists != (int64(i) < 10-expectedEvicted) {
+					t.Errorf("object %d exists = %v after trim", i, exists)
+				}
+			}
+			if _, ok := client.objects["other/00"]; !ok {
+				t.Error("trim deleted an object outside the prefix")
+			}
+		})
+	}
+}
+
+func TestS3TrimOnlyEntries(t *testing.T) {
+	client := newFakeS3Client()
+	backend := newTestS3(client, S3Options{})
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for _, key := range []string{"entry", "manifest/main", "keyfilter", "pack/01", "packidx/01", "index/entry", "blob/aa"} {
+		client.objects[backend.actionIDToKey([]byte(key))] = &fakeS3Object{data: []byte("x"), modified: old}
+	}
+
+	policy := TrimPolicy{
+		OlderThan: 24 * time.Hour,
+		IsEntry:   func(key []byte) bool { return string(key) == "entry" },
+	}
+	stats, err := backend.Trim(policy)
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if stats.Entries != 1 || stats.EvictedEntries != 1 || stats.Skipped != 6 {
+		t.Errorf("stats = %+v, expected the only entry to be evicted and the rest skipped", stats)
+	}
+	if len(client.objects) != 6 {
+		t.Errorf("%d objects left after trim, expected the 6 that aren't entries", len(client.objects))
+	}
+}
+
+func TestTrimPolicySelect(t *testing.T) {
+	var (
+		now     = time.Now()
+		entries = []TrimEntry{
+			{Key: "old-unused", Size: 10, Created: now.Add(-10 * time.Hour), LastUsed: now.Add(-9 * time.Hour)},
+			{Key: "old-used", Size: 10, Created: now.Add(-10 * time.Hour), LastUsed: now},
+			{Key: "new-unused", Size: 10, Created: now.Add(-2 * time.Hour), LastUsed: now.Add(-2 * time.Hour)},
+			{Key: "new-used", Size: 10, Created: now.Add(-time.Hour), LastUsed: now.Add(-time.Minute)},
+		}
+	)
+
+	tests := []struct {
+		name     string
+		policy   TrimPolicy
+		expected []string
+	}{
+		{"zero", TrimPolicy{}, nil},
+		{"older than", TrimPolicy{OlderThan: 5 * time.Hour}, []string{"old-unused", "old-used"}},
+		{"unused for", TrimPolicy{UnusedFor: time.Hour}, []string{"new-unused", "old-unused"}},
+		{"max size", TrimPolicy{MaxSize: 25}, []string{"new-unused", "old-unused"}},
+		{"max size after age", TrimPolicy{OlderThan: 5 * time.Hour, MaxSize: 15}, []string{"new-unused", "old-unused", "old-used"}},
+		{"max size not exceeded", TrimPolicy{MaxSize: 40}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evict, keep := tt.policy.Select(entries, now)
+			var keys []string
+			for _, entry := range evict {
+				keys = append(keys, entry.Key)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("evicted %v, expected %v", keys, tt.expected)
+			}
+			if len(evict)+len(keep) != len(entries) {
+				t.Errorf("evicted %d and kept %d of %d entries", len(evict), len(keep), len(entries))
+			}
+		})
+	}
+}
+
+// accessLogKeys returns the keys of all access logs in client.
+func accessLogKeys(client *fakeS3Client) []string {
+	client.Lock()
+	defer client.Unlock()
+
+	var keys []string
+	for key := range client.objects {
+		if strings.HasPrefix(key, "test/"+s3AccessLogDir) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestS3TrackAccess(t *testing.T) {
+	client := newFakeS3Client()
+	writer := newTestS3(client, S3Options{})
+	for _, id := range []byte{0x01, 0x02} {
+		if err := writer.Put([]byte{id}, []byte{0xff}, bytes.NewReader([]byte("data")), 4); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	backend := newTestS3(client, S3Options{TrackAccess: true})
+	for _, id := range []byte{0x01, 0x01, 0x03} {
+		_, body, _, _, miss, err := backend.Get([]byte{id})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if !miss {
+			body.Close()
+		}
+	}
+	if len(accessLogKeys(client)) != 0 {
+		t.Fatal("access log published before Close")
+	}
+
+	if err := backend.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	logKeys := accessLogKeys(client)
+	if len(logKeys) != 1 {
+		t.Fatalf("published %d access logs, expected 1", len(logKeys))
+	}
+	accesses, err := backend.readAccessLog(logKeys[0])
+	if err != nil {
+		t.Fatalf("failed to read access log: %v", err)
+	}
+	if len(accesses) != 1 || accesses["01"].IsZero() {
+		t.Errorf("access log = %v, expected a single access to 01", accesses)
+	}
+
+	// Closing again doesn't publish anything.
+	if err := backend.Close(); err != nil || len(accessLogKeys(client)) != 1 {
+		t.Errorf("second Close: err = %v, %d access logs", err, len(accessLogKeys(client)))
+	}
+}
+
+func TestS3TrimByLastAccess(t *testing.T) {
+	var (
+		client  = newFakeS3Client()
+		backend = newTestS3(client, S3Options{Concurrency: 2})
+		now     = time.Now()
+	)
+	for _, key := range []string{"01", "02", "03"} {
+		client.objects["test/"+key] = &fakeS3Object{data: make([]byte, 10), modified: now.Add(-10 * 24 * time.Hour)}
+	}
+
+	// 01 was used yesterday, and 03 only before it was last uploaded.
+	logs := []map[string]time.Time{
+		{"01": now.Add(-5 * 24 * time.Hour), "03": now.Add(-20 * 24 * time.Hour)},
+		{"01": now.Add(-24 * time.Hour)},
+	}
+	for _, accesses := range logs {
+		if err := backend.writeAccessLog(accesses); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := TrimPolicy{UnusedFor: 7 * 24 * time.Hour}
+	stats, err := backend.Trim(policy)
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if stats.Entries != 3 || stats.EvictedEntries != 2 {
+		t.Errorf("stats = %+v, expected 2 of 3 entries to be evicted", stats)
+	}
+	if _, ok := client.objects["test/01"]; !ok {
+		t.Error("recently accessed entry was evicted")
+	}
+
+	// The access logs are compacted into one that only covers remaining entries.
+	logKeys := accessLogKeys(client)
+	if len(logKeys) != 1 {
+		t.Fatalf("%d access logs after trim, expected 1", len(logKeys))
+	}
+	accesses, err := backend.readAccessLog(logKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != 1 || accesses["01"].Unix() != now.Add(-24*time.Hour).Unix() {
+		t.Errorf("compacted access log = %v, expected only the latest access to 01", accesses)
+	}
+
+	// The compacted log is still honored by the next trim.
+	if stats, err := backend.Trim(policy); err != nil || stats.EvictedEntries != 0 {
+		t.Errorf("second trim: stats = %+v, err = %v, expected nothing to be evicted", stats, err)
+	}
+}
+
+func TestParseAccessLog(t *testing.T) {
+	accesses, err := parseAccessLog(strings.NewReader("100 aa\n\n300 bb\n200 aa\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != 2 || accesses["aa"].Unix() != 200 || accesses["bb"].Unix() != 300 {
+		t.Errorf("accesses = %v", accesses)
+	}
+
+	if _, err := parseAccessLog(strings.NewReader("not-a-time aa\n")); err == nil {
+		t.Error("expected error for invalid line")
+	}
+}
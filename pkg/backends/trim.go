@@ -0,0 +1,317 @@
+package backends
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TrimPolicy selects which cache entries a trim removes. Zero values disable the
+// corresponding rule, and an entry is removed if any enabled rule selects it.
+type TrimPolicy struct {
+	// OlderThan removes entries that were created more than OlderThan ago.
+	OlderThan time.Duration
+	// UnusedFor removes entries that haven't been used within UnusedFor.
+	UnusedFor time.Duration
+	// MaxSize removes the least recently used of the remaining entries until their
+	// total size is no larger than MaxSize.
+	MaxSize int64
+	// DryRun only reports what would be removed.
+	DryRun bool
+	// IsEntry reports whether a key, as passed to Put, is the key of a cache entry.
+	// Only entries are trimmed, so that other objects such as manifests are kept
+	// no matter how old they are. Nil treats every key as an entry.
+	IsEntry func(key []byte) bool
+}
+
+// isEntry reports whether the policy may trim the object stored under key.
+func (p TrimPolicy) isEntry(key []byte) bool {
+	return p.IsEntry == nil || p.IsEntry(key)
+}
+
+// IsZero reports whether the policy never removes anything.
+func (p TrimPolicy) IsZero() bool {
+	return p.OlderThan <= 0 && p.UnusedFor <= 0 && p.MaxSize <= 0
+}
+
+// TrimEntry describes a cache entry that is a candidate for trimming.
+type TrimEntry struct {
+	Key      string
+	Size     int64
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// TrimStats holds the results of a trim. In a dry run, the evicted counts are
+// what would have been removed.
+type TrimStats struct {
+	Entries        int64
+	Bytes          int64
+	EvictedEntries int64
+	EvictedBytes   int64
+	// Skipped counts the objects that were listed but not trimmed because
+	// they aren't entries, or share storage with objects that aren't.
+	Skipped int64
+}
+
+// Add records entries as scanned, and as evicted if evicted is true.
+func (s *TrimStats) Add(entries []TrimEntry, evicted bool) {
+	for _, entry := range entries {
+		s.Entries++
+		s.Bytes += entry.Size
+		if evicted {
+			s.EvictedEntries++
+			s.EvictedBytes += entry.Size
+		}
+	}
+}
+
+// Trimmer is implemented by backends that support removing entries according
+// to a TrimPolicy. Wrappers forward it to the backend they wrap.
+type Trimmer interface {
+	Trim(policy TrimPolicy) (TrimStats, error)
+}
+
+// trim trims backend if it implements Trimmer.
+func trim(backend Backend, policy TrimPolicy) (TrimStats, error) {
+	if t, ok := backend.(Trimmer); ok {
+		return t.Trim(policy)
+	}
+	return TrimStats{}, fmt.Errorf("backend does not support trimming")
+}
+
+// Select partitions entries into those the policy removes and those it keeps.
+// The order of entries is not preserved.
+func (p TrimPolicy) Select(entries []TrimEntry, now time.Time) (evict, keep []TrimEntry) {
+	for _, entry := range entries {
+		if p.expired(entry, now) {
+			evict = append(evict, entry)
+		} else {
+			keep = append(keep, entry)
+		}
+	}
+	if p.MaxSize <= 0 {
+		return evict, keep
+	}
+
+	var totalSize int64
+	for _, entry := range keep {
+		totalSize += entry.Size
+	}
+	if totalSize <= p.MaxSize {
+		return evict, keep
+	}
+
+	// Least recently used first.
+	sort.Slice(keep, func(i, j int) bool {
+		return keep[i].LastUsed.Before(keep[j].LastUsed)
+	})
+	i := 0
+	for ; i < len(keep) && totalSize > p.MaxSize; i++ {
+		totalSize -= keep[i].Size
+	}
+	return append(evict, keep[:i]...), keep[i:]
+}
+
+// expired reports whether the age-based rules of the policy select entry.
+func (p TrimPolicy) expired(entry TrimEntry, now time.Time) bool {
+	if p.OlderThan > 0 && now.Sub(entry.Created) > p.OlderThan {
+		return true
+	}
+	if p.UnusedFor > 0 && now.Sub(entry.LastUsed) > p.UnusedFor {
+		return true
+	}
+	return false
+}
+
+// trimCandidate is a group of stored objects that a layout wrapper trims as a
+// whole, such as a pack together with its index. TrimEntry describes the group,
+// with a Key that is unique among the candidates of a trim.
+type trimCandidate struct {
+	TrimEntry
+	// objects are the keys of the stored objects that are deleted with it.
+	objects [][]byte
+	// entries are the keys, as passed to the layout's Put, of the objects it holds.
+	// Candidates holding anything that isn't an entry are never trimmed.
+	entries [][]byte
+	// outputIDs holds the output IDs of entries, where the layout knows them.
+	outputIDs map[string][]byte
+	// provides are the keys of shared objects it holds, which are kept as long as
+	// a kept candidate needs them.
+	provides []string
+	// needs returns the keys of the shared objects it refers to. Nil if it refers
+	// to none.
+	needs func() ([]string, error)
+}
+
+// objectTrimmer is implemented by storage backends that layout wrappers trim
+// through. trimObjects lists every stored object, keyed by the key passed to Put,
+// passes them to plan and deletes the objects whose keys plan returns, unless
+// dryRun is set.
+type objectTrimmer interface {
+	trimObjects(dryRun bool, plan func(objects []TrimEntry) ([][]byte, error)) error
+}
+
+// trimLayout is implemented by wrappers that lay out entries as several stored
+// objects, and that have to trim those objects together.
+type trimLayout interface {
+	Backend
+	// trimBackend returns the backend the wrapper stores its objects in.
+	trimBackend() Backend
+	// trimCandidates groups the objects stored in the backend into candidates.
+	trimCandidates(objects []TrimEntry) ([]trimCandidate, error)
+}
+
+// layoutCandidates returns the trim candidates of the objects stored in backend:
+// those grouped by backend if it's a layout wrapper, and one per object
+// otherwise.
+func layoutCandidates(backend Backend, objects []TrimEntry) ([]trimCandidate, error) {
+	if layout, ok := backend.(trimLayout); ok {
+		return layout.trimCandidates(objects)
+	}
+	candidates := make([]trimCandidate, 0, len(objects))
+	for _, object := range objects {
+		key := []byte(object.Key)
+		candidates = append(candidates, trimCandidate{TrimEntry: object, objects: [][]byte{key}, entries: [][]byte{key}})
+	}
+	return candidates, nil
+}
+
+// trimWithLayout trims the storage backend under a layout wrapper according to
+// policy. It lists every stored object, has the layout group them into
+// candidates and selects among the candidates.
+func trimWithLayout(layout trimLayout, policy TrimPolicy) (TrimStats, error) {
+	storage := layout.trimBackend()
+	for {
+		inner, ok := storage.(trimLayout)
+		if !ok {
+			break
+		}
+		storage = inner.trimBackend()
+	}
+	trimmer, ok := storage.(objectTrimmer)
+	if !ok {
+		return TrimStats{}, fmt.Errorf("backend does not support trimming")
+	}
+
+	var stats TrimStats
+	err := trimmer.trimObjects(policy.DryRun, func(objects []TrimEntry) ([][]byte, error) {
+		candidates, err := layoutCandidates(layout, objects)
+		if err != nil {
+			return nil, err
+		}
+		evict, keep, err := policy.selectCandidates(candidates, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		var keys [][]byte
+		for _, c := range evict {
+			stats.Add([]TrimEntry{c.TrimEntry}, true)
+			keys = append(keys, c.objects...)
+		}
+		for _, c := range keep {
+			stats.Add([]TrimEntry{c.TrimEntry}, false)
+		}
+		stats.Skipped += int64(len(candidates) - len(evict) - len(keep))
+		return keys, nil
+	})
+	return stats, err
+}
+
+// selectCandidates partitions the candidates that hold nothing but entries into
+// those the policy removes and those it keeps, like Select. Evicted candidates
+// that provide objects needed by a kept candidate are kept too, even if that
+// leaves more than MaxSize. Candidates holding other objects are in neither.
+func (p TrimPolicy) selectCandidates(candidates []trimCandidate, now time.Time) (evict, keep []trimCandidate, err error) {
+	var (
+		byKey     = make(map[string]trimCandidate, len(candidates))
+		entries   = make([]TrimEntry, 0, len(candidates))
+		protected []trimCandidate
+	)
+	for _, c := range candidates {
+		if slices.ContainsFunc(c.entries, func(key []byte) bool { return !p.isEntry(key) }) {
+			protected = append(protected, c)
+			continue
+		}
+		byKey[c.Key] = c
+		entries = append(entries, c.TrimEntry)
+	}
+	evictEntries, keepEntries := p.Select(entries, now)
+
+	// Evicted candidates by the keys of the shared objects they provide.
+	providers := make(map[string]string)
+	for _, entry := range evictEntries {
+		for _, key := range byKey[entry.Key].provides {
+			providers[key] = entry.Key
+		}
+	}
+	restored := make(map[string]bool)
+	if len(providers) > 0 {
+		frontier := protected
+		for _, entry := range keepEntries {
+			frontier = append(frontier, byKey[entry.Key])
+		}
+		for len(frontier) > 0 {
+			needs, err := candidateNeeds(frontier)
+			if err != nil {
+				return nil, nil, err
+			}
+			frontier = nil
+			for _, key := range needs {
+				if provider, ok := providers[key]; ok && !restored[provider] {
+					restored[provider] = true
+					frontier = append(frontier, byKey[provider])
+				}
+			}
+		}
+	}
+
+	for _, entry := range evictEntries {
+		if restored[entry.Key] {
+			keep = append(keep, byKey[entry.Key])
+		} else {
+			evict = append(evict, byKey[entry.Key])
+		}
+	}
+	for _, entry := range keepEntries {
+		keep = append(keep, byKey[entry.Key])
+	}
+	return evict, keep, nil
+}
+
+// trimNeedsConcurrency bounds how many candidates' needs are resolved in
+// parallel, since resolving them may take a backend request each.
+const trimNeedsConcurrency = 16
+
+// candidateNeeds returns the keys of the shared objects that candidates need.
+func candidateNeeds(candidates []trimCandidate) ([]string, error) {
+	var (
+		mu       sync.Mutex
+		all      []string
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, trimNeedsConcurrency)
+	)
+	for _, c := range candidates {
+		if c.needs == nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			needs, err := c.needs()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			all = append(all, needs...)
+		}()
+	}
+	wg.Wait()
+	return all, firstErr
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+const (
+	// serveMaxKeySize bounds the keys of stored objects so that their file names
+	// stay within filesystem limits.
+	serveMaxKeySize = 100
+
+	// serveTrimTarget is the share of the maximum size that the cache is trimmed
+	// to once it grows past it, so that not every PUT starts a trim.
+	serveTrimTarget = 0.9
+)
+
+// cacheServer serves a local cache over HTTP to gobuildcache instances using the
+// remote backend. See backends.Remote for the API.
+type cacheServer struct {
+	lc      *localCache
+	locker  locking.Group
+	logger  *slog.Logger
+	tokens  map[string]string // Token to client name, empty to allow anyone
+	maxSize int64             // 0 for unlimited
+
+	// readOnly rejects PUTs and listing, for serving the local cache to peers.
+	readOnly bool
+
+	// size is the approximate size of the cache, as of the last trim plus the
+	// objects stored since. It's only tracked if maxSize is set.
+	size     atomic.Int64
+	trimming atomic.Bool
+	trims    sync.WaitGroup
+
+	evictedEntries atomic.Int64
+	evictedBytes   atomic.Int64
+	unauthorized   atomic.Int64
+
+	mu      sync.Mutex
+	clients map[string]*serveClientStats
+}
+
+// serveClientStats counts the requests of one client, identified by the name of
+// its token or by its address if no tokens are configured.
+type serveClientStats struct {
+	Gets        atomic.Int64 // GET and HEAD requests for objects
+	Hits        atomic.Int64
+	Puts        atomic.Int64
+	BytesServed atomic.Int64
+	BytesStored atomic.Int64
+}
+
+// serveStats is the JSON document served at backends.RemoteStatsPath.
+type serveStats struct {
+	Size           int64                       `json:"size,omitempty"`
+	MaxSize        int64                       `json:"maxSize,omitempty"`
+	EvictedEntries int64                       `json:"evictedEntries"`
+	EvictedBytes   int64                       `json:"evictedBytes"`
+	Unauthorized   int64                       `json:"unauthorized"`
+	Clients        map[string]serveClientCount `json:"clients"`
+}
+
+type serveClientCount struct {
+	Gets        int64 `json:"gets"`
+	Hits        int64 `json:"hits"`
+	Puts        int64 `json:"puts"`
+	BytesServed int64 `json:"bytesServed"`
+	BytesStored int64 `json:"bytesStored"`
+}
+
+func newCacheServer(lc *localCache, locker locking.Group, tokens map[string]string, maxSize int64, logger *slog.Logger) *cacheServer {
+	s := &cacheServer{
+		lc:      lc,
+		locker:  locker,
+		logger:  logger,
+		tokens:  tokens,
+		maxSize: maxSize,
+		clients: make(map[string]*serveClientStats),
+	}
+	if maxSize > 0 {
+		// Find out how much is stored already.
+		s.startTrim()
+	}
+	return s
+}
+
+// loadServeTokens reads a tokens file with one "<client name> <token>" pair per
+// line. Empty lines and lines starting with # are ignored.
+func loadServeTokens(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("tokens file line %d: expected \"<client name> <token>\"", line)
+		}
+		if _, ok := tokens[fields[1]]; ok {
+			return nil, fmt.Errorf("tokens file line %d: duplicate token", line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("tokens file %s contains no tokens", path)
+	}
+	return tokens, nil
+}
+
+// client returns the stats of the named client, creating them if necessary.
+func (s *cacheServer) client(name string) *serveClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[name]
+	if !ok {
+		c = &serveClientStats{}
+		s.clients[name] = c
+	}
+	return c
+}
+
+// authenticate returns the name of the client that sent r, or false if its token
+// isn't valid.
+func (s *cacheServer) authenticate(r *http.Request) (string, bool) {
+	if len(s.tokens) == 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr, true
+		}
+		return host, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	// Compare against every token so that the time taken doesn't reveal which
+	// one is closest.
+	var name string
+	for candidate, client := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			name = client
+		}
+	}
+	return name, name != ""
+}
+
+func (s *cacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == backends.RemoteHealthPath {
+		s.handleHealth(w)
+		return
+	}
+
+	name, ok := s.authenticate(r)
+	if !ok {
+		s.unauthorized.Add(1)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+	client := s.client(name)
+
+	switch {
+	case r.URL.Path == backends.RemoteStatsPath && r.Method == http.MethodGet:
+		s.handleStats(w)
+	case r.URL.Path == backends.RemoteObjectsPath && r.Method == http.MethodGet && !s.readOnly:
+		s.handleList(w, r)
+	case strings.HasPrefix(r.URL.Path, backends.RemoteObjectsPath):
+		key, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, backends.RemoteObjectsPath))
+		if err != nil || len(key) == 0 || len(key) > serveMaxKeySize {
+			http.Error(w, "invalid object key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			s.handleGet(w, r, client, key)
+		case http.MethodPut:
+			if s.readOnly {
+				w.Header().Set("Allow", "GET, HEAD")
+				http.Error(w, "cache is read-only", http.StatusMethodNotAllowed)
+				return
+			}
+			s.handlePut(w, r, client, key)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleHealth reports whether the cache directory is usable. It doesn't require
+// a token so that load balancers can use it.
+func (s *cacheServer) handleHealth(w http.ResponseWriter) {
+	if _, err := os.Stat(s.lc.cacheDir); err != nil {
+		http.Error(w, fmt.Sprintf("cache directory unavailable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *cacheServer) handleStats(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats())
+}
+
+// handleList writes the hex encoded keys of the objects starting with the hex
+// encoded prefix query parameter, one per line.
+func (s *cacheServer) handleList(w http.ResponseWriter, r *http.Request) {
+	prefix, err := hex.DecodeString(r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, "invalid prefix", http.StatusBadRequest)
+		return
+	}
+	entries, err := s.lc.listEntries()
+	if err != nil {
+		s.logger.Error("failed to list cache entries", "error", err)
+		http.Error(w, "failed to list objects", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	out := bufio.NewWriter(w)
+	for _, entry := range entries {
+		if bytes.HasPrefix(entry.actionID, prefix) {
+			fmt.Fprintln(out, hex.EncodeToString(entry.actionID))
+		}
+	}
+	out.Flush()
+}
+
+// handleGet serves an object, or the requested range of it.
+func (s *cacheServer) handleGet(w http.ResponseWriter, r *http.Request, client *serveClientStats, key []byte) {
+	client.Gets.Add(1)
+
+	// Like the cacheprog server, only take the lock if the entry needs more than a
+	// plain read.
+	meta := s.lc.checkUnlocked(key)
+	if meta == nil {
+		v, err := s.locker.DoWithLock(hex.EncodeToString(key), func() (interface{}, error) {
+			return s.lc.check(key), nil
+		})
+		if err != nil {
+			s.logger.Error("failed to lock cache entry", "key", hex.EncodeToString(key), "error", err)
+			http.Error(w, "failed to read object", http.StatusInternalServerError)
+			return
+		}
+		meta = v.(*localCacheMetadata)
+	}
+	if meta == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(s.lc.getPath(key))
+	if err != nil {
+		// Evicted since it was checked.
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	client.Hits.Add(1)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(backends.RemoteOutputIDHeader, hex.EncodeToString(meta.OutputID))
+	w.Header().Set(backends.RemotePutTimeHeader, strconv.FormatInt(meta.PutTime.UnixNano(), 10))
+	// ServeContent handles HEAD and range requests.
+	http.ServeContent(&countingResponseWriter{ResponseWriter: w, n: &client.BytesServed}, r, "", time.Time{}, f)
+}
+
+// handlePut stores an object, trimming the cache afterwards if it grew past its
+// maximum size.
+func (s *cacheServer) handlePut(w http.ResponseWriter, r *http.Request, client *serveClientStats, key []byte) {
+	outputID, err := hex.DecodeString(r.Header.Get(backends.RemoteOutputIDHeader))
+	if err != nil || len(outputID) == 0 {
+		http.Error(w, "missing or invalid output ID", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "content length required", http.StatusLengthRequired)
+		return
+	}
+
+	meta := localCacheMetadata{OutputID: outputID, Size: r.ContentLength, PutTime: time.Now()}
+	_, err = s.locker.DoWithLock(hex.EncodeToString(key), func() (interface{}, error) {
+		return s.lc.writeWithMetadata(key, r.Body, meta)
+	})
+	if err != nil {
+		s.logger.Error("failed to store object", "key", hex.EncodeToString(key), "error", err)
+		http.Error(w, "failed to store object", http.StatusInternalServerError)
+		return
+	}
+	client.Puts.Add(1)
+	client.BytesStored.Add(meta.Size)
+
+	if s.maxSize > 0 && s.size.Add(meta.Size) > s.maxSize {
+		s.startTrim()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startTrim trims the cache in the background, unless it's already being trimmed.
+func (s *cacheServer) startTrim() {
+	if !s.trimming.CompareAndSwap(false, true) {
+		return
+	}
+	s.trims.Add(1)
+	go func() {
+		defer s.trims.Done()
+		defer s.trimming.Store(false)
+
+		policy := backends.TrimPolicy{MaxSize: int64(float64(s.maxSize) * serveTrimTarget)}
+		stats, err := s.lc.trim(s.locker, policy, time.Now())
+		if err == errTrimInProgress {
+			s.logger.Debug("another process is trimming the cache, skipping")
+			return
+		}
+		if err != nil {
+			s.logger.Error("failed to trim cache", "error", err)
+			return
+		}
+		s.size.Store(stats.Bytes - stats.EvictedBytes)
+		s.evictedEntries.Add(stats.EvictedEntries)
+		s.evictedBytes.Add(stats.EvictedBytes)
+		if stats.EvictedEntries > 0 {
+			s.logger.Info("trimmed cache", "evictedEntries", stats.EvictedEntries, "evictedBytes", stats.EvictedBytes)
+		}
+	}()
+}
+
+// stats returns a snapshot of the server's statistics.
+func (s *cacheServer) stats() serveStats {
+	stats := serveStats{
+		MaxSize:        s.maxSize,
+		EvictedEntries: s.evictedEntries.Load(),
+		EvictedBytes:   s.evictedBytes.Load(),
+		Unauthorized:   s.unauthorized.Load(),
+		Clients:        make(map[string]serveClientCount),
+	}
+	if s.maxSize > 0 {
+		stats.Size = s.size.Load()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, c := range s.clients {
+		stats.Clients[name] = serveClientCount{
+			Gets:        c.Gets.Load(),
+			Hits:        c.Hits.Load(),
+			Puts:        c.Puts.Load(),
+			BytesServed: c.BytesServed.Load(),
+			BytesStored: c.BytesStored.Load(),
+		}
+	}
+	return stats
+}
+
+// writeStats writes the statistics of every client to w.
+func (s *cacheServer) writeStats(w io.Writer) {
+	stats := s.stats()
+	names := make([]string, 0, len(stats.Clients))
+	for name := range stats.Clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Cache server statistics:\n")
+	for _, name := range names {
+		c := stats.Clients[name]
+		fmt.Fprintf(w, "  %s: %d GETs (%d hits), %d PUTs, %s served, %s stored\n",
+			name, c.Gets, c.Hits, c.Puts, formatBytes(c.BytesServed), formatBytes(c.BytesStored))
+	}
+	if stats.Unauthorized > 0 {
+		fmt.Fprintf(w, "  Unauthorized requests: %d\n", stats.Unauthorized)
+	}
+	if s.maxSize > 0 {
+		fmt.Fprintf(w, "  Evicted: %d entries (%s)\n", stats.EvictedEntries, formatBytes(stats.EvictedBytes))
+	}
+}
+
+// close waits for a running trim and saves the local cache index.
+func (s *cacheServer) close() {
+	s.trims.Wait()
+	if err := s.lc.saveIndex(); err != nil {
+		s.logger.Warn("failed to save local cache index", "error", err)
+	}
+}
+
+// countingResponseWriter adds the number of body bytes written to n.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// listenAndServe serves the cache on addr, over HTTPS if certFile and keyFile are
+// set, until it's interrupted. It then waits for running requests and trims, and
+// saves the local cache index.
+func (s *cacheServer) listenAndServe(addr, certFile, keyFile string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	defer s.close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	shutdown := make(chan error, 1)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		s.logger.Info("received signal, stopping", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	s.logger.Info("serving cache", "addr", addr, "cacheDir", s.lc.cacheDir, "maxSize", s.maxSize, "clients", len(s.tokens))
+	var err error
+	if certFile != "" {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdown
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardartoul/gobuildcache/pkg/backends"
+	"github.com/richardartoul/gobuildcache/pkg/locking"
+)
+
+func newTestCacheServer(t *testing.T, tokens map[string]string, maxSize int64) (*cacheServer, *httptest.Server) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	lc, err := newLocalCache(t.TempDir(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newCacheServer(lc, locking.NewMemLock(), tokens, maxSize, logger)
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		s.close()
+	})
+	return s, ts
+}
+
+func TestServeRemoteBackend(t *testing.T) {
+	tokens := map[string]string{"secret-a": "ci", "secret-b": "laptop"}
+	s, ts := newTestCacheServer(t, tokens, 0)
+
+	ci, err := backends.NewRemote(ts.URL, backends.RemoteOptions{Token: "secret-a"})
+	if err != nil {
+		t.Fatalf("NewRemote failed: %v", err)
+	}
+	data := []byte("compiled output")
+	if err := ci.Put([]byte{1, 2}, []byte{0xaa}, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	laptop, err := backends.NewRemote(ts.URL, backends.RemoteOptions{Token: "secret-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputID, body, size, putTime, miss, err := laptop.Get([]byte{1, 2})
+	if err != nil || miss {
+		t.Fatalf("Get: miss = %v, err = %v", miss, err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(got, data) || !bytes.Equal(outputID, []byte{0xaa}) || size != int64(len(data)) || putTime == nil {
+		t.Errorf("Get returned %q with output ID %x and size %d", got, outputID, size)
+	}
+	if _, _, _, _, miss, err := laptop.Get([]byte{3}); !miss || err != nil {
+		t.Errorf("Get of absent key: miss = %v, err = %v", miss, err)
+	}
+	if exists, err := laptop.Exists([]byte{1, 2}); !exists || err != nil {
+		t.Errorf("Exists = %v, %v", exists, err)
+	}
+	rangeBody, miss, err := laptop.GetRange([]byte{1, 2}, 9, 6)
+	if err != nil || miss {
+		t.Fatalf("GetRange: miss = %v, err = %v", miss, err)
+	}
+	got, _ = io.ReadAll(rangeBody)
+	rangeBody.Close()
+	if string(got) != "output" {
+		t.Errorf("GetRange returned %q", got)
+	}
+	if keys, err := laptop.List([]byte{1}); err != nil || len(keys) != 1 || !bytes.Equal(keys[0], []byte{1, 2}) {
+		t.Errorf("List = %x, %v", keys, err)
+	}
+
+	// Requests without a valid token are rejected.
+	intruder, err := backends.NewRemote(ts.URL, backends.RemoteOptions{Token: "guess"})
+	if err != nil {
+		t.Fatalf("health check needs no token, got %v", err)
+	}
+	if _, _, _, _, _, err := intruder.Get([]byte{1, 2}); err == nil {
+		t.Error("Get with an invalid token succeeded")
+	}
+
+	stats := s.stats()
+	if c := stats.Clients["ci"]; c.Puts != 1 || c.BytesStored != int64(len(data)) {
+		t.Errorf("ci stats: %+v", c)
+	}
+	if c := stats.Clients["laptop"]; c.Gets != 4 || c.Hits != 3 || c.BytesServed != int64(len(data))+6 {
+		t.Errorf("laptop stats: %+v", c)
+	}
+	if stats.Unauthorized != 1 {
+		t.Errorf("%d unauthorized requests, expected 1", stats.Unauthorized)
+	}
+}
+
+func TestServeEviction(t *testing.T) {
+	s, ts := newTestCacheServer(t, nil, 1000)
+	remote, err := backends.NewRemote(ts.URL, backends.RemoteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		data := bytes.Repeat([]byte{byte(i)}, 400)
+		if err := remote.Put([]byte{byte(i)}, []byte{byte(i)}, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		s.trims.Wait()
+	}
+
+	stats := s.stats()
+	if stats.EvictedEntries < 3 || stats.Size > 900 {
+		t.Errorf("evicted %d entries leaving %d bytes, expected at most 900", stats.EvictedEntries, stats.Size)
+	}
+	keys, err := remote.List(nil)
+	if err != nil || int64(len(keys)) != 5-stats.EvictedEntries {
+		t.Errorf("listed %d keys (err %v) after evicting %d", len(keys), err, stats.EvictedEntries)
+	}
+}
+
+func TestLoadServeTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# build machines\nci s3cr3t\n\nlaptop other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadServeTokens(path)
+	if err != nil || len(tokens) != 2 || tokens["s3cr3t"] != "ci" {
+		t.Errorf("loadServeTokens = %v, %v", tokens, err)
+	}
+	if err := os.WriteFile(path, []byte("ci s3cr3t\nlaptop s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadServeTokens(path); err == nil {
+		t.Error("duplicate tokens were accepted")
+	}
+}
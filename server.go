@@ -3,13 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -64,17 +64,37 @@ type Response struct {
 type CacheProg struct {
 	backend    backends.Backend
 	localCache *localCache
-	reader     *bufio.Reader
-	writer     struct {
-		sync.Mutex
-		w *bufio.Writer
-	}
 
 	debug       bool
 	printStats  bool
 	compression bool
 	logger      *slog.Logger
 
+	// Limits for trimming the local cache. Zero disables the corresponding limit.
+	localMaxSize int64
+	localMaxAge  time.Duration
+
+	// manifestName is the name under which the action IDs requested during the run
+	// are uploaded on close, and prefetchManifest the name of the manifest whose
+	// entries are downloaded at startup. Either can be empty.
+	manifestName     string
+	prefetchManifest string
+	prefetch         struct {
+		stop chan struct{}
+		done chan struct{}
+
+		sync.Mutex
+		missed map[string]bool // Hex action IDs the backend didn't have
+	}
+	trimDone chan struct{} // Closed when the trim started by start is done
+
+	// negativeCache answers repeated GETs for entries the backend just missed.
+	negativeCache *negativeCache
+
+	// peers is asked for local misses before the backend, nil if peer sharing
+	// is disabled.
+	peers *peerGroup
+
 	// Latency tracking using DDSketch for quantile estimation.
 	latencyTracker *metrics.LatencyTracker
 
@@ -100,6 +120,7 @@ type CacheProg struct {
 	getCount              atomic.Int64
 	hitCount              atomic.Int64
 	localCacheHits        atomic.Int64
+	unlockedLocalHits     atomic.Int64 // Local hits served without taking the lock
 	backendCacheHits      atomic.Int64
 	deduplicatedGets      atomic.Int64
 	deduplicatedPuts      atomic.Int64
@@ -111,6 +132,21 @@ type CacheProg struct {
 	compressionBytesOut   atomic.Int64 // Compressed bytes after compression
 	decompressionBytesIn  atomic.Int64 // Compressed bytes before decompression
 	decompressionBytesOut atomic.Int64 // Uncompressed bytes after decompression
+	localEvictedEntries   atomic.Int64 // Local cache entries removed by trimming
+	localEvictedBytes     atomic.Int64 // Local cache bytes removed by trimming
+
+	prefetchManifestEntries atomic.Int64 // Entries in the prefetched manifest
+	prefetchedEntries       atomic.Int64 // Manifest entries downloaded into the local cache
+	prefetchedBytes         atomic.Int64
+	prefetchCachedEntries   atomic.Int64 // Manifest entries that were already cached locally
+	prefetchMissedEntries   atomic.Int64 // Manifest entries missing from the backend
+
+	negativeCacheHits          atomic.Int64 // Backend misses answered by the negative cache
+	negativeCacheInvalidations atomic.Int64 // Remembered misses removed by PUTs
+
+	daemonClients atomic.Int64 // go commands served by the daemon
+
+	peerHits atomic.Int64 // Local misses served by peers
 }
 
 // NewCacheProg creates a new cache program instance.
@@ -122,6 +158,13 @@ func NewCacheProg(
 	debug bool,
 	printStats bool,
 	compression bool,
+	localMaxSize int64,
+	localMaxAge time.Duration,
+	manifestName string,
+	prefetchManifest string,
+	negativeCacheTTL time.Duration,
+	negativeCacheShared bool,
+	peers *peerGroup,
 ) (*CacheProg, error) {
 	logLevel := slog.LevelInfo
 	if debug {
@@ -136,27 +179,66 @@ func NewCacheProg(
 	if err != nil {
 		return nil, err
 	}
+	negativeCache, err := newNegativeCache(negativeCacheTTL, localCache.cacheDir, negativeCacheShared)
+	if err != nil {
+		return nil, err
+	}
 
 	cp := &CacheProg{
-		backend:        backend,
-		localCache:     localCache,
-		reader:         bufio.NewReader(os.Stdin),
-		debug:          debug,
-		printStats:     printStats,
-		compression:    compression,
-		logger:         logger,
-		locker:         sfGroup,
-		latencyTracker: metrics.NewLatencyTracker(0.01), // 1% relative accuracy
-	}
-	cp.writer.w = bufio.NewWriter(os.Stdout)
+		backend:          backend,
+		localCache:       localCache,
+		debug:            debug,
+		printStats:       printStats,
+		compression:      compression,
+		logger:           logger,
+		localMaxSize:     localMaxSize,
+		localMaxAge:      localMaxAge,
+		manifestName:     manifestName,
+		prefetchManifest: prefetchManifest,
+		negativeCache:    negativeCache,
+		peers:            peers,
+		locker:           sfGroup,
+		latencyTracker:   metrics.NewLatencyTracker(0.01), // 1% relative accuracy
+	}
 	cp.seenActionIDs.ids = make(map[string]int)
 	return cp, nil
 }
 
-// Run starts the cache program and processes requests concurrently.
+// Run starts the cache program and processes the requests of the go command on
+// stdin and stdout concurrently.
 func (cp *CacheProg) Run() error {
+	cp.start()
+	if err := cp.serve(newConn(os.Stdin, os.Stdout), true); err != nil {
+		return err
+	}
+	cp.finish()
+	return nil
+}
+
+// start starts the background work that runs while requests are served.
+func (cp *CacheProg) start() {
+	// Trim the local cache in the background while serving requests.
+	cp.trimDone = make(chan struct{})
+	go func() {
+		defer close(cp.trimDone)
+		cp.trimLocalCache()
+	}()
+
+	// Download the entries of the prefetch manifest in the background, so that the
+	// go command finds them in the local cache.
+	cp.startPrefetch()
+
+	if cp.peers != nil {
+		cp.peers.serve(cp.localCache, cp.locker)
+	}
+}
+
+// serve processes the requests of a go command on c until it sends a close
+// request or closes the connection. If closeBackend is false, the backend
+// outlives the connection and a close request only ends the connection.
+func (cp *CacheProg) serve(c *conn, closeBackend bool) error {
 	// Send initial response with capabilities
-	if err := cp.sendInitialResponse(); err != nil {
+	if err := c.sendInitialResponse(); err != nil {
 		return fmt.Errorf("failed to send initial response: %w", err)
 	}
 
@@ -166,7 +248,7 @@ func (cp *CacheProg) Run() error {
 
 	// Process requests concurrently
 	for {
-		req, err := cp.readRequest()
+		req, err := c.readRequest()
 		if err == io.EOF {
 			break
 		}
@@ -184,7 +266,14 @@ func (cp *CacheProg) Run() error {
 			// Wait for all pending requests to complete before handling close
 			wg.Wait()
 			requestLogger.Debug("pending requests completed, handling close command in backend")
-			resp, err := cp.handleRequest(req)
+			var (
+				resp = Response{ID: req.ID}
+				err  error
+			)
+			// A daemon's backend outlives the go command, so there's nothing to close.
+			if closeBackend {
+				resp, err = cp.handleRequest(req)
+			}
 			if err != nil {
 				requestLogger.Error("failed to handle close request in backend", "error", err)
 				// Complation / testing will fail if cleanup fails, but we've already done all the
@@ -195,7 +284,7 @@ func (cp *CacheProg) Run() error {
 				requestLogger.Debug("close command handled in backend")
 			}
 
-			if err := cp.sendResponse(resp); err != nil {
+			if err := c.sendResponse(resp); err != nil {
 				requestLogger.Error("failed to send close response, exiting...", "error", err)
 				return fmt.Errorf("failed to send close response: %w", err)
 			}
@@ -204,6 +293,7 @@ func (cp *CacheProg) Run() error {
 		}
 
 		// Process request concurrently
+		body, hasBody := req.Body.(*bodyReader)
 		wg.Add(1)
 		go func(r *Request) {
 			defer wg.Done()
@@ -215,7 +305,7 @@ func (cp *CacheProg) Run() error {
 			} else {
 				requestLogger.Debug("command handled in backend", "duration", time.Since(start))
 			}
-			if err := cp.sendResponse(resp); err != nil {
+			if err := c.sendResponse(resp); err != nil {
 				select {
 				case errChan <- err:
 				default:
@@ -223,6 +313,15 @@ func (cp *CacheProg) Run() error {
 			}
 		}(req)
 
+		// The body of a PUT shares the reader with the request stream, so it must be
+		// consumed before we can read the next request.
+		if hasBody {
+			if err := body.wait(); err != nil {
+				wg.Wait()
+				return fmt.Errorf("failed to read request body: %w", err)
+			}
+		}
+
 		// Check for errors from goroutines
 		select {
 		case err := <-errChan:
@@ -244,107 +343,171 @@ func (cp *CacheProg) Run() error {
 		wg.Wait()
 		return fmt.Errorf("failed to send response: %w", err)
 	}
+	return nil
+}
+
+// finish waits for the background work started by start, saves the local index
+// and prints statistics if enabled.
+func (cp *CacheProg) finish() {
+	// Don't exit in the middle of a trim so that its stats are complete.
+	<-cp.trimDone
+	// Stopped already if the go command sent a close.
+	cp.stopPrefetch()
+	if cp.peers != nil {
+		cp.peers.close()
+	}
+
+	// Save the local index so that the next process starts with a warm index.
+	if err := cp.localCache.saveIndex(); err != nil {
+		cp.logger.Warn("failed to save local cache index", "error", err)
+	}
 
 	// Print statistics if enabled
 	if cp.printStats {
-		var (
-			getCount              = cp.getCount.Load()
-			hitCount              = cp.hitCount.Load()
-			localCacheHits        = cp.localCacheHits.Load()
-			backendCacheHits      = cp.backendCacheHits.Load()
-			putCount              = cp.putCount.Load()
-			duplicateGets         = cp.duplicateGets.Load()
-			duplicatePuts         = cp.duplicatePuts.Load()
-			deduplicatedGets      = cp.deduplicatedGets.Load()
-			deduplicatedPuts      = cp.deduplicatedPuts.Load()
-			retriedRequests       = cp.retriedRequests.Load()
-			totalRetries          = cp.totalRetries.Load()
-			backendBytesRead      = cp.backendBytesRead.Load()
-			backendBytesWritten   = cp.backendBytesWritten.Load()
-			compressionBytesIn    = cp.compressionBytesIn.Load()
-			compressionBytesOut   = cp.compressionBytesOut.Load()
-			decompressionBytesIn  = cp.decompressionBytesIn.Load()
-			decompressionBytesOut = cp.decompressionBytesOut.Load()
-			missCount             = getCount - hitCount
-			hitRate               = 0.0
-			localHitRate          = 0.0
-			backendHitRate        = 0.0
-		)
-		if getCount > 0 {
-			hitRate = float64(hitCount) / float64(getCount) * 100
-			localHitRate = float64(localCacheHits) / float64(getCount) * 100
-			backendHitRate = float64(backendCacheHits) / float64(getCount) * 100
-		}
+		cp.writeStats(os.Stderr)
+	}
+}
 
-		cp.seenActionIDs.Lock()
-		uniqueActionIDs := len(cp.seenActionIDs.ids)
-		cp.seenActionIDs.Unlock()
-
-		totalOps := getCount + putCount
-
-		fmt.Fprintf(os.Stderr, "Cache statistics:\n")
-		fmt.Fprintf(os.Stderr, "  GET operations: %d (hits: %d, misses: %d, hit rate: %.1f%%)\n",
-			getCount, hitCount, missCount, hitRate)
-		fmt.Fprintf(os.Stderr, "    Local cache hits: %d (%.1f%% of GETs)\n",
-			localCacheHits, localHitRate)
-		fmt.Fprintf(os.Stderr, "    Backend cache hits: %d (%.1f%% of GETs)\n",
-			backendCacheHits, backendHitRate)
-		fmt.Fprintf(os.Stderr, "    Duplicate GETs: %d (%.1f%% of GETs)\n",
-			duplicateGets, float64(duplicateGets)/float64(getCount)*100)
-		fmt.Fprintf(os.Stderr, "    Deduplicated GETs (singleflight): %d (%.1f%% of GETs)\n",
-			deduplicatedGets, float64(deduplicatedGets)/float64(getCount)*100)
-		fmt.Fprintf(os.Stderr, "    Backend bytes read: %s\n", formatBytes(backendBytesRead))
-		fmt.Fprintf(os.Stderr, "  PUT operations: %d\n", putCount)
-		fmt.Fprintf(os.Stderr, "    Duplicate PUTs: %d (%.1f%% of PUTs)\n",
-			duplicatePuts, float64(duplicatePuts)/float64(putCount)*100)
-		fmt.Fprintf(os.Stderr, "    Deduplicated PUTs (singleflight): %d (%.1f%% of PUTs)\n",
-			deduplicatedPuts, float64(deduplicatedPuts)/float64(putCount)*100)
-		fmt.Fprintf(os.Stderr, "    Backend bytes written: %s\n", formatBytes(backendBytesWritten))
-		fmt.Fprintf(os.Stderr, "  Total operations: %d\n", totalOps)
-		fmt.Fprintf(os.Stderr, "  Unique action IDs: %d\n", uniqueActionIDs)
-		fmt.Fprintf(os.Stderr, "  Total backend bytes transferred: %s\n", formatBytes(backendBytesRead+backendBytesWritten))
-
-		// Print compression statistics if compression is enabled
-		if cp.compression {
-			fmt.Fprintf(os.Stderr, "\nCompression statistics:\n")
-			if compressionBytesIn > 0 {
-				compressionRatio := float64(compressionBytesOut) / float64(compressionBytesIn) * 100
-				spaceSaved := compressionBytesIn - compressionBytesOut
-				fmt.Fprintf(os.Stderr, "  Compression (PUT): %s -> %s (%.1f%%, saved %s)\n",
-					formatBytes(compressionBytesIn), formatBytes(compressionBytesOut),
-					compressionRatio, formatBytes(spaceSaved))
-			}
-			if decompressionBytesIn > 0 {
-				decompressionRatio := float64(decompressionBytesOut) / float64(decompressionBytesIn) * 100
-				fmt.Fprintf(os.Stderr, "  Decompression (GET): %s -> %s (%.1f%% expansion)\n",
-					formatBytes(decompressionBytesIn), formatBytes(decompressionBytesOut),
-					decompressionRatio)
-			}
-			if compressionBytesIn == 0 && decompressionBytesIn == 0 {
-				fmt.Fprintf(os.Stderr, "  No compression activity (compression enabled but no data compressed/decompressed)\n")
-			}
+// writeStats writes the cache statistics to w.
+func (cp *CacheProg) writeStats(w io.Writer) {
+	var (
+		getCount              = cp.getCount.Load()
+		hitCount              = cp.hitCount.Load()
+		localCacheHits        = cp.localCacheHits.Load()
+		unlockedLocalHits     = cp.unlockedLocalHits.Load()
+		backendCacheHits      = cp.backendCacheHits.Load()
+		putCount              = cp.putCount.Load()
+		duplicateGets         = cp.duplicateGets.Load()
+		duplicatePuts         = cp.duplicatePuts.Load()
+		deduplicatedGets      = cp.deduplicatedGets.Load()
+		deduplicatedPuts      = cp.deduplicatedPuts.Load()
+		retriedRequests       = cp.retriedRequests.Load()
+		totalRetries          = cp.totalRetries.Load()
+		backendBytesRead      = cp.backendBytesRead.Load()
+		backendBytesWritten   = cp.backendBytesWritten.Load()
+		compressionBytesIn    = cp.compressionBytesIn.Load()
+		compressionBytesOut   = cp.compressionBytesOut.Load()
+		decompressionBytesIn  = cp.decompressionBytesIn.Load()
+		decompressionBytesOut = cp.decompressionBytesOut.Load()
+		missCount             = getCount - hitCount
+		hitRate               = 0.0
+		localHitRate          = 0.0
+		backendHitRate        = 0.0
+	)
+	// Skipped PUTs were handed to the backend but never uploaded.
+	skippedPuts, bytesSaved := cp.putSkipStats()
+	backendBytesWritten -= bytesSaved
+
+	if getCount > 0 {
+		hitRate = float64(hitCount) / float64(getCount) * 100
+		localHitRate = float64(localCacheHits) / float64(getCount) * 100
+		backendHitRate = float64(backendCacheHits) / float64(getCount) * 100
+	}
+
+	cp.seenActionIDs.Lock()
+	uniqueActionIDs := len(cp.seenActionIDs.ids)
+	cp.seenActionIDs.Unlock()
+
+	totalOps := getCount + putCount
+
+	fmt.Fprintf(w, "Cache statistics:\n")
+	fmt.Fprintf(w, "  GET operations: %d (hits: %d, misses: %d, hit rate: %.1f%%)\n",
+		getCount, hitCount, missCount, hitRate)
+	fmt.Fprintf(w, "    Local cache hits: %d (%.1f%% of GETs)\n",
+		localCacheHits, localHitRate)
+	fmt.Fprintf(w, "      Served without locking: %d\n", unlockedLocalHits)
+	fmt.Fprintf(w, "    Backend cache hits: %d (%.1f%% of GETs)\n",
+		backendCacheHits, backendHitRate)
+	if g := cp.peers; g != nil {
+		fmt.Fprintf(w, "    Peer hits: %d (%s), misses: %d, rejected: %d, errors: %d, served to peers: %d\n",
+			cp.peerHits.Load(), formatBytes(g.hitBytes.Load()), g.misses.Load(), g.rejected.Load(), g.errors.Load(), g.served())
+	}
+	fmt.Fprintf(w, "    Duplicate GETs: %d (%.1f%% of GETs)\n",
+		duplicateGets, float64(duplicateGets)/float64(getCount)*100)
+	fmt.Fprintf(w, "    Deduplicated GETs (singleflight): %d (%.1f%% of GETs)\n",
+		deduplicatedGets, float64(deduplicatedGets)/float64(getCount)*100)
+	if cp.negativeCache.enabled() {
+		fmt.Fprintf(w, "    Negative cache hits: %d (backend misses answered locally), invalidated by PUTs: %d\n",
+			cp.negativeCacheHits.Load(), cp.negativeCacheInvalidations.Load())
+	}
+	if filter := cp.keyFilterStats(); filter.Keys > 0 {
+		fmt.Fprintf(w, "    Key filter misses: %d (answered without a backend request, filter of %d keys built %s ago)\n",
+			filter.FilteredGets, filter.Keys, time.Since(filter.BuiltAt).Round(time.Second))
+	}
+	fmt.Fprintf(w, "    Backend bytes read: %s\n", formatBytes(backendBytesRead))
+	fmt.Fprintf(w, "  PUT operations: %d\n", putCount)
+	fmt.Fprintf(w, "    Duplicate PUTs: %d (%.1f%% of PUTs)\n",
+		duplicatePuts, float64(duplicatePuts)/float64(putCount)*100)
+	fmt.Fprintf(w, "    Deduplicated PUTs (singleflight): %d (%.1f%% of PUTs)\n",
+		deduplicatedPuts, float64(deduplicatedPuts)/float64(putCount)*100)
+	if skippedPuts > 0 {
+		fmt.Fprintf(w, "    Skipped PUTs (already in backend): %d (%.1f%% of PUTs, saved %s)\n",
+			skippedPuts, float64(skippedPuts)/float64(putCount)*100, formatBytes(bytesSaved))
+	}
+	fmt.Fprintf(w, "    Backend bytes written: %s\n", formatBytes(backendBytesWritten))
+	if packs := cp.packStats(); packs.PackedPuts > 0 || packs.PackedGets > 0 {
+		fmt.Fprintf(w, "    Packed PUTs: %d (%s) in %d packs, GETs served from packs: %d\n",
+			packs.PackedPuts, formatBytes(packs.PackedBytes), packs.Packs, packs.PackedGets)
+	}
+	fmt.Fprintf(w, "  Total operations: %d\n", totalOps)
+	fmt.Fprintf(w, "  Unique action IDs: %d\n", uniqueActionIDs)
+	if clients := cp.daemonClients.Load(); clients > 0 {
+		fmt.Fprintf(w, "  Daemon clients: %d\n", clients)
+	}
+	fmt.Fprintf(w, "  Total backend bytes transferred: %s\n", formatBytes(backendBytesRead+backendBytesWritten))
+	if dedup := &cp.localCache.dedup; dedup.writes.Load() > 0 {
+		fmt.Fprintf(w, "  Local cache writes: %d (%s), %d linked to existing outputs (saved %s, dedup ratio %.2fx)\n",
+			dedup.writes.Load(), formatBytes(dedup.bytes.Load()),
+			dedup.linkedWrites.Load(), formatBytes(dedup.linkedBytes.Load()), dedup.ratio())
+	}
+	if cp.prefetchManifest != "" {
+		fmt.Fprintf(w, "  Prefetched: %d of %d manifest entries (%s), %d already cached, %d not in backend\n",
+			cp.prefetchedEntries.Load(), cp.prefetchManifestEntries.Load(), formatBytes(cp.prefetchedBytes.Load()),
+			cp.prefetchCachedEntries.Load(), cp.prefetchMissedEntries.Load())
+	}
+	if cp.localMaxSize > 0 || cp.localMaxAge > 0 {
+		fmt.Fprintf(w, "  Local cache evicted: %d entries (%s)\n",
+			cp.localEvictedEntries.Load(), formatBytes(cp.localEvictedBytes.Load()))
+	}
+
+	// Print compression statistics if compression is enabled
+	if cp.compression {
+		fmt.Fprintf(w, "\nCompression statistics:\n")
+		if compressionBytesIn > 0 {
+			compressionRatio := float64(compressionBytesOut) / float64(compressionBytesIn) * 100
+			spaceSaved := compressionBytesIn - compressionBytesOut
+			fmt.Fprintf(w, "  Compression (PUT): %s -> %s (%.1f%%, saved %s)\n",
+				formatBytes(compressionBytesIn), formatBytes(compressionBytesOut),
+				compressionRatio, formatBytes(spaceSaved))
 		}
-		if retriedRequests > 0 {
-			avgRetries := float64(totalRetries) / float64(retriedRequests)
-			fmt.Fprintf(os.Stderr, "  Retried requests: %d (%.1f%% of operations)\n",
-				retriedRequests, float64(retriedRequests)/float64(totalOps)*100)
-			fmt.Fprintf(os.Stderr, "  Total retries: %d (avg %.1f retries per failed request)\n",
-				totalRetries, avgRetries)
+		if decompressionBytesIn > 0 {
+			decompressionRatio := float64(decompressionBytesOut) / float64(decompressionBytesIn) * 100
+			fmt.Fprintf(w, "  Decompression (GET): %s -> %s (%.1f%% expansion)\n",
+				formatBytes(decompressionBytesIn), formatBytes(decompressionBytesOut),
+				decompressionRatio)
 		}
-
-		// Print latency quantiles
-		fmt.Fprintf(os.Stderr, "\nLatency quantiles (ms):\n")
-		allStats := cp.latencyTracker.GetAllStats()
-		if len(allStats) == 0 {
-			fmt.Fprintf(os.Stderr, "  No latency data collected\n")
-		} else {
-			for _, stat := range allStats {
-				fmt.Fprintf(os.Stderr, "%s\n", stat.String())
-			}
+		if compressionBytesIn == 0 && decompressionBytesIn == 0 {
+			fmt.Fprintf(w, "  No compression activity (compression enabled but no data compressed/decompressed)\n")
 		}
 	}
+	if retriedRequests > 0 {
+		avgRetries := float64(totalRetries) / float64(retriedRequests)
+		fmt.Fprintf(w, "  Retried requests: %d (%.1f%% of operations)\n",
+			retriedRequests, float64(retriedRequests)/float64(totalOps)*100)
+		fmt.Fprintf(w, "  Total retries: %d (avg %.1f retries per failed request)\n",
+			totalRetries, avgRetries)
+	}
 
-	return nil
+	// Print latency quantiles
+	fmt.Fprintf(w, "\nLatency quantiles (ms):\n")
+	allStats := cp.latencyTracker.GetAllStats()
+	if len(allStats) == 0 {
+		fmt.Fprintf(w, "  No latency data collected\n")
+	} else {
+		for _, stat := range allStats {
+			fmt.Fprintf(w, "%s\n", stat.String())
+		}
+	}
 }
 
 // handleRequest processes a single request and returns a response.
@@ -360,6 +523,13 @@ func (cp *CacheProg) handleRequest(req *Request) (Response, error) {
 		return cp.handleGet(req)
 
 	case CmdClose:
+		// Prefetching and uploading the manifest both need the backend.
+		cp.stopPrefetch()
+		if cp.manifestName != "" {
+			if err := cp.uploadManifest(); err != nil {
+				cp.logger.Warn("failed to upload build manifest", "name", cp.manifestName, "error", err)
+			}
+		}
 		if err := cp.backend.Close(); err != nil {
 			resp.Err = err.Error()
 			return resp, err
@@ -396,31 +566,47 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 		}
 	}
 
+	// Stream the body into a temp file in the local cache, which becomes the entry
+	// and is uploaded to the backend from there. This happens before acquiring the
+	// lock because the next request can't be read off the wire until the body has
+	// been consumed.
+	body := req.Body
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	staged, err := cp.localCache.stage(req.ActionID, body)
+	if err != nil {
+		err = fmt.Errorf("failed to read body: %w", err)
+		resp.Err = err.Error()
+		return resp, err
+	}
+	defer os.Remove(staged.path)
+	if staged.size != req.BodySize {
+		err = fmt.Errorf("size mismatch: expected %d, read %d", req.BodySize, staged.size)
+		resp.Err = err.Error()
+		return resp, err
+	}
+
 	key := hex.EncodeToString(req.ActionID)
 	v, err := cp.locker.DoWithLock(key, func() (interface{}, error) {
+		// The entry is about to exist, so a remembered miss is stale.
+		if removed, err := cp.negativeCache.remove(req.ActionID); err != nil {
+			cp.logger.Warn("failed to invalidate negative cache entry",
+				"actionID", hex.EncodeToString(req.ActionID), "error", err)
+		} else if removed {
+			cp.negativeCacheInvalidations.Add(1)
+		}
+
 		// Someone may have cached the result already, so check the local cache first
 		// before doing anything expensive.
 		localCacheCheckStart := time.Now()
-		existingMeta := cp.localCache.check(req.ActionID)
+		existingMeta := cp.localCache.checkExists(req.ActionID)
 		cp.latencyTracker.Record("put_local_cache_check", time.Since(localCacheCheckStart))
 
 		if existingMeta != nil {
 			return &putResult{diskPath: cp.localCache.getPath(req.ActionID)}, nil
 		}
 
-		// Read body into memory (we need to write it to both local cache and backend)
-		var bodyData []byte
-		if req.BodySize > 0 && req.Body != nil {
-			bodyData = make([]byte, req.BodySize)
-			n, err := io.ReadFull(req.Body, bodyData)
-			if err != nil && err != io.EOF {
-				return nil, fmt.Errorf("failed to read body: %w", err)
-			}
-			if int64(n) != req.BodySize {
-				return nil, fmt.Errorf("size mismatch: expected %d, read %d", req.BodySize, n)
-			}
-		}
-
 		// Write to local cache with metadata
 		meta := localCacheMetadata{
 			OutputID: req.OutputID,
@@ -429,39 +615,15 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 		}
 
 		localCacheWriteStart := time.Now()
-		diskPath, err := cp.localCache.writeWithMetadata(req.ActionID, bytes.NewReader(bodyData), meta)
+		diskPath, err := cp.localCache.writeStaged(req.ActionID, staged, meta)
 		cp.latencyTracker.Record("put_local_cache_write", time.Since(localCacheWriteStart))
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to write to local cache: %w", err)
 		}
 
-		var (
-			backendPutStart = time.Now()
-			dataToStore     []byte
-			dataSize        int64
-		)
-		if cp.compression && req.BodySize > 0 {
-			compressStart := time.Now()
-			compressed, err := compressData(bodyData)
-			cp.latencyTracker.Record("put_compression", time.Since(compressStart))
-
-			if err != nil {
-				return nil, fmt.Errorf("failed to compress data: %w", err)
-			}
-
-			dataToStore = compressed
-			dataSize = int64(len(compressed))
-
-			cp.compressionBytesIn.Add(req.BodySize)
-			cp.compressionBytesOut.Add(dataSize)
-		} else {
-			dataToStore = bodyData
-			dataSize = req.BodySize
-		}
-
-		backendKey := cp.generateBackendKey(req.ActionID)
-		err = cp.backend.Put(backendKey, req.OutputID, bytes.NewReader(dataToStore), dataSize)
+		backendPutStart := time.Now()
+		dataSize, err := cp.putFromFile(req.ActionID, req.OutputID, diskPath, req.BodySize)
 		cp.latencyTracker.Record("put_backend", time.Since(backendPutStart))
 
 		if err != nil {
@@ -487,6 +649,41 @@ func (cp *CacheProg) handlePut(req *Request) (Response, error) {
 	return resp, nil
 }
 
+// putFromFile uploads the entry for actionID from the local cache file at path,
+// compressed if compression is enabled, and returns the number of bytes
+// uploaded.
+func (cp *CacheProg) putFromFile(actionID, outputID []byte, path string, size int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local cache file: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		body     io.Reader = f
+		dataSize           = size
+	)
+	if cp.compression && size > 0 {
+		compressStart := time.Now()
+		compressed, n, err := compressToTemp(f, filepath.Dir(path))
+		cp.latencyTracker.Record("put_compression", time.Since(compressStart))
+		if err != nil {
+			return 0, fmt.Errorf("failed to compress data: %w", err)
+		}
+		defer os.Remove(compressed.Name())
+		defer compressed.Close()
+
+		body, dataSize = compressed, n
+		cp.compressionBytesIn.Add(size)
+		cp.compressionBytesOut.Add(dataSize)
+	}
+
+	if err := cp.backend.Put(cp.generateBackendKey(actionID), outputID, body, dataSize); err != nil {
+		return 0, err
+	}
+	return dataSize, nil
+}
+
 // getResult holds the result of a Get operation for singleflight
 type getResult struct {
 	outputID       []byte
@@ -494,7 +691,8 @@ type getResult struct {
 	size           int64
 	putTime        *time.Time
 	miss           bool
-	fromLocalCache bool // true if hit was from local cache, false if from backend
+	fromLocalCache bool // true if hit was from local cache, false if from a peer or the backend
+	fromPeer       bool // true if hit was from a peer
 }
 
 // handleGet processes a GET request.
@@ -516,6 +714,21 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		}
 	}
 
+	// Local hits don't need the lock, since entries are published atomically. Only
+	// misses and anything else that needs to modify the local cache take the lock.
+	localCacheCheckStart := time.Now()
+	if meta := cp.localCache.checkUnlocked(req.ActionID); meta != nil {
+		cp.latencyTracker.Record("get_local_cache_check", time.Since(localCacheCheckStart))
+		cp.unlockedLocalHits.Add(1)
+		return cp.getResponse(resp, &getResult{
+			outputID:       meta.OutputID,
+			diskPath:       cp.localCache.getPath(req.ActionID),
+			size:           meta.Size,
+			putTime:        &meta.PutTime,
+			fromLocalCache: true,
+		}), nil
+	}
+
 	key := hex.EncodeToString(req.ActionID)
 	v, err := cp.locker.DoWithLock(key, func() (interface{}, error) {
 		// Check local cache first
@@ -537,101 +750,126 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 			}, nil
 		}
 
-		// Local cache miss - get from backend
-		backendGetStart := time.Now()
-		backendKey := cp.generateBackendKey(req.ActionID)
-		outputID, body, size, putTime, miss, err := cp.backend.Get(backendKey)
-		cp.latencyTracker.Record("get_backend", time.Since(backendGetStart))
-
-		if err != nil {
-			return nil, err
+		// Local cache miss - ask the peer that owns the entry, then the backend
+		if result := cp.fetchFromPeer(req.ActionID); result != nil {
+			return result, nil
 		}
+		return cp.fetchFromBackend(req.ActionID)
+	})
 
-		if miss {
-			// Backend miss
-			return &getResult{
-				miss: true,
-			}, nil
-		}
+	if err != nil {
+		resp.Err = err.Error()
+		resp.Miss = true
+		return resp, err
+	}
 
-		// Backend hit - track bytes read from backend (compressed size)
-		cp.backendBytesRead.Add(size)
+	return cp.getResponse(resp, v.(*getResult)), nil
+}
 
-		// Backend hit - decompress if needed, then write to local cache with metadata
-		defer body.Close()
+// fetchFromBackend gets an entry from the backend and writes it to the local
+// cache. The caller must hold the lock for actionID.
+func (cp *CacheProg) fetchFromBackend(actionID []byte) (*getResult, error) {
+	if cp.negativeCache.contains(actionID, time.Now()) {
+		cp.negativeCacheHits.Add(1)
+		return &getResult{miss: true}, nil
+	}
 
-		var dataToCache io.Reader
-		var actualSize int64
+	backendGetStart := time.Now()
+	backendKey := cp.generateBackendKey(actionID)
+	outputID, body, size, putTime, miss, err := cp.backend.Get(backendKey)
+	cp.latencyTracker.Record("get_backend", time.Since(backendGetStart))
 
-		if cp.compression && size > 0 {
-			// Read compressed data from backend
-			compressedData, err := io.ReadAll(body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read compressed data from backend: %w", err)
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			// Decompress data
-			decompressStart := time.Now()
-			decompressed, err := decompressData(compressedData)
-			cp.latencyTracker.Record("get_decompression", time.Since(decompressStart))
+	if miss {
+		// Backend miss. The go command is likely to PUT the entry soon, so
+		// remember the miss until then.
+		if err := cp.negativeCache.add(actionID, time.Now()); err != nil {
+			cp.logger.Debug("failed to record backend miss", "actionID", hex.EncodeToString(actionID), "error", err)
+		}
+		return &getResult{
+			miss: true,
+		}, nil
+	}
 
-			if err != nil {
-				return nil, fmt.Errorf("failed to decompress data: %w", err)
-			}
+	// Backend hit - track bytes read from backend (compressed size)
+	cp.backendBytesRead.Add(size)
 
-			// Track decompression statistics
-			cp.decompressionBytesIn.Add(size)
-			cp.decompressionBytesOut.Add(int64(len(decompressed)))
+	// Backend hit - decompress if needed, then write to local cache with metadata
+	defer body.Close()
 
-			dataToCache = bytes.NewReader(decompressed)
-			actualSize = int64(len(decompressed))
-		} else {
-			dataToCache = body
-			actualSize = size
-		}
+	var dataToCache io.Reader
+	var actualSize int64
 
-		metaForWrite := localCacheMetadata{
-			OutputID: outputID,
-			Size:     actualSize,
-			PutTime:  *putTime,
+	if cp.compression && size > 0 {
+		// Read compressed data from backend
+		compressedData, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compressed data from backend: %w", err)
 		}
 
-		localCacheWriteStart := time.Now()
-		diskPath, err := cp.localCache.writeWithMetadata(req.ActionID, dataToCache, metaForWrite)
-		cp.latencyTracker.Record("get_local_cache_write", time.Since(localCacheWriteStart))
+		// Decompress data
+		decompressStart := time.Now()
+		decompressed, err := decompressData(compressedData)
+		cp.latencyTracker.Record("get_decompression", time.Since(decompressStart))
 
 		if err != nil {
-			cp.logger.Warn("failed to write to local cache after backend hit",
-				"actionID", hex.EncodeToString(req.ActionID),
-				"error", err)
-			// We got data from backend but couldn't cache it locally
-			// This is not fatal - we can still serve from backend
-			return nil, fmt.Errorf("failed to cache locally: %w", err)
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
 		}
 
-		return &getResult{
-			outputID:       outputID,
-			diskPath:       diskPath,
-			size:           actualSize,
-			putTime:        putTime,
-			miss:           false,
-			fromLocalCache: false,
-		}, nil
-	})
+		// Track decompression statistics
+		cp.decompressionBytesIn.Add(size)
+		cp.decompressionBytesOut.Add(int64(len(decompressed)))
+
+		dataToCache = bytes.NewReader(decompressed)
+		actualSize = int64(len(decompressed))
+	} else {
+		dataToCache = body
+		actualSize = size
+	}
+
+	metaForWrite := localCacheMetadata{
+		OutputID: outputID,
+		Size:     actualSize,
+		PutTime:  *putTime,
+	}
+
+	localCacheWriteStart := time.Now()
+	diskPath, err := cp.localCache.writeWithMetadata(actionID, dataToCache, metaForWrite)
+	cp.latencyTracker.Record("get_local_cache_write", time.Since(localCacheWriteStart))
 
 	if err != nil {
-		resp.Err = err.Error()
-		resp.Miss = true
-		return resp, err
+		cp.logger.Warn("failed to write to local cache after backend hit",
+			"actionID", hex.EncodeToString(actionID),
+			"error", err)
+		// We got data from backend but couldn't cache it locally
+		// This is not fatal - we can still serve from backend
+		return nil, fmt.Errorf("failed to cache locally: %w", err)
 	}
 
-	result := v.(*getResult)
+	return &getResult{
+		outputID:       outputID,
+		diskPath:       diskPath,
+		size:           actualSize,
+		putTime:        putTime,
+		miss:           false,
+		fromLocalCache: false,
+	}, nil
+}
+
+// getResponse fills in resp from the result of a GET and records it in the stats.
+func (cp *CacheProg) getResponse(resp Response, result *getResult) Response {
 	resp.Miss = result.miss
 	if !result.miss {
 		cp.hitCount.Add(1)
-		if result.fromLocalCache {
+		switch {
+		case result.fromLocalCache:
 			cp.localCacheHits.Add(1)
-		} else {
+		case result.fromPeer:
+			cp.peerHits.Add(1)
+		default:
 			cp.backendCacheHits.Add(1)
 		}
 		resp.OutputID = result.outputID
@@ -639,42 +877,58 @@ func (cp *CacheProg) handleGet(req *Request) (Response, error) {
 		resp.Size = result.size
 		resp.Time = result.putTime
 	}
-	return resp, nil
+	return resp
 }
 
-// sendResponse sends a response to stdout (thread-safe).
-func (cp *CacheProg) sendResponse(resp Response) error {
+// conn is a connection to a go command, over stdin and stdout or a daemon's
+// Unix socket.
+type conn struct {
+	reader *bufio.Reader
+	writer struct {
+		sync.Mutex
+		w *bufio.Writer
+	}
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	c := &conn{reader: bufio.NewReader(r)}
+	c.writer.w = bufio.NewWriter(w)
+	return c
+}
+
+// sendResponse sends a response to the go command (thread-safe).
+func (c *conn) sendResponse(resp Response) error {
 	data, err := json.Marshal(resp)
 	if err != nil {
 		return fmt.Errorf("failed to marshal response: %w", err)
 	}
 
-	cp.writer.Lock()
-	defer cp.writer.Unlock()
+	c.writer.Lock()
+	defer c.writer.Unlock()
 
-	if _, err := cp.writer.w.Write(data); err != nil {
+	if _, err := c.writer.w.Write(data); err != nil {
 		return fmt.Errorf("failed to write response: %w", err)
 	}
 
-	if err := cp.writer.w.WriteByte('\n'); err != nil {
+	if err := c.writer.w.WriteByte('\n'); err != nil {
 		return fmt.Errorf("failed to write newline: %w", err)
 	}
 
-	return cp.writer.w.Flush()
+	return c.writer.w.Flush()
 }
 
 // sendInitialResponse sends the initial response with capabilities.
-func (cp *CacheProg) sendInitialResponse() error {
-	return cp.sendResponse(Response{
+func (c *conn) sendInitialResponse() error {
+	return c.sendResponse(Response{
 		ID:            0,
 		KnownCommands: []Cmd{CmdPut, CmdGet, CmdClose},
 	})
 }
 
-// readLine reads a line from stdin, skipping empty lines.
-func (cp *CacheProg) readLine() ([]byte, error) {
+// readLine reads a line from the go command, skipping empty lines.
+func (c *conn) readLine() ([]byte, error) {
 	for {
-		line, err := cp.reader.ReadBytes('\n')
+		line, err := c.reader.ReadBytes('\n')
 		if err != nil {
 			return nil, err
 		}
@@ -689,10 +943,10 @@ func (cp *CacheProg) readLine() ([]byte, error) {
 	}
 }
 
-// readRequest reads a request from stdin.
-func (cp *CacheProg) readRequest() (*Request, error) {
+// readRequest reads a request from the go command.
+func (c *conn) readRequest() (*Request, error) {
 	// Read the request line
-	line, err := cp.readLine()
+	line, err := c.readLine()
 	if err != nil {
 		if err == io.EOF {
 			return nil, io.EOF
@@ -705,33 +959,71 @@ func (cp *CacheProg) readRequest() (*Request, error) {
 		return nil, fmt.Errorf("failed to unmarshal request: %w (line: %q)", err, string(line))
 	}
 
-	// For "put" commands with BodySize > 0, read the base64 body on the next line
+	// For "put" commands with BodySize > 0, the base64 body follows on the next line.
+	// It's decoded lazily as handlePut consumes it so that we never have to hold the
+	// encoded body in memory.
 	if req.Command == CmdPut && req.BodySize > 0 {
-		// Read the body line
-		bodyLine, err := cp.readLine()
-		if err != nil {
-			if err == io.EOF {
-				// EOF reached without finding body - connection closed
-				return nil, io.EOF
-			}
-			return nil, fmt.Errorf("error reading body line: %w", err)
-		}
+		req.Body = newBodyReader(c.reader, req.BodySize)
+	}
 
-		// The body is sent as a base64-encoded JSON string (a JSON string literal)
-		var base64Str string
-		if err := json.Unmarshal(bodyLine, &base64Str); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal body as JSON string: %w (line: %q)", err, string(bodyLine))
-		}
+	return &req, nil
+}
 
-		bodyData, err := base64.StdEncoding.DecodeString(base64Str)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode base64 body: %w", err)
-		}
+// trimLocalCache trims the local cache according to localMaxSize and localMaxAge,
+// unless neither is set or the cache was trimmed recently.
+func (cp *CacheProg) trimLocalCache() {
+	if cp.localMaxSize <= 0 && cp.localMaxAge <= 0 {
+		return
+	}
 
-		req.Body = strings.NewReader(string(bodyData))
+	start := time.Now()
+	stats, err := cp.localCache.maybeTrim(cp.locker, backends.TrimPolicy{
+		MaxSize:   cp.localMaxSize,
+		UnusedFor: cp.localMaxAge,
+	})
+	cp.latencyTracker.Record("local_cache_trim", time.Since(start))
+	if err != nil {
+		cp.logger.Warn("failed to trim local cache", "error", err)
+		return
 	}
 
-	return &req, nil
+	cp.localEvictedEntries.Add(stats.EvictedEntries)
+	cp.localEvictedBytes.Add(stats.EvictedBytes)
+	if stats.EvictedEntries > 0 {
+		cp.logger.Debug("trimmed local cache",
+			"evictedEntries", stats.EvictedEntries,
+			"evictedBytes", stats.EvictedBytes,
+			"remainingBytes", stats.Bytes-stats.EvictedBytes,
+			"duration", time.Since(start))
+	}
+}
+
+// putSkipStats returns the number of backend PUTs that were skipped because the
+// object already existed remotely, and the number of bytes that weren't uploaded
+// as a result.
+func (cp *CacheProg) putSkipStats() (skipped, bytesSaved int64) {
+	if r, ok := cp.backend.(backends.PutSkipReporter); ok {
+		return r.PutSkipStats()
+	}
+	return 0, 0
+}
+
+// packStats returns the activity of the backend's packing of small objects, if
+// it packs them.
+func (cp *CacheProg) packStats() backends.PackStats {
+	if r, ok := cp.backend.(backends.PackStatsReporter); ok {
+		return r.PackStats()
+	}
+	return backends.PackStats{}
+}
+
+// keyFilterStats returns the key filter loaded by the backend and the GETs it
+// answered, if the backend filters GETs.
+func (cp *CacheProg) keyFilterStats() backends.KeyFilterStats {
+	if r, ok := cp.backend.(backends.KeyFilterStatsReporter); ok {
+		return r.KeyFilterStats()
+	}
+	return backends.KeyFilterStats{}
 }
 
 // trackActionID records an action ID and returns whether it's a duplicate.
@@ -750,9 +1042,26 @@ func (cp *CacheProg) trackActionID(actionID []byte) bool {
 // generateBackendKey generates the key to use for backend storage operations.
 // This allows for versioning, prefixing, or other key transformations.
 func (cp *CacheProg) generateBackendKey(actionID []byte) []byte {
+	return backendKey(actionID)
+}
+
+// backendKey returns the backend key of an action ID. Commands that write to the
+// backend outside of a CacheProg use it directly.
+func backendKey(actionID []byte) []byte {
 	return []byte(fileFormatVersion + hex.EncodeToString(actionID))
 }
 
+// isEntryKey reports whether key is the backend key of an entry, as opposed to a
+// manifest or another object that shares the backend. Only entries are trimmed.
+func isEntryKey(key []byte) bool {
+	hexID, ok := bytes.CutPrefix(key, []byte(fileFormatVersion))
+	if !ok || len(hexID) == 0 {
+		return false
+	}
+	_, err := hex.DecodeString(string(hexID))
+	return err == nil
+}
+
 // formatBytes formats a byte count as a human-readable string.
 func formatBytes(bytes int64) string {
 	const (
@@ -791,6 +1100,34 @@ func compressData(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// compressToTemp compresses r with LZ4 into a new temp file in dir, and returns
+// it positioned at the start along with its size. The caller must close and
+// remove it.
+func compressToTemp(r io.Reader, dir string) (*os.File, int64, error) {
+	tmpFile, err := os.CreateTemp(dir, "compressed.*.tmp")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	writer := lz4.NewWriter(tmpFile)
+	_, err = io.Copy(writer, r)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	var size int64
+	if err == nil {
+		size, err = tmpFile.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tmpFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, fmt.Errorf("failed to write to LZ4 compressor: %w", err)
+	}
+	return tmpFile, size, nil
+}
+
 // decompressData decompresses LZ4-compressed data.
 func decompressData(data []byte) ([]byte, error) {
 	reader := lz4.NewReader(bytes.NewReader(data))
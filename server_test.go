@@ -1,9 +1,50 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestCacheProgPut(t *testing.T) {
+	var (
+		backend  = &recordingBackend{puts: make(map[string][]byte)}
+		cp       = newTestCacheProg(t, backend, "", "")
+		data     = bytes.Repeat([]byte("compiled output "), 1000)
+		sum      = sha256.Sum256(data)
+		actionID = []byte{0x42, 0x01}
+	)
+
+	// The body is streamed into the local cache and uploaded compressed.
+	req := &Request{Command: CmdPut, ActionID: actionID, OutputID: sum[:], Body: bytes.NewReader(data), BodySize: int64(len(data))}
+	resp, err := cp.handlePut(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	if local, err := os.ReadFile(resp.DiskPath); err != nil || !bytes.Equal(local, data) {
+		t.Errorf("local cache has %d bytes (err %v), expected the body", len(local), err)
+	}
+	stored := backend.puts[string(cp.generateBackendKey(actionID))]
+	if decompressed, err := decompressData(stored); err != nil || !bytes.Equal(decompressed, data) || len(stored) >= len(data) {
+		t.Errorf("backend has %d bytes that decompress to %d (err %v), expected the compressed body", len(stored), len(decompressed), err)
+	}
+
+	// A body of the wrong size is rejected, and no temp files are left behind.
+	req = &Request{Command: CmdPut, ActionID: []byte{0x42, 0x02}, OutputID: sum[:], Body: bytes.NewReader(data[:10]), BodySize: int64(len(data))}
+	if _, err := cp.handlePut(req); err == nil {
+		t.Error("PUT of a truncated body succeeded")
+	}
+	tmps, err := filepath.Glob(filepath.Join(filepath.Dir(resp.DiskPath), "*.tmp"))
+	if err != nil || len(tmps) != 0 {
+		t.Errorf("temp files left after PUTs: %v (err %v)", tmps, err)
+	}
+}
+
 func TestFormatBytes(t *testing.T) {
 	tests := []struct {
 		bytes    int64
@@ -29,3 +70,149 @@ func TestFormatBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"1KB", 1024, false},
+		{"1.5 KB", 1536, false},
+		{"64MB", 64 * 1024 * 1024, false},
+		{"64mib", 64 * 1024 * 1024, false},
+		{"10G", 10 * 1024 * 1024 * 1024, false},
+		{"1TB", 1024 * 1024 * 1024 * 1024, false},
+		{"32.00 MB", 32 * 1024 * 1024, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"12XB", 0, true},
+		{"-5MB", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseBytes(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBytes(%q) = %d, expected error", tt.input, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBytes(%q) returned error: %v", tt.input, err)
+		} else if result != tt.expected {
+			t.Errorf("parseBytes(%q) = %d, expected %d", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	t.Setenv("TEST_RUN_ID", "1234")
+
+	tests := []struct {
+		input    string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{"", nil, false},
+		{"team=build", map[string]string{"team": "build"}, false},
+		{"team=build, run=${TEST_RUN_ID}", map[string]string{"team": "build", "run": "1234"}, false},
+		{"empty=", map[string]string{"empty": ""}, false},
+		{"novalue", nil, true},
+		{"=value", nil, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseTags(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTags(%q) = %v, expected error", tt.input, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTags(%q) returned error: %v", tt.input, err)
+		} else if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("parseTags(%q) = %v, expected %v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestIsEntryKey(t *testing.T) {
+	tests := []struct {
+		key      []byte
+		expected bool
+	}{
+		{backendKey([]byte{0x01, 0x02}), true},
+		{manifestKey("main"), false},
+		{[]byte("keyfilter"), false},
+		{[]byte("v2"), false},
+		{[]byte("vabcdef"), false},
+		{[]byte("index/v2abcdef"), false},
+	}
+	for _, tt := range tests {
+		if got := isEntryKey(tt.key); got != tt.expected {
+			t.Errorf("isEntryKey(%q) = %v, expected %v", tt.key, got, tt.expected)
+		}
+	}
+}
+
+func TestReadCustomerKey(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte(strings.Repeat("k", 32))
+
+	rawPath := filepath.Join(dir, "raw")
+	encodedPath := filepath.Join(dir, "encoded")
+	shortPath := filepath.Join(dir, "short")
+	os.WriteFile(rawPath, key, 0600)
+	os.WriteFile(encodedPath, []byte("a2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2s=\n"), 0600)
+	os.WriteFile(shortPath, []byte("too short"), 0600)
+
+	for _, path := range []string{rawPath, encodedPath} {
+		got, err := readCustomerKey(path)
+		if err != nil {
+			t.Fatalf("readCustomerKey(%s) returned error: %v", filepath.Base(path), err)
+		}
+		if string(got) != string(key) {
+			t.Errorf("readCustomerKey(%s) = %q, expected %q", filepath.Base(path), got, key)
+		}
+	}
+
+	if _, err := readCustomerKey(shortPath); err == nil {
+		t.Error("expected error for invalid key file")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"90m", 90 * time.Minute, false},
+		{"168h", 7 * 24 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"0d", 0, false},
+		{"d", 0, true},
+		{"-1d", 0, true},
+		{"7 days", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseDuration(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseDuration(%q) = %v, expected error", tt.input, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDuration(%q) returned error: %v", tt.input, err)
+		} else if result != tt.expected {
+			t.Errorf("parseDuration(%q) = %v, expected %v", tt.input, result, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const errNoAttr = unix.ENODATA
@@ -0,0 +1,29 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Extended attributes aren't supported on this platform, so entry headers are
+// always stored in header files.
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func getxattr(path, name string, buf []byte) (int, error) {
+	return 0, errXattrUnsupported
+}
+
+func setxattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func fsetxattr(f *os.File, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func isXattrMissing(err error) bool {
+	return false
+}
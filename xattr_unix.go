@@ -0,0 +1,28 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func getxattr(path, name string, buf []byte) (int, error) {
+	return unix.Getxattr(path, name, buf)
+}
+
+func setxattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
+
+func fsetxattr(f *os.File, name string, value []byte) error {
+	return unix.Fsetxattr(int(f.Fd()), name, value, 0)
+}
+
+// isXattrMissing reports whether err means that a file exists but doesn't have
+// the requested extended attribute.
+func isXattrMissing(err error) bool {
+	return errors.Is(err, errNoAttr)
+}